@@ -43,6 +43,12 @@ const (
 	SequenceNumberKey = "Checkpoint"
 	ParentShardIdKey  = "ParentShardId"
 	ClaimRequestKey   = "ClaimRequest"
+	// HeartbeatKey is the time the lease was last checkpointed, or touched while its shard was idle
+	HeartbeatKey = "Heartbeat"
+	// StreamGenerationKey is the generation of the stream the lease belongs to, when scoped to one
+	StreamGenerationKey = "StreamGeneration"
+	// StreamNameKey is the name of the stream the lease belongs to
+	StreamNameKey = "StreamName"
 
 	// ShardEnd We've completely processed all records in this shard.
 	ShardEnd = "SHARD_END"
@@ -59,36 +65,115 @@ func (e ErrLeaseNotAcquired) Error() string {
 	return fmt.Sprintf("lease not acquired: %s", e.cause)
 }
 
-// Checkpointer handles checkpointing when a record has been processed
+// Checkpointer handles checkpointing when a record has been processed. It stores the lease table shared by the workers
+// of the application, one lease per shard: its owner, lease timeout and checkpoint. DynamoCheckpoint is the DynamoDB
+// implementation, MemoryCheckpointer keeps the lease table in memory; another store can be used by passing its own
+// implementation to the worker. The workers rely on the store for mutual exclusion, so the writes acquiring a lease
+// must be conditional on the lease read, e.g. a compare-and-set of its owner and lease timeout, for two workers racing
+// for the same shard never to both get it. The checkpointtest package checks an implementation against this contract.
 type Checkpointer interface {
-	// Init initialises the Checkpoint
+	// Init initialises the Checkpoint, e.g. creates the lease table if it does not exist. It is called once, before any
+	// other method.
 	Init() error
 
-	// GetLease attempts to gain a lock on the given shard
+	// GetLease attempts to gain a lock on the given shard for the given worker, until FailoverTimeMillis from now. It
+	// succeeds when the lease does not exist, has no owner, has expired or is already held by the worker, in which case
+	// it is renewed, and then sets the owner and lease timeout of the shard. It returns ErrLeaseNotAcquired when the lease
+	// is held by another worker, or was changed by one since it was read. With lease stealing, it returns an error when
+	// another worker has a pending claim on the shard.
 	GetLease(*par.ShardStatus, string) error
 
-	// CheckpointSequence writes a checkpoint at the designated sequence ID
+	// CheckpointSequence writes a checkpoint at the designated sequence ID, along with the owner and lease timeout of the
+	// shard. The write is not conditional: the shard consumer checkpoints only the shards it holds the lease on.
 	CheckpointSequence(*par.ShardStatus) error
 
-	// FetchCheckpoint retrieves the checkpoint for the given shard
+	// FetchCheckpoint retrieves the checkpoint for the given shard, along with its lease owner and timeout. It returns
+	// ErrSequenceIDNotFound when no checkpoint has been written for the shard yet.
 	FetchCheckpoint(*par.ShardStatus) error
 
-	// RemoveLeaseInfo to remove lease info for shard entry because the shard no longer exists
+	// RemoveLeaseInfo to remove lease info for shard entry because the shard no longer exists. Removing a lease which
+	// does not exist is not an error.
 	RemoveLeaseInfo(string) error
 
-	// RemoveLeaseOwner to remove lease owner for the shard entry to make the shard available for reassignment
+	// RemoveLeaseOwner to remove lease owner for the shard entry to make the shard available for reassignment. It only
+	// releases the lease held by the worker of the checkpointer, and keeps the checkpoint.
 	RemoveLeaseOwner(string) error
 
-	// GetLeaseOwner to get current owner of lease for shard
+	// GetLeaseOwner to get current owner of lease for shard. It returns NoLeaseOwnerErr when the lease has no owner.
 	GetLeaseOwner(string) (string, error)
 
-	// ListActiveWorkers returns active workers and their shards (New Lease Stealing Methods)
+	// ListActiveWorkers returns active workers and their shards (New Lease Stealing Methods). It refreshes the given
+	// shards from the lease table, and returns ErrShardNotAssigned when a shard not completed yet has no owner.
 	ListActiveWorkers(map[string]*par.ShardStatus) (map[string][]*par.ShardStatus, error)
 
-	// ClaimShard claims a shard for stealing
+	// ClaimShard claims a shard for stealing. The claim is written provided the lease is unchanged since it was last read
+	// and not claimed already. GetLease then only grants the lease to the claimer, until the claim expires.
 	ClaimShard(*par.ShardStatus, string) error
 }
 
+// LeaseCreator is implemented by checkpointers able to create the lease of a shard before it is first acquired
+type LeaseCreator interface {
+	// CreateLease creates the lease entry of the shard, without owner. A lease which exists already is left untouched,
+	// and is not an error.
+	CreateLease(*par.ShardStatus) error
+}
+
+// CheckpointToucher is implemented by checkpointers able to advance the heartbeat of a lease without writing its
+// checkpoint, so that an idle shard can be told apart from a stalled one
+type CheckpointToucher interface {
+	// TouchCheckpoint sets the heartbeat of the lease of the shard to the current time, provided the lease is still
+	// held by the owner of the shard.
+	TouchCheckpoint(*par.ShardStatus) error
+}
+
+// BatchLeaseRenewer is implemented by checkpointers able to renew several leases held by the same worker at once
+type BatchLeaseRenewer interface {
+	// RenewLeases renews the leases on the given shards held by the given owner. The returned map holds the error of
+	// every shard whose lease could not be renewed.
+	RenewLeases([]*par.ShardStatus, string) map[string]error
+}
+
+// CheckpointLeaseRenewer is implemented by checkpointers able to extend the lease of a shard with the write of its
+// checkpoint
+type CheckpointLeaseRenewer interface {
+	// CheckpointAndRenewLease writes the checkpoint of the shard and extends its lease in a single write, provided the
+	// lease is still held by the owner of the shard and unchanged since it was last written. It returns
+	// ErrLeaseNotAcquired, without writing the checkpoint, otherwise.
+	CheckpointAndRenewLease(*par.ShardStatus) error
+}
+
+// StreamGenerationScoper is implemented by checkpointers able to tell the leases of the current generation of the
+// stream from those left in a shared lease table by an earlier stream of the same name, whose shard IDs may collide
+type StreamGenerationScoper interface {
+	// SetStreamGeneration scopes the leases to the generation of the stream, e.g. its creation time. The leases of
+	// another generation are ignored, as if they did not exist, and overwritten when acquired. The leases without
+	// generation, written before the leases were scoped, are taken to be of the current generation.
+	SetStreamGeneration(string)
+}
+
+// Lease is a row of the lease table, as exported for backups
+type Lease struct {
+	ShardID       string `json:"shardId"`
+	Checkpoint    string `json:"checkpoint,omitempty"`
+	ParentShardID string `json:"parentShardId,omitempty"`
+	Owner         string `json:"owner,omitempty"`
+	LeaseTimeout  string `json:"leaseTimeout,omitempty"`
+	// StreamName is the stream the lease was written for, empty for the leases written before it was recorded
+	StreamName string `json:"streamName,omitempty"`
+}
+
+// LeaseBackup is implemented by checkpointers able to export and import the whole lease table, e.g. to move it to
+// another region
+type LeaseBackup interface {
+	// ListLeases returns every lease of the lease table.
+	ListLeases() ([]Lease, error)
+
+	// ImportLease writes the checkpoint and the parent shard of the lease, unless the lease table holds a checkpoint of
+	// the shard which is not older. The owner of the lease in the table, if any, is kept. It returns whether the lease
+	// was written.
+	ImportLease(Lease) (bool, error)
+}
+
 // ErrSequenceIDNotFound is returned by FetchCheckpoint when no SequenceID is found
 var ErrSequenceIDNotFound = errors.New("SequenceIDNotFoundForShard")
 
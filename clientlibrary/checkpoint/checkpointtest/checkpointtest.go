@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package checkpointtest checks that an implementation of the Checkpointer interface honors its contract, e.g. a lease
+// table kept in another store than DynamoDB.
+package checkpointtest
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+const (
+	workerID = "worker-1"
+	otherID  = "worker-2"
+	shardID  = "shard-0"
+	// leaseDuration is the FailoverTimeMillis the checkpointers are created with
+	leaseDuration = 200 * time.Millisecond
+)
+
+// TestCheckpointer runs the contract tests against the checkpointers returned by newCheckpointer. Every call must return
+// a checkpointer, not initialized yet, of the given configuration on an empty lease table.
+func TestCheckpointer(t *testing.T, newCheckpointer func(kclConfig *config.KinesisClientLibConfiguration) chk.Checkpointer) {
+	start := func(t *testing.T) chk.Checkpointer {
+		kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", workerID).
+			WithFailoverTimeMillis(int(leaseDuration / time.Millisecond))
+		checkpointer := newCheckpointer(kclConfig)
+		if err := checkpointer.Init(); err != nil {
+			t.Fatalf("Init: %+v", err)
+		}
+		return checkpointer
+	}
+
+	t.Run("GetLease", func(t *testing.T) {
+		checkpointer := start(t)
+		shard := newShard()
+		if err := checkpointer.GetLease(shard, workerID); err != nil {
+			t.Fatalf("GetLease of a new lease: %+v", err)
+		}
+		if owner := shard.GetLeaseOwner(); owner != workerID {
+			t.Errorf("GetLease set the owner of the shard to %q, want %q", owner, workerID)
+		}
+		if !shard.GetLeaseTimeout().After(time.Now()) {
+			t.Errorf("GetLease set an expired lease timeout %s", shard.GetLeaseTimeout())
+		}
+
+		if err := checkpointer.GetLease(newShard(), otherID); !errors.As(err, &chk.ErrLeaseNotAcquired{}) {
+			t.Errorf("GetLease of a lease held by another worker returned %v, want ErrLeaseNotAcquired", err)
+		}
+
+		renewed := newShard()
+		if err := checkpointer.GetLease(renewed, workerID); err != nil {
+			t.Fatalf("GetLease renewing the lease of its owner: %+v", err)
+		}
+		if renewed.GetLeaseTimeout().Before(shard.GetLeaseTimeout()) {
+			t.Errorf("GetLease renewed the lease until %s, before %s", renewed.GetLeaseTimeout(), shard.GetLeaseTimeout())
+		}
+	})
+
+	t.Run("GetLeaseExpired", func(t *testing.T) {
+		checkpointer := start(t)
+		if err := checkpointer.GetLease(newShard(), workerID); err != nil {
+			t.Fatalf("GetLease of a new lease: %+v", err)
+		}
+		time.Sleep(leaseDuration + 50*time.Millisecond)
+
+		shard := newShard()
+		if err := checkpointer.GetLease(shard, otherID); err != nil {
+			t.Fatalf("GetLease of an expired lease: %+v", err)
+		}
+		if owner := shard.GetLeaseOwner(); owner != otherID {
+			t.Errorf("GetLease set the owner of the shard to %q, want %q", owner, otherID)
+		}
+	})
+
+	t.Run("GetLeaseConcurrently", func(t *testing.T) {
+		checkpointer := start(t)
+		var wg sync.WaitGroup
+		var mux sync.Mutex
+		var acquired []string
+		for _, id := range []string{"worker-a", "worker-b", "worker-c", "worker-d", "worker-e"} {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				err := checkpointer.GetLease(newShard(), id)
+				if err == nil {
+					mux.Lock()
+					acquired = append(acquired, id)
+					mux.Unlock()
+				} else if !errors.As(err, &chk.ErrLeaseNotAcquired{}) {
+					t.Errorf("GetLease by %s: %+v", id, err)
+				}
+			}(id)
+		}
+		wg.Wait()
+		if len(acquired) != 1 {
+			t.Errorf("the lease was acquired by %v, want exactly one worker", acquired)
+		}
+	})
+
+	t.Run("Checkpoint", func(t *testing.T) {
+		checkpointer := start(t)
+		if err := checkpointer.FetchCheckpoint(newShard()); !errors.Is(err, chk.ErrSequenceIDNotFound) {
+			t.Errorf("FetchCheckpoint of a new shard returned %v, want ErrSequenceIDNotFound", err)
+		}
+
+		shard := newShard()
+		if err := checkpointer.GetLease(shard, workerID); err != nil {
+			t.Fatalf("GetLease of a new lease: %+v", err)
+		}
+		if err := checkpointer.FetchCheckpoint(newShard()); !errors.Is(err, chk.ErrSequenceIDNotFound) {
+			t.Errorf("FetchCheckpoint of a lease without checkpoint returned %v, want ErrSequenceIDNotFound", err)
+		}
+
+		shard.SetCheckpoint("42")
+		if err := checkpointer.CheckpointSequence(shard); err != nil {
+			t.Fatalf("CheckpointSequence: %+v", err)
+		}
+		fetched := newShard()
+		if err := checkpointer.FetchCheckpoint(fetched); err != nil {
+			t.Fatalf("FetchCheckpoint: %+v", err)
+		}
+		if checkpoint := fetched.GetCheckpoint(); checkpoint != "42" {
+			t.Errorf("FetchCheckpoint returned checkpoint %q, want %q", checkpoint, "42")
+		}
+		if owner := fetched.GetLeaseOwner(); owner != workerID {
+			t.Errorf("FetchCheckpoint returned lease owner %q, want %q", owner, workerID)
+		}
+	})
+
+	t.Run("RemoveLeaseOwner", func(t *testing.T) {
+		checkpointer := start(t)
+		shard := newShard()
+		if err := checkpointer.GetLease(shard, workerID); err != nil {
+			t.Fatalf("GetLease of a new lease: %+v", err)
+		}
+		shard.SetCheckpoint("42")
+		if err := checkpointer.CheckpointSequence(shard); err != nil {
+			t.Fatalf("CheckpointSequence: %+v", err)
+		}
+		if owner, err := checkpointer.GetLeaseOwner(shardID); err != nil || owner != workerID {
+			t.Errorf("GetLeaseOwner returned %q, %v, want %q", owner, err, workerID)
+		}
+
+		if err := checkpointer.RemoveLeaseOwner(shardID); err != nil {
+			t.Fatalf("RemoveLeaseOwner: %+v", err)
+		}
+		if owner, err := checkpointer.GetLeaseOwner(shardID); !errors.Is(err, chk.NoLeaseOwnerErr) {
+			t.Errorf("GetLeaseOwner of a released lease returned %q, %v, want NoLeaseOwnerErr", owner, err)
+		}
+		fetched := newShard()
+		if err := checkpointer.FetchCheckpoint(fetched); err != nil || fetched.GetCheckpoint() != "42" {
+			t.Errorf("FetchCheckpoint of a released lease returned %q, %v, want the checkpoint kept", fetched.GetCheckpoint(), err)
+		}
+		// the lease is available right away
+		if err := checkpointer.GetLease(newShard(), otherID); err != nil {
+			t.Errorf("GetLease of a released lease: %+v", err)
+		}
+	})
+
+	t.Run("RemoveLeaseInfo", func(t *testing.T) {
+		checkpointer := start(t)
+		shard := newShard()
+		if err := checkpointer.GetLease(shard, workerID); err != nil {
+			t.Fatalf("GetLease of a new lease: %+v", err)
+		}
+		shard.SetCheckpoint("42")
+		if err := checkpointer.CheckpointSequence(shard); err != nil {
+			t.Fatalf("CheckpointSequence: %+v", err)
+		}
+
+		if err := checkpointer.RemoveLeaseInfo(shardID); err != nil {
+			t.Fatalf("RemoveLeaseInfo: %+v", err)
+		}
+		if err := checkpointer.FetchCheckpoint(newShard()); !errors.Is(err, chk.ErrSequenceIDNotFound) {
+			t.Errorf("FetchCheckpoint of a removed lease returned %v, want ErrSequenceIDNotFound", err)
+		}
+		if err := checkpointer.RemoveLeaseInfo(shardID); err != nil {
+			t.Errorf("RemoveLeaseInfo of a missing lease: %+v", err)
+		}
+	})
+}
+
+func newShard() *par.ShardStatus {
+	return &par.ShardStatus{ID: shardID, Mux: &sync.RWMutex{}}
+}
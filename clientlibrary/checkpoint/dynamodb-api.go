@@ -103,4 +103,12 @@ type DynamoDBAPI interface {
 	// conditions are met. If those conditions are met, DynamoDB performs the delete.
 	// Otherwise, the item is not deleted.
 	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+
+	// TransactWriteItems is a synchronous write operation that groups up to 25 action requests.
+	// These actions can target items in different tables, but not in different Amazon
+	// Web Services accounts or Regions, and no two actions can target the same item.
+	// The actions are completed atomically so that either all of them succeed, or all
+	// of them fail. A condition check failing on any item cancels the whole
+	// transaction with a TransactionCanceledException.
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
 }
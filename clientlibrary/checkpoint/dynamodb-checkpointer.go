@@ -33,6 +33,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -49,6 +50,9 @@ import (
 const (
 	// NumMaxRetries is the max times of doing retry
 	NumMaxRetries = 10
+
+	// maxTransactItems is the maximum number of items written by one TransactWriteItems request
+	maxTransactItems = 25
 )
 
 var (
@@ -67,6 +71,8 @@ type DynamoCheckpoint struct {
 	kclConfig     *config.KinesisClientLibConfiguration
 	Retries       int
 	lastLeaseSync time.Time
+	// the generation of the stream the leases are scoped to, empty when not scoped
+	generation string
 }
 
 func NewDynamoCheckpoint(kclConfig *config.KinesisClientLibConfiguration) *DynamoCheckpoint {
@@ -89,27 +95,24 @@ func (checkpointer *DynamoCheckpoint) WithDynamoDB(svc DynamoDBAPI) *DynamoCheck
 	return checkpointer
 }
 
+// SetStreamGeneration scopes the leases to the generation of the stream: the leases written from then on are tagged
+// with it, and the leases tagged with another generation are ignored.
+func (checkpointer *DynamoCheckpoint) SetStreamGeneration(generation string) {
+	checkpointer.generation = generation
+}
+
 // Init initialises the DynamoDB Checkpoint
 func (checkpointer *DynamoCheckpoint) Init() error {
 	checkpointer.log.Infof("Creating DynamoDB session")
 
 	if checkpointer.svc == nil {
-		resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-			if service == dynamodb.ServiceID && len(checkpointer.kclConfig.DynamoDBEndpoint) > 0 {
-				return aws.Endpoint{
-					PartitionID:   "aws",
-					URL:           checkpointer.kclConfig.DynamoDBEndpoint,
-					SigningRegion: checkpointer.kclConfig.RegionName,
-				}, nil
-			}
-			// returning EndpointNotFoundError will allow the service to fallback to it's default resolution
-			return aws.Endpoint{}, &aws.EndpointNotFoundError{}
-		})
+		resolver := config.NewEndpointResolver(dynamodb.ServiceID, checkpointer.kclConfig.DynamoDBEndpoint, checkpointer.kclConfig.RegionName)
 
 		cfg, err := awsConfig.LoadDefaultConfig(
 			context.TODO(),
 			awsConfig.WithRegion(checkpointer.kclConfig.RegionName),
 			awsConfig.WithCredentialsProvider(checkpointer.kclConfig.DynamoDBCredentials),
+			awsConfig.WithHTTPClient(checkpointer.kclConfig.NewHTTPClient()),
 			awsConfig.WithEndpointResolverWithOptions(resolver),
 			awsConfig.WithRetryer(func() aws.Retryer {
 				return retry.AddWithMaxBackoffDelay(retry.NewStandard(), retry.DefaultMaxBackoff)
@@ -139,6 +142,15 @@ func (checkpointer *DynamoCheckpoint) GetLease(shard *par.ShardStatus, newAssign
 		return err
 	}
 
+	// the lease of a shard of an earlier stream with the same ID is overwritten as if it did not exist
+	var staleGeneration string
+	if checkpointer.staleGeneration(currentCheckpoint) {
+		staleGeneration = stringAttribute(currentCheckpoint, StreamGenerationKey)
+		checkpointer.log.Infof("Lease of shard %s belongs to stream generation %s, taking it over for generation %s",
+			shard.ID, staleGeneration, checkpointer.generation)
+		currentCheckpoint = nil
+	}
+
 	isClaimRequestExpired := shard.IsClaimRequestExpired(checkpointer.kclConfig)
 
 	var claimRequest string
@@ -159,7 +171,14 @@ func (checkpointer *DynamoCheckpoint) GetLease(shard *par.ShardStatus, newAssign
 	var conditionalExpression string
 	var expressionAttributeValues map[string]types.AttributeValue
 
-	if !leaseTimeoutOk || !assignedToOk {
+	if staleGeneration != "" {
+		conditionalExpression = "StreamGeneration = :stale_generation"
+		expressionAttributeValues = map[string]types.AttributeValue{
+			":stale_generation": &types.AttributeValueMemberS{
+				Value: staleGeneration,
+			},
+		}
+	} else if !leaseTimeoutOk || !assignedToOk {
 		conditionalExpression = "attribute_not_exists(AssignedTo)"
 	} else {
 		assignedTo := assignedVar.(*types.AttributeValueMemberS).Value
@@ -170,12 +189,15 @@ func (checkpointer *DynamoCheckpoint) GetLease(shard *par.ShardStatus, newAssign
 			return err
 		}
 
+		// the lease may have been written by a worker whose clock is ahead of ours
+		skew := time.Duration(checkpointer.kclConfig.ClockSkewToleranceMillis) * time.Millisecond
+
 		if checkpointer.kclConfig.EnableLeaseStealing {
-			if time.Now().UTC().Before(currentLeaseTimeout) && assignedTo != newAssignTo && !isClaimRequestExpired {
+			if time.Now().UTC().Before(currentLeaseTimeout.Add(skew)) && assignedTo != newAssignTo && !isClaimRequestExpired {
 				return ErrLeaseNotAcquired{"current lease timeout not yet expired"}
 			}
 		} else {
-			if time.Now().UTC().Before(currentLeaseTimeout) && assignedTo != newAssignTo {
+			if time.Now().UTC().Before(currentLeaseTimeout.Add(skew)) && assignedTo != newAssignTo {
 				return ErrLeaseNotAcquired{"current lease timeout not yet expired"}
 			}
 		}
@@ -219,6 +241,12 @@ func (checkpointer *DynamoCheckpoint) GetLease(shard *par.ShardStatus, newAssign
 		}
 	}
 
+	// the lease is written whole, keep its heartbeat
+	if heartbeat, ok := currentCheckpoint[HeartbeatKey]; ok {
+		marshalledCheckpoint[HeartbeatKey] = heartbeat
+	}
+	checkpointer.tagLease(marshalledCheckpoint)
+
 	if checkpointer.kclConfig.EnableLeaseStealing {
 		if claimRequest != "" && claimRequest == newAssignTo && !isClaimRequestExpired {
 			if expressionAttributeValues == nil {
@@ -248,6 +276,106 @@ func (checkpointer *DynamoCheckpoint) GetLease(shard *par.ShardStatus, newAssign
 	return nil
 }
 
+// RenewLeases renews the leases held by assignTo in chunks of up to 25 leases. BatchWriteItem does not support
+// conditions, so each chunk is written as one transaction, every renewal conditional on the lease being unchanged
+// since it was last written by assignTo and not claimed by another worker. When a chunk is canceled, its leases are
+// renewed one by one with GetLease, which sorts out the leases that were actually lost.
+func (checkpointer *DynamoCheckpoint) RenewLeases(shards []*par.ShardStatus, assignTo string) map[string]error {
+	errs := make(map[string]error)
+	for start := 0; start < len(shards); start += maxTransactItems {
+		end := start + maxTransactItems
+		if end > len(shards) {
+			end = len(shards)
+		}
+		chunk := shards[start:end]
+
+		err := checkpointer.renewLeaseChunk(chunk, assignTo)
+		if err == nil {
+			continue
+		}
+
+		checkpointer.log.Debugf("Batched renewal of %d leases failed, renewing them one by one. Error: %+v", len(chunk), err)
+		for _, shard := range chunk {
+			if err := checkpointer.GetLease(shard, assignTo); err != nil {
+				errs[shard.ID] = err
+			}
+		}
+	}
+	return errs
+}
+
+// renewLeaseChunk renews the leases of at most maxTransactItems shards in one transaction
+func (checkpointer *DynamoCheckpoint) renewLeaseChunk(shards []*par.ShardStatus, assignTo string) error {
+	newLeaseTimeout := time.Now().Add(time.Duration(checkpointer.LeaseDuration) * time.Millisecond).UTC()
+	newLeaseTimeoutString := newLeaseTimeout.Format(time.RFC3339Nano)
+
+	items := make([]types.TransactWriteItem, 0, len(shards))
+	for _, shard := range shards {
+		items = append(items, types.TransactWriteItem{
+			Update: &types.Update{
+				TableName: aws.String(checkpointer.TableName),
+				Key: map[string]types.AttributeValue{
+					LeaseKeyKey: &types.AttributeValueMemberS{
+						Value: shard.ID,
+					},
+				},
+				UpdateExpression:    aws.String("set LeaseTimeout = :new_lease_timeout"),
+				ConditionExpression: aws.String("AssignedTo = :assigned_to AND LeaseTimeout = :lease_timeout AND attribute_not_exists(ClaimRequest)"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":assigned_to": &types.AttributeValueMemberS{
+						Value: assignTo,
+					},
+					":lease_timeout": &types.AttributeValueMemberS{
+						Value: shard.GetLeaseTimeout().UTC().Format(time.RFC3339Nano),
+					},
+					":new_lease_timeout": &types.AttributeValueMemberS{
+						Value: newLeaseTimeoutString,
+					},
+				},
+			},
+		})
+	}
+
+	_, err := checkpointer.svc.TransactWriteItems(context.Background(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		shard.Mux.Lock()
+		shard.AssignedTo = assignTo
+		shard.LeaseTimeout = newLeaseTimeout
+		shard.Mux.Unlock()
+	}
+	return nil
+}
+
+// CreateLease creates the lease entry of the shard unless it exists already. The workers ending sibling shards race to
+// create the lease of their common child shard: the put is conditional on the entry not existing, and losing the race
+// counts as success.
+func (checkpointer *DynamoCheckpoint) CreateLease(shard *par.ShardStatus) error {
+	marshalledCheckpoint := map[string]types.AttributeValue{
+		LeaseKeyKey: &types.AttributeValueMemberS{
+			Value: shard.ID,
+		},
+	}
+
+	if len(shard.ParentShardId) > 0 {
+		marshalledCheckpoint[ParentShardIdKey] = &types.AttributeValueMemberS{Value: shard.ParentShardId}
+	}
+	checkpointer.tagLease(marshalledCheckpoint)
+
+	err := checkpointer.conditionalUpdate("attribute_not_exists(ShardID)", nil, marshalledCheckpoint)
+	var conditionalCheckErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionalCheckErr) {
+		checkpointer.log.Debugf("Lease of shard %s already created", shard.ID)
+		return nil
+	}
+	return err
+}
+
 // CheckpointSequence writes a checkpoint at the designated sequence ID
 func (checkpointer *DynamoCheckpoint) CheckpointSequence(shard *par.ShardStatus) error {
 	leaseTimeout := shard.GetLeaseTimeout().UTC().Format(time.RFC3339Nano)
@@ -264,15 +392,101 @@ func (checkpointer *DynamoCheckpoint) CheckpointSequence(shard *par.ShardStatus)
 		LeaseTimeoutKey: &types.AttributeValueMemberS{
 			Value: leaseTimeout,
 		},
+		HeartbeatKey: &types.AttributeValueMemberS{
+			Value: time.Now().UTC().Format(time.RFC3339Nano),
+		},
 	}
 
 	if len(shard.ParentShardId) > 0 {
 		marshalledCheckpoint[ParentShardIdKey] = &types.AttributeValueMemberS{Value: shard.ParentShardId}
 	}
+	checkpointer.tagLease(marshalledCheckpoint)
 
 	return checkpointer.saveItem(marshalledCheckpoint)
 }
 
+// CheckpointAndRenewLease writes the checkpoint of the shard along with a new lease timeout. Like the batched lease
+// renewals, the write is conditional on the lease being held by the owner of the shard, with the lease timeout it was
+// last written with, and not claimed by another worker: a worker which lost the lease in the meantime can neither
+// extend it nor overwrite the checkpoint of the new owner.
+func (checkpointer *DynamoCheckpoint) CheckpointAndRenewLease(shard *par.ShardStatus) error {
+	newLeaseTimeout := time.Now().Add(time.Duration(checkpointer.LeaseDuration) * time.Millisecond).UTC()
+	owner := shard.GetLeaseOwner()
+	marshalledCheckpoint := map[string]types.AttributeValue{
+		LeaseKeyKey: &types.AttributeValueMemberS{
+			Value: shard.ID,
+		},
+		SequenceNumberKey: &types.AttributeValueMemberS{
+			Value: shard.GetCheckpoint(),
+		},
+		LeaseOwnerKey: &types.AttributeValueMemberS{
+			Value: owner,
+		},
+		LeaseTimeoutKey: &types.AttributeValueMemberS{
+			Value: newLeaseTimeout.Format(time.RFC3339Nano),
+		},
+		HeartbeatKey: &types.AttributeValueMemberS{
+			Value: time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	}
+
+	if len(shard.ParentShardId) > 0 {
+		marshalledCheckpoint[ParentShardIdKey] = &types.AttributeValueMemberS{Value: shard.ParentShardId}
+	}
+	checkpointer.tagLease(marshalledCheckpoint)
+
+	conditionalExpression := "AssignedTo = :assigned_to AND LeaseTimeout = :lease_timeout AND attribute_not_exists(ClaimRequest)"
+	expressionAttributeValues := map[string]types.AttributeValue{
+		":assigned_to": &types.AttributeValueMemberS{
+			Value: owner,
+		},
+		":lease_timeout": &types.AttributeValueMemberS{
+			Value: shard.GetLeaseTimeout().UTC().Format(time.RFC3339Nano),
+		},
+	}
+
+	err := checkpointer.conditionalUpdate(conditionalExpression, expressionAttributeValues, marshalledCheckpoint)
+	if err != nil {
+		var conditionalCheckErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckErr) {
+			return ErrLeaseNotAcquired{conditionalCheckErr.ErrorMessage()}
+		}
+		return err
+	}
+
+	shard.Mux.Lock()
+	shard.LeaseTimeout = newLeaseTimeout
+	shard.Mux.Unlock()
+
+	return nil
+}
+
+// TouchCheckpoint sets the heartbeat of the lease to the current time, leaving the checkpoint unchanged
+func (checkpointer *DynamoCheckpoint) TouchCheckpoint(shard *par.ShardStatus) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(checkpointer.TableName),
+		Key: map[string]types.AttributeValue{
+			LeaseKeyKey: &types.AttributeValueMemberS{
+				Value: shard.ID,
+			},
+		},
+		UpdateExpression: aws.String("set " + HeartbeatKey + " = :heartbeat"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":assigned_to": &types.AttributeValueMemberS{
+				Value: shard.GetLeaseOwner(),
+			},
+			":heartbeat": &types.AttributeValueMemberS{
+				Value: time.Now().UTC().Format(time.RFC3339Nano),
+			},
+		},
+		ConditionExpression: aws.String("AssignedTo = :assigned_to"),
+	}
+
+	_, err := checkpointer.svc.UpdateItem(context.TODO(), input)
+
+	return err
+}
+
 // FetchCheckpoint retrieves the checkpoint for the given shard
 func (checkpointer *DynamoCheckpoint) FetchCheckpoint(shard *par.ShardStatus) error {
 	checkpoint, err := checkpointer.getItem(shard.ID)
@@ -280,6 +494,11 @@ func (checkpointer *DynamoCheckpoint) FetchCheckpoint(shard *par.ShardStatus) er
 		return err
 	}
 
+	// the checkpoint of a shard of an earlier stream with the same ID
+	if checkpointer.staleGeneration(checkpoint) {
+		return ErrSequenceIDNotFound
+	}
+
 	sequenceID, ok := checkpoint[SequenceNumberKey]
 	if !ok {
 		return ErrSequenceIDNotFound
@@ -456,24 +675,23 @@ func (checkpointer *DynamoCheckpoint) syncLeases(shardStatus map[string]*par.Sha
 
 	checkpointer.lastLeaseSync = time.Now()
 	input := &dynamodb.ScanInput{
-		ProjectionExpression: aws.String(fmt.Sprintf("%s,%s,%s", LeaseKeyKey, LeaseOwnerKey, SequenceNumberKey)),
+		ProjectionExpression: aws.String(fmt.Sprintf("%s,%s,%s,%s", LeaseKeyKey, LeaseOwnerKey, SequenceNumberKey, StreamGenerationKey)),
 		Select:               "SPECIFIC_ATTRIBUTES",
 		TableName:            aws.String(checkpointer.kclConfig.TableName),
 	}
 
-	scanOutput, err := checkpointer.svc.Scan(context.TODO(), input)
+	results, err := checkpointer.scan(input)
 
 	if err != nil {
 		log.Debugf("Error performing DynamoDB Scan. Error: %+v ", err)
 		return err
 	}
 
-	results := scanOutput.Items
 	for _, result := range results {
 		shardId, foundShardId := result[LeaseKeyKey]
 		assignedTo, foundAssignedTo := result[LeaseOwnerKey]
 		checkpoint, foundCheckpoint := result[SequenceNumberKey]
-		if !foundShardId || !foundAssignedTo || !foundCheckpoint {
+		if !foundShardId || !foundAssignedTo || !foundCheckpoint || checkpointer.staleGeneration(result) {
 			continue
 		}
 
@@ -487,6 +705,178 @@ func (checkpointer *DynamoCheckpoint) syncLeases(shardStatus map[string]*par.Sha
 	return nil
 }
 
+// ListLeases returns every lease of the lease table
+func (checkpointer *DynamoCheckpoint) ListLeases() ([]Lease, error) {
+	items, err := checkpointer.scan(&dynamodb.ScanInput{
+		ConsistentRead: aws.Bool(true),
+		TableName:      aws.String(checkpointer.TableName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []Lease
+	for _, item := range items {
+		if _, ok := item[LeaseKeyKey]; !ok {
+			continue
+		}
+		leases = append(leases, Lease{
+			ShardID:       stringAttribute(item, LeaseKeyKey),
+			Checkpoint:    stringAttribute(item, SequenceNumberKey),
+			ParentShardID: stringAttribute(item, ParentShardIdKey),
+			Owner:         stringAttribute(item, LeaseOwnerKey),
+			LeaseTimeout:  stringAttribute(item, LeaseTimeoutKey),
+			StreamName:    stringAttribute(item, StreamNameKey),
+		})
+	}
+	return leases, nil
+}
+
+// scan reads the whole lease table with the given input. The table is split into LeaseTableScanSegments segments,
+// scanned in parallel and each followed through all of its pages. The items of all the segments are returned, or the
+// first error met.
+func (checkpointer *DynamoCheckpoint) scan(input *dynamodb.ScanInput) ([]map[string]types.AttributeValue, error) {
+	segments := checkpointer.kclConfig.LeaseTableScanSegments
+	if segments <= 1 {
+		return checkpointer.scanSegment(*input)
+	}
+
+	results := make([][]map[string]types.AttributeValue, segments)
+	errs := make([]error, segments)
+	var wg sync.WaitGroup
+	for i := 0; i < segments; i++ {
+		segmentInput := *input
+		segmentInput.Segment = aws.Int32(int32(i))
+		segmentInput.TotalSegments = aws.Int32(int32(segments))
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = checkpointer.scanSegment(segmentInput)
+		}(i)
+	}
+	wg.Wait()
+
+	var items []map[string]types.AttributeValue
+	for i := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		items = append(items, results[i]...)
+	}
+	return items, nil
+}
+
+// scanSegment reads all the pages of the scan
+func (checkpointer *DynamoCheckpoint) scanSegment(input dynamodb.ScanInput) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	for {
+		scanOutput, err := checkpointer.svc.Scan(context.TODO(), &input)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, scanOutput.Items...)
+
+		if len(scanOutput.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+		input.ExclusiveStartKey = scanOutput.LastEvaluatedKey
+	}
+}
+
+// ImportLease writes the checkpoint and parent shard of the lease unless the table already holds a checkpoint of the
+// shard that is not older. The write is conditional on the checkpoint read, so a checkpoint committed concurrently is
+// never overwritten.
+func (checkpointer *DynamoCheckpoint) ImportLease(lease Lease) (bool, error) {
+	if lease.ShardID == "" {
+		return false, errors.New("lease without a shard ID")
+	}
+
+	current, err := checkpointer.getItem(lease.ShardID)
+	if err != nil {
+		return false, err
+	}
+
+	item := map[string]types.AttributeValue{
+		LeaseKeyKey: &types.AttributeValueMemberS{Value: lease.ShardID},
+	}
+	if lease.Checkpoint != "" {
+		item[SequenceNumberKey] = &types.AttributeValueMemberS{Value: lease.Checkpoint}
+	}
+	if lease.ParentShardID != "" {
+		item[ParentShardIdKey] = &types.AttributeValueMemberS{Value: lease.ParentShardID}
+	}
+
+	if len(current) == 0 {
+		return checkpointer.importItem("attribute_not_exists(ShardID)", nil, item)
+	}
+
+	currentCheckpoint, ok := current[SequenceNumberKey]
+	if !ok {
+		if lease.Checkpoint == "" {
+			return false, nil
+		}
+		keepLeaseAttributes(current, item)
+		return checkpointer.importItem("attribute_not_exists(Checkpoint)", nil, item)
+	}
+
+	checkpoint := currentCheckpoint.(*types.AttributeValueMemberS).Value
+	if lease.Checkpoint == "" || CompareSequenceNumbers(checkpoint, lease.Checkpoint) >= 0 {
+		return false, nil
+	}
+
+	keepLeaseAttributes(current, item)
+	return checkpointer.importItem("Checkpoint = :checkpoint", map[string]types.AttributeValue{
+		":checkpoint": &types.AttributeValueMemberS{Value: checkpoint},
+	}, item)
+}
+
+// importItem writes an imported lease, treating a failed condition as a lease which moved on since it was read
+func (checkpointer *DynamoCheckpoint) importItem(conditionExpression string, expressionAttributeValues map[string]types.AttributeValue, item map[string]types.AttributeValue) (bool, error) {
+	err := checkpointer.conditionalUpdate(conditionExpression, expressionAttributeValues, item)
+	var conditionalCheckErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionalCheckErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// keepLeaseAttributes copies the ownership of a lease, and its parent shard if the import has none, so importing a
+// checkpoint does not take a lease away from its owner
+func keepLeaseAttributes(current, item map[string]types.AttributeValue) {
+	for _, key := range []string{LeaseOwnerKey, LeaseTimeoutKey, ClaimRequestKey, HeartbeatKey, ParentShardIdKey} {
+		if _, ok := item[key]; ok {
+			continue
+		}
+		if value, ok := current[key]; ok {
+			item[key] = value
+		}
+	}
+}
+
+// staleGeneration returns whether the lease belongs to another generation of the stream than the one the leases are
+// scoped to. A lease without generation is taken to be of the current generation.
+func (checkpointer *DynamoCheckpoint) staleGeneration(item map[string]types.AttributeValue) bool {
+	generation := stringAttribute(item, StreamGenerationKey)
+	return checkpointer.generation != "" && generation != "" && generation != checkpointer.generation
+}
+
+// tagLease tags the lease with the name of its stream and with the generation of the stream the leases are scoped
+// to, if any.
+func (checkpointer *DynamoCheckpoint) tagLease(item map[string]types.AttributeValue) {
+	item[StreamNameKey] = &types.AttributeValueMemberS{Value: checkpointer.kclConfig.StreamName}
+	if checkpointer.generation != "" {
+		item[StreamGenerationKey] = &types.AttributeValueMemberS{Value: checkpointer.generation}
+	}
+}
+
+func stringAttribute(item map[string]types.AttributeValue, key string) string {
+	if value, ok := item[key].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
 func (checkpointer *DynamoCheckpoint) createTable() error {
 	input := &dynamodb.CreateTableInput{
 		AttributeDefinitions: []types.AttributeDefinition{
@@ -30,6 +30,7 @@ package checkpoint
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"testing"
 	"time"
@@ -158,6 +159,32 @@ func TestGetLeaseAquired(t *testing.T) {
 	assert.Equal(t, "", status.GetLeaseOwner())
 }
 
+func TestGetLeaseNotAcquiredWithinClockSkewTolerance(t *testing.T) {
+	svc := &mockDynamoDB{tableExist: true, item: map[string]types.AttributeValue{}}
+	kclConfig := cfg.NewKinesisClientLibConfig("appName", "test", "us-west-2", "abc").
+		WithInitialPositionInStream(cfg.LATEST).
+		WithClockSkewToleranceMillis(5000)
+
+	checkpoint := NewDynamoCheckpoint(kclConfig).WithDynamoDB(svc)
+	_ = checkpoint.Init()
+	// the lease expired a second ago by our clock, which may just be running ahead of the owner's
+	leaseTimeout := time.Now().Add(-time.Second).UTC()
+	svc.item = map[string]types.AttributeValue{
+		LeaseKeyKey:     &types.AttributeValueMemberS{Value: "0001"},
+		LeaseOwnerKey:   &types.AttributeValueMemberS{Value: "abcd-efgh"},
+		LeaseTimeoutKey: &types.AttributeValueMemberS{Value: leaseTimeout.Format(time.RFC3339Nano)},
+	}
+
+	err := checkpoint.GetLease(&par.ShardStatus{ID: "0001", Mux: &sync.RWMutex{}}, "ijkl-mnop")
+	assert.True(t, errors.As(err, &ErrLeaseNotAcquired{}), "lease taken within the clock skew tolerance: %v", err)
+
+	// past the tolerance the lease can be taken over
+	leaseTimeout = time.Now().Add(-10 * time.Second).UTC()
+	svc.item[LeaseTimeoutKey] = &types.AttributeValueMemberS{Value: leaseTimeout.Format(time.RFC3339Nano)}
+	err = checkpoint.GetLease(&par.ShardStatus{ID: "0001", Mux: &sync.RWMutex{}}, "ijkl-mnop")
+	assert.Nil(t, err)
+}
+
 func TestGetLeaseShardClaimed(t *testing.T) {
 	leaseTimeout := time.Now().Add(-100 * time.Second).UTC()
 	svc := &mockDynamoDB{
@@ -272,6 +299,76 @@ func TestGetLeaseClaimRequestExpiredClaimer(t *testing.T) {
 	}
 }
 
+func TestRenewLeasesBatched(t *testing.T) {
+	svc := &mockDynamoDB{tableExist: true, item: map[string]types.AttributeValue{}}
+	kclConfig := cfg.NewKinesisClientLibConfig("appName", "test", "us-west-2", "abc").
+		WithBatchedLeaseRenewal(true)
+
+	checkpoint := NewDynamoCheckpoint(kclConfig).WithDynamoDB(svc)
+	_ = checkpoint.Init()
+
+	leaseTimeout := time.Now().Add(5 * time.Second)
+	var shards []*par.ShardStatus
+	for i := 0; i < 30; i++ {
+		shards = append(shards, &par.ShardStatus{
+			ID:           fmt.Sprintf("%04d", i),
+			AssignedTo:   "abc",
+			LeaseTimeout: leaseTimeout,
+			Mux:          &sync.RWMutex{},
+		})
+	}
+
+	errs := checkpoint.RenewLeases(shards, "abc")
+	assert.Empty(t, errs)
+
+	// 25 leases at most per transaction
+	if assert.Len(t, svc.transactions, 2) {
+		assert.Len(t, svc.transactions[0], 25)
+		assert.Len(t, svc.transactions[1], 5)
+	}
+
+	update := svc.transactions[1][0].Update
+	assert.Equal(t, "0025", update.Key[LeaseKeyKey].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "abc", update.ExpressionAttributeValues[":assigned_to"].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, leaseTimeout.UTC().Format(time.RFC3339Nano), update.ExpressionAttributeValues[":lease_timeout"].(*types.AttributeValueMemberS).Value)
+
+	for _, shard := range shards {
+		assert.True(t, shard.GetLeaseTimeout().After(leaseTimeout))
+	}
+}
+
+func TestCreateChildLeaseConcurrently(t *testing.T) {
+	svc := &mockDynamoDB{tableExist: true, item: map[string]types.AttributeValue{}}
+	kclConfig := cfg.NewKinesisClientLibConfig("appName", "test", "us-west-2", "abc")
+
+	// the workers ending the two parents of a merged shard both create the lease of the child
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, workerID := range []string{"abc", "def"} {
+		checkpoint := NewDynamoCheckpoint(cfg.NewKinesisClientLibConfig("appName", "test", "us-west-2", workerID)).WithDynamoDB(svc)
+		_ = checkpoint.Init()
+		wg.Add(1)
+		go func(i int, checkpoint *DynamoCheckpoint) {
+			defer wg.Done()
+			errs[i] = checkpoint.CreateLease(&par.ShardStatus{ID: "0003", ParentShardId: "0001", Mux: &sync.RWMutex{}})
+		}(i, checkpoint)
+	}
+	wg.Wait()
+
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.Equal(t, "0003", svc.item[LeaseKeyKey].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "0001", svc.item[ParentShardIdKey].(*types.AttributeValueMemberS).Value)
+	_, owned := svc.item[LeaseOwnerKey]
+	assert.False(t, owned)
+
+	// the lease created without owner can be acquired
+	checkpoint := NewDynamoCheckpoint(kclConfig).WithDynamoDB(svc)
+	_ = checkpoint.Init()
+	assert.Nil(t, checkpoint.GetLease(&par.ShardStatus{ID: "0003", ParentShardId: "0001", Mux: &sync.RWMutex{}}, "abc"))
+	assert.Equal(t, "attribute_not_exists(AssignedTo)", svc.conditionalExpression)
+}
+
 func TestFetchCheckpointWithStealing(t *testing.T) {
 	future := time.Now().AddDate(0, 1, 0)
 
@@ -485,3 +582,226 @@ func TestClaimShard(t *testing.T) {
 	assert.Equal(t, shard.Checkpoint, status.Checkpoint)
 	assert.Equal(t, shard.ParentShardId, status.ParentShardId)
 }
+
+func TestTouchCheckpoint(t *testing.T) {
+	svc := &mockDynamoDB{tableExist: true, item: map[string]types.AttributeValue{}}
+	kclConfig := cfg.NewKinesisClientLibConfig("appName", "test", "us-west-2", "abc")
+	checkpoint := NewDynamoCheckpoint(kclConfig).WithDynamoDB(svc)
+	_ = checkpoint.Init()
+
+	shard := &par.ShardStatus{
+		ID:         "0001",
+		Checkpoint: "deadbeef",
+		Mux:        &sync.RWMutex{},
+	}
+	assert.Nil(t, checkpoint.GetLease(shard, "abc"))
+	_, ok := svc.item[HeartbeatKey]
+	assert.False(t, ok)
+
+	// checkpoints advance the heartbeat
+	assert.Nil(t, checkpoint.CheckpointSequence(shard))
+	checkpointed := svc.item[HeartbeatKey].(*types.AttributeValueMemberS).Value
+
+	// so does touching the checkpoint, without writing it
+	time.Sleep(time.Millisecond)
+	assert.Nil(t, checkpoint.TouchCheckpoint(shard))
+	touched := svc.item[HeartbeatKey].(*types.AttributeValueMemberS).Value
+	assert.NotEqual(t, checkpointed, touched)
+	assert.Equal(t, "deadbeef", svc.item[SequenceNumberKey].(*types.AttributeValueMemberS).Value)
+
+	// the heartbeat survives the lease renewals
+	assert.Nil(t, checkpoint.GetLease(shard, "abc"))
+	assert.Equal(t, touched, svc.item[HeartbeatKey].(*types.AttributeValueMemberS).Value)
+}
+
+func TestCheckpointAndRenewLease(t *testing.T) {
+	svc := &mockDynamoDB{tableExist: true, item: map[string]types.AttributeValue{}}
+	kclConfig := cfg.NewKinesisClientLibConfig("appName", "test", "us-west-2", "abc").
+		WithCheckpointRenewsLease(true)
+	checkpoint := NewDynamoCheckpoint(kclConfig).WithDynamoDB(svc)
+	_ = checkpoint.Init()
+
+	shard := &par.ShardStatus{
+		ID:         "0001",
+		Checkpoint: "deadbeef",
+		Mux:        &sync.RWMutex{},
+	}
+	assert.Nil(t, checkpoint.GetLease(shard, "abc"))
+	leaseTimeout := shard.GetLeaseTimeout()
+
+	time.Sleep(time.Millisecond)
+	shard.SetCheckpoint("cafebabe")
+	puts := svc.puts
+	assert.Nil(t, checkpoint.CheckpointAndRenewLease(shard))
+
+	// the checkpoint and the new lease timeout are written together
+	assert.Equal(t, puts+1, svc.puts)
+	assert.Equal(t, "cafebabe", svc.item[SequenceNumberKey].(*types.AttributeValueMemberS).Value)
+	assert.True(t, shard.GetLeaseTimeout().After(leaseTimeout))
+	assert.Equal(t, shard.GetLeaseTimeout().Format(time.RFC3339Nano), svc.item[LeaseTimeoutKey].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "abc", svc.item[LeaseOwnerKey].(*types.AttributeValueMemberS).Value)
+
+	// provided the lease is still held by the worker, unchanged since it was last written
+	assert.Equal(t, "AssignedTo = :assigned_to AND LeaseTimeout = :lease_timeout AND attribute_not_exists(ClaimRequest)", svc.conditionalExpression)
+	assert.Equal(t, "abc", svc.expressionAttributeValues[":assigned_to"].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, leaseTimeout.UTC().Format(time.RFC3339Nano), svc.expressionAttributeValues[":lease_timeout"].(*types.AttributeValueMemberS).Value)
+}
+
+func TestListLeases(t *testing.T) {
+	svc := &mockDynamoDB{tableExist: true, item: map[string]types.AttributeValue{}}
+	svc.scanPages = [][]map[string]types.AttributeValue{
+		{
+			{
+				LeaseKeyKey:       &types.AttributeValueMemberS{Value: "0001"},
+				SequenceNumberKey: &types.AttributeValueMemberS{Value: "100"},
+				LeaseOwnerKey:     &types.AttributeValueMemberS{Value: "abc"},
+				LeaseTimeoutKey:   &types.AttributeValueMemberS{Value: "2023-01-01T00:00:00Z"},
+				StreamNameKey:     &types.AttributeValueMemberS{Value: "test"},
+			},
+		},
+		{
+			{
+				LeaseKeyKey:       &types.AttributeValueMemberS{Value: "0002"},
+				SequenceNumberKey: &types.AttributeValueMemberS{Value: ShardEnd},
+				ParentShardIdKey:  &types.AttributeValueMemberS{Value: "0001"},
+			},
+		},
+	}
+	kclConfig := cfg.NewKinesisClientLibConfig("appName", "test", "us-west-2", "abc")
+	checkpoint := NewDynamoCheckpoint(kclConfig).WithDynamoDB(svc)
+	_ = checkpoint.Init()
+
+	leases, err := checkpoint.ListLeases()
+	assert.Nil(t, err)
+	assert.Equal(t, []Lease{
+		{ShardID: "0001", Checkpoint: "100", Owner: "abc", LeaseTimeout: "2023-01-01T00:00:00Z", StreamName: "test"},
+		{ShardID: "0002", Checkpoint: ShardEnd, ParentShardID: "0001"},
+	}, leases)
+}
+
+func TestImportLease(t *testing.T) {
+	svc := &mockDynamoDB{tableExist: true, item: map[string]types.AttributeValue{}}
+	kclConfig := cfg.NewKinesisClientLibConfig("appName", "test", "us-west-2", "abc")
+	checkpoint := NewDynamoCheckpoint(kclConfig).WithDynamoDB(svc)
+	_ = checkpoint.Init()
+
+	// an empty table takes the lease as is, without its owner
+	written, err := checkpoint.ImportLease(Lease{ShardID: "0001", Checkpoint: "200", Owner: "def", ParentShardID: "0000"})
+	assert.Nil(t, err)
+	assert.True(t, written)
+	assert.Equal(t, "attribute_not_exists(ShardID)", svc.conditionalExpression)
+	assert.Equal(t, "200", svc.item[SequenceNumberKey].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "0000", svc.item[ParentShardIdKey].(*types.AttributeValueMemberS).Value)
+	_, owned := svc.item[LeaseOwnerKey]
+	assert.False(t, owned)
+
+	// newer or equal checkpoints in the table are kept
+	for _, older := range []string{"200", "150", ""} {
+		written, err = checkpoint.ImportLease(Lease{ShardID: "0001", Checkpoint: older})
+		assert.Nil(t, err)
+		assert.False(t, written)
+		assert.Equal(t, "200", svc.item[SequenceNumberKey].(*types.AttributeValueMemberS).Value)
+	}
+
+	// older checkpoints are replaced, conditionally on the checkpoint read and keeping the lease owner
+	svc.item[LeaseOwnerKey] = &types.AttributeValueMemberS{Value: "abc"}
+	written, err = checkpoint.ImportLease(Lease{ShardID: "0001", Checkpoint: ShardEnd})
+	assert.Nil(t, err)
+	assert.True(t, written)
+	assert.Equal(t, "Checkpoint = :checkpoint", svc.conditionalExpression)
+	assert.Equal(t, "200", svc.expressionAttributeValues[":checkpoint"].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, ShardEnd, svc.item[SequenceNumberKey].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "abc", svc.item[LeaseOwnerKey].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "0000", svc.item[ParentShardIdKey].(*types.AttributeValueMemberS).Value)
+}
+
+func TestListLeasesParallelScan(t *testing.T) {
+	lease := func(shardID string) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			LeaseKeyKey:       &types.AttributeValueMemberS{Value: shardID},
+			SequenceNumberKey: &types.AttributeValueMemberS{Value: "100"},
+		}
+	}
+	svc := &mockDynamoDB{tableExist: true, item: map[string]types.AttributeValue{}}
+	svc.segmentPages = map[int32][][]map[string]types.AttributeValue{
+		0: {{lease("0001"), lease("0002")}, {lease("0003")}},
+		1: {{lease("0004")}},
+	}
+	kclConfig := cfg.NewKinesisClientLibConfig("appName", "test", "us-west-2", "abc").
+		WithLeaseTableScanSegments(3)
+	checkpoint := NewDynamoCheckpoint(kclConfig).WithDynamoDB(svc)
+	_ = checkpoint.Init()
+
+	leases, err := checkpoint.ListLeases()
+	assert.Nil(t, err)
+
+	// every segment is scanned, through all of its pages
+	assert.Equal(t, map[int32]int{0: 2, 1: 1, 2: 1}, svc.scans)
+	assert.Equal(t, []Lease{
+		{ShardID: "0001", Checkpoint: "100"},
+		{ShardID: "0002", Checkpoint: "100"},
+		{ShardID: "0003", Checkpoint: "100"},
+		{ShardID: "0004", Checkpoint: "100"},
+	}, leases)
+}
+
+func TestLeasesTaggedWithStreamName(t *testing.T) {
+	svc := &mockDynamoDB{tableExist: true, item: map[string]types.AttributeValue{}}
+	kclConfig := cfg.NewKinesisClientLibConfig("appName", "test", "us-west-2", "abc")
+	checkpoint := NewDynamoCheckpoint(kclConfig).WithDynamoDB(svc)
+	_ = checkpoint.Init()
+
+	shard := &par.ShardStatus{ID: "0001", Checkpoint: "cafebabe", Mux: &sync.RWMutex{}}
+	assert.Nil(t, checkpoint.CheckpointSequence(shard))
+	assert.Equal(t, "test", svc.item[StreamNameKey].(*types.AttributeValueMemberS).Value)
+}
+
+func TestStreamGenerations(t *testing.T) {
+	svc := &mockDynamoDB{tableExist: true, item: map[string]types.AttributeValue{}}
+	kclConfig := cfg.NewKinesisClientLibConfig("appName", "test", "us-west-2", "abc")
+	checkpoint := NewDynamoCheckpoint(kclConfig).WithDynamoDB(svc)
+	_ = checkpoint.Init()
+	checkpoint.SetStreamGeneration("2023-06-01T00:00:00Z")
+
+	// a lease of the previous stream of the same name, still held
+	leaseOf := func(generation, owner, checkpoint string) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			LeaseKeyKey:         &types.AttributeValueMemberS{Value: "0001"},
+			LeaseOwnerKey:       &types.AttributeValueMemberS{Value: owner},
+			LeaseTimeoutKey:     &types.AttributeValueMemberS{Value: time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano)},
+			SequenceNumberKey:   &types.AttributeValueMemberS{Value: checkpoint},
+			StreamGenerationKey: &types.AttributeValueMemberS{Value: generation},
+		}
+	}
+	svc.item = leaseOf("2022-01-01T00:00:00Z", "previous", "deadbeef")
+	shard := &par.ShardStatus{ID: "0001", Mux: &sync.RWMutex{}}
+
+	// is ignored
+	assert.Equal(t, ErrSequenceIDNotFound, checkpoint.FetchCheckpoint(shard))
+	assert.Equal(t, "", shard.GetCheckpoint())
+	assert.Equal(t, "", shard.GetLeaseOwner())
+	shardStatus := map[string]*par.ShardStatus{"0001": shard}
+	svc.scanPages = [][]map[string]types.AttributeValue{{svc.item}}
+	assert.Nil(t, checkpoint.syncLeases(shardStatus))
+	assert.Equal(t, "", shard.GetCheckpoint())
+	assert.Equal(t, "", shard.GetLeaseOwner())
+
+	// and taken over, without its checkpoint, although not expired
+	assert.Nil(t, checkpoint.GetLease(shard, "abc"))
+	assert.Equal(t, "StreamGeneration = :stale_generation", svc.conditionalExpression)
+	assert.Equal(t, "2022-01-01T00:00:00Z", svc.expressionAttributeValues[":stale_generation"].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "2023-06-01T00:00:00Z", svc.item[StreamGenerationKey].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "abc", svc.item[LeaseOwnerKey].(*types.AttributeValueMemberS).Value)
+	assert.NotContains(t, svc.item, SequenceNumberKey)
+
+	// the leases of the current generation are used
+	shard.SetCheckpoint("cafebabe")
+	assert.Nil(t, checkpoint.CheckpointSequence(shard))
+	assert.Equal(t, "2023-06-01T00:00:00Z", svc.item[StreamGenerationKey].(*types.AttributeValueMemberS).Value)
+	shard = &par.ShardStatus{ID: "0001", Mux: &sync.RWMutex{}}
+	assert.Nil(t, checkpoint.FetchCheckpoint(shard))
+	assert.Equal(t, "cafebabe", shard.GetCheckpoint())
+
+	svc.item = leaseOf("2023-06-01T00:00:00Z", "other", "cafebabe")
+	assert.True(t, errors.As(checkpoint.GetLease(shard, "abc"), &ErrLeaseNotAcquired{}))
+}
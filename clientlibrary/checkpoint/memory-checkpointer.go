@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package checkpoint
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+// MemoryLeaseTable is a lease table kept in memory, e.g. to run workers locally or in tests without DynamoDB. It is safe
+// for concurrent use by the checkpointers of several workers.
+type MemoryLeaseTable struct {
+	mux    sync.Mutex
+	leases map[string]*memoryLease
+}
+
+type memoryLease struct {
+	owner        string
+	leaseTimeout time.Time
+	checkpoint   string
+	parent       string
+	claimRequest string
+}
+
+// NewMemoryLeaseTable returns an empty lease table.
+func NewMemoryLeaseTable() *MemoryLeaseTable {
+	return &MemoryLeaseTable{leases: make(map[string]*memoryLease)}
+}
+
+// MemoryCheckpointer implements the Checkpointer interface on a MemoryLeaseTable, with the same semantics as
+// DynamoCheckpoint. Each worker has a checkpointer of its own, on the lease table they share.
+type MemoryCheckpointer struct {
+	table     *MemoryLeaseTable
+	kclConfig *config.KinesisClientLibConfiguration
+}
+
+// NewMemoryCheckpointer returns a checkpointer of the worker of the given configuration on the lease table.
+func NewMemoryCheckpointer(kclConfig *config.KinesisClientLibConfiguration, table *MemoryLeaseTable) *MemoryCheckpointer {
+	return &MemoryCheckpointer{table: table, kclConfig: kclConfig}
+}
+
+// Init has nothing to create, the lease table exists already.
+func (checkpointer *MemoryCheckpointer) Init() error {
+	return nil
+}
+
+// GetLease attempts to gain a lock on the given shard
+func (checkpointer *MemoryCheckpointer) GetLease(shard *par.ShardStatus, newAssignTo string) error {
+	t := checkpointer.table
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	now := time.Now().UTC()
+	lease, ok := t.leases[shard.ID]
+	if !ok {
+		lease = &memoryLease{}
+	}
+
+	isClaimRequestExpired := shard.IsClaimRequestExpired(checkpointer.kclConfig)
+	if checkpointer.kclConfig.EnableLeaseStealing && lease.claimRequest != "" &&
+		lease.claimRequest != newAssignTo && !isClaimRequestExpired {
+		return errors.New(ErrShardClaimed)
+	}
+
+	// the lease may have been written by a worker whose clock is ahead of ours
+	skew := time.Duration(checkpointer.kclConfig.ClockSkewToleranceMillis) * time.Millisecond
+	if lease.owner != "" && lease.owner != newAssignTo && now.Before(lease.leaseTimeout.Add(skew)) &&
+		!(checkpointer.kclConfig.EnableLeaseStealing && isClaimRequestExpired) {
+		return ErrLeaseNotAcquired{"current lease timeout not yet expired"}
+	}
+
+	lease.owner = newAssignTo
+	lease.leaseTimeout = now.Add(time.Duration(checkpointer.kclConfig.FailoverTimeMillis) * time.Millisecond)
+	lease.claimRequest = ""
+	if len(shard.ParentShardId) > 0 {
+		lease.parent = shard.ParentShardId
+	}
+	if checkpoint := shard.GetCheckpoint(); checkpoint != "" {
+		lease.checkpoint = checkpoint
+	}
+	t.leases[shard.ID] = lease
+
+	shard.Mux.Lock()
+	shard.AssignedTo = newAssignTo
+	shard.LeaseTimeout = lease.leaseTimeout
+	shard.ClaimRequest = ""
+	shard.Mux.Unlock()
+	return nil
+}
+
+// CheckpointSequence writes a checkpoint at the designated sequence ID
+func (checkpointer *MemoryCheckpointer) CheckpointSequence(shard *par.ShardStatus) error {
+	t := checkpointer.table
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	lease, ok := t.leases[shard.ID]
+	if !ok {
+		lease = &memoryLease{}
+		t.leases[shard.ID] = lease
+	}
+	lease.checkpoint = shard.GetCheckpoint()
+	lease.owner = shard.GetLeaseOwner()
+	lease.leaseTimeout = shard.GetLeaseTimeout().UTC()
+	if len(shard.ParentShardId) > 0 {
+		lease.parent = shard.ParentShardId
+	}
+	return nil
+}
+
+// FetchCheckpoint retrieves the checkpoint for the given shard
+func (checkpointer *MemoryCheckpointer) FetchCheckpoint(shard *par.ShardStatus) error {
+	t := checkpointer.table
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	lease, ok := t.leases[shard.ID]
+	if !ok || lease.checkpoint == "" {
+		return ErrSequenceIDNotFound
+	}
+	shard.SetCheckpoint(lease.checkpoint)
+	if lease.owner != "" {
+		shard.SetLeaseOwner(lease.owner)
+	}
+	if !lease.leaseTimeout.IsZero() {
+		shard.SetLeaseTimeout(lease.leaseTimeout)
+	}
+	return nil
+}
+
+// RemoveLeaseInfo to remove lease info for shard entry because the shard no longer exists
+func (checkpointer *MemoryCheckpointer) RemoveLeaseInfo(shardID string) error {
+	t := checkpointer.table
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	delete(t.leases, shardID)
+	return nil
+}
+
+// RemoveLeaseOwner to remove lease owner for the shard entry, provided it is held by the worker
+func (checkpointer *MemoryCheckpointer) RemoveLeaseOwner(shardID string) error {
+	t := checkpointer.table
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	lease, ok := t.leases[shardID]
+	if !ok || lease.owner != checkpointer.kclConfig.WorkerID {
+		return ErrLeaseNotAcquired{"lease not held by " + checkpointer.kclConfig.WorkerID}
+	}
+	lease.owner = ""
+	return nil
+}
+
+// GetLeaseOwner returns current lease owner of given shard
+func (checkpointer *MemoryCheckpointer) GetLeaseOwner(shardID string) (string, error) {
+	t := checkpointer.table
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	lease, ok := t.leases[shardID]
+	if !ok || lease.owner == "" {
+		return "", NoLeaseOwnerErr
+	}
+	return lease.owner, nil
+}
+
+// ListActiveWorkers returns a map of workers and their shards
+func (checkpointer *MemoryCheckpointer) ListActiveWorkers(shardStatus map[string]*par.ShardStatus) (map[string][]*par.ShardStatus, error) {
+	t := checkpointer.table
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	workers := map[string][]*par.ShardStatus{}
+	for _, shard := range shardStatus {
+		if lease, ok := t.leases[shard.ID]; ok && lease.owner != "" && lease.checkpoint != "" {
+			shard.SetLeaseOwner(lease.owner)
+			shard.SetCheckpoint(lease.checkpoint)
+		}
+		if shard.GetCheckpoint() == ShardEnd {
+			continue
+		}
+
+		leaseOwner := shard.GetLeaseOwner()
+		if leaseOwner == "" {
+			return nil, ErrShardNotAssigned
+		}
+		workers[leaseOwner] = append(workers[leaseOwner], shard)
+	}
+	return workers, nil
+}
+
+// ClaimShard places a claim request on a shard to signal a steal attempt
+func (checkpointer *MemoryCheckpointer) ClaimShard(shard *par.ShardStatus, claimID string) error {
+	if err := checkpointer.FetchCheckpoint(shard); err != nil && err != ErrSequenceIDNotFound {
+		return err
+	}
+
+	t := checkpointer.table
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	lease, ok := t.leases[shard.ID]
+	if !ok || lease.claimRequest != "" || !lease.leaseTimeout.Equal(shard.GetLeaseTimeout()) ||
+		lease.owner != shard.GetLeaseOwner() || lease.checkpoint == ShardEnd {
+		return ErrLeaseNotAcquired{"lease changed or claimed already"}
+	}
+	lease.claimRequest = claimID
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package checkpoint_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint/checkpointtest"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+func TestMemoryCheckpointerContract(t *testing.T) {
+	checkpointtest.TestCheckpointer(t, func(kclConfig *config.KinesisClientLibConfiguration) chk.Checkpointer {
+		return chk.NewMemoryCheckpointer(kclConfig, chk.NewMemoryLeaseTable())
+	})
+}
+
+func TestMemoryCheckpointersShareLeaseTable(t *testing.T) {
+	table := chk.NewMemoryLeaseTable()
+	workers := map[string]*chk.MemoryCheckpointer{}
+	for _, workerID := range []string{"worker-1", "worker-2"} {
+		kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", workerID)
+		workers[workerID] = chk.NewMemoryCheckpointer(kclConfig, table)
+	}
+	newShard := func() *par.ShardStatus {
+		return &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}
+	}
+
+	// the workers race for the lease: exactly one of them gets it
+	var wg sync.WaitGroup
+	results := make(map[string]error)
+	var mux sync.Mutex
+	for workerID, checkpointer := range workers {
+		wg.Add(1)
+		go func(workerID string, checkpointer *chk.MemoryCheckpointer) {
+			defer wg.Done()
+			err := checkpointer.GetLease(newShard(), workerID)
+			mux.Lock()
+			results[workerID] = err
+			mux.Unlock()
+		}(workerID, checkpointer)
+	}
+	wg.Wait()
+	var owner, other string
+	for workerID, err := range results {
+		if err == nil {
+			assert.Equal(t, "", owner, "both workers acquired the lease")
+			owner = workerID
+		} else {
+			assert.True(t, errors.As(err, &chk.ErrLeaseNotAcquired{}), "unexpected error: %v", err)
+			other = workerID
+		}
+	}
+	if !assert.NotEqual(t, "", owner) || !assert.NotEqual(t, "", other) {
+		return
+	}
+
+	// the checkpoint written by the owner is read by the other worker
+	shard := newShard()
+	assert.Nil(t, workers[owner].GetLease(shard, owner))
+	shard.SetCheckpoint("42")
+	assert.Nil(t, workers[owner].CheckpointSequence(shard))
+	fetched := newShard()
+	assert.Nil(t, workers[other].FetchCheckpoint(fetched))
+	assert.Equal(t, "42", fetched.GetCheckpoint())
+	assert.Equal(t, owner, fetched.GetLeaseOwner())
+
+	// only the owner releases the lease, which the other worker then takes over from the checkpoint
+	assert.NotNil(t, workers[other].RemoveLeaseOwner("shard-0"))
+	assert.Nil(t, workers[owner].RemoveLeaseOwner("shard-0"))
+	taken := newShard()
+	assert.Nil(t, workers[other].GetLease(taken, other))
+	leaseOwner, err := workers[owner].GetLeaseOwner("shard-0")
+	assert.Nil(t, err)
+	assert.Equal(t, other, leaseOwner)
+	assert.Nil(t, workers[other].FetchCheckpoint(taken))
+	assert.Equal(t, "42", taken.GetCheckpoint())
+}
+
+func TestMemoryCheckpointerLeaseStealing(t *testing.T) {
+	table := chk.NewMemoryLeaseTable()
+	newCheckpointer := func(workerID string) *chk.MemoryCheckpointer {
+		kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", workerID).
+			WithLeaseStealing(true).
+			WithFailoverTimeMillis(100)
+		return chk.NewMemoryCheckpointer(kclConfig, table)
+	}
+	victim, thief := newCheckpointer("victim"), newCheckpointer("thief")
+
+	shard := &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}, Checkpoint: "42"}
+	assert.Nil(t, victim.GetLease(shard, "victim"))
+
+	// the claim is placed once, and keeps the victim from renewing its lease
+	claimed := &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}
+	assert.Nil(t, thief.ClaimShard(claimed, "thief"))
+	assert.NotNil(t, thief.ClaimShard(claimed, "thief"))
+	assert.EqualError(t, victim.GetLease(shard, "victim"), chk.ErrShardClaimed)
+
+	workers, err := thief.ListActiveWorkers(map[string]*par.ShardStatus{"shard-0": claimed})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(workers["victim"]))
+
+	// the lease is no longer renewed, the thief takes it over once expired
+	time.Sleep(150 * time.Millisecond)
+	assert.Nil(t, thief.GetLease(claimed, "thief"))
+	assert.Equal(t, "thief", claimed.GetLeaseOwner())
+	assert.Nil(t, victim.FetchCheckpoint(shard))
+	assert.Equal(t, "thief", shard.GetLeaseOwner())
+	assert.Equal(t, "42", shard.GetCheckpoint())
+}
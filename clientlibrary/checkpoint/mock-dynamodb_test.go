@@ -30,21 +30,60 @@ package checkpoint
 
 import (
 	"context"
+	"strconv"
+	"sync"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
 type mockDynamoDB struct {
+	mux                       sync.Mutex
 	client                    *dynamodb.Client
 	tableExist                bool
 	item                      map[string]types.AttributeValue
 	conditionalExpression     string
 	expressionAttributeValues map[string]types.AttributeValue
+	transactions              [][]types.TransactWriteItem
+	// puts counts the PutItem calls
+	puts int
+	// scanPages are the pages of items returned by Scan, following LastEvaluatedKey
+	scanPages [][]map[string]types.AttributeValue
+	// segmentPages are the pages of items returned by the parallel scans of each segment
+	segmentPages map[int32][][]map[string]types.AttributeValue
+	// scans counts the Scan calls of each segment
+	scans map[int32]int
 }
 
 func (m *mockDynamoDB) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
-	return &dynamodb.ScanOutput{}, nil
+	pages := m.scanPages
+	if params.TotalSegments != nil {
+		segment := aws.ToInt32(params.Segment)
+		m.mux.Lock()
+		if m.scans == nil {
+			m.scans = make(map[int32]int)
+		}
+		m.scans[segment]++
+		pages = m.segmentPages[segment]
+		m.mux.Unlock()
+	}
+	if len(pages) == 0 {
+		return &dynamodb.ScanOutput{}, nil
+	}
+
+	page := 0
+	if start, ok := params.ExclusiveStartKey["page"]; ok {
+		page, _ = strconv.Atoi(start.(*types.AttributeValueMemberN).Value)
+	}
+
+	output := &dynamodb.ScanOutput{Items: pages[page]}
+	if page+1 < len(pages) {
+		output.LastEvaluatedKey = map[string]types.AttributeValue{
+			"page": &types.AttributeValueMemberN{Value: strconv.Itoa(page + 1)},
+		}
+	}
+	return output, nil
 }
 
 func (m *mockDynamoDB) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
@@ -60,8 +99,26 @@ func (m *mockDynamoDB) CreateTable(ctx context.Context, params *dynamodb.CreateT
 }
 
 func (m *mockDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.puts++
 	item := params.Item
 
+	if aws.ToString(params.ConditionExpression) == "attribute_not_exists(ShardID)" {
+		if _, ok := m.item[LeaseKeyKey]; ok {
+			return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+		}
+	}
+
+	// a lease of another stream generation is written whole
+	if generation, ok := item[StreamGenerationKey]; ok {
+		if current := m.item[StreamGenerationKey]; current != nil &&
+			current.(*types.AttributeValueMemberS).Value != generation.(*types.AttributeValueMemberS).Value {
+			m.item = map[string]types.AttributeValue{}
+		}
+		m.item[StreamGenerationKey] = generation
+	}
+
 	if shardID, ok := item[LeaseKeyKey]; ok {
 		m.item[LeaseKeyKey] = shardID
 	}
@@ -70,6 +127,10 @@ func (m *mockDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInpu
 		m.item[LeaseOwnerKey] = owner
 	}
 
+	if streamName, ok := item[StreamNameKey]; ok {
+		m.item[StreamNameKey] = streamName
+	}
+
 	if timeout, ok := item[LeaseTimeoutKey]; ok {
 		m.item[LeaseTimeoutKey] = timeout
 	}
@@ -86,6 +147,10 @@ func (m *mockDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInpu
 		m.item[ClaimRequestKey] = claimRequest
 	}
 
+	if heartbeat, ok := item[HeartbeatKey]; ok {
+		m.item[HeartbeatKey] = heartbeat
+	}
+
 	if params.ConditionExpression != nil {
 		m.conditionalExpression = *params.ConditionExpression
 	}
@@ -108,9 +173,18 @@ func (m *mockDynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateIt
 		delete(m.item, LeaseOwnerKey)
 	}
 
+	if aws.ToString(exp) == "set "+HeartbeatKey+" = :heartbeat" {
+		m.item[HeartbeatKey] = params.ExpressionAttributeValues[":heartbeat"]
+	}
+
 	return nil, nil
 }
 
 func (m *mockDynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
 	return &dynamodb.DeleteItemOutput{}, nil
 }
+
+func (m *mockDynamoDB) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	m.transactions = append(m.transactions, params.TransactItems)
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
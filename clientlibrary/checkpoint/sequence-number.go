@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package checkpoint
+
+import "strings"
+
+// ValidSequenceNumber returns true if s is a Kinesis sequence number: a non-empty string of decimal digits.
+func ValidSequenceNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// CompareSequenceNumbers compares two Kinesis sequence numbers numerically and returns -1, 0 or 1 when a is
+// respectively lower than, equal to or greater than b. Sequence numbers are decimal strings of variable length,
+// up to 128 bits, so they cannot be compared lexically: "9" is lower than "10".
+//
+// Values which are not sequence numbers, such as SHARD_END, are ordered after all sequence numbers and
+// compared lexically between themselves.
+func CompareSequenceNumbers(a, b string) int {
+	validA, validB := ValidSequenceNumber(a), ValidSequenceNumber(b)
+	switch {
+	case !validA && !validB:
+		return strings.Compare(a, b)
+	case !validA:
+		return 1
+	case !validB:
+		return -1
+	}
+
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
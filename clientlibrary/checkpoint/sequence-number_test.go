@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package checkpoint
+
+import (
+	"math/big"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareSequenceNumbers(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"49590338271490256608559692538361571095921575989136588898", "49590338271490256608559692538361571095921575989136588898", 0},
+		{"49590338271490256608559692538361571095921575989136588898", "49590338271490256608559692540925702759324208523137515618", -1},
+		{"49590338271490256608559692540925702759324208523137515618", "49590338271490256608559692538361571095921575989136588898", 1},
+		// lexically greater but numerically lower
+		{"9", "10", -1},
+		{"49590338271490256608559692538361571095921575989136588898", "100000000000000000000000000000000000000000000000000000000", -1},
+		{"00123", "123", 0},
+		{"0", "1", -1},
+		{"21269319989653637946712965403778482371", "49590338271490256608559692538361571095921575989136588898", -1},
+		// values which are not sequence numbers come last
+		{ShardEnd, "49590338271490256608559692538361571095921575989136588898", 1},
+		{"49590338271490256608559692538361571095921575989136588898", ShardEnd, -1},
+		{ShardEnd, ShardEnd, 0},
+		{"", "1", 1},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, CompareSequenceNumbers(tt.a, tt.b), "%s <=> %s", tt.a, tt.b)
+	}
+}
+
+func TestCompareSequenceNumbersOrdersLikeBigInt(t *testing.T) {
+	seqs := []string{
+		"49590338271490256608559692540925702759324208523137515618",
+		"21269319989653637946712965403778482371",
+		"49590338271490256608559692538361571095921575989136588898",
+		"495903382714902566085596925383615710959215759891365888",
+		"100",
+		"99",
+		"49590338271490256608559692538361571095921575989136588899",
+	}
+	sort.Slice(seqs, func(i, j int) bool { return CompareSequenceNumbers(seqs[i], seqs[j]) < 0 })
+
+	for i := 1; i < len(seqs); i++ {
+		prev, _ := new(big.Int).SetString(seqs[i-1], 10)
+		cur, _ := new(big.Int).SetString(seqs[i], 10)
+		assert.Equal(t, -1, prev.Cmp(cur), "%s before %s", seqs[i-1], seqs[i])
+	}
+}
+
+func TestValidSequenceNumber(t *testing.T) {
+	assert.True(t, ValidSequenceNumber("49590338271490256608559692538361571095921575989136588898"))
+	assert.False(t, ValidSequenceNumber(""))
+	assert.False(t, ValidSequenceNumber(ShardEnd))
+	assert.False(t, ValidSequenceNumber("-1"))
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package cloudwatchlogs decodes the records CloudWatch Logs subscription filters deliver to Kinesis: gzip
+// compressed JSON envelopes carrying a batch of log events.
+package cloudwatchlogs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+const (
+	// DataMessage is the type of the envelopes carrying log events
+	DataMessage = "DATA_MESSAGE"
+	// ControlMessage is the type of the envelopes CloudWatch Logs sends to check the destination is reachable
+	ControlMessage = "CONTROL_MESSAGE"
+)
+
+// ErrNotCloudWatchLogs is returned for data which is not a CloudWatch Logs subscription envelope.
+var ErrNotCloudWatchLogs = errors.New("not a CloudWatch Logs subscription envelope")
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Envelope is the payload of a record delivered by a CloudWatch Logs subscription filter.
+type Envelope struct {
+	MessageType         string     `json:"messageType"`
+	Owner               string     `json:"owner"`
+	LogGroup            string     `json:"logGroup"`
+	LogStream           string     `json:"logStream"`
+	SubscriptionFilters []string   `json:"subscriptionFilters"`
+	LogEvents           []LogEvent `json:"logEvents"`
+}
+
+// LogEvent is a log event of an envelope. Once delivered on its own, it carries the log group and stream, and the
+// account, of its envelope.
+type LogEvent struct {
+	ID string `json:"id"`
+	// Timestamp is the time of the event, in milliseconds since the epoch
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+
+	Owner     string `json:"owner,omitempty"`
+	LogGroup  string `json:"logGroup,omitempty"`
+	LogStream string `json:"logStream,omitempty"`
+}
+
+// IsCompressed returns whether the data is gzip compressed, as the CloudWatch Logs envelopes are. Data which is not
+// can be told apart from an envelope without decompressing it.
+func IsCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, gzipMagic)
+}
+
+// Decode decompresses and parses a CloudWatch Logs subscription envelope. ErrNotCloudWatchLogs is returned when the
+// data is not compressed, or is compressed JSON without the fields of an envelope. Other errors are returned for
+// data which is compressed but corrupt.
+func Decode(data []byte) (*Envelope, error) {
+	if !IsCompressed(data) {
+		return nil, ErrNotCloudWatchLogs
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(decompressed, &envelope); err != nil || envelope.MessageType == "" {
+		return nil, ErrNotCloudWatchLogs
+	}
+	return &envelope, nil
+}
+
+// Events returns the log events of a data message, each with the log group and stream, and the account, of the
+// envelope. A control message has none.
+func (e *Envelope) Events() []LogEvent {
+	if e.MessageType != DataMessage {
+		return nil
+	}
+	events := make([]LogEvent, 0, len(e.LogEvents))
+	for _, event := range e.LogEvents {
+		event.Owner, event.LogGroup, event.LogStream = e.Owner, e.LogGroup, e.LogStream
+		events = append(events, event)
+	}
+	return events
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package cloudwatchlogs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dataMessagePayload is a payload delivered by a subscription filter of a CloudTrail log group
+const dataMessagePayload = `{
+	"owner": "111111111111",
+	"logGroup": "CloudTrail/logs",
+	"logStream": "111111111111_CloudTrail/logs_us-east-1",
+	"subscriptionFilters": ["Destination"],
+	"messageType": "DATA_MESSAGE",
+	"logEvents": [
+		{
+			"id": "31953106606966983378809025079804211143289615424298221568",
+			"timestamp": 1432826855000,
+			"message": "{\"eventVersion\":\"1.03\",\"userIdentity\":{\"type\":\"Root\"}"
+		},
+		{
+			"id": "31953106606966983378809025079804211143289615424298221569",
+			"timestamp": 1432826855000,
+			"message": "{\"eventVersion\":\"1.03\",\"userIdentity\":{\"type\":\"Root\"}"
+		}
+	]
+}`
+
+// controlMessagePayload is sent by CloudWatch Logs when the subscription filter is created
+const controlMessagePayload = `{
+	"messageType": "CONTROL_MESSAGE",
+	"owner": "CloudwatchLogs",
+	"logGroup": "",
+	"logStream": "",
+	"subscriptionFilters": [],
+	"logEvents": [
+		{
+			"id": "",
+			"timestamp": 1432826855000,
+			"message": "CWL CONTROL MESSAGE: Checking health of destination Kinesis stream."
+		}
+	]
+}`
+
+// compress compresses the payload as CloudWatch Logs does.
+func compress(t *testing.T, payload string) []byte {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write([]byte(payload))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+	return compressed.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	envelope, err := Decode(compress(t, dataMessagePayload))
+	assert.Nil(t, err)
+	assert.Equal(t, DataMessage, envelope.MessageType)
+	assert.Equal(t, []string{"Destination"}, envelope.SubscriptionFilters)
+	events := envelope.Events()
+	assert.Len(t, events, 2)
+	assert.Equal(t, LogEvent{
+		ID:        "31953106606966983378809025079804211143289615424298221568",
+		Timestamp: 1432826855000,
+		Message:   `{"eventVersion":"1.03","userIdentity":{"type":"Root"}`,
+		Owner:     "111111111111",
+		LogGroup:  "CloudTrail/logs",
+		LogStream: "111111111111_CloudTrail/logs_us-east-1",
+	}, events[0])
+
+	// control messages carry no log event
+	envelope, err = Decode(compress(t, controlMessagePayload))
+	assert.Nil(t, err)
+	assert.Equal(t, ControlMessage, envelope.MessageType)
+	assert.Empty(t, envelope.Events())
+
+	// the data of other sources is told apart, compressed or not
+	_, err = Decode([]byte(dataMessagePayload))
+	assert.Equal(t, ErrNotCloudWatchLogs, err)
+	_, err = Decode(compress(t, `{"level":"info"}`))
+	assert.Equal(t, ErrNotCloudWatchLogs, err)
+	_, err = Decode(compress(t, "plain text"))
+	assert.Equal(t, ErrNotCloudWatchLogs, err)
+
+	// while a corrupt envelope is an error
+	_, err = Decode(compress(t, dataMessagePayload)[:20])
+	assert.NotNil(t, err)
+	assert.NotEqual(t, ErrNotCloudWatchLogs, err)
+}
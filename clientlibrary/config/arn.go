@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+)
+
+// PartitionForRegion returns the AWS partition of a region, e.g. aws-us-gov for the GovCloud regions and aws-cn for
+// the China regions. The ARNs of the resources of a region start with arn:<partition>. A region unknown to the AWS
+// SDK is taken to be in the aws partition.
+func PartitionForRegion(region string) string {
+	endpoint, err := kinesis.NewDefaultEndpointResolver().ResolveEndpoint(region, kinesis.EndpointResolverOptions{})
+	if err != nil || endpoint.PartitionID == "" {
+		return "aws"
+	}
+	return endpoint.PartitionID
+}
+
+// StreamARN builds the ARN of a Kinesis stream of the AWS account in the region, within the partition of the region.
+func StreamARN(region, accountID, streamName string) string {
+	return arn.ARN{
+		Partition: PartitionForRegion(region),
+		Service:   "kinesis",
+		Region:    region,
+		AccountID: accountID,
+		Resource:  "stream/" + streamName,
+	}.String()
+}
+
+// ParseStreamARN parses the ARN of a Kinesis stream, or of one of its enhanced fan-out consumers, and returns it
+// along with the name of the stream.
+func ParseStreamARN(streamOrConsumerARN string) (arn.ARN, string, error) {
+	parsed, err := arn.Parse(streamOrConsumerARN)
+	if err != nil {
+		return arn.ARN{}, "", err
+	}
+	if parsed.Service != "kinesis" || !strings.HasPrefix(parsed.Resource, "stream/") {
+		return arn.ARN{}, "", fmt.Errorf("%s is not the ARN of a Kinesis stream", streamOrConsumerARN)
+	}
+	streamName := strings.TrimPrefix(parsed.Resource, "stream/")
+	if i := strings.Index(streamName, "/"); i >= 0 {
+		streamName = streamName[:i]
+	}
+	return parsed, streamName, nil
+}
+
+// NewEndpointResolver resolves the endpoint of the service to the endpoint URL when set, and leaves the other
+// services, or the service when endpoint is empty, to the default resolution of the AWS SDK. The endpoint is taken
+// to be in the partition of the region.
+func NewEndpointResolver(serviceID, endpoint, region string) aws.EndpointResolverWithOptions {
+	return aws.EndpointResolverWithOptionsFunc(func(service, _ string, _ ...interface{}) (aws.Endpoint, error) {
+		if service == serviceID && len(endpoint) > 0 {
+			return aws.Endpoint{
+				PartitionID:   PartitionForRegion(region),
+				URL:           endpoint,
+				SigningRegion: region,
+			}, nil
+		}
+		// returning EndpointNotFoundError will allow the service to fallback to it's default resolution
+		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+	})
+}
+
+// checkConsumerARN checks the enhanced fan-out consumer ARN is one of a consumer of the stream, in the region and its
+// partition.
+func (c *KinesisClientLibConfiguration) checkConsumerARN() error {
+	consumerARN, streamName, err := ParseStreamARN(c.EnhancedFanOutConsumerARN)
+	switch {
+	case err != nil:
+		return err
+	case !strings.Contains(consumerARN.Resource, "/consumer/"):
+		return fmt.Errorf("%s is not the ARN of an enhanced fan-out consumer", c.EnhancedFanOutConsumerARN)
+	case consumerARN.Partition != PartitionForRegion(c.RegionName):
+		return fmt.Errorf("partition %s differs from partition %s of region %s", consumerARN.Partition, PartitionForRegion(c.RegionName), c.RegionName)
+	case consumerARN.Region != c.RegionName:
+		return fmt.Errorf("region %s differs from region %s", consumerARN.Region, c.RegionName)
+	case streamName != c.StreamName:
+		return fmt.Errorf("stream %s differs from stream %s", streamName, c.StreamName)
+	}
+	return nil
+}
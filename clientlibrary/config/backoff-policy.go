@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package config
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+var (
+	// DefaultThroughputExceededBackoff waits a second after a ProvisionedThroughputExceededException: the calls made
+	// within the next second are throttled as well.
+	DefaultThroughputExceededBackoff = BackoffPolicy{BaseMillis: 1000, Multiplier: 1}
+
+	// DefaultKMSThrottlingBackoff doubles the wait after each consecutive KMSThrottlingException, from 200ms up to 10s,
+	// with equal jitter so that the consumers throttled together do not retry in lockstep.
+	// https://docs.aws.amazon.com/amazondynamodb/latest/developerguide/Programming.Errors.html#Programming.Errors.RetryAndBackoff
+	DefaultKMSThrottlingBackoff = BackoffPolicy{BaseMillis: 200, Multiplier: 2, MaxMillis: 10000, JitterMode: EqualJitter}
+
+	// DefaultGetRecordsTimeoutBackoff doubles the wait after each consecutive GetRecords call timing out, from 200ms up
+	// to 10s, with equal jitter.
+	DefaultGetRecordsTimeoutBackoff = BackoffPolicy{BaseMillis: 200, Multiplier: 2, MaxMillis: 10000, JitterMode: EqualJitter}
+
+	// DefaultProcessorCreateBackoff doubles the wait after each consecutive failure to create the record processor of a
+	// shard, from 1s up to 1 minute, with equal jitter.
+	DefaultProcessorCreateBackoff = BackoffPolicy{BaseMillis: 1000, Multiplier: 2, MaxMillis: 60000, JitterMode: EqualJitter}
+)
+
+// JitterMode is how a BackoffPolicy randomizes its waits.
+type JitterMode int
+
+const (
+	// SpreadJitter spreads the wait by up to Jitter of it, either way.
+	SpreadJitter JitterMode = iota
+	// FullJitter waits a random duration between 0 and the wait.
+	FullJitter
+	// EqualJitter waits half the wait, plus a random duration up to the other half.
+	EqualJitter
+)
+
+// BackoffPolicy describes how long to wait before retrying after consecutive errors of a class: BaseMillis after the
+// first error, multiplied by Multiplier after each of the following ones, up to MaxMillis. The wait is randomized
+// according to JitterMode, by default spread by up to Jitter of it, either way.
+type BackoffPolicy struct {
+	// BaseMillis is the wait after the first error.
+	BaseMillis int
+
+	// Multiplier is applied to the wait after each consecutive error. 1 keeps the wait constant.
+	Multiplier float64
+
+	// MaxMillis caps the wait. 0 sets no cap.
+	MaxMillis int
+
+	// Jitter is the fraction of the wait, between 0 and 1, it is randomly spread by with SpreadJitter.
+	Jitter float64
+
+	// JitterMode is how the wait is randomized. The jittered wait is capped at MaxMillis as well.
+	JitterMode JitterMode
+}
+
+// Delay returns the wait, before jitter, after the given number of consecutive errors, starting at 1.
+func (p BackoffPolicy) Delay(retries int) time.Duration {
+	if retries < 1 {
+		retries = 1
+	}
+
+	delay := float64(p.BaseMillis) * math.Pow(p.Multiplier, float64(retries-1))
+	if p.MaxMillis > 0 && delay > float64(p.MaxMillis) {
+		delay = float64(p.MaxMillis)
+	}
+	return time.Duration(delay * float64(time.Millisecond))
+}
+
+// Backoff returns the wait after the given number of consecutive errors, jittered with random, a number drawn in
+// [0, 1), and capped at MaxMillis.
+func (p BackoffPolicy) Backoff(retries int, random float64) time.Duration {
+	delay := float64(p.Delay(retries))
+	switch p.JitterMode {
+	case FullJitter:
+		delay *= random
+	case EqualJitter:
+		delay = delay/2 + delay/2*random
+	default:
+		delay *= 1 + (2*random-1)*p.Jitter
+	}
+
+	if ceiling := time.Duration(p.MaxMillis) * time.Millisecond; p.MaxMillis > 0 && time.Duration(delay) > ceiling {
+		return ceiling
+	}
+	return time.Duration(delay)
+}
+
+// Validate returns an error describing the first invalid setting of the policy.
+func (p BackoffPolicy) Validate() error {
+	switch {
+	case p.BaseMillis <= 0:
+		return fmt.Errorf("expected a positive BaseMillis, actual: %d", p.BaseMillis)
+	case p.Multiplier < 1:
+		return fmt.Errorf("expected a Multiplier of at least 1, actual: %v", p.Multiplier)
+	case p.MaxMillis < 0:
+		return fmt.Errorf("expected a non-negative MaxMillis, actual: %d", p.MaxMillis)
+	case p.Jitter < 0 || p.Jitter > 1:
+		return fmt.Errorf("expected a Jitter between 0 and 1, actual: %v", p.Jitter)
+	case p.JitterMode < SpreadJitter || p.JitterMode > EqualJitter:
+		return fmt.Errorf("unknown JitterMode: %d", p.JitterMode)
+	}
+	return nil
+}
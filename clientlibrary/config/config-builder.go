@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2018 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package config
+// The implementation is derived from https://github.com/awslabs/amazon-kinesis-client
+/*
+ * Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Amazon Software License (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ * http://aws.amazon.com/asl/
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
+	"github.com/vmware/vmware-go-kcl-v2/logger"
+)
+
+// ErrInvalidConfiguration is returned by ConfigBuilder.Build when the configuration violates a constraint.
+var ErrInvalidConfiguration = errors.New("invalid configuration")
+
+// ConfigBuilder builds a KinesisClientLibConfiguration. Unlike the With* setters on KinesisClientLibConfiguration,
+// which panic on a bad value, the builder collects the settings and validates them as a whole in Build, so that
+// constraints across fields (e.g. the lease refresh period being shorter than the lease timeout) are caught
+// before a worker is started.
+type ConfigBuilder struct {
+	config KinesisClientLibConfiguration
+}
+
+// NewConfigBuilder creates a ConfigBuilder holding the default configuration for the required fields.
+func NewConfigBuilder(applicationName, streamName, regionName, workerID string) *ConfigBuilder {
+	return &ConfigBuilder{config: *newDefaultConfig(applicationName, streamName, regionName, workerID, nil, nil)}
+}
+
+// WithCredentials sets the credentials used for Kinesis and DynamoDB.
+func (b *ConfigBuilder) WithCredentials(kinesisCreds, dynamodbCreds aws.CredentialsProvider) *ConfigBuilder {
+	b.config.KinesisCredentials = kinesisCreds
+	b.config.DynamoDBCredentials = dynamodbCreds
+	return b
+}
+
+func (b *ConfigBuilder) WithMaxRecords(maxRecords int) *ConfigBuilder {
+	b.config.MaxRecords = maxRecords
+	return b
+}
+
+func (b *ConfigBuilder) WithIdleTimeBetweenReadsInMillis(idleTimeBetweenReadsInMillis int) *ConfigBuilder {
+	b.config.IdleTimeBetweenReadsInMillis = idleTimeBetweenReadsInMillis
+	return b
+}
+
+// WithFailoverTimeMillis sets the lease timeout.
+func (b *ConfigBuilder) WithFailoverTimeMillis(failoverTimeMillis int) *ConfigBuilder {
+	b.config.FailoverTimeMillis = failoverTimeMillis
+	return b
+}
+
+func (b *ConfigBuilder) WithLeaseRefreshPeriodMillis(leaseRefreshPeriodMillis int) *ConfigBuilder {
+	b.config.LeaseRefreshPeriodMillis = leaseRefreshPeriodMillis
+	return b
+}
+
+func (b *ConfigBuilder) WithLeaseRefreshWaitTime(leaseRefreshWaitTime int) *ConfigBuilder {
+	b.config.LeaseRefreshWaitTime = leaseRefreshWaitTime
+	return b
+}
+
+func (b *ConfigBuilder) WithShardSyncIntervalMillis(shardSyncIntervalMillis int) *ConfigBuilder {
+	b.config.ShardSyncIntervalMillis = shardSyncIntervalMillis
+	return b
+}
+
+func (b *ConfigBuilder) WithMaxLeasesForWorker(n int) *ConfigBuilder {
+	b.config.MaxLeasesForWorker = n
+	return b
+}
+
+func (b *ConfigBuilder) WithMaxRetryCount(maxRetryCount int) *ConfigBuilder {
+	b.config.MaxRetryCount = maxRetryCount
+	return b
+}
+
+func (b *ConfigBuilder) WithClockSkewToleranceMillis(clockSkewToleranceMillis int) *ConfigBuilder {
+	b.config.ClockSkewToleranceMillis = clockSkewToleranceMillis
+	return b
+}
+
+func (b *ConfigBuilder) WithMinLeaseRenewalIntervalMillis(minLeaseRenewalIntervalMillis int) *ConfigBuilder {
+	b.config.MinLeaseRenewalIntervalMillis = minLeaseRenewalIntervalMillis
+	return b
+}
+
+func (b *ConfigBuilder) WithIdleTimeBetweenReadsJitter(jitter float64) *ConfigBuilder {
+	b.config.IdleTimeBetweenReadsJitter = jitter
+	return b
+}
+
+func (b *ConfigBuilder) WithInitialPositionInStream(initialPositionInStream InitialPositionInStream) *ConfigBuilder {
+	b.config.InitialPositionInStream = initialPositionInStream
+	b.config.InitialPositionInStreamExtended = *newInitialPosition(initialPositionInStream)
+	return b
+}
+
+func (b *ConfigBuilder) WithTimestampAtInitialPositionInStream(timestamp *time.Time) *ConfigBuilder {
+	b.config.InitialPositionInStream = AT_TIMESTAMP
+	b.config.InitialPositionInStreamExtended = *newInitialPositionAtTimestamp(timestamp)
+	return b
+}
+
+// WithEnhancedFanOutConsumerName enables enhanced fan-out consumer with the specified name.
+func (b *ConfigBuilder) WithEnhancedFanOutConsumerName(consumerName string) *ConfigBuilder {
+	b.config.EnhancedFanOutConsumerName = consumerName
+	b.config.EnableEnhancedFanOutConsumer = true
+	return b
+}
+
+// WithEnhancedFanOutConsumerARN enables enhanced fan-out consumer with the specified consumer ARN.
+func (b *ConfigBuilder) WithEnhancedFanOutConsumerARN(consumerARN string) *ConfigBuilder {
+	b.config.EnhancedFanOutConsumerARN = consumerARN
+	b.config.EnableEnhancedFanOutConsumer = true
+	return b
+}
+
+func (b *ConfigBuilder) WithLogger(logger logger.Logger) *ConfigBuilder {
+	b.config.Logger = logger
+	return b
+}
+
+func (b *ConfigBuilder) WithMonitoringService(mService metrics.MonitoringService) *ConfigBuilder {
+	b.config.MonitoringService = mService
+	return b
+}
+
+// Configure applies fn to the configuration being built. It covers the settings without a dedicated setter on
+// the builder; the result is still validated by Build.
+func (b *ConfigBuilder) Configure(fn func(*KinesisClientLibConfiguration)) *ConfigBuilder {
+	fn(&b.config)
+	return b
+}
+
+// Build validates the configuration and returns a copy of it. The error wraps ErrInvalidConfiguration and names
+// the first constraint violated.
+func (b *ConfigBuilder) Build() (*KinesisClientLibConfiguration, error) {
+	if err := b.config.validate(); err != nil {
+		return nil, err
+	}
+
+	config := b.config
+	return &config, nil
+}
+
+func (c *KinesisClientLibConfiguration) validate() error {
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"ApplicationName", c.ApplicationName},
+		{"StreamName", c.StreamName},
+		{"RegionName", c.RegionName},
+	}
+	for _, r := range required {
+		if empty(r.value) {
+			return fmt.Errorf("%w: %s should not be empty", ErrInvalidConfiguration, r.name)
+		}
+	}
+
+	positives := []struct {
+		name  string
+		value int
+	}{
+		{"MaxRecords", c.MaxRecords},
+		{"IdleTimeBetweenReadsInMillis", c.IdleTimeBetweenReadsInMillis},
+		{"FailoverTimeMillis", c.FailoverTimeMillis},
+		{"LeaseRefreshPeriodMillis", c.LeaseRefreshPeriodMillis},
+		{"LeaseRefreshWaitTime", c.LeaseRefreshWaitTime},
+		{"ShardSyncIntervalMillis", c.ShardSyncIntervalMillis},
+		{"MaxLeasesForWorker", c.MaxLeasesForWorker},
+		{"MaxRetryCount", c.MaxRetryCount},
+		{"ShutdownGraceMillis", c.ShutdownGraceMillis},
+	}
+	for _, p := range positives {
+		if p.value <= 0 {
+			return fmt.Errorf("%w: %s should be positive, got %d", ErrInvalidConfiguration, p.name, p.value)
+		}
+	}
+
+	switch {
+	case c.MaxRecords > DefaultMaxRecords:
+		return fmt.Errorf("%w: MaxRecords %d exceeds the GetRecords limit of %d",
+			ErrInvalidConfiguration, c.MaxRecords, DefaultMaxRecords)
+	case c.LeaseRefreshPeriodMillis >= c.FailoverTimeMillis:
+		return fmt.Errorf("%w: LeaseRefreshPeriodMillis %d should be less than FailoverTimeMillis %d",
+			ErrInvalidConfiguration, c.LeaseRefreshPeriodMillis, c.FailoverTimeMillis)
+	case c.ClockSkewToleranceMillis < 0:
+		return fmt.Errorf("%w: ClockSkewToleranceMillis should not be negative, got %d",
+			ErrInvalidConfiguration, c.ClockSkewToleranceMillis)
+	case c.MinLeaseRenewalIntervalMillis > 0 &&
+		c.MinLeaseRenewalIntervalMillis >= c.FailoverTimeMillis-c.ClockSkewToleranceMillis:
+		return fmt.Errorf("%w: MinLeaseRenewalIntervalMillis %d should be less than FailoverTimeMillis minus ClockSkewToleranceMillis (%d)",
+			ErrInvalidConfiguration, c.MinLeaseRenewalIntervalMillis, c.FailoverTimeMillis-c.ClockSkewToleranceMillis)
+	case c.IdleTimeBetweenReadsJitter < 0 || c.IdleTimeBetweenReadsJitter > 1:
+		return fmt.Errorf("%w: IdleTimeBetweenReadsJitter should be within [0, 1], got %v",
+			ErrInvalidConfiguration, c.IdleTimeBetweenReadsJitter)
+	case c.ThroughputExceededBackoff.Validate() != nil:
+		return fmt.Errorf("%w: ThroughputExceededBackoff: %v", ErrInvalidConfiguration, c.ThroughputExceededBackoff.Validate())
+	case c.KMSThrottlingBackoff.Validate() != nil:
+		return fmt.Errorf("%w: KMSThrottlingBackoff: %v", ErrInvalidConfiguration, c.KMSThrottlingBackoff.Validate())
+	case c.GetRecordsTimeoutBackoff.Validate() != nil:
+		return fmt.Errorf("%w: GetRecordsTimeoutBackoff: %v", ErrInvalidConfiguration, c.GetRecordsTimeoutBackoff.Validate())
+	case c.ProcessorCreateBackoff.Validate() != nil:
+		return fmt.Errorf("%w: ProcessorCreateBackoff: %v", ErrInvalidConfiguration, c.ProcessorCreateBackoff.Validate())
+	case c.InitialPositionInStream == AT_TIMESTAMP && c.InitialPositionInStreamExtended.Timestamp == nil:
+		return fmt.Errorf("%w: AT_TIMESTAMP requires a timestamp", ErrInvalidConfiguration)
+	case c.EnableEnhancedFanOutConsumer && empty(c.EnhancedFanOutConsumerName) && empty(c.EnhancedFanOutConsumerARN):
+		return fmt.Errorf("%w: enhanced fan-out requires a consumer name or ARN", ErrInvalidConfiguration)
+	case !empty(c.EnhancedFanOutConsumerARN) && c.checkConsumerARN() != nil:
+		return fmt.Errorf("%w: EnhancedFanOutConsumerARN: %v", ErrInvalidConfiguration, c.checkConsumerARN())
+	case c.LagThresholdMillis > 0 && (c.LagRecoveryMillis < 0 || c.LagRecoveryMillis >= c.LagThresholdMillis):
+		return fmt.Errorf("%w: LagRecoveryMillis %d should be within [0, LagThresholdMillis %d)",
+			ErrInvalidConfiguration, c.LagRecoveryMillis, c.LagThresholdMillis)
+	case c.MaxGetRecordsCalls > 0 && c.GetRecordsBudgetWindowMillis <= 0:
+		return fmt.Errorf("%w: MaxGetRecordsCalls requires a positive GetRecordsBudgetWindowMillis, got %d",
+			ErrInvalidConfiguration, c.GetRecordsBudgetWindowMillis)
+	case c.ListShardsExpiredTokenRetries < 0:
+		return fmt.Errorf("%w: ListShardsExpiredTokenRetries should not be negative, got %d",
+			ErrInvalidConfiguration, c.ListShardsExpiredTokenRetries)
+	case c.MaxConcurrentCheckpoints < 0:
+		return fmt.Errorf("%w: MaxConcurrentCheckpoints should not be negative, got %d",
+			ErrInvalidConfiguration, c.MaxConcurrentCheckpoints)
+	case c.MaxRecordsInFlight < 0:
+		return fmt.Errorf("%w: MaxRecordsInFlight should not be negative, got %d", ErrInvalidConfiguration, c.MaxRecordsInFlight)
+	case c.MaxProcessorCreateRetries < 0:
+		return fmt.Errorf("%w: MaxProcessorCreateRetries should not be negative, got %d",
+			ErrInvalidConfiguration, c.MaxProcessorCreateRetries)
+	case c.DecodeErrorPolicy == DeadLetterOnDecodeError && c.DecodeErrorDeadLetter == nil:
+		return fmt.Errorf("%w: DeadLetterOnDecodeError requires a DecodeErrorDeadLetter", ErrInvalidConfiguration)
+	}
+
+	return nil
+}
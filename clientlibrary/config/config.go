@@ -43,8 +43,12 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
 	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/utils"
 	"github.com/vmware/vmware-go-kcl-v2/logger"
 )
 
@@ -55,7 +59,49 @@ const (
 	TRIM_HORIZON
 	// AT_TIMESTAMP start from the record at or after the specified server-side Timestamp.
 	AT_TIMESTAMP
+)
+
+const (
+	// IdleOnUnknownLag waits IdleTimeBetweenReadsInMillis before the next read, as if the consumer was caught up.
+	IdleOnUnknownLag UnknownLagPolicy = iota + 1
+	// ReadOnUnknownLag reads again right away, as if the consumer was behind.
+	ReadOnUnknownLag
+)
+
+const (
+	// SkipOnDecodeError drops a record which cannot be decoded, counting it with the DecodeError metric.
+	SkipOnDecodeError DecodeErrorPolicy = iota + 1
+	// DeadLetterOnDecodeError drops a record which cannot be decoded after passing it to DecodeErrorDeadLetter.
+	DeadLetterOnDecodeError
+	// FailOnDecodeError stops consuming the shard at the first record which cannot be decoded.
+	FailOnDecodeError
+)
+
+const (
+	// ProceedAfterParentShardTimeout starts consuming the child shard without the end of its parent.
+	ProceedAfterParentShardTimeout ParentShardTimeoutPolicy = iota + 1
+	// FailAfterParentShardTimeout gives up the child shard, to be tried again on the next lease acquisition.
+	FailAfterParentShardTimeout
+)
 
+const (
+	// FailOnCorruptCheckpoint stops consuming the shard, to be tried again on the next lease acquisition.
+	FailOnCorruptCheckpoint CorruptCheckpointPolicy = iota + 1
+	// TrimHorizonOnCorruptCheckpoint reads the shard again from its oldest record.
+	TrimHorizonOnCorruptCheckpoint
+	// LatestOnCorruptCheckpoint reads the shard from its latest record, skipping the records in between.
+	LatestOnCorruptCheckpoint
+)
+
+const (
+	// AllowUpdatingStream starts the worker on an ACTIVE stream, or on an UPDATING one with a warning, e.g. while the
+	// stream is being resharded.
+	AllowUpdatingStream StreamStatusPolicy = iota + 1
+	// RequireActiveStream starts the worker on an ACTIVE stream only.
+	RequireActiveStream
+)
+
+const (
 	// DefaultInitialPositionInStream The location in the shard from which the KinesisClientLibrary will start fetching records from
 	// when the application starts for the first time and there is no checkpoint for the shard.
 	DefaultInitialPositionInStream = LATEST
@@ -142,6 +188,151 @@ const (
 
 	// DefaultMaxRetryCount The default maximum number of retries in case of error
 	DefaultMaxRetryCount = 5
+
+	// DefaultShardMetadataCacheTTLMillis Number of milliseconds cached shard metadata (parents, hash key range)
+	// stays valid before it is re-read from Kinesis. It matches the default shard sync interval.
+	DefaultShardMetadataCacheTTLMillis = 60000
+
+	// DefaultProcessingDeadlineMarginMillis Number of milliseconds before the shard lease expires at which
+	// the context passed to ProcessRecords is canceled.
+	DefaultProcessingDeadlineMarginMillis = 2000
+
+	// DefaultMinBatchRecords The minimum number of records delivered to the record processor at once. The default
+	// delivers the records of every poll without buffering.
+	DefaultMinBatchRecords = 1
+
+	// DefaultMaxBatchWaitMillis The maximum number of milliseconds records are buffered waiting for MinBatchRecords.
+	DefaultMaxBatchWaitMillis = 1000
+
+	// DefaultBlockOnTPSExceeded Whether the polling consumer sleeps until the GetRecords rate limit window resets,
+	// instead of returning an error, once the calls allowed in the current second are used up.
+	DefaultBlockOnTPSExceeded = false
+
+	// DefaultSubscriptionRenewalMillis Number of milliseconds after which an enhanced fan-out subscription is renewed,
+	// ahead of the 5 minutes limit of SubscribeToShard.
+	DefaultSubscriptionRenewalMillis = 270000
+
+	// DefaultClockSkewToleranceMillis is the default tolerance, in milliseconds, for clock skew between workers
+	// when comparing lease timeouts.
+	DefaultClockSkewToleranceMillis = 0
+
+	// DefaultMaxWorkerLifetimeMillis is the default lifetime of a worker, 0 meaning the worker runs until it is shut down.
+	DefaultMaxWorkerLifetimeMillis = 0
+
+	// DefaultUnknownLagPolicy idles between reads when GetRecords returns no record and no MillisBehindLatest.
+	DefaultUnknownLagPolicy = IdleOnUnknownLag
+
+	// DefaultDecodeErrorPolicy skips the records which cannot be decoded.
+	DefaultDecodeErrorPolicy = SkipOnDecodeError
+
+	// DefaultMaxDecodeErrorsPerBatch is the default number of records of a batch which may fail to be decoded before the
+	// shard is failed, 0 meaning no limit.
+	DefaultMaxDecodeErrorsPerBatch = 0
+
+	// DefaultMaxConsecutiveEmptyPollsBeforeRelease is the default number of consecutive empty polls after which the lease
+	// on a shard is released, 0 meaning never.
+	DefaultMaxConsecutiveEmptyPollsBeforeRelease = 0
+
+	// DefaultHTTPMaxIdleConns is the default maximum number of idle connections, across all hosts, of the HTTP
+	// client used by the Kinesis and DynamoDB clients created by the library. It is the SDK default.
+	DefaultHTTPMaxIdleConns = 100
+
+	// DefaultHTTPMaxIdleConnsPerHost is the default maximum number of idle connections per host. It is the SDK default.
+	DefaultHTTPMaxIdleConnsPerHost = 10
+
+	// DefaultHTTPIdleConnTimeoutMillis is the default time, in milliseconds, an idle connection is kept open. It is the
+	// SDK default.
+	DefaultHTTPIdleConnTimeoutMillis = 90000
+
+	// DefaultMaxInitRetries The default maximum number of retries of a failed record processor initialization
+	DefaultMaxInitRetries = 3
+
+	// DefaultHeartbeatIntervalMillis The default interval between two heartbeats of the worker
+	DefaultHeartbeatIntervalMillis = 30000
+
+	// DefaultSlidingWindowTPSLimit Whether the polling consumer limits GetRecords over a rolling second rather than
+	// over fixed one second windows.
+	DefaultSlidingWindowTPSLimit = false
+
+	// DefaultTouchCheckpointOnIdle Idle shards do not write to their lease.
+	DefaultTouchCheckpointOnIdle = false
+
+	// DefaultTouchCheckpointIntervalMillis The minimum time an idle shard waits before advancing the heartbeat of its
+	// lease.
+	DefaultTouchCheckpointIntervalMillis = 60000
+
+	// DefaultCoordinateSelfOwnedParentShards Child shards poll the lease table for the end of their parent shards.
+	DefaultCoordinateSelfOwnedParentShards = false
+
+	// DefaultShardIteratorRefreshMillis is the default time since the last GetRecords call after which the shard iterator is
+	// refreshed before the next one. 0 never refreshes it.
+	DefaultShardIteratorRefreshMillis = 0
+
+	// DefaultLeaseVerificationGapMillis is the default unexpected gap between two polls of a shard after which the lease is
+	// verified before processing the records read, 0 meaning never.
+	DefaultLeaseVerificationGapMillis = 0
+
+	// DefaultMaxUnackedRecords is the default number of records delivered and not checkpointed yet after which a shard
+	// stops being polled, 0 meaning no limit.
+	DefaultMaxUnackedRecords = 0
+
+	// DefaultRejoinOnLeaseLoss is the default for reacquiring leases right away after losing all of them.
+	DefaultRejoinOnLeaseLoss = false
+
+	// DefaultParentShardWaitTimeoutMillis waits for the end of a parent shard indefinitely.
+	DefaultParentShardWaitTimeoutMillis = 0
+
+	// DefaultParentShardTimeoutPolicy starts consuming a child shard whose parent did not end in time.
+	DefaultParentShardTimeoutPolicy = ProceedAfterParentShardTimeout
+
+	// DefaultAdaptiveMaxRecords asks every GetRecords call for MaxRecords records.
+	DefaultAdaptiveMaxRecords = false
+
+	// DefaultCleanupOrphanedLeases leaves the leases of shards missing from the stream in the lease table.
+	DefaultCleanupOrphanedLeases = false
+
+	// DefaultOrphanedLeaseMinSyncs is the number of consecutive shard syncs a shard has to be missing from before
+	// its lease is removed with CleanupOrphanedLeases.
+	DefaultOrphanedLeaseMinSyncs = 3
+
+	// DefaultCheckpointRenewsLease writes the checkpoints and the lease renewals separately.
+	DefaultCheckpointRenewsLease = false
+
+	// DefaultLeaseTableScanSegments scans the lease table sequentially.
+	DefaultLeaseTableScanSegments = 1
+
+	// DefaultVerifyRecordOrdering does not verify the order of the records read from the shards.
+	DefaultVerifyRecordOrdering = false
+
+	// DefaultCorruptCheckpointPolicy fails the shards whose checkpoint is corrupt.
+	DefaultCorruptCheckpointPolicy = FailOnCorruptCheckpoint
+
+	// DefaultFanOutThrottleThreshold keeps polling the stream however often it is throttled.
+	DefaultFanOutThrottleThreshold = 0
+
+	// DefaultFanOutThrottleWindowMillis is the default window the throttled GetRecords calls are counted over, with
+	// FanOutThrottleThreshold.
+	DefaultFanOutThrottleWindowMillis = 60000
+
+	// DefaultErrorLogSummaryIntervalMillis logs every warning and error of the shard consumers.
+	DefaultErrorLogSummaryIntervalMillis = 0
+
+	// DefaultGetRecordsBudgetWindowMillis is the window over which MaxGetRecordsCalls applies: a minute.
+	DefaultGetRecordsBudgetWindowMillis = 60000
+
+	// DefaultListShardsExpiredTokenRetries is the default number of times the listing of the shards resumes after
+	// an expired pagination token.
+	DefaultListShardsExpiredTokenRetries = 3
+
+	// DefaultGetRecordsTimeoutMillis bounds a GetRecords call to 30 seconds.
+	DefaultGetRecordsTimeoutMillis = 30000
+
+	// DefaultMaxProcessorCreateRetries is the default number of times the worker retries creating the record
+	// processor of a shard before leaving the shard to the other workers.
+	DefaultMaxProcessorCreateRetries = 10
+
+	// DefaultStreamStatusPolicy starts the worker on a stream being updated, e.g. resharded.
+	DefaultStreamStatusPolicy = AllowUpdatingStream
 )
 
 type (
@@ -149,6 +340,26 @@ type (
 	// This is used during initial application bootstrap (when a checkpoint doesn't exist for a shard or its parents)
 	InitialPositionInStream int
 
+	// UnknownLagPolicy decides what a polling consumer does after an empty GetRecords response which does not
+	// tell how far behind the tip of the stream the consumer is (nil MillisBehindLatest).
+	UnknownLagPolicy int
+
+	// DecodeErrorPolicy decides what a consumer does with a record which cannot be decoded, e.g. a corrupted KPL
+	// aggregated record.
+	DecodeErrorPolicy int
+
+	// ParentShardTimeoutPolicy decides what the consumer of a child shard does when its parent shard did not reach
+	// SHARD_END within ParentShardWaitTimeoutMillis, e.g. a dangling parent reference.
+	ParentShardTimeoutPolicy int
+
+	// CorruptCheckpointPolicy decides what the consumer of a shard does when its checkpoint is neither a sequence number
+	// nor SHARD_END, e.g. a lease table row edited by hand.
+	CorruptCheckpointPolicy int
+
+	// StreamStatusPolicy decides which statuses of the stream the worker starts on. A stream being created or deleted
+	// is never consumed.
+	StreamStatusPolicy int
+
 	// InitialPositionInStreamExtended Class that houses the entities needed to specify the Position in the stream from where a new application should
 	// start.
 	InitialPositionInStreamExtended struct {
@@ -184,6 +395,12 @@ type (
 		// DynamoDBCredentials is used to access DynamoDB
 		DynamoDBCredentials aws.CredentialsProvider
 
+		// CredentialsRefresh, when set, supplies the credentials of both the Kinesis and the DynamoDB clients in place
+		// of KinesisCredentials and DynamoDBCredentials. It supports short-lived credentials issued by a custom source,
+		// e.g. SPIFFE or Vault: the credentials returned are cached until they expire, then refreshed by calling it again.
+		// The worker fails to start if it cannot retrieve credentials from it.
+		CredentialsRefresh aws.CredentialsProviderFunc
+
 		// TableName is name of the dynamo db table for managing kinesis stream default to ApplicationName
 		TableName string
 
@@ -254,7 +471,8 @@ type (
 		// RegionName The region name for the service
 		RegionName string
 
-		// ShutdownGraceMillis The number of milliseconds before graceful shutdown terminates forcefully
+		// ShutdownGraceMillis The number of milliseconds a record processor shut down with REQUESTED is given to return, and
+		// so to write its final checkpoint, before the lease on its shard is released regardless
 		ShutdownGraceMillis int
 
 		// Operation parameters
@@ -295,6 +513,418 @@ type (
 
 		// MaxRetryCount The maximum number of retries in case of error
 		MaxRetryCount int
+
+		// ShardMetadataCacheTTLMillis The number of milliseconds shard metadata shared by the shard consumers of a
+		// worker is cached before being refreshed from Kinesis
+		ShardMetadataCacheTTLMillis int
+
+		// ShardFilter restricts the shards leased by the application to the ones it accepts. When nil, all
+		// shards of the stream are consumed.
+		ShardFilter ShardFilter
+
+		// PauseController, when set, is consulted by the polling consumers before each GetRecords call. While it reports
+		// paused, the shards are not read, checking again every IdleTimeBetweenReadsInMillis, but their leases are still
+		// renewed. Pauses longer than the 5 minutes shard iterators are valid for need ShardIteratorRefreshMillis.
+		PauseController PauseController
+
+		// ProcessingDeadlineMarginMillis The number of milliseconds before the shard lease expires at which the
+		// context handed to the record processor in ProcessRecordsInput is canceled
+		ProcessingDeadlineMarginMillis int
+
+		// MinBatchRecords Records from consecutive polls are buffered until at least this many are available, or
+		// MaxBatchWaitMillis elapsed, before being delivered to the record processor as a single batch
+		MinBatchRecords int
+
+		// MaxBatchWaitMillis The maximum number of milliseconds records are buffered while waiting for MinBatchRecords
+		MaxBatchWaitMillis int
+
+		// BlockOnTPSExceeded The polling consumer sleeps until the GetRecords rate limit window resets when the calls
+		// allowed per second are used up, instead of returning an error and retrying
+		BlockOnTPSExceeded bool
+
+		// SubscriptionRenewalMillis The number of milliseconds after which the enhanced fan-out consumer renews its shard
+		// subscription from the last continuation sequence number. It must stay below the 5 minutes subscription lifetime
+		SubscriptionRenewalMillis int
+
+		// CheckpointEvents receives an event for every checkpoint committed by the record processors. Events are
+		// sent without blocking: they are dropped while the channel is full, so checkpointing is never slowed down
+		CheckpointEvents chan<- CheckpointEvent
+
+		// ClockSkewToleranceMillis is the tolerated clock skew, in milliseconds, between the workers sharing the lease table.
+		// Leases are renewed that much earlier, and leases held by other workers are only taken over that much after
+		// their timeout, so that a skewed clock does not let a lease expire before it is renewed.
+		ClockSkewToleranceMillis int
+
+		// MaxWorkerLifetimeMillis is the time after which the worker shuts itself down gracefully, releasing its leases, so
+		// that an orchestrator can restart it fresh, e.g. to mitigate memory leaks or rotate credentials. 0 disables it.
+		MaxWorkerLifetimeMillis int
+
+		// UnknownLagPolicy decides whether to idle after a GetRecords response without records and without
+		// MillisBehindLatest. An unknown lag is not assumed to mean that the consumer is caught up.
+		UnknownLagPolicy UnknownLagPolicy
+
+		// DecodeErrorPolicy decides what to do with a record which cannot be decoded: skip it, hand it over to
+		// DecodeErrorDeadLetter or stop consuming the shard. Either way the error is counted with the DecodeError metric.
+		DecodeErrorPolicy DecodeErrorPolicy
+
+		// DecodeErrorDeadLetter receives the records which cannot be decoded with DeadLetterOnDecodeError, from the
+		// goroutine consuming the shard.
+		DecodeErrorDeadLetter func(shardID string, record types.Record, err error)
+
+		// MaxDecodeErrorsPerBatch is the number of records of a GetRecords batch which may fail to be decoded before the
+		// shard is failed as with FailOnDecodeError, to catch a systemic corruption while tolerating rare bad records.
+		// 0, the default, sets no limit.
+		MaxDecodeErrorsPerBatch int
+
+		// RecordValidator validates every user record before its delivery, e.g. against a schema. A record it returns
+		// an error for is handled as a record which cannot be decoded, according to DecodeErrorPolicy, and never reaches
+		// the record processor. Nil, the default, accepts every record.
+		RecordValidator func(record types.Record) error
+
+		// EnableEnhancedMonitoring enables shard-level enhanced monitoring on the stream when the worker starts, and
+		// disables the metrics it enabled when the worker shuts down.
+		// See: https://docs.aws.amazon.com/streams/latest/dev/monitoring-with-cloudwatch.html#kinesis-metrics-shard
+		EnableEnhancedMonitoring bool
+
+		// ShardLevelMetrics are the shard-level metrics enabled with enhanced monitoring, e.g. IncomingBytes or
+		// IteratorAgeMilliseconds. When empty, IncomingBytes and IteratorAgeMilliseconds are enabled.
+		ShardLevelMetrics []string
+
+		// MaxConsecutiveEmptyPollsBeforeRelease is the number of consecutive GetRecords calls returning no record after which
+		// the polling consumer shuts its record processor down and releases the lease on the shard, so that the shard can be
+		// redistributed by the next shard sync. 0 means the lease is never released for being idle.
+		MaxConsecutiveEmptyPollsBeforeRelease int
+
+		// IDGenerator generates unique identifiers, such as the worker ID when none is given. It defaults to random
+		// UUIDs from a cryptographically secure source.
+		IDGenerator utils.IDGenerator
+
+		// workerIDGenerated is true when WorkerID was generated rather than given
+		workerIDGenerated bool
+
+		// CallProcessRecordsOnShardEnd Call the IRecordProcessor::processRecords() API one last time, with no record and
+		// IsShardEnd set, once a shard has been completely read and before the record processor is shut down with TERMINATE.
+		// Processors buffering records can flush them and checkpoint SHARD_END there.
+		CallProcessRecordsOnShardEnd bool
+
+		// HTTPMaxIdleConns is the maximum number of idle (keep-alive) connections, across all hosts, of the HTTP client
+		// used by the Kinesis and DynamoDB clients created by the library. Raise it, with HTTPMaxIdleConnsPerHost, when
+		// consuming many shards concurrently. It does not apply to clients provided with WithKinesis or WithDynamoDB.
+		HTTPMaxIdleConns int
+
+		// HTTPMaxIdleConnsPerHost is the maximum number of idle (keep-alive) connections per host of the HTTP client used
+		// by the Kinesis and DynamoDB clients created by the library.
+		HTTPMaxIdleConnsPerHost int
+
+		// HTTPIdleConnTimeoutMillis is the time, in milliseconds, an idle (keep-alive) connection of the HTTP client used
+		// by the Kinesis and DynamoDB clients created by the library is kept open.
+		HTTPIdleConnTimeoutMillis int
+
+		// EnableBatchedLeaseRenewal collects the lease renewals of all the shards held by the worker and writes them together,
+		// in chunks of up to 25 leases, instead of renewing each lease with its own request. It requires a checkpointer
+		// implementing BatchLeaseRenewer, as the DynamoDB checkpointer does.
+		EnableBatchedLeaseRenewal bool
+
+		// OnGetRecordsResponse, when set, is called with every successful GetRecords response of the polling consumers,
+		// before its records are processed, so that the responses can be audited. It runs on the consumer goroutine and
+		// must return quickly, and it must not modify the response.
+		OnGetRecordsResponse func(shardID string, resp *kinesis.GetRecordsOutput)
+
+		// MaxInitRetries The maximum number of times the initialization of a record processor implementing
+		// IRecordProcessorInitializer is retried when it fails, before the lease on the shard is released.
+		MaxInitRetries int
+
+		// HeartbeatIntervalMillis is the interval between two calls to the heartbeat set with Worker.WithHeartbeat.
+		HeartbeatIntervalMillis int
+
+		// MaxConcurrentGetRecords caps the number of GetRecords calls in flight across the polling shard consumers of the
+		// worker. Consumers wait for a free slot before polling their shard. 0, the default, leaves polling unbounded.
+		MaxConcurrentGetRecords int
+
+		// PrioritizePollingByLag hands the free GetRecords slots, under MaxConcurrentGetRecords, to the waiting shard with
+		// the highest MillisBehindLatest first rather than in arrival order, so that catching up favors the oldest data.
+		// Shards not polled yet come first. It has no effect when MaxConcurrentGetRecords is not set.
+		PrioritizePollingByLag bool
+
+		// MinLeaseRenewalIntervalMillis is the minimum interval between two renewals of the lease on a shard, capping the
+		// DynamoDB write rate whatever LeaseRefreshPeriodMillis and LeaseRefreshWaitTime would lead to. It must leave room
+		// to renew the lease before it expires: it has to be lower than FailoverTimeMillis minus ClockSkewToleranceMillis.
+		// 0, the default, sets no minimum.
+		MinLeaseRenewalIntervalMillis int
+
+		// IdleTimeBetweenReadsJitter spreads the idle time between reads of a shard by up to this fraction of
+		// IdleTimeBetweenReadsInMillis, either way, so that idle shards do not all poll at the same time. For instance 0.2
+		// sleeps between 80% and 120% of IdleTimeBetweenReadsInMillis. 0, the default, sleeps exactly
+		// IdleTimeBetweenReadsInMillis.
+		IdleTimeBetweenReadsJitter float64
+
+		// StartingSequenceNumbers maps shard IDs to the position consumption of the shard starts at when the shard has no
+		// checkpoint yet, in place of InitialPositionInStream. The shard is read AT_SEQUENCE_NUMBER and the user records of
+		// an aggregated record before SubSequenceNumber are skipped, which allows replaying from the middle of a KPL
+		// aggregated record. Once the shard is checkpointed, its checkpoint takes precedence, whichever worker takes the
+		// lease next.
+		StartingSequenceNumbers map[string]kcl.ExtendedSequenceNumber
+
+		// CheckpointFinalRecordsAtShardEnd checkpoints the last record delivered from a closed shard, unless the record
+		// processor did, before the processor is shut down with TERMINATE and checkpoints SHARD_END. The final records of a
+		// shard may come with the response telling the shard is closed: this makes sure their checkpoint is committed first.
+		// When this checkpoint fails, the processor is shut down with REQUESTED and the shard is not ended, so that the final
+		// records are read again by the next owner of the lease.
+		CheckpointFinalRecordsAtShardEnd bool
+
+		// ThroughputExceededBackoff is the backoff of a polling consumer after GetRecords failed with
+		// ProvisionedThroughputExceededException. It defaults to DefaultThroughputExceededBackoff.
+		ThroughputExceededBackoff BackoffPolicy
+
+		// KMSThrottlingBackoff is the backoff of a polling consumer after GetRecords failed with KMSThrottlingException.
+		// It defaults to DefaultKMSThrottlingBackoff.
+		KMSThrottlingBackoff BackoffPolicy
+
+		// GetRecordsTimeoutBackoff is the backoff of a polling consumer after a GetRecords call timed out, see
+		// GetRecordsTimeoutMillis. It defaults to DefaultGetRecordsTimeoutBackoff.
+		GetRecordsTimeoutBackoff BackoffPolicy
+
+		// ProcessorCreateBackoff is the wait before the worker retries acquiring a shard whose record processor could not
+		// be created. It defaults to DefaultProcessorCreateBackoff.
+		ProcessorCreateBackoff BackoffPolicy
+
+		// SlidingWindowTPSLimit The polling consumer allows 5 GetRecords calls in any rolling second, instead of 5 calls per
+		// fixed one second window, which lets up to 10 calls through within a second straddling two windows
+		SlidingWindowTPSLimit bool
+
+		// ReshardingSyncIntervalMillis When set, the closure of a shard by resharding triggers a shard sync, so that its child
+		// shards are leased without waiting for the next periodic sync. The closures are coalesced: at most one such sync runs
+		// per interval, whatever the number of shards closed meanwhile, which keeps a resharding storm from turning into a burst
+		// of syncs. 0, the default, leaves shard syncs to ShardSyncIntervalMillis.
+		ReshardingSyncIntervalMillis int
+
+		// MaxReshardingLeaseWritesPerSecond caps the lease table writes caused by resharding, i.e. the creation of the leases
+		// of child shards and the removal of the leases of expired shards, across the worker. The writes are spread evenly so
+		// that a resharding storm is absorbed steadily by the lease table. 0, the default, sets no cap.
+		MaxReshardingLeaseWritesPerSecond int
+
+		// TouchCheckpointOnIdle advances the heartbeat of the lease of a shard which stays idle, at most every
+		// TouchCheckpointIntervalMillis, without writing its checkpoint. The heartbeat is otherwise only advanced by
+		// checkpoints: with it, an idle but healthy shard can be told apart from a stalled one. It requires a checkpointer
+		// implementing checkpoint.CheckpointToucher.
+		TouchCheckpointOnIdle bool
+
+		// TouchCheckpointIntervalMillis is the minimum time without records before the heartbeat of the lease of an idle
+		// shard is advanced, and between two such writes, with TouchCheckpointOnIdle.
+		TouchCheckpointIntervalMillis int
+
+		// ConsumerPoolSize, when positive, polls the shards with that many goroutines, every goroutine polling in turn the
+		// shard whose next poll is due first, instead of one goroutine per shard. It reduces the scheduler and memory overhead
+		// of very wide streams. The rate limits of every shard still apply. It does not apply to enhanced fan-out consumers.
+		// 0, the default, polls every shard with a goroutine of its own.
+		ConsumerPoolSize int
+
+		// CoordinateSelfOwnedParentShards lets the consumer of a child shard wait for its parent shard, when the parent is
+		// consumed by the same worker, by being signaled when the consumer of the parent returns rather than by polling the
+		// lease table every ParentShardPollIntervalMillis. The child starts as soon as the parent is checkpointed at SHARD_END.
+		// The lease table is polled as before for parents consumed by other workers, or not checkpointed at SHARD_END.
+		CoordinateSelfOwnedParentShards bool
+
+		// ShardIteratorRefreshMillis is the time since the last successful GetRecords call of a shard after which its shard
+		// iterator is derived again before the next call, because shard iterators expire after 5 minutes. The new iterator
+		// starts after the last record read from the shard, or at its checkpoint when none was read yet. 0, the default, keeps
+		// using the iterator returned by the last call.
+		ShardIteratorRefreshMillis int
+
+		// LeaseVerificationGapMillis is the unexpected gap between two polls of a shard, beyond the wait between them, after
+		// which the polling consumer reads the owner of the lease before handing the records over. A gap is typically a long
+		// stop-the-world pause of the process, during which the lease may have expired and been taken over by another worker:
+		// the record processor is then shut down with ZOMBIE instead of processing the records a second time. 0, the default,
+		// never verifies the lease.
+		LeaseVerificationGapMillis int
+
+		// MaxUnackedRecords is the number of records of a shard delivered to the record processor and not covered by a
+		// checkpoint yet above which the consumer stops reading the shard, until checkpoints acknowledge enough of them.
+		// It bounds the memory held by record processors checkpointing asynchronously, e.g. once a sink confirmed the
+		// records. GetRecords calls are limited to the records left below the cap. The enhanced fan-out consumer stops
+		// reading the events of its subscription, see BackpressureSubscriptionTimeoutMillis. 0, the default, sets no limit.
+		MaxUnackedRecords int
+
+		// RejoinOnLeaseLoss runs a lease distribution pass as soon as the worker is left without any lease while the stream has
+		// shards to consume, e.g. after a DynamoDB outage let all its leases expire, rather than waiting for the next shard
+		// sync. Such rejoins are reported with the WorkerRejoined metric.
+		RejoinOnLeaseLoss bool
+
+		// ParentShardWaitTimeoutMillis bounds the wait of a child shard for the end of its parent shard. A parent
+		// which is not checkpointed at SHARD_END in time, e.g. a shard of another stream sharing the lease table, is handled
+		// with ParentShardTimeoutPolicy. 0 waits indefinitely.
+		ParentShardWaitTimeoutMillis int
+
+		// ParentShardTimeoutPolicy decides whether to start consuming a child shard whose parent shard did not end
+		// within ParentShardWaitTimeoutMillis, or to give it up.
+		ParentShardTimeoutPolicy ParentShardTimeoutPolicy
+
+		// AdaptiveMaxRecords tunes the number of records asked for per GetRecords call to the average size of the
+		// records of the shard, so that a call asks for as many records as fit in the 10 MB a call returns at most. It starts
+		// from MaxRecords and stays within [1, 10000].
+		AdaptiveMaxRecords bool
+
+		// CleanupOrphanedLeases removes from the lease table the leases of shards which are not in the stream anymore,
+		// e.g. after the stream was deleted and recreated with the same name, so that they are neither acquired nor polled.
+		// A lease is only removed once its shard is missing from OrphanedLeaseMinSyncs consecutive shard syncs. Only the
+		// leases tagged with the name of the stream are removed, so that a lease table shared with other streams is left
+		// alone; the leases written before the tag was introduced are kept until rewritten. The checkpointer needs to
+		// list the leases, as the DynamoDB checkpointer does.
+		CleanupOrphanedLeases bool
+
+		// OrphanedLeaseMinSyncs is the number of consecutive shard syncs a shard has to be missing from before its
+		// lease is removed with CleanupOrphanedLeases, so that a listing missing shards by accident does not remove them.
+		OrphanedLeaseMinSyncs int
+
+		// CheckpointRenewsLease extends the lease of the shard with every checkpoint, in the same write, so that a shard
+		// checkpointed more often than its lease is refreshed needs no separate lease renewal. The checkpoint is then
+		// conditional on the lease being held by the worker. It requires a checkpointer implementing CheckpointLeaseRenewer,
+		// as the DynamoDB checkpointer does, and has no effect with lease stealing.
+		CheckpointRenewsLease bool
+
+		// LeaseTableScanSegments is the number of segments the lease table is split into when it is read whole, e.g. to
+		// learn the checkpoints and owners of the leases at startup. The segments are scanned in parallel, which speeds up
+		// the reading of tables holding thousands of leases at the cost of a burst of read capacity.
+		LeaseTableScanSegments int
+
+		// VerifyRecordOrdering checks that the records read from each shard come in strictly increasing sequence numbers,
+		// compared numerically, for as long as the shard is held by the worker. Every record which does not is logged and
+		// counted with the RecordOrderViolation metric, and still delivered. The user records of an aggregated record share
+		// its sequence number, so the check applies to the records read from Kinesis, before de-aggregation.
+		VerifyRecordOrdering bool
+
+		// CorruptCheckpointPolicy decides whether to fail a shard whose checkpoint is not a valid sequence number, or to read
+		// it from TRIM_HORIZON or LATEST instead, so that a single corrupt lease does not keep the shard from being consumed.
+		// Corrupt checkpoints are logged and counted with the CorruptCheckpoint metric, whatever the policy.
+		CorruptCheckpointPolicy CorruptCheckpointPolicy
+
+		// FanOutThrottleThreshold switches a polling worker to enhanced fan-out once its GetRecords calls have been throttled
+		// that many times within FanOutThrottleWindowMillis, e.g. by other applications sharing the read throughput of the
+		// shards. The enhanced fan-out consumer EnhancedFanOutConsumerName is registered if needed, and the polled shards are
+		// handed over to fan-out consumers, which resume from the same checkpoints. The switch is reported with the
+		// WorkerFanOutUpgraded metric and lasts until the worker stops. 0 never switches.
+		FanOutThrottleThreshold int
+
+		// FanOutThrottleWindowMillis is the sliding window the throttled GetRecords calls are counted over, with
+		// FanOutThrottleThreshold.
+		FanOutThrottleWindowMillis int
+
+		// ErrorLogSummaryIntervalMillis coalesces the warnings and errors a shard consumer logs repeatedly, e.g. on every
+		// retry of a throttled call: the first occurrence is logged, then at most one line per interval with the number of
+		// occurrences. Messages are told apart by their format and the type of their errors. 0 logs every occurrence.
+		ErrorLogSummaryIntervalMillis int
+
+		// EnablePrefetch makes a polling consumer read the next records of its shard while the record processor
+		// processes the previous ones, overlapping the GetRecords calls with the processing to catch up faster. The records
+		// prefetched are delivered, and can be checkpointed, only once the previous ones have been processed. The calls
+		// prefetching count against the GetRecords rate limits like any other.
+		EnablePrefetch bool
+
+		// StartAsStandby starts the worker as a warm standby: it is fully initialized, syncs the shards and reports its
+		// health, but acquires no lease, nor steals any, until promoted with Worker.Promote, e.g. when the active worker of
+		// an active/standby deployment fails over.
+		StartAsStandby bool
+
+		// EnableStreamGenerations scopes the leases to the generation of the stream, its creation time as returned by
+		// DescribeStreamSummary, for lease tables outliving their stream: the shards of a stream deleted and created again
+		// with the same name may have the IDs of the shards of the previous stream, whose leases are then ignored rather
+		// than taken for the checkpoints of the new shards. The leases written before enabling it are taken to be of the
+		// current generation. It requires a checkpointer implementing checkpoint.StreamGenerationScoper.
+		EnableStreamGenerations bool
+
+		// LagThresholdMillis is the MillisBehindLatest over which a shard is reported as falling behind, with
+		// OnLagThresholdExceeded, until its lag is back down to LagRecoveryMillis, when OnLagRecovered is called. 0 disables
+		// the lag callbacks.
+		LagThresholdMillis int
+
+		// LagRecoveryMillis is the MillisBehindLatest a shard which exceeded LagThresholdMillis has to get back down to for
+		// OnLagRecovered to be called. Kept below the threshold, the gap keeps a lag hovering around the threshold from
+		// firing the callbacks on every read. 0 waits for the shard to be caught up.
+		LagRecoveryMillis int
+
+		// OnLagThresholdExceeded, when set, is called once the lag of a shard goes over LagThresholdMillis, with the lag.
+		// It runs on the consumer goroutine and must return quickly.
+		OnLagThresholdExceeded func(shardID string, millisBehindLatest int64)
+
+		// OnLagRecovered, when set, is called once the lag of a shard which exceeded LagThresholdMillis is back down to
+		// LagRecoveryMillis. It runs on the consumer goroutine and must return quickly.
+		OnLagRecovered func(shardID string)
+
+		// DecodeCloudWatchLogs delivers the log events of the records written by CloudWatch Logs subscription filters,
+		// gzip compressed envelopes of log events, rather than the records themselves: each log event is delivered as a
+		// record of its own, with the JSON of a cloudwatchlogs.LogEvent as data and the sequence number of its envelope. The
+		// control messages are dropped. Other records are delivered as they are, and an envelope which cannot be
+		// decompressed is handled by the DecodeErrorPolicy.
+		DecodeCloudWatchLogs bool
+
+		// ProcessTimerIntervalMillis is how often ProcessTimer is invoked on the record processors implementing
+		// IRecordProcessorTimer, whether records keep coming or the shard is idle, so that they can flush the state they
+		// accumulate and checkpoint. 0 disables the timer.
+		ProcessTimerIntervalMillis int
+
+		// MaxGetRecordsCalls caps the GetRecords calls of all the polling shard consumers of the worker over each
+		// GetRecordsBudgetWindowMillis, e.g. to keep a misconfigured development or test worker from running up the API
+		// costs. Once the calls of a window are used up, polling pauses until the next window, reported with the
+		// GetRecordsBudgetExhausted metric. This is a coarse limit on top of the per shard ones. 0 leaves the calls
+		// unbounded.
+		MaxGetRecordsCalls int
+
+		// GetRecordsBudgetWindowMillis is the window over which the MaxGetRecordsCalls GetRecords calls are allowed.
+		GetRecordsBudgetWindowMillis int
+
+		// BackpressureSubscriptionTimeoutMillis is how long the enhanced fan-out consumer keeps the subscription of a
+		// shard open while MaxUnackedRecords holds the reading of its events back. The subscription is then closed, and a new
+		// one opened from the last continuation sequence number once the record processor caught up, rather than leaving
+		// Kinesis to end the stalled subscription. 0 keeps the subscription open, a subscription ended meanwhile being renewed
+		// the same way.
+		BackpressureSubscriptionTimeoutMillis int
+
+		// ListShardsExpiredTokenRetries is the number of times a shard sync resumes listing the shards when the ListShards
+		// pagination token expired, e.g. after slow pages on a large stream, before failing. The listing resumes after the last
+		// shard listed, with ExclusiveStartShardId, or from the beginning when none was. 0 fails the shard sync right away.
+		ListShardsExpiredTokenRetries int
+
+		// GetRecordsTimeoutMillis bounds each GetRecords call of the polling consumer, e.g. on a shard whose backend is
+		// degraded. A call timing out is retried after the GetRecordsTimeoutBackoff, up to MaxRetryCount times in a row.
+		GetRecordsTimeoutMillis int
+
+		// ReportUnackedRecords reports the UnackedRecords gauge of every shard, the records delivered to the record
+		// processor and not covered by a checkpoint yet, after each delivery and checkpoint, even without MaxUnackedRecords.
+		// These are the records delivered again after a failover: the gauge bounds the replay of record processors which
+		// checkpoint every few batches, or on a timer.
+		ReportUnackedRecords bool
+
+		// ReadinessTimeoutMillis closes the channel returned by Worker.Ready once the worker has been started for that
+		// long, even though its first shard discovery and lease acquisition have not completed yet, e.g. because Kinesis or
+		// the lease table cannot be reached. 0 waits for them.
+		ReadinessTimeoutMillis int
+
+		// ShutdownWhenNoOpenShards shuts the worker down once it has nothing left to consume: it holds no lease, every
+		// shard known is completed, and DescribeStreamSummary confirms that the stream has no open shard. A listing failing or
+		// returning no shard while the stream still has open shards, e.g. because of a transient error, never shuts it down.
+		ShutdownWhenNoOpenShards bool
+
+		// MaxProcessorCreateRetries is the number of times in a row the worker retries acquiring a shard whose record
+		// processor could not be created, see IShardRecordProcessorFactory, after the ProcessorCreateBackoff. It then
+		// leaves the shard to the other workers until it is restarted.
+		MaxProcessorCreateRetries int
+
+		// StreamStatusPolicy decides whether the worker starts on a stream in UPDATING status, e.g. mid-resharding, or
+		// requires it to be ACTIVE. The worker fails to start on a stream in CREATING or DELETING status either way. The
+		// status is read with DescribeStreamSummary at startup.
+		StreamStatusPolicy StreamStatusPolicy
+
+		// MaxConcurrentCheckpoints caps the number of checkpoint writes in flight across the shards of the worker, so
+		// that processors checkpointing at the same time, e.g. on a timer, do not spike the DynamoDB write capacity. The
+		// checkpoints over the cap wait for a free slot, counted with the CheckpointThrottled metric. 0, the default, leaves
+		// checkpoints unbounded.
+		MaxConcurrentCheckpoints int
+
+		// MaxRecordsInFlight caps the number of records read and not processed yet across the polling shard consumers of
+		// the worker, so that a slow record processor does not let the worker read far ahead and balloon memory. Consumers
+		// wait for the record processors to drain before reading their shard again. Records prefetched with EnablePrefetch
+		// are only counted once picked up. 0, the default, leaves the reads unbounded.
+		MaxRecordsInFlight int
 	}
 )
 
@@ -327,3 +957,31 @@ func checkIsValuePositive(key string, value int) {
 		log.Panicf("Positive value expected for %v, actual: %v", key, value)
 	}
 }
+
+// checkIsValueNonNegative makes sure the value is not negative, for the options which 0 disables.
+func checkIsValueNonNegative(key string, value int) {
+	if value < 0 {
+		// There is no point to continue for incorrect configuration. Fail fast!
+		log.Panicf("Non-negative value expected for %v, actual: %v", key, value)
+	}
+}
+
+// checkIsBackoffPolicyValid makes sure the backoff policy is valid.
+func checkIsBackoffPolicyValid(key string, policy BackoffPolicy) {
+	if err := policy.Validate(); err != nil {
+		// There is no point to continue for incorrect configuration. Fail fast!
+		log.Panicf("Invalid %v: %v", key, err)
+	}
+}
+
+// CheckpointEvent describes a checkpoint committed to the lease table.
+type CheckpointEvent struct {
+	// ShardID is the shard the checkpoint was written for.
+	ShardID string
+
+	// SequenceNumber is the checkpointed sequence number, SHARD_END once the shard has been fully processed.
+	SequenceNumber string
+
+	// Timestamp is the time the checkpoint was committed.
+	Timestamp time.Time
+}
@@ -19,8 +19,15 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/vmware/vmware-go-kcl-v2/logger"
@@ -100,3 +107,261 @@ func TestEmptyEnhancedFanOutConsumerARN(t *testing.T) {
 		NewKinesisClientLibConfig("app", "stream", "us-west-2", "worker").WithEnhancedFanOutConsumerARN("")
 	})
 }
+
+func TestPartitionKeyFilter(t *testing.T) {
+	hashKey := HashKeyForPartitionKey("tenant-a")
+	filter := NewPartitionKeyFilter("tenant-a")
+
+	assert.True(t, filter.Accept("shard-0", big.NewInt(0), hashKey))
+	assert.True(t, filter.Accept("shard-1", hashKey, new(big.Int).Add(hashKey, big.NewInt(1))))
+	assert.False(t, filter.Accept("shard-2", new(big.Int).Add(hashKey, big.NewInt(1)), new(big.Int).Add(hashKey, big.NewInt(10))))
+}
+
+func TestConfigWithIDGenerator(t *testing.T) {
+	sequentialIDs := func() func() string {
+		n := 0
+		return func() string {
+			n++
+			return fmt.Sprintf("worker-%d", n)
+		}
+	}
+
+	// generated worker IDs are reproducible with a deterministic generator
+	for i := 0; i < 2; i++ {
+		kclConfig := NewKinesisClientLibConfig("appName", "StreamName", "us-west-2", "").
+			WithIDGenerator(sequentialIDs())
+		assert.Equal(t, "worker-1", kclConfig.WorkerID)
+		assert.Equal(t, "worker-2", kclConfig.IDGenerator())
+	}
+
+	// a given worker ID is kept
+	kclConfig := NewKinesisClientLibConfig("appName", "StreamName", "us-west-2", "workerId").
+		WithIDGenerator(sequentialIDs())
+	assert.Equal(t, "workerId", kclConfig.WorkerID)
+
+	// random IDs by default
+	assert.NotEqual(t, NewKinesisClientLibConfig("appName", "StreamName", "us-west-2", "").WorkerID,
+		NewKinesisClientLibConfig("appName", "StreamName", "us-west-2", "").WorkerID)
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	kclConfig := NewKinesisClientLibConfig("appName", "StreamName", "us-west-2", "workerId")
+	transport := kclConfig.NewHTTPClient().GetTransport()
+	assert.Equal(t, DefaultHTTPMaxIdleConns, transport.MaxIdleConns)
+	assert.Equal(t, DefaultHTTPMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 90*time.Second, transport.IdleConnTimeout)
+
+	kclConfig.WithHTTPMaxIdleConns(500).
+		WithHTTPMaxIdleConnsPerHost(200).
+		WithHTTPIdleConnTimeoutMillis(30000)
+	transport = kclConfig.NewHTTPClient().GetTransport()
+	assert.Equal(t, 500, transport.MaxIdleConns)
+	assert.Equal(t, 200, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 30*time.Second, transport.IdleConnTimeout)
+
+	assert.Panics(t, func() { kclConfig.WithHTTPMaxIdleConnsPerHost(0) })
+}
+
+func TestZeroDisablesOptions(t *testing.T) {
+	kclConfig := NewKinesisClientLibConfig("appName", "StreamName", "us-west-2", "workerId")
+
+	// the options which 0 disables can be set back to 0, but not below
+	setters := []struct {
+		name string
+		set  func(int) *KinesisClientLibConfiguration
+	}{
+		{"ClockSkewToleranceMillis", kclConfig.WithClockSkewToleranceMillis},
+		{"MaxWorkerLifetimeMillis", kclConfig.WithMaxWorkerLifetimeMillis},
+		{"MaxConsecutiveEmptyPollsBeforeRelease", kclConfig.WithMaxConsecutiveEmptyPollsBeforeRelease},
+		{"MaxInitRetries", kclConfig.WithMaxInitRetries},
+		{"MaxConcurrentGetRecords", kclConfig.WithMaxConcurrentGetRecords},
+		{"MinLeaseRenewalIntervalMillis", kclConfig.WithMinLeaseRenewalIntervalMillis},
+		{"ReshardingSyncIntervalMillis", kclConfig.WithReshardingSyncIntervalMillis},
+		{"MaxReshardingLeaseWritesPerSecond", kclConfig.WithMaxReshardingLeaseWritesPerSecond},
+		{"ConsumerPoolSize", kclConfig.WithConsumerPoolSize},
+		{"ShardIteratorRefreshMillis", kclConfig.WithShardIteratorRefreshMillis},
+		{"MaxDecodeErrorsPerBatch", kclConfig.WithMaxDecodeErrorsPerBatch},
+		{"LeaseVerificationGapMillis", kclConfig.WithLeaseVerificationGapMillis},
+		{"MaxUnackedRecords", kclConfig.WithMaxUnackedRecords},
+		{"ParentShardWaitTimeoutMillis", kclConfig.WithParentShardWaitTimeoutMillis},
+		{"LagThresholdMillis", kclConfig.WithLagThresholdMillis},
+		{"ProcessTimerIntervalMillis", kclConfig.WithProcessTimerIntervalMillis},
+		{"MaxGetRecordsCalls", kclConfig.WithMaxGetRecordsCalls},
+		{"BackpressureSubscriptionTimeoutMillis", kclConfig.WithBackpressureSubscriptionTimeoutMillis},
+		{"ReadinessTimeoutMillis", kclConfig.WithReadinessTimeoutMillis},
+		{"MaxConcurrentCheckpoints", kclConfig.WithMaxConcurrentCheckpoints},
+		{"MaxRecordsInFlight", kclConfig.WithMaxRecordsInFlight},
+	}
+	for _, s := range setters {
+		assert.NotPanics(t, func() { s.set(0) }, s.name)
+		assert.PanicsWithValue(t, "Non-negative value expected for "+s.name+", actual: -1", func() { s.set(-1) }, s.name)
+	}
+}
+
+func TestConfigBuilderDefaults(t *testing.T) {
+	kclConfig, err := NewConfigBuilder("appName", "StreamName", "us-west-2", "workerId").Build()
+	assert.Nil(t, err)
+	assert.Equal(t, "appName", kclConfig.ApplicationName)
+	assert.Equal(t, "appName", kclConfig.TableName)
+	assert.Equal(t, DefaultMaxRecords, kclConfig.MaxRecords)
+	assert.Equal(t, DefaultIdleTimeBetweenReadsMillis, kclConfig.IdleTimeBetweenReadsInMillis)
+	assert.Equal(t, DefaultFailoverTimeMillis, kclConfig.FailoverTimeMillis)
+	assert.Equal(t, DefaultLeaseRefreshPeriodMillis, kclConfig.LeaseRefreshPeriodMillis)
+	assert.Equal(t, DefaultMaxRetryCount, kclConfig.MaxRetryCount)
+	assert.Equal(t, DefaultInitialPositionInStream, kclConfig.InitialPositionInStream)
+
+	kclConfig, err = NewConfigBuilder("appName", "StreamName", "us-west-2", "").
+		WithMaxRecords(100).
+		WithFailoverTimeMillis(2000).
+		WithLeaseRefreshPeriodMillis(500).
+		Configure(func(c *KinesisClientLibConfiguration) { c.TableName = "leases" }).
+		Build()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, kclConfig.WorkerID)
+	assert.Equal(t, 100, kclConfig.MaxRecords)
+	assert.Equal(t, 2000, kclConfig.FailoverTimeMillis)
+	assert.Equal(t, 500, kclConfig.LeaseRefreshPeriodMillis)
+	assert.Equal(t, "leases", kclConfig.TableName)
+}
+
+func TestConfigBuilderValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(b *ConfigBuilder) *ConfigBuilder
+	}{
+		{"empty stream name", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.Configure(func(c *KinesisClientLibConfiguration) { c.StreamName = "" })
+		}},
+		{"zero max records", func(b *ConfigBuilder) *ConfigBuilder { return b.WithMaxRecords(0) }},
+		{"max records over limit", func(b *ConfigBuilder) *ConfigBuilder { return b.WithMaxRecords(DefaultMaxRecords + 1) }},
+		{"negative idle time", func(b *ConfigBuilder) *ConfigBuilder { return b.WithIdleTimeBetweenReadsInMillis(-1) }},
+		{"zero lease timeout", func(b *ConfigBuilder) *ConfigBuilder { return b.WithFailoverTimeMillis(0) }},
+		{"zero max retry count", func(b *ConfigBuilder) *ConfigBuilder { return b.WithMaxRetryCount(0) }},
+		{"zero shutdown grace", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.Configure(func(c *KinesisClientLibConfiguration) { c.ShutdownGraceMillis = 0 })
+		}},
+		{"lease refresh not shorter than lease timeout", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.WithFailoverTimeMillis(1000).WithLeaseRefreshPeriodMillis(1000)
+		}},
+		{"negative clock skew", func(b *ConfigBuilder) *ConfigBuilder { return b.WithClockSkewToleranceMillis(-1) }},
+		{"min lease renewal interval within clock skew", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.WithFailoverTimeMillis(10000).WithClockSkewToleranceMillis(2000).WithMinLeaseRenewalIntervalMillis(8000)
+		}},
+		{"jitter out of range", func(b *ConfigBuilder) *ConfigBuilder { return b.WithIdleTimeBetweenReadsJitter(1.5) }},
+		{"AT_TIMESTAMP without timestamp", func(b *ConfigBuilder) *ConfigBuilder { return b.WithTimestampAtInitialPositionInStream(nil) }},
+		{"enhanced fan-out without consumer", func(b *ConfigBuilder) *ConfigBuilder { return b.WithEnhancedFanOutConsumerName("") }},
+		{"consumer ARN of another partition", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.WithEnhancedFanOutConsumerARN("arn:aws-us-gov:kinesis:us-west-2:123456789012:stream/StreamName/consumer/appName:1")
+		}},
+		{"consumer ARN of another stream", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.WithEnhancedFanOutConsumerARN("arn:aws:kinesis:us-west-2:123456789012:stream/other/consumer/appName:1")
+		}},
+		{"lag recovery not below lag threshold", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.Configure(func(c *KinesisClientLibConfiguration) { c.WithLagThresholdMillis(1000).WithLagRecoveryMillis(1000) })
+		}},
+		{"get records budget without window", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.Configure(func(c *KinesisClientLibConfiguration) {
+				c.WithMaxGetRecordsCalls(1000).GetRecordsBudgetWindowMillis = 0
+			})
+		}},
+		{"negative list shards expired token retries", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.Configure(func(c *KinesisClientLibConfiguration) { c.WithListShardsExpiredTokenRetries(-1) })
+		}},
+		{"negative max concurrent checkpoints", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.Configure(func(c *KinesisClientLibConfiguration) { c.MaxConcurrentCheckpoints = -1 })
+		}},
+		{"negative max records in flight", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.Configure(func(c *KinesisClientLibConfiguration) { c.MaxRecordsInFlight = -1 })
+		}},
+		{"negative processor create retries", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.Configure(func(c *KinesisClientLibConfiguration) { c.WithMaxProcessorCreateRetries(-1) })
+		}},
+		{"dead letter policy without dead letter", func(b *ConfigBuilder) *ConfigBuilder {
+			return b.Configure(func(c *KinesisClientLibConfiguration) { c.DecodeErrorPolicy = DeadLetterOnDecodeError })
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kclConfig, err := tt.build(NewConfigBuilder("appName", "StreamName", "us-west-2", "workerId")).Build()
+			assert.Nil(t, kclConfig)
+			assert.True(t, errors.Is(err, ErrInvalidConfiguration), "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestBackoffPolicy(t *testing.T) {
+	policy := BackoffPolicy{BaseMillis: 100, Multiplier: 2, MaxMillis: 500}
+	assert.Equal(t, 100*time.Millisecond, policy.Delay(1))
+	assert.Equal(t, 200*time.Millisecond, policy.Delay(2))
+	assert.Equal(t, 400*time.Millisecond, policy.Delay(3))
+	assert.Equal(t, 500*time.Millisecond, policy.Delay(4))
+
+	// the defaults keep the historical curves
+	assert.Equal(t, time.Second, DefaultThroughputExceededBackoff.Delay(5))
+	for retries := 1; retries <= 5; retries++ {
+		assert.Equal(t, time.Duration(math.Exp2(float64(retries))*100)*time.Millisecond, DefaultKMSThrottlingBackoff.Delay(retries))
+	}
+
+	// the jittered waits stay under the ceiling
+	assert.Equal(t, 150*time.Millisecond, BackoffPolicy{BaseMillis: 100, Multiplier: 2, MaxMillis: 500, Jitter: 0.5}.Backoff(1, 1))
+	assert.Equal(t, 500*time.Millisecond, BackoffPolicy{BaseMillis: 100, Multiplier: 2, MaxMillis: 500, Jitter: 0.5}.Backoff(3, 1))
+	full := BackoffPolicy{BaseMillis: 100, Multiplier: 2, MaxMillis: 500, JitterMode: FullJitter}
+	assert.Equal(t, time.Duration(0), full.Backoff(2, 0))
+	assert.Equal(t, 50*time.Millisecond, full.Backoff(2, 0.25))
+	assert.Equal(t, 250*time.Millisecond, full.Backoff(10, 0.5))
+	equal := BackoffPolicy{BaseMillis: 100, Multiplier: 2, MaxMillis: 500, JitterMode: EqualJitter}
+	assert.Equal(t, 100*time.Millisecond, equal.Backoff(2, 0))
+	assert.Equal(t, 150*time.Millisecond, equal.Backoff(2, 0.5))
+	assert.Equal(t, 375*time.Millisecond, equal.Backoff(10, 0.5))
+	assert.Error(t, BackoffPolicy{BaseMillis: 100, Multiplier: 2, JitterMode: EqualJitter + 1}.Validate())
+
+	kclConfig := NewKinesisClientLibConfig("appName", "StreamName", "us-west-2", "workerId").
+		WithKMSThrottlingBackoff(BackoffPolicy{BaseMillis: 50, Multiplier: 1.5, Jitter: 0.1})
+	assert.Equal(t, DefaultThroughputExceededBackoff, kclConfig.ThroughputExceededBackoff)
+	assert.Equal(t, DefaultGetRecordsTimeoutBackoff, kclConfig.GetRecordsTimeoutBackoff)
+	assert.Equal(t, 75*time.Millisecond, kclConfig.KMSThrottlingBackoff.Delay(2))
+
+	assert.Panics(t, func() { kclConfig.WithThroughputExceededBackoff(BackoffPolicy{BaseMillis: 100, Multiplier: 0.5}) })
+	assert.Panics(t, func() { kclConfig.WithKMSThrottlingBackoff(BackoffPolicy{BaseMillis: 100, Multiplier: 2, Jitter: 2}) })
+}
+
+func TestPartitions(t *testing.T) {
+	tests := []struct {
+		region, partition, endpoint string
+	}{
+		{"us-west-2", "aws", "https://kinesis.us-west-2.amazonaws.com"},
+		{"us-gov-west-1", "aws-us-gov", "https://kinesis.us-gov-west-1.amazonaws.com"},
+		{"cn-north-1", "aws-cn", "https://kinesis.cn-north-1.amazonaws.com.cn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.region, func(t *testing.T) {
+			assert.Equal(t, tt.partition, PartitionForRegion(tt.region))
+
+			streamARN := StreamARN(tt.region, "123456789012", "stream")
+			assert.Equal(t, "arn:"+tt.partition+":kinesis:"+tt.region+":123456789012:stream/stream", streamARN)
+			parsed, streamName, err := ParseStreamARN(streamARN + "/consumer/app:1")
+			assert.Nil(t, err)
+			assert.Equal(t, tt.partition, parsed.Partition)
+			assert.Equal(t, tt.region, parsed.Region)
+			assert.Equal(t, "stream", streamName)
+
+			// the consumer ARN is checked against the partition of the region
+			_, err = NewConfigBuilder("app", "stream", tt.region, "worker").WithEnhancedFanOutConsumerARN(streamARN + "/consumer/app:1").Build()
+			assert.Nil(t, err)
+
+			// the default endpoint of the region, or the custom endpoint within the partition of the region
+			endpoint, err := kinesis.NewDefaultEndpointResolver().ResolveEndpoint(tt.region, kinesis.EndpointResolverOptions{})
+			assert.Nil(t, err)
+			assert.Equal(t, tt.endpoint, endpoint.URL)
+			_, err = NewEndpointResolver(kinesis.ServiceID, "", tt.region).ResolveEndpoint(kinesis.ServiceID, tt.region)
+			assert.NotNil(t, err)
+			endpoint, err = NewEndpointResolver(kinesis.ServiceID, "https://vpce.example.com", tt.region).ResolveEndpoint(kinesis.ServiceID, tt.region)
+			assert.Nil(t, err)
+			assert.Equal(t, aws.Endpoint{PartitionID: tt.partition, URL: "https://vpce.example.com", SigningRegion: tt.region}, endpoint)
+		})
+	}
+
+	_, _, err := ParseStreamARN("arn:aws:dynamodb:us-west-2:123456789012:table/stream")
+	assert.NotNil(t, err)
+}
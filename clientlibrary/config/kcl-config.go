@@ -37,11 +37,15 @@
 package config
 
 import (
+	"context"
 	"log"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
 	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
 	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/utils"
 	"github.com/vmware/vmware-go-kcl-v2/logger"
@@ -65,12 +69,17 @@ func NewKinesisClientLibConfigWithCredentials(applicationName, streamName, regio
 	checkIsValueNotEmpty("ApplicationName", applicationName)
 	checkIsValueNotEmpty("StreamName", streamName)
 	checkIsValueNotEmpty("RegionName", regionName)
+	return newDefaultConfig(applicationName, streamName, regionName, workerID, kinesisCreds, dynamodbCreds)
+}
 
-	if empty(workerID) {
-		workerID = utils.MustNewUUID()
+// newDefaultConfig populates the KCL configuration with default values, leaving the required fields unchecked.
+func newDefaultConfig(applicationName, streamName, regionName, workerID string,
+	kinesisCreds, dynamodbCreds aws.CredentialsProvider) *KinesisClientLibConfiguration {
+	workerIDGenerated := empty(workerID)
+	if workerIDGenerated {
+		workerID = utils.NewRandomID()
 	}
 
-	// populate the KCL configuration with default values
 	return &KinesisClientLibConfiguration{
 		ApplicationName:                                  applicationName,
 		KinesisCredentials:                               kinesisCreds,
@@ -104,6 +113,54 @@ func NewKinesisClientLibConfigWithCredentials(applicationName, streamName, regio
 		LeaseSyncingTimeIntervalMillis:                   DefaultLeaseSyncingIntervalMillis,
 		LeaseRefreshWaitTime:                             DefaultLeaseRefreshWaitTime,
 		MaxRetryCount:                                    DefaultMaxRetryCount,
+		ShardMetadataCacheTTLMillis:                      DefaultShardMetadataCacheTTLMillis,
+		ProcessingDeadlineMarginMillis:                   DefaultProcessingDeadlineMarginMillis,
+		MinBatchRecords:                                  DefaultMinBatchRecords,
+		MaxBatchWaitMillis:                               DefaultMaxBatchWaitMillis,
+		BlockOnTPSExceeded:                               DefaultBlockOnTPSExceeded,
+		SubscriptionRenewalMillis:                        DefaultSubscriptionRenewalMillis,
+		ClockSkewToleranceMillis:                         DefaultClockSkewToleranceMillis,
+		MaxWorkerLifetimeMillis:                          DefaultMaxWorkerLifetimeMillis,
+		UnknownLagPolicy:                                 DefaultUnknownLagPolicy,
+		DecodeErrorPolicy:                                DefaultDecodeErrorPolicy,
+		MaxDecodeErrorsPerBatch:                          DefaultMaxDecodeErrorsPerBatch,
+		MaxConsecutiveEmptyPollsBeforeRelease:            DefaultMaxConsecutiveEmptyPollsBeforeRelease,
+		IDGenerator:                                      utils.NewRandomID,
+		workerIDGenerated:                                workerIDGenerated,
+		HTTPMaxIdleConns:                                 DefaultHTTPMaxIdleConns,
+		HTTPMaxIdleConnsPerHost:                          DefaultHTTPMaxIdleConnsPerHost,
+		HTTPIdleConnTimeoutMillis:                        DefaultHTTPIdleConnTimeoutMillis,
+		ThroughputExceededBackoff:                        DefaultThroughputExceededBackoff,
+		KMSThrottlingBackoff:                             DefaultKMSThrottlingBackoff,
+		GetRecordsTimeoutBackoff:                         DefaultGetRecordsTimeoutBackoff,
+		ProcessorCreateBackoff:                           DefaultProcessorCreateBackoff,
+		MaxInitRetries:                                   DefaultMaxInitRetries,
+		HeartbeatIntervalMillis:                          DefaultHeartbeatIntervalMillis,
+		SlidingWindowTPSLimit:                            DefaultSlidingWindowTPSLimit,
+		TouchCheckpointOnIdle:                            DefaultTouchCheckpointOnIdle,
+		TouchCheckpointIntervalMillis:                    DefaultTouchCheckpointIntervalMillis,
+		CoordinateSelfOwnedParentShards:                  DefaultCoordinateSelfOwnedParentShards,
+		ShardIteratorRefreshMillis:                       DefaultShardIteratorRefreshMillis,
+		LeaseVerificationGapMillis:                       DefaultLeaseVerificationGapMillis,
+		MaxUnackedRecords:                                DefaultMaxUnackedRecords,
+		RejoinOnLeaseLoss:                                DefaultRejoinOnLeaseLoss,
+		ParentShardWaitTimeoutMillis:                     DefaultParentShardWaitTimeoutMillis,
+		ParentShardTimeoutPolicy:                         DefaultParentShardTimeoutPolicy,
+		AdaptiveMaxRecords:                               DefaultAdaptiveMaxRecords,
+		CleanupOrphanedLeases:                            DefaultCleanupOrphanedLeases,
+		OrphanedLeaseMinSyncs:                            DefaultOrphanedLeaseMinSyncs,
+		CheckpointRenewsLease:                            DefaultCheckpointRenewsLease,
+		LeaseTableScanSegments:                           DefaultLeaseTableScanSegments,
+		VerifyRecordOrdering:                             DefaultVerifyRecordOrdering,
+		CorruptCheckpointPolicy:                          DefaultCorruptCheckpointPolicy,
+		FanOutThrottleThreshold:                          DefaultFanOutThrottleThreshold,
+		FanOutThrottleWindowMillis:                       DefaultFanOutThrottleWindowMillis,
+		ErrorLogSummaryIntervalMillis:                    DefaultErrorLogSummaryIntervalMillis,
+		GetRecordsBudgetWindowMillis:                     DefaultGetRecordsBudgetWindowMillis,
+		ListShardsExpiredTokenRetries:                    DefaultListShardsExpiredTokenRetries,
+		GetRecordsTimeoutMillis:                          DefaultGetRecordsTimeoutMillis,
+		MaxProcessorCreateRetries:                        DefaultMaxProcessorCreateRetries,
+		StreamStatusPolicy:                               DefaultStreamStatusPolicy,
 		Logger:                                           logger.GetDefaultLogger(),
 	}
 }
@@ -120,6 +177,20 @@ func (c *KinesisClientLibConfiguration) WithDynamoDBEndpoint(dynamoDBEndpoint st
 	return c
 }
 
+// WithCredentialsRefresh sets the callback supplying the credentials of both the Kinesis and the DynamoDB clients,
+// for short-lived credentials issued by a custom source. The credentials are cached until they expire.
+func (c *KinesisClientLibConfiguration) WithCredentialsRefresh(refresh func(ctx context.Context) (aws.Credentials, error)) *KinesisClientLibConfiguration {
+	if refresh == nil {
+		// There is no point to continue for incorrect configuration. Fail fast!
+		log.Panicf("Non-nil value expected for CredentialsRefresh")
+	}
+	c.CredentialsRefresh = refresh
+	creds := aws.NewCredentialsCache(c.CredentialsRefresh)
+	c.KinesisCredentials = creds
+	c.DynamoDBCredentials = creds
+	return c
+}
+
 // WithTableName to provide alternative lease table in DynamoDB
 func (c *KinesisClientLibConfiguration) WithTableName(tableName string) *KinesisClientLibConfiguration {
 	c.TableName = tableName
@@ -132,6 +203,8 @@ func (c *KinesisClientLibConfiguration) WithInitialPositionInStream(initialPosit
 	return c
 }
 
+// WithTimestampAtInitialPositionInStream starts the shards without checkpoint at the records written at or after the
+// timestamp, e.g. to replay a known window after an outage. The shards with a checkpoint resume from it.
 func (c *KinesisClientLibConfiguration) WithTimestampAtInitialPositionInStream(timestamp *time.Time) *KinesisClientLibConfiguration {
 	c.InitialPositionInStream = AT_TIMESTAMP
 	c.InitialPositionInStreamExtended = *newInitialPositionAtTimestamp(timestamp)
@@ -276,3 +349,587 @@ func (c *KinesisClientLibConfiguration) WithLeaseSyncingIntervalMillis(leaseSync
 	c.LeaseSyncingTimeIntervalMillis = leaseSyncingIntervalMillis
 	return c
 }
+
+// WithShardMetadataCacheTTLMillis sets how long shard metadata is cached before being re-read from Kinesis.
+func (c *KinesisClientLibConfiguration) WithShardMetadataCacheTTLMillis(shardMetadataCacheTTLMillis int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("ShardMetadataCacheTTLMillis", shardMetadataCacheTTLMillis)
+	c.ShardMetadataCacheTTLMillis = shardMetadataCacheTTLMillis
+	return c
+}
+
+// WithShardFilter only leases the shards accepted by the filter, e.g. a HashKeyRangeFilter covering
+// the key space of a subset of tenants.
+func (c *KinesisClientLibConfiguration) WithShardFilter(filter ShardFilter) *KinesisClientLibConfiguration {
+	c.ShardFilter = filter
+	return c
+}
+
+// WithPauseController stops polling the shards while the controller reports paused, e.g. with a PauseSwitch paused
+// during an outage of the downstream sink.
+func (c *KinesisClientLibConfiguration) WithPauseController(controller PauseController) *KinesisClientLibConfiguration {
+	c.PauseController = controller
+	return c
+}
+
+// WithProcessingDeadlineMarginMillis sets the safety margin before lease expiry at which processing is asked to stop.
+func (c *KinesisClientLibConfiguration) WithProcessingDeadlineMarginMillis(processingDeadlineMarginMillis int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("ProcessingDeadlineMarginMillis", processingDeadlineMarginMillis)
+	c.ProcessingDeadlineMarginMillis = processingDeadlineMarginMillis
+	return c
+}
+
+// WithMinBatchRecords buffers records across polls until at least minBatchRecords are available.
+func (c *KinesisClientLibConfiguration) WithMinBatchRecords(minBatchRecords int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("MinBatchRecords", minBatchRecords)
+	c.MinBatchRecords = minBatchRecords
+	return c
+}
+
+// WithMaxBatchWaitMillis sets how long records are buffered at most while waiting for MinBatchRecords.
+func (c *KinesisClientLibConfiguration) WithMaxBatchWaitMillis(maxBatchWaitMillis int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("MaxBatchWaitMillis", maxBatchWaitMillis)
+	c.MaxBatchWaitMillis = maxBatchWaitMillis
+	return c
+}
+
+// WithBlockOnTPSExceeded makes the polling consumer wait for the rate limit window to reset instead of failing the call.
+func (c *KinesisClientLibConfiguration) WithBlockOnTPSExceeded(block bool) *KinesisClientLibConfiguration {
+	c.BlockOnTPSExceeded = block
+	return c
+}
+
+// WithSubscriptionRenewalMillis sets how often the enhanced fan-out subscription to a shard is renewed.
+func (c *KinesisClientLibConfiguration) WithSubscriptionRenewalMillis(subscriptionRenewalMillis int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("SubscriptionRenewalMillis", subscriptionRenewalMillis)
+	if subscriptionRenewalMillis >= 300000 {
+		log.Panicf("SubscriptionRenewalMillis must be below the 5 minutes subscription lifetime, actual: %v", subscriptionRenewalMillis)
+	}
+	c.SubscriptionRenewalMillis = subscriptionRenewalMillis
+	return c
+}
+
+// WithCheckpointEvents publishes every committed checkpoint to the given channel. A buffered channel should be
+// used, as events are dropped rather than blocking checkpointing when the channel is full.
+func (c *KinesisClientLibConfiguration) WithCheckpointEvents(events chan<- CheckpointEvent) *KinesisClientLibConfiguration {
+	c.CheckpointEvents = events
+	return c
+}
+
+// WithClockSkewToleranceMillis sets the tolerated clock skew between workers when comparing lease timeouts.
+func (c *KinesisClientLibConfiguration) WithClockSkewToleranceMillis(millis int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("ClockSkewToleranceMillis", millis)
+	c.ClockSkewToleranceMillis = millis
+	return c
+}
+
+// WithMaxWorkerLifetimeMillis sets the time after which the worker shuts itself down gracefully.
+func (c *KinesisClientLibConfiguration) WithMaxWorkerLifetimeMillis(millis int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("MaxWorkerLifetimeMillis", millis)
+	c.MaxWorkerLifetimeMillis = millis
+	return c
+}
+
+// WithUnknownLagPolicy sets what to do after an empty GetRecords response without MillisBehindLatest.
+func (c *KinesisClientLibConfiguration) WithUnknownLagPolicy(policy UnknownLagPolicy) *KinesisClientLibConfiguration {
+	c.UnknownLagPolicy = policy
+	return c
+}
+
+// WithDecodeErrorPolicy sets what to do with a record which cannot be decoded.
+func (c *KinesisClientLibConfiguration) WithDecodeErrorPolicy(policy DecodeErrorPolicy) *KinesisClientLibConfiguration {
+	c.DecodeErrorPolicy = policy
+	return c
+}
+
+// WithDecodeErrorDeadLetter hands the records which cannot be decoded over to deadLetter, setting the
+// DecodeErrorPolicy to DeadLetterOnDecodeError.
+func (c *KinesisClientLibConfiguration) WithDecodeErrorDeadLetter(deadLetter func(shardID string, record types.Record, err error)) *KinesisClientLibConfiguration {
+	if deadLetter == nil {
+		log.Panic("DecodeErrorDeadLetter cannot be nil")
+	}
+	c.DecodeErrorPolicy = DeadLetterOnDecodeError
+	c.DecodeErrorDeadLetter = deadLetter
+	return c
+}
+
+// WithRecordValidator validates every user record before its delivery. The records failing validation are handled
+// according to DecodeErrorPolicy.
+func (c *KinesisClientLibConfiguration) WithRecordValidator(validator func(record types.Record) error) *KinesisClientLibConfiguration {
+	if validator == nil {
+		log.Panic("RecordValidator cannot be nil")
+	}
+	c.RecordValidator = validator
+	return c
+}
+
+// WithMaxDecodeErrorsPerBatch sets the number of records of a batch which may fail to be decoded before the shard is
+// failed.
+func (c *KinesisClientLibConfiguration) WithMaxDecodeErrorsPerBatch(maxErrors int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("MaxDecodeErrorsPerBatch", maxErrors)
+	c.MaxDecodeErrorsPerBatch = maxErrors
+	return c
+}
+
+// WithEnhancedMonitoring enables shard-level enhanced monitoring of the stream for the given metrics, or
+// IncomingBytes and IteratorAgeMilliseconds when none is given.
+// For more info see: https://docs.aws.amazon.com/streams/latest/dev/monitoring-with-cloudwatch.html#kinesis-metrics-shard
+func (c *KinesisClientLibConfiguration) WithEnhancedMonitoring(shardLevelMetrics ...string) *KinesisClientLibConfiguration {
+	c.EnableEnhancedMonitoring = true
+	c.ShardLevelMetrics = shardLevelMetrics
+	return c
+}
+
+// WithMaxConsecutiveEmptyPollsBeforeRelease sets the number of consecutive empty polls after which the lease on a shard is
+// released.
+func (c *KinesisClientLibConfiguration) WithMaxConsecutiveEmptyPollsBeforeRelease(polls int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("MaxConsecutiveEmptyPollsBeforeRelease", polls)
+	c.MaxConsecutiveEmptyPollsBeforeRelease = polls
+	return c
+}
+
+// WithIDGenerator sets the function generating unique identifiers, e.g. to make them deterministic in tests or to
+// align them with a tracing system. A worker ID generated because none was given is generated again with it.
+func (c *KinesisClientLibConfiguration) WithIDGenerator(generator utils.IDGenerator) *KinesisClientLibConfiguration {
+	if generator == nil {
+		log.Panic("IDGenerator cannot be nil")
+	}
+	c.IDGenerator = generator
+	if c.workerIDGenerated {
+		c.WorkerID = generator()
+	}
+	return c
+}
+
+// WithCallProcessRecordsOnShardEnd delivers a final, empty, batch with IsShardEnd set when a shard ends.
+func (c *KinesisClientLibConfiguration) WithCallProcessRecordsOnShardEnd(callProcessRecordsOnShardEnd bool) *KinesisClientLibConfiguration {
+	c.CallProcessRecordsOnShardEnd = callProcessRecordsOnShardEnd
+	return c
+}
+
+// WithHTTPMaxIdleConns sets the maximum number of idle connections of the HTTP client used by the SDK clients.
+func (c *KinesisClientLibConfiguration) WithHTTPMaxIdleConns(maxIdleConns int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("HTTPMaxIdleConns", maxIdleConns)
+	c.HTTPMaxIdleConns = maxIdleConns
+	return c
+}
+
+// WithHTTPMaxIdleConnsPerHost sets the maximum number of idle connections per host of the HTTP client used by the SDK
+// clients.
+func (c *KinesisClientLibConfiguration) WithHTTPMaxIdleConnsPerHost(maxIdleConnsPerHost int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("HTTPMaxIdleConnsPerHost", maxIdleConnsPerHost)
+	c.HTTPMaxIdleConnsPerHost = maxIdleConnsPerHost
+	return c
+}
+
+// WithHTTPIdleConnTimeoutMillis sets the time an idle connection of the HTTP client used by the SDK clients is kept
+// open.
+func (c *KinesisClientLibConfiguration) WithHTTPIdleConnTimeoutMillis(idleConnTimeoutMillis int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("HTTPIdleConnTimeoutMillis", idleConnTimeoutMillis)
+	c.HTTPIdleConnTimeoutMillis = idleConnTimeoutMillis
+	return c
+}
+
+// WithBatchedLeaseRenewal renews the leases held by the worker with batched writes.
+func (c *KinesisClientLibConfiguration) WithBatchedLeaseRenewal(enableBatchedLeaseRenewal bool) *KinesisClientLibConfiguration {
+	c.EnableBatchedLeaseRenewal = enableBatchedLeaseRenewal
+	return c
+}
+
+// WithOnGetRecordsResponse sets the hook observing the raw GetRecords responses.
+func (c *KinesisClientLibConfiguration) WithOnGetRecordsResponse(onGetRecordsResponse func(shardID string, resp *kinesis.GetRecordsOutput)) *KinesisClientLibConfiguration {
+	c.OnGetRecordsResponse = onGetRecordsResponse
+	return c
+}
+
+// WithMaxInitRetries sets the max retry count of a failed record processor initialization.
+func (c *KinesisClientLibConfiguration) WithMaxInitRetries(maxInitRetries int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("MaxInitRetries", maxInitRetries)
+	c.MaxInitRetries = maxInitRetries
+	return c
+}
+
+// WithHeartbeatIntervalMillis sets the interval between two heartbeats of the worker.
+func (c *KinesisClientLibConfiguration) WithHeartbeatIntervalMillis(heartbeatIntervalMillis int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("HeartbeatIntervalMillis", heartbeatIntervalMillis)
+	c.HeartbeatIntervalMillis = heartbeatIntervalMillis
+	return c
+}
+
+// WithMaxConcurrentGetRecords caps the number of GetRecords calls in flight across the shards of the worker.
+func (c *KinesisClientLibConfiguration) WithMaxConcurrentGetRecords(maxConcurrentGetRecords int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("MaxConcurrentGetRecords", maxConcurrentGetRecords)
+	c.MaxConcurrentGetRecords = maxConcurrentGetRecords
+	return c
+}
+
+// WithPrioritizePollingByLag polls the most behind shards first under MaxConcurrentGetRecords.
+func (c *KinesisClientLibConfiguration) WithPrioritizePollingByLag(prioritizePollingByLag bool) *KinesisClientLibConfiguration {
+	c.PrioritizePollingByLag = prioritizePollingByLag
+	return c
+}
+
+// WithMinLeaseRenewalIntervalMillis sets the minimum interval between two renewals of a lease.
+func (c *KinesisClientLibConfiguration) WithMinLeaseRenewalIntervalMillis(minLeaseRenewalIntervalMillis int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("MinLeaseRenewalIntervalMillis", minLeaseRenewalIntervalMillis)
+	c.MinLeaseRenewalIntervalMillis = minLeaseRenewalIntervalMillis
+	return c
+}
+
+// WithIdleTimeBetweenReadsJitter spreads the idle time between reads by up to the given fraction, between 0 and 1.
+func (c *KinesisClientLibConfiguration) WithIdleTimeBetweenReadsJitter(idleTimeBetweenReadsJitter float64) *KinesisClientLibConfiguration {
+	if idleTimeBetweenReadsJitter < 0 || idleTimeBetweenReadsJitter > 1 {
+		// There is no point to continue for incorrect configuration. Fail fast!
+		log.Panicf("Value between 0 and 1 expected for IdleTimeBetweenReadsJitter, actual: %v", idleTimeBetweenReadsJitter)
+	}
+	c.IdleTimeBetweenReadsJitter = idleTimeBetweenReadsJitter
+	return c
+}
+
+// WithStartingSequenceNumber starts consuming the shard at the given sequence and sub-sequence numbers, unless the
+// shard has been checkpointed already.
+func (c *KinesisClientLibConfiguration) WithStartingSequenceNumber(shardID string, sequenceNumber kcl.ExtendedSequenceNumber) *KinesisClientLibConfiguration {
+	checkIsValueNotEmpty("ShardID", shardID)
+	checkIsValueNotEmpty("SequenceNumber", aws.ToString(sequenceNumber.SequenceNumber))
+	if c.StartingSequenceNumbers == nil {
+		c.StartingSequenceNumbers = make(map[string]kcl.ExtendedSequenceNumber)
+	}
+	c.StartingSequenceNumbers[shardID] = sequenceNumber
+	return c
+}
+
+// WithCheckpointFinalRecordsAtShardEnd checkpoints the final records of a shard before it is ended.
+func (c *KinesisClientLibConfiguration) WithCheckpointFinalRecordsAtShardEnd(checkpointFinalRecordsAtShardEnd bool) *KinesisClientLibConfiguration {
+	c.CheckpointFinalRecordsAtShardEnd = checkpointFinalRecordsAtShardEnd
+	return c
+}
+
+// WithThroughputExceededBackoff sets the backoff after GetRecords exceeded the provisioned throughput.
+func (c *KinesisClientLibConfiguration) WithThroughputExceededBackoff(backoff BackoffPolicy) *KinesisClientLibConfiguration {
+	checkIsBackoffPolicyValid("ThroughputExceededBackoff", backoff)
+	c.ThroughputExceededBackoff = backoff
+	return c
+}
+
+// WithKMSThrottlingBackoff sets the backoff after GetRecords was throttled by KMS.
+func (c *KinesisClientLibConfiguration) WithKMSThrottlingBackoff(backoff BackoffPolicy) *KinesisClientLibConfiguration {
+	checkIsBackoffPolicyValid("KMSThrottlingBackoff", backoff)
+	c.KMSThrottlingBackoff = backoff
+	return c
+}
+
+// WithGetRecordsTimeoutBackoff sets the backoff after a GetRecords call timed out.
+func (c *KinesisClientLibConfiguration) WithGetRecordsTimeoutBackoff(backoff BackoffPolicy) *KinesisClientLibConfiguration {
+	checkIsBackoffPolicyValid("GetRecordsTimeoutBackoff", backoff)
+	c.GetRecordsTimeoutBackoff = backoff
+	return c
+}
+
+// WithProcessorCreateBackoff sets the backoff before retrying a shard whose record processor could not be created.
+func (c *KinesisClientLibConfiguration) WithProcessorCreateBackoff(backoff BackoffPolicy) *KinesisClientLibConfiguration {
+	checkIsBackoffPolicyValid("ProcessorCreateBackoff", backoff)
+	c.ProcessorCreateBackoff = backoff
+	return c
+}
+
+// WithSlidingWindowTPSLimit limits the GetRecords calls of the polling consumer over a rolling second.
+func (c *KinesisClientLibConfiguration) WithSlidingWindowTPSLimit(slidingWindowTPSLimit bool) *KinesisClientLibConfiguration {
+	c.SlidingWindowTPSLimit = slidingWindowTPSLimit
+	return c
+}
+
+// WithReshardingSyncIntervalMillis syncs the shards after resharding, at most once per interval.
+func (c *KinesisClientLibConfiguration) WithReshardingSyncIntervalMillis(reshardingSyncIntervalMillis int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("ReshardingSyncIntervalMillis", reshardingSyncIntervalMillis)
+	c.ReshardingSyncIntervalMillis = reshardingSyncIntervalMillis
+	return c
+}
+
+// WithMaxReshardingLeaseWritesPerSecond caps the lease table writes caused by resharding.
+func (c *KinesisClientLibConfiguration) WithMaxReshardingLeaseWritesPerSecond(maxReshardingLeaseWritesPerSecond int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("MaxReshardingLeaseWritesPerSecond", maxReshardingLeaseWritesPerSecond)
+	c.MaxReshardingLeaseWritesPerSecond = maxReshardingLeaseWritesPerSecond
+	return c
+}
+
+// WithTouchCheckpointOnIdle sets whether the lease of an idle shard gets its heartbeat advanced.
+func (c *KinesisClientLibConfiguration) WithTouchCheckpointOnIdle(touchCheckpointOnIdle bool) *KinesisClientLibConfiguration {
+	c.TouchCheckpointOnIdle = touchCheckpointOnIdle
+	return c
+}
+
+// WithTouchCheckpointIntervalMillis sets how often the lease of an idle shard gets its heartbeat advanced.
+func (c *KinesisClientLibConfiguration) WithTouchCheckpointIntervalMillis(touchCheckpointIntervalMillis int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("TouchCheckpointIntervalMillis", touchCheckpointIntervalMillis)
+	c.TouchCheckpointIntervalMillis = touchCheckpointIntervalMillis
+	return c
+}
+
+// WithConsumerPoolSize sets the number of goroutines polling the shards of the worker.
+func (c *KinesisClientLibConfiguration) WithConsumerPoolSize(consumerPoolSize int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("ConsumerPoolSize", consumerPoolSize)
+	c.ConsumerPoolSize = consumerPoolSize
+	return c
+}
+
+// WithCoordinateSelfOwnedParentShards sets whether child shards are signaled the end of the parent shards consumed
+// by the same worker.
+func (c *KinesisClientLibConfiguration) WithCoordinateSelfOwnedParentShards(coordinateSelfOwnedParentShards bool) *KinesisClientLibConfiguration {
+	c.CoordinateSelfOwnedParentShards = coordinateSelfOwnedParentShards
+	return c
+}
+
+// WithShardIteratorRefreshMillis sets the time since the last successful GetRecords call of a shard after which its
+// shard iterator is derived again, to avoid ExpiredIteratorException after long idle periods. It should be lower than
+// the 5 minutes shard iterators are valid for.
+func (c *KinesisClientLibConfiguration) WithShardIteratorRefreshMillis(shardIteratorRefreshMillis int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("ShardIteratorRefreshMillis", shardIteratorRefreshMillis)
+	c.ShardIteratorRefreshMillis = shardIteratorRefreshMillis
+	return c
+}
+
+// WithLeaseVerificationGapMillis sets the unexpected gap between two polls of a shard, e.g. a long GC pause, after
+// which the lease is verified before processing the records read.
+func (c *KinesisClientLibConfiguration) WithLeaseVerificationGapMillis(leaseVerificationGapMillis int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("LeaseVerificationGapMillis", leaseVerificationGapMillis)
+	c.LeaseVerificationGapMillis = leaseVerificationGapMillis
+	return c
+}
+
+// WithMaxUnackedRecords sets the number of records of a shard delivered and not checkpointed yet above which the
+// shard stops being polled until checkpoints catch up.
+func (c *KinesisClientLibConfiguration) WithMaxUnackedRecords(maxUnackedRecords int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("MaxUnackedRecords", maxUnackedRecords)
+	c.MaxUnackedRecords = maxUnackedRecords
+	return c
+}
+
+// WithRejoinOnLeaseLoss reacquires leases right away once the worker lost all of them, instead of waiting for the next
+// shard sync.
+func (c *KinesisClientLibConfiguration) WithRejoinOnLeaseLoss(rejoinOnLeaseLoss bool) *KinesisClientLibConfiguration {
+	c.RejoinOnLeaseLoss = rejoinOnLeaseLoss
+	return c
+}
+
+// WithParentShardWaitTimeoutMillis bounds the wait of a child shard for the end of its parent shard.
+func (c *KinesisClientLibConfiguration) WithParentShardWaitTimeoutMillis(parentShardWaitTimeoutMillis int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("ParentShardWaitTimeoutMillis", parentShardWaitTimeoutMillis)
+	c.ParentShardWaitTimeoutMillis = parentShardWaitTimeoutMillis
+	return c
+}
+
+// WithParentShardTimeoutPolicy sets what to do with a child shard whose parent shard did not end in time.
+func (c *KinesisClientLibConfiguration) WithParentShardTimeoutPolicy(policy ParentShardTimeoutPolicy) *KinesisClientLibConfiguration {
+	c.ParentShardTimeoutPolicy = policy
+	return c
+}
+
+// WithAdaptiveMaxRecords tunes the number of records asked for per GetRecords call to the size of the records.
+func (c *KinesisClientLibConfiguration) WithAdaptiveMaxRecords(adaptiveMaxRecords bool) *KinesisClientLibConfiguration {
+	c.AdaptiveMaxRecords = adaptiveMaxRecords
+	return c
+}
+
+// WithCleanupOrphanedLeases removes the leases of shards which are not in the stream anymore.
+func (c *KinesisClientLibConfiguration) WithCleanupOrphanedLeases(cleanup bool) *KinesisClientLibConfiguration {
+	c.CleanupOrphanedLeases = cleanup
+	return c
+}
+
+// WithOrphanedLeaseMinSyncs sets the number of consecutive shard syncs a shard has to be missing from before its
+// lease is removed with CleanupOrphanedLeases.
+func (c *KinesisClientLibConfiguration) WithOrphanedLeaseMinSyncs(orphanedLeaseMinSyncs int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("OrphanedLeaseMinSyncs", orphanedLeaseMinSyncs)
+	c.OrphanedLeaseMinSyncs = orphanedLeaseMinSyncs
+	return c
+}
+
+// WithCheckpointRenewsLease extends the lease of the shard with every checkpoint.
+func (c *KinesisClientLibConfiguration) WithCheckpointRenewsLease(renew bool) *KinesisClientLibConfiguration {
+	c.CheckpointRenewsLease = renew
+	return c
+}
+
+// WithLeaseTableScanSegments sets the number of segments the lease table is scanned in parallel with.
+func (c *KinesisClientLibConfiguration) WithLeaseTableScanSegments(segments int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("LeaseTableScanSegments", segments)
+	c.LeaseTableScanSegments = segments
+	return c
+}
+
+// WithVerifyRecordOrdering checks that the records of each shard are read in order.
+func (c *KinesisClientLibConfiguration) WithVerifyRecordOrdering(verify bool) *KinesisClientLibConfiguration {
+	c.VerifyRecordOrdering = verify
+	return c
+}
+
+// WithCorruptCheckpointPolicy sets what to do with a shard whose checkpoint is corrupt.
+func (c *KinesisClientLibConfiguration) WithCorruptCheckpointPolicy(policy CorruptCheckpointPolicy) *KinesisClientLibConfiguration {
+	c.CorruptCheckpointPolicy = policy
+	return c
+}
+
+// WithFanOutThrottleThreshold sets the number of throttled GetRecords calls within FanOutThrottleWindowMillis which
+// switch the worker to enhanced fan-out.
+func (c *KinesisClientLibConfiguration) WithFanOutThrottleThreshold(threshold int) *KinesisClientLibConfiguration {
+	c.FanOutThrottleThreshold = threshold
+	return c
+}
+
+// WithFanOutThrottleWindowMillis sets the window the throttled GetRecords calls are counted over.
+func (c *KinesisClientLibConfiguration) WithFanOutThrottleWindowMillis(windowMillis int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("FanOutThrottleWindowMillis", windowMillis)
+	c.FanOutThrottleWindowMillis = windowMillis
+	return c
+}
+
+// WithErrorLogSummaryIntervalMillis coalesces the warnings and errors repeated by a shard consumer within the interval.
+func (c *KinesisClientLibConfiguration) WithErrorLogSummaryIntervalMillis(intervalMillis int) *KinesisClientLibConfiguration {
+	c.ErrorLogSummaryIntervalMillis = intervalMillis
+	return c
+}
+
+// WithEnablePrefetch reads the next records of a shard while the previous ones are processed.
+func (c *KinesisClientLibConfiguration) WithEnablePrefetch(enable bool) *KinesisClientLibConfiguration {
+	c.EnablePrefetch = enable
+	return c
+}
+
+// WithStartAsStandby starts the worker as a warm standby, acquiring no lease until promoted with Worker.Promote.
+func (c *KinesisClientLibConfiguration) WithStartAsStandby(standby bool) *KinesisClientLibConfiguration {
+	c.StartAsStandby = standby
+	return c
+}
+
+// WithEnableStreamGenerations ignores the leases left by an earlier stream with the same name.
+func (c *KinesisClientLibConfiguration) WithEnableStreamGenerations(enable bool) *KinesisClientLibConfiguration {
+	c.EnableStreamGenerations = enable
+	return c
+}
+
+// WithLagThresholdMillis sets the lag over which OnLagThresholdExceeded is called.
+func (c *KinesisClientLibConfiguration) WithLagThresholdMillis(thresholdMillis int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("LagThresholdMillis", thresholdMillis)
+	c.LagThresholdMillis = thresholdMillis
+	return c
+}
+
+// WithLagRecoveryMillis sets the lag under which OnLagRecovered is called, below LagThresholdMillis.
+func (c *KinesisClientLibConfiguration) WithLagRecoveryMillis(recoveryMillis int) *KinesisClientLibConfiguration {
+	c.LagRecoveryMillis = recoveryMillis
+	return c
+}
+
+// WithOnLagThresholdExceeded sets the callback of the shards falling behind LagThresholdMillis.
+func (c *KinesisClientLibConfiguration) WithOnLagThresholdExceeded(onLagThresholdExceeded func(shardID string, millisBehindLatest int64)) *KinesisClientLibConfiguration {
+	c.OnLagThresholdExceeded = onLagThresholdExceeded
+	return c
+}
+
+// WithOnLagRecovered sets the callback of the lagging shards back down to LagRecoveryMillis.
+func (c *KinesisClientLibConfiguration) WithOnLagRecovered(onLagRecovered func(shardID string)) *KinesisClientLibConfiguration {
+	c.OnLagRecovered = onLagRecovered
+	return c
+}
+
+// WithDecodeCloudWatchLogs delivers the log events of the CloudWatch Logs subscription records one by one.
+func (c *KinesisClientLibConfiguration) WithDecodeCloudWatchLogs(decode bool) *KinesisClientLibConfiguration {
+	c.DecodeCloudWatchLogs = decode
+	return c
+}
+
+// WithProcessTimerIntervalMillis sets how often ProcessTimer is invoked on the record processors implementing
+// IRecordProcessorTimer.
+func (c *KinesisClientLibConfiguration) WithProcessTimerIntervalMillis(intervalMillis int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("ProcessTimerIntervalMillis", intervalMillis)
+	c.ProcessTimerIntervalMillis = intervalMillis
+	return c
+}
+
+// WithMaxGetRecordsCalls caps the GetRecords calls of the worker over each GetRecordsBudgetWindowMillis.
+func (c *KinesisClientLibConfiguration) WithMaxGetRecordsCalls(maxCalls int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("MaxGetRecordsCalls", maxCalls)
+	c.MaxGetRecordsCalls = maxCalls
+	return c
+}
+
+// WithGetRecordsBudgetWindowMillis sets the window over which MaxGetRecordsCalls applies.
+func (c *KinesisClientLibConfiguration) WithGetRecordsBudgetWindowMillis(windowMillis int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("GetRecordsBudgetWindowMillis", windowMillis)
+	c.GetRecordsBudgetWindowMillis = windowMillis
+	return c
+}
+
+// WithBackpressureSubscriptionTimeoutMillis sets how long a subscription held back by MaxUnackedRecords is kept open.
+func (c *KinesisClientLibConfiguration) WithBackpressureSubscriptionTimeoutMillis(timeoutMillis int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("BackpressureSubscriptionTimeoutMillis", timeoutMillis)
+	c.BackpressureSubscriptionTimeoutMillis = timeoutMillis
+	return c
+}
+
+// WithListShardsExpiredTokenRetries sets how many times the listing of the shards resumes after an expired pagination
+// token.
+func (c *KinesisClientLibConfiguration) WithListShardsExpiredTokenRetries(retries int) *KinesisClientLibConfiguration {
+	c.ListShardsExpiredTokenRetries = retries
+	return c
+}
+
+// WithGetRecordsTimeoutMillis bounds each GetRecords call.
+func (c *KinesisClientLibConfiguration) WithGetRecordsTimeoutMillis(timeoutMillis int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("GetRecordsTimeoutMillis", timeoutMillis)
+	c.GetRecordsTimeoutMillis = timeoutMillis
+	return c
+}
+
+// WithReportUnackedRecords reports the number of records delivered and not checkpointed yet of every shard.
+func (c *KinesisClientLibConfiguration) WithReportUnackedRecords(report bool) *KinesisClientLibConfiguration {
+	c.ReportUnackedRecords = report
+	return c
+}
+
+// WithReadinessTimeoutMillis reports the worker ready after the timeout, even before its first leases are acquired.
+func (c *KinesisClientLibConfiguration) WithReadinessTimeoutMillis(timeoutMillis int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("ReadinessTimeoutMillis", timeoutMillis)
+	c.ReadinessTimeoutMillis = timeoutMillis
+	return c
+}
+
+// WithShutdownWhenNoOpenShards shuts the worker down once the stream has no open shard left to consume.
+func (c *KinesisClientLibConfiguration) WithShutdownWhenNoOpenShards(shutdown bool) *KinesisClientLibConfiguration {
+	c.ShutdownWhenNoOpenShards = shutdown
+	return c
+}
+
+// WithMaxProcessorCreateRetries sets how many times the worker retries a shard whose record processor could not be
+// created.
+func (c *KinesisClientLibConfiguration) WithMaxProcessorCreateRetries(retries int) *KinesisClientLibConfiguration {
+	c.MaxProcessorCreateRetries = retries
+	return c
+}
+
+// WithShutdownGraceMillis sets how long a record processor shut down with REQUESTED is waited for before the lease on
+// its shard is released.
+func (c *KinesisClientLibConfiguration) WithShutdownGraceMillis(graceMillis int) *KinesisClientLibConfiguration {
+	checkIsValuePositive("ShutdownGraceMillis", graceMillis)
+	c.ShutdownGraceMillis = graceMillis
+	return c
+}
+
+// WithStreamStatusPolicy sets whether the worker starts on a stream in UPDATING status.
+func (c *KinesisClientLibConfiguration) WithStreamStatusPolicy(policy StreamStatusPolicy) *KinesisClientLibConfiguration {
+	c.StreamStatusPolicy = policy
+	return c
+}
+
+// WithMaxConcurrentCheckpoints caps the number of checkpoint writes in flight across the shards of the worker.
+func (c *KinesisClientLibConfiguration) WithMaxConcurrentCheckpoints(maxConcurrentCheckpoints int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("MaxConcurrentCheckpoints", maxConcurrentCheckpoints)
+	c.MaxConcurrentCheckpoints = maxConcurrentCheckpoints
+	return c
+}
+
+// WithMaxRecordsInFlight caps the number of records read and not processed yet across the shards of the worker.
+func (c *KinesisClientLibConfiguration) WithMaxRecordsInFlight(maxRecordsInFlight int) *KinesisClientLibConfiguration {
+	checkIsValueNonNegative("MaxRecordsInFlight", maxRecordsInFlight)
+	c.MaxRecordsInFlight = maxRecordsInFlight
+	return c
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package config
+
+import "sync/atomic"
+
+// PauseController tells the polling consumers to stop reading their shards, e.g. while the downstream sink of the
+// record processors is down. It is consulted before each GetRecords call.
+type PauseController interface {
+	// Paused reports whether reading the shards is paused.
+	Paused() bool
+}
+
+// PauseSwitch is a PauseController paused and resumed by hand. Its zero value is not paused.
+type PauseSwitch struct {
+	paused int32
+}
+
+// Pause stops the polling of the shards, from their next GetRecords call.
+func (s *PauseSwitch) Pause() {
+	atomic.StoreInt32(&s.paused, 1)
+}
+
+// Resume lets the shards be polled again.
+func (s *PauseSwitch) Resume() {
+	atomic.StoreInt32(&s.paused, 0)
+}
+
+// Paused implements PauseController.
+func (s *PauseSwitch) Paused() bool {
+	return atomic.LoadInt32(&s.paused) == 1
+}
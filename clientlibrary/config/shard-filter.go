@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package config
+
+import (
+	"crypto/md5"
+	"math/big"
+)
+
+// ShardFilter decides whether a worker should lease and consume a shard, based on the shard's
+// hash key range. Shards rejected by the filter are never leased by the application.
+type ShardFilter interface {
+	Accept(shardID string, startingHashKey, endingHashKey *big.Int) bool
+}
+
+// HashKeyRange is an inclusive range of 128 bit hash keys.
+type HashKeyRange struct {
+	StartingHashKey *big.Int
+	EndingHashKey   *big.Int
+}
+
+// Overlaps returns true if the range shares at least one hash key with [startingHashKey, endingHashKey].
+func (r HashKeyRange) Overlaps(startingHashKey, endingHashKey *big.Int) bool {
+	return r.StartingHashKey.Cmp(endingHashKey) <= 0 && startingHashKey.Cmp(r.EndingHashKey) <= 0
+}
+
+// HashKeyRangeFilter accepts the shards whose hash key range overlaps at least one of its ranges.
+type HashKeyRangeFilter []HashKeyRange
+
+// Accept implements ShardFilter.
+func (f HashKeyRangeFilter) Accept(_ string, startingHashKey, endingHashKey *big.Int) bool {
+	for _, r := range f {
+		if r.Overlaps(startingHashKey, endingHashKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// HashKeyForPartitionKey returns the hash key Kinesis maps a partition key to, i.e. the MD5 digest
+// of the key read as an unsigned 128 bit integer.
+func HashKeyForPartitionKey(partitionKey string) *big.Int {
+	digest := md5.Sum([]byte(partitionKey))
+	return new(big.Int).SetBytes(digest[:])
+}
+
+// NewPartitionKeyFilter returns a filter accepting only the shards which can receive records put
+// with one of the given partition keys.
+//
+// Kinesis hashes the whole partition key, so the keys sharing a prefix are spread over the entire
+// key space. Tenants identified by a key prefix should either enumerate their partition keys here
+// or be routed by the producer with an explicit hash key, and filtered with a HashKeyRangeFilter.
+func NewPartitionKeyFilter(partitionKeys ...string) HashKeyRangeFilter {
+	filter := make(HashKeyRangeFilter, 0, len(partitionKeys))
+	for _, key := range partitionKeys {
+		hashKey := HashKeyForPartitionKey(key)
+		filter = append(filter, HashKeyRange{StartingHashKey: hashKey, EndingHashKey: hashKey})
+	}
+	return filter
+}
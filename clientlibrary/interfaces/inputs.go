@@ -37,6 +37,7 @@
 package interfaces
 
 import (
+	"context"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -86,6 +87,10 @@ type (
 
 		// The last extended sequence number that was successfully checkpointed by the previous record processor.
 		ExtendedSequenceNumber *ExtendedSequenceNumber
+
+		// The range of hash keys of the shard, i.e. the part of the key space the record processor is responsible for.
+		// Nil when the shard metadata could not be read.
+		HashKeyRange *types.HashKeyRange
 	}
 
 	ProcessRecordsInput struct {
@@ -103,6 +108,23 @@ type (
 
 		// How far behind this batch of records was when received from Kinesis.
 		MillisBehindLatest int64
+
+		// Ctx is canceled when the lease on the shard is about to expire. Long-running processing should
+		// wrap up and avoid checkpointing once it is done, as another worker may take over the shard.
+		Ctx context.Context
+
+		// IsShardEnd is set on the final batch, without record, delivered when the shard has been completely read
+		// and CallProcessRecordsOnShardEnd is enabled. The RecordProcessor can flush its state and checkpoint
+		// SHARD_END (Checkpoint(nil)) before being shut down with TERMINATE.
+		IsShardEnd bool
+	}
+
+	ProcessTimerInput struct {
+		// A checkpointer that the RecordProcessor can use to checkpoint its progress.
+		Checkpointer IRecordProcessorCheckpointer
+
+		// How long since ProcessTimer was last invoked, or since the RecordProcessor was initialized.
+		SinceLastTimer time.Duration
 	}
 
 	ShutdownInput struct {
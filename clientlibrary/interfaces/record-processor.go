@@ -78,6 +78,35 @@ type (
 		Shutdown(shutdownInput *ShutdownInput)
 	}
 
+	// IRecordProcessorInitializer is optionally implemented by an IRecordProcessor whose initialization can fail, for
+	// instance on a transient connection error. InitializeWithError is then invoked instead of Initialize, and retried
+	// up to MaxInitRetries times before the lease on the shard is released for another worker to try.
+	IRecordProcessorInitializer interface {
+		// InitializeWithError
+		/*
+		 * Invoked by the Amazon Kinesis Client Library before data records are delivered to the RecordProcessor instance
+		 * (via processRecords).
+		 *
+		 * @param initializationInput Provides information related to initialization
+		 * @return error if the record processor could not be initialized
+		 */
+		InitializeWithError(initializationInput *InitializationInput) error
+	}
+
+	// IRecordProcessorTimer is optionally implemented by an IRecordProcessor which accumulates state across batches,
+	// e.g. windowed aggregates. ProcessTimer is invoked every ProcessTimerIntervalMillis, whether records keep coming
+	// or the shard is idle, from the same goroutine as ProcessRecords.
+	IRecordProcessorTimer interface {
+		// ProcessTimer
+		/*
+		 * Invoked by the Amazon Kinesis Client Library on the configured interval, between the deliveries of records.
+		 * The RecordProcessor can flush its state and checkpoint its progress.
+		 *
+		 * @param processTimerInput Provides capabilities (eg checkpointing) to flush the state of the processor.
+		 */
+		ProcessTimer(processTimerInput *ProcessTimerInput)
+	}
+
 	// IRecordProcessorFactory is interface for creating IRecordProcessor. Each Worker can have multiple threads
 	// for processing shard. Client can choose either creating one processor per shard or sharing them.
 	IRecordProcessorFactory interface {
@@ -90,4 +119,19 @@ type (
 		 */
 		CreateProcessor() IRecordProcessor
 	}
+
+	// IShardRecordProcessorFactory is implemented by the factories creating the record processor of a given shard, which
+	// can fail, e.g. on resource exhaustion. The worker then uses it instead of CreateProcessor.
+	IShardRecordProcessorFactory interface {
+
+		// CreateShardProcessor
+		/*
+		 * Returns a record processor to be used for processing data records for a (assigned) shard.
+		 *
+		 * @param shardID The ID of the shard the worker acquired the lease on.
+		 * @return Returns a processor object, or an error if it cannot be created. The worker then releases the lease on
+		 *         the shard and retries later, see ProcessorCreateBackoff.
+		 */
+		CreateShardProcessor(shardID string) (IRecordProcessor, error)
+	}
 )
@@ -31,6 +31,9 @@ package cloudwatch
 
 import (
 	"context"
+	"fmt"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -38,14 +41,24 @@ import (
 	cwatch "github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
 	"github.com/vmware/vmware-go-kcl-v2/logger"
 )
 
 // DefaultCloudwatchMetricsBufferDuration Buffer metrics for at most this long before publishing to CloudWatch.
 const DefaultCloudwatchMetricsBufferDuration = 10 * time.Second
 
+// namespacePattern matches the characters CloudWatch accepts in a custom namespace.
+var namespacePattern = regexp.MustCompile(`^[0-9A-Za-z.\-_/#: ]{1,255}$`)
+
+// cloudWatchAPI is the subset of the CloudWatch client used for publishing metrics.
+type cloudWatchAPI interface {
+	PutMetricData(ctx context.Context, params *cwatch.PutMetricDataInput, optFns ...func(*cwatch.Options)) (*cwatch.PutMetricDataOutput, error)
+}
+
 type MonitoringService struct {
 	appName     string
+	namespace   string
 	streamName  string
 	workerID    string
 	region      string
@@ -55,10 +68,11 @@ type MonitoringService struct {
 	// control how often to publish to CloudWatch
 	bufferDuration time.Duration
 
-	stop         *chan struct{}
-	waitGroup    *sync.WaitGroup
-	svc          *cwatch.Client
-	shardMetrics *sync.Map
+	stop          *chan struct{}
+	waitGroup     *sync.WaitGroup
+	svc           cloudWatchAPI
+	shardMetrics  *sync.Map
+	workerMetrics workerMetrics
 }
 
 type cloudWatchMetrics struct {
@@ -71,6 +85,28 @@ type cloudWatchMetrics struct {
 	leaseRenewals      int64
 	getRecordsTime     []float64
 	processRecordsTime []float64
+	timeToFirstRecord  []float64
+	// shard starts by shard iterator type
+	starts                    map[string]int64
+	checkpoints               int64
+	checkpointFailures        int64
+	decodeErrors              int64
+	checkpointsThrottled      int64
+	processorCreateFailures   int64
+	getRecordsBudgetExhausted int64
+	corruptCheckpoints        int64
+	orderViolations           int64
+	unackedRecords            []float64
+}
+
+// workerMetrics holds the metrics which are not tied to a shard.
+type workerMetrics struct {
+	sync.Mutex
+
+	lifetimeShutdowns int64
+	rejoins           int64
+	fanOutUpgrades    int64
+	reshardingEvents  []float64
 }
 
 // NewMonitoringService returns a Monitoring service publishing metrics to CloudWatch.
@@ -89,11 +125,39 @@ func NewMonitoringServiceWithOptions(region string, creds aws.CredentialsProvide
 	}
 }
 
+// WithMetricsNamespace publishes metrics under the given CloudWatch namespace instead of the
+// application name, so that several environments (dev/stage/prod) of the same application
+// do not collide. The namespace is validated in Init.
+func (cw *MonitoringService) WithMetricsNamespace(namespace string) *MonitoringService {
+	cw.namespace = namespace
+	return cw
+}
+
+// ForStream returns a monitoring service publishing the metrics of the given stream with the same options, for a
+// worker of that stream. It buffers and publishes its metrics on its own, so the shards of different streams never mix.
+func (cw *MonitoringService) ForStream(streamName string) metrics.MonitoringService {
+	return &MonitoringService{
+		namespace:      cw.namespace,
+		streamName:     streamName,
+		region:         cw.region,
+		credentials:    cw.credentials,
+		logger:         cw.logger,
+		bufferDuration: cw.bufferDuration,
+	}
+}
+
 func (cw *MonitoringService) Init(appName, streamName, workerID string) error {
 	cw.appName = appName
 	cw.streamName = streamName
 	cw.workerID = workerID
 
+	// only a namespace set with WithMetricsNamespace is validated, the application name is used as is
+	if cw.namespace == "" {
+		cw.namespace = appName
+	} else if err := validateNamespace(cw.namespace); err != nil {
+		return err
+	}
+
 	cfg := &aws.Config{Region: cw.region}
 	cfg.Credentials = cw.credentials
 
@@ -201,6 +265,62 @@ func (cw *MonitoringService) flushShard(shard string, metric *cloudWatchMetrics)
 			Timestamp:  &metricTimestamp,
 			Value:      aws.Float64(float64(metric.leasesHeld)),
 		},
+		{
+			Dimensions: defaultDimensions,
+			MetricName: aws.String("Checkpoint.Success"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(metric.checkpoints)),
+		},
+		{
+			Dimensions: defaultDimensions,
+			MetricName: aws.String("Checkpoint.Failure"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(metric.checkpointFailures)),
+		},
+		{
+			Dimensions: defaultDimensions,
+			MetricName: aws.String("DecodeError"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(metric.decodeErrors)),
+		},
+		{
+			Dimensions: defaultDimensions,
+			MetricName: aws.String("CheckpointThrottled"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(metric.checkpointsThrottled)),
+		},
+		{
+			Dimensions: defaultDimensions,
+			MetricName: aws.String("ProcessorCreateFailed"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(metric.processorCreateFailures)),
+		},
+		{
+			Dimensions: defaultDimensions,
+			MetricName: aws.String("GetRecordsBudgetExhausted"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(metric.getRecordsBudgetExhausted)),
+		},
+		{
+			Dimensions: defaultDimensions,
+			MetricName: aws.String("CorruptCheckpoint"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(metric.corruptCheckpoints)),
+		},
+		{
+			Dimensions: defaultDimensions,
+			MetricName: aws.String("RecordOrderViolation"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(metric.orderViolations)),
+		},
 	}
 
 	if len(metric.behindLatestMillis) > 0 {
@@ -217,6 +337,20 @@ func (cw *MonitoringService) flushShard(shard string, metric *cloudWatchMetrics)
 			}})
 	}
 
+	if len(metric.unackedRecords) > 0 {
+		data = append(data, types.MetricDatum{
+			Dimensions: defaultDimensions,
+			MetricName: aws.String("UnackedRecords"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			StatisticValues: &types.StatisticSet{
+				SampleCount: aws.Float64(float64(len(metric.unackedRecords))),
+				Sum:         sumFloat64(metric.unackedRecords),
+				Maximum:     maxFloat64(metric.unackedRecords),
+				Minimum:     minFloat64(metric.unackedRecords),
+			}})
+	}
+
 	if len(metric.getRecordsTime) > 0 {
 		data = append(data, types.MetricDatum{
 			Dimensions: defaultDimensions,
@@ -245,9 +379,37 @@ func (cw *MonitoringService) flushShard(shard string, metric *cloudWatchMetrics)
 			}})
 	}
 
+	if len(metric.timeToFirstRecord) > 0 {
+		data = append(data, types.MetricDatum{
+			Dimensions: defaultDimensions,
+			MetricName: aws.String("TimeToFirstRecord"),
+			Unit:       types.StandardUnitMilliseconds,
+			Timestamp:  &metricTimestamp,
+			StatisticValues: &types.StatisticSet{
+				SampleCount: aws.Float64(float64(len(metric.timeToFirstRecord))),
+				Sum:         sumFloat64(metric.timeToFirstRecord),
+				Maximum:     maxFloat64(metric.timeToFirstRecord),
+				Minimum:     minFloat64(metric.timeToFirstRecord),
+			}})
+	}
+
+	for iteratorType, count := range metric.starts {
+		iteratorType := iteratorType
+		data = append(data, types.MetricDatum{
+			Dimensions: append(defaultDimensions[:len(defaultDimensions):len(defaultDimensions)], types.Dimension{
+				Name:  aws.String("IteratorType"),
+				Value: &iteratorType,
+			}),
+			MetricName: aws.String("ShardStart"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(count)),
+		})
+	}
+
 	// Publish metrics data to cloud watch
 	_, err := cw.svc.PutMetricData(context.TODO(), &cwatch.PutMetricDataInput{
-		Namespace:  aws.String(cw.appName),
+		Namespace:  aws.String(cw.namespace),
 		MetricData: data,
 	})
 
@@ -258,6 +420,17 @@ func (cw *MonitoringService) flushShard(shard string, metric *cloudWatchMetrics)
 		metric.leaseRenewals = 0
 		metric.getRecordsTime = []float64{}
 		metric.processRecordsTime = []float64{}
+		metric.timeToFirstRecord = []float64{}
+		metric.starts = nil
+		metric.checkpoints = 0
+		metric.checkpointFailures = 0
+		metric.decodeErrors = 0
+		metric.checkpointsThrottled = 0
+		metric.processorCreateFailures = 0
+		metric.getRecordsBudgetExhausted = 0
+		metric.corruptCheckpoints = 0
+		metric.orderViolations = 0
+		metric.unackedRecords = []float64{}
 	} else {
 		cw.logger.Errorf("Error in publishing cloudwatch metrics. Error: %+v", err)
 	}
@@ -273,10 +446,83 @@ func (cw *MonitoringService) flush() error {
 		shard, metric := k.(string), v.(*cloudWatchMetrics)
 		return cw.flushShard(shard, metric)
 	})
+	cw.flushWorker()
 
 	return nil
 }
 
+// flushWorker publishes the worker level metrics, if any.
+func (cw *MonitoringService) flushWorker() {
+	metric := &cw.workerMetrics
+	metric.Lock()
+	defer metric.Unlock()
+	if metric.lifetimeShutdowns == 0 && metric.rejoins == 0 && metric.fanOutUpgrades == 0 && len(metric.reshardingEvents) == 0 {
+		return
+	}
+
+	workerDimensions := []types.Dimension{
+		{
+			Name:  aws.String("KinesisStreamName"),
+			Value: &cw.streamName,
+		},
+		{
+			Name:  aws.String("WorkerID"),
+			Value: &cw.workerID,
+		},
+	}
+	metricTimestamp := time.Now()
+
+	data := []types.MetricDatum{
+		{
+			Dimensions: workerDimensions,
+			MetricName: aws.String("Worker.LifetimeShutdown"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(metric.lifetimeShutdowns)),
+		},
+		{
+			Dimensions: workerDimensions,
+			MetricName: aws.String("Worker.Rejoin"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(metric.rejoins)),
+		},
+		{
+			Dimensions: workerDimensions,
+			MetricName: aws.String("Worker.FanOutUpgrade"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			Value:      aws.Float64(float64(metric.fanOutUpgrades)),
+		},
+	}
+	if len(metric.reshardingEvents) > 0 {
+		data = append(data, types.MetricDatum{
+			Dimensions: workerDimensions,
+			MetricName: aws.String("ReshardingEventsPerInterval"),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &metricTimestamp,
+			StatisticValues: &types.StatisticSet{
+				SampleCount: aws.Float64(float64(len(metric.reshardingEvents))),
+				Sum:         sumFloat64(metric.reshardingEvents),
+				Maximum:     maxFloat64(metric.reshardingEvents),
+				Minimum:     minFloat64(metric.reshardingEvents),
+			}})
+	}
+
+	_, err := cw.svc.PutMetricData(context.TODO(), &cwatch.PutMetricDataInput{
+		Namespace:  aws.String(cw.namespace),
+		MetricData: data,
+	})
+	if err != nil {
+		cw.logger.Errorf("Error in publishing cloudwatch metrics. Error: %+v", err)
+		return
+	}
+	metric.lifetimeShutdowns = 0
+	metric.rejoins = 0
+	metric.fanOutUpgrades = 0
+	metric.reshardingEvents = nil
+}
+
 func (cw *MonitoringService) IncrRecordsProcessed(shard string, count int) {
 	m := cw.getOrCreatePerShardMetrics(shard)
 	m.Lock()
@@ -298,6 +544,13 @@ func (cw *MonitoringService) MillisBehindLatest(shard string, millSeconds float6
 	m.behindLatestMillis = append(m.behindLatestMillis, millSeconds)
 }
 
+func (cw *MonitoringService) DeleteMetricMillisBehindLatest(shard string) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	m.behindLatestMillis = []float64{}
+}
+
 func (cw *MonitoringService) LeaseGained(shard string) {
 	m := cw.getOrCreatePerShardMetrics(shard)
 	m.Lock()
@@ -332,6 +585,110 @@ func (cw *MonitoringService) RecordProcessRecordsTime(shard string, time float64
 	m.processRecordsTime = append(m.processRecordsTime, time)
 }
 
+func (cw *MonitoringService) TimeToFirstRecord(shard string, d time.Duration) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	m.timeToFirstRecord = append(m.timeToFirstRecord, float64(d.Milliseconds()))
+}
+
+func (cw *MonitoringService) ShardStarted(shard string, iteratorType string) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	if m.starts == nil {
+		m.starts = make(map[string]int64)
+	}
+	m.starts[iteratorType]++
+}
+
+func (cw *MonitoringService) CheckpointSuccess(shard string) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	m.checkpoints++
+}
+
+func (cw *MonitoringService) CheckpointFailure(shard string, _ error) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	m.checkpointFailures++
+}
+
+func (cw *MonitoringService) DecodeError(shard string) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	m.decodeErrors++
+}
+
+func (cw *MonitoringService) RecordOrderViolation(shard string) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	m.orderViolations++
+}
+
+func (cw *MonitoringService) CorruptCheckpoint(shard string) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	m.corruptCheckpoints++
+}
+
+func (cw *MonitoringService) GetRecordsBudgetExhausted(shard string) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	m.getRecordsBudgetExhausted++
+}
+
+func (cw *MonitoringService) ProcessorCreateFailed(shard string) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	m.processorCreateFailures++
+}
+
+func (cw *MonitoringService) CheckpointThrottled(shard string) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	m.checkpointsThrottled++
+}
+
+func (cw *MonitoringService) UnackedRecords(shard string, count int) {
+	m := cw.getOrCreatePerShardMetrics(shard)
+	m.Lock()
+	defer m.Unlock()
+	m.unackedRecords = append(m.unackedRecords, float64(count))
+}
+
+func (cw *MonitoringService) WorkerLifetimeExpired() {
+	cw.workerMetrics.Lock()
+	defer cw.workerMetrics.Unlock()
+	cw.workerMetrics.lifetimeShutdowns++
+}
+
+func (cw *MonitoringService) WorkerRejoined() {
+	cw.workerMetrics.Lock()
+	defer cw.workerMetrics.Unlock()
+	cw.workerMetrics.rejoins++
+}
+
+func (cw *MonitoringService) WorkerFanOutUpgraded() {
+	cw.workerMetrics.Lock()
+	defer cw.workerMetrics.Unlock()
+	cw.workerMetrics.fanOutUpgrades++
+}
+
+func (cw *MonitoringService) ReshardingEventsPerInterval(count int) {
+	cw.workerMetrics.Lock()
+	defer cw.workerMetrics.Unlock()
+	cw.workerMetrics.reshardingEvents = append(cw.workerMetrics.reshardingEvents, float64(count))
+}
+
 func (cw *MonitoringService) getOrCreatePerShardMetrics(shard string) *cloudWatchMetrics {
 	var i interface{}
 	var ok bool
@@ -344,6 +701,17 @@ func (cw *MonitoringService) getOrCreatePerShardMetrics(shard string) *cloudWatc
 	return i.(*cloudWatchMetrics)
 }
 
+// validateNamespace checks the namespace against the CloudWatch naming rules.
+func validateNamespace(namespace string) error {
+	if !namespacePattern.MatchString(namespace) {
+		return fmt.Errorf("invalid CloudWatch namespace %q: must be 1-255 characters of letters, digits, spaces or .-_/#:", namespace)
+	}
+	if strings.HasPrefix(namespace, "AWS/") {
+		return fmt.Errorf("invalid CloudWatch namespace %q: the AWS/ prefix is reserved", namespace)
+	}
+	return nil
+}
+
 func sumFloat64(slice []float64) *float64 {
 	sum := float64(0)
 	for _, num := range slice {
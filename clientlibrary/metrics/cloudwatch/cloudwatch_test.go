@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package cloudwatch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cwatch "github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vmware/vmware-go-kcl-v2/logger"
+)
+
+type mockCloudWatch struct {
+	inputs []*cwatch.PutMetricDataInput
+}
+
+func (m *mockCloudWatch) PutMetricData(_ context.Context, params *cwatch.PutMetricDataInput, _ ...func(*cwatch.Options)) (*cwatch.PutMetricDataOutput, error) {
+	m.inputs = append(m.inputs, params)
+	return &cwatch.PutMetricDataOutput{}, nil
+}
+
+func TestMetricsNamespace(t *testing.T) {
+	cw := NewMonitoringServiceWithOptions("us-west-2", nil, logger.GetDefaultLogger(), DefaultCloudwatchMetricsBufferDuration).
+		WithMetricsNamespace("kcl/stage")
+	assert.Nil(t, cw.Init("appName", "streamName", "workerID"))
+
+	mock := &mockCloudWatch{}
+	cw.svc = mock
+	cw.IncrRecordsProcessed("shard-0", 1)
+	assert.Nil(t, cw.flush())
+
+	assert.Equal(t, 1, len(mock.inputs))
+	assert.Equal(t, "kcl/stage", aws.ToString(mock.inputs[0].Namespace))
+}
+
+func TestMetricsNamespaceDefaultsToAppName(t *testing.T) {
+	cw := NewMonitoringService("us-west-2", nil)
+	assert.Nil(t, cw.Init("appName", "streamName", "workerID"))
+
+	mock := &mockCloudWatch{}
+	cw.svc = mock
+	cw.IncrRecordsProcessed("shard-0", 1)
+	assert.Nil(t, cw.flush())
+
+	assert.Equal(t, 1, len(mock.inputs))
+	assert.Equal(t, "appName", aws.ToString(mock.inputs[0].Namespace))
+}
+
+func TestInvalidMetricsNamespace(t *testing.T) {
+	for _, ns := range []string{"AWS/Kinesis", "bad*namespace", string(make([]byte, 256))} {
+		cw := NewMonitoringService("us-west-2", nil).WithMetricsNamespace(ns)
+		assert.NotNil(t, cw.Init("appName", "streamName", "workerID"), ns)
+	}
+
+	// the application name is not validated when used as the namespace
+	cw := NewMonitoringService("us-west-2", nil)
+	assert.Nil(t, cw.Init("app*Name", "streamName", "workerID"))
+}
+
+func TestMetricsScopedPerStream(t *testing.T) {
+	cw := NewMonitoringService("us-west-2", nil)
+	published := map[string]float64{}
+	for stream, count := range map[string]int{"stream-a": 1, "stream-b": 2} {
+		scoped := cw.ForStream(stream).(*MonitoringService)
+		assert.Nil(t, scoped.Init("appName", stream, "workerID"))
+
+		mock := &mockCloudWatch{}
+		scoped.svc = mock
+		scoped.IncrRecordsProcessed("shard-0", count)
+		assert.Nil(t, scoped.flush())
+
+		for _, input := range mock.inputs {
+			for _, datum := range input.MetricData {
+				if aws.ToString(datum.MetricName) != "RecordsProcessed" {
+					continue
+				}
+				dimensions := map[string]string{}
+				for _, dimension := range datum.Dimensions {
+					dimensions[aws.ToString(dimension.Name)] = aws.ToString(dimension.Value)
+				}
+				assert.Equal(t, "shard-0", dimensions["Shard"])
+				published[dimensions["KinesisStreamName"]] += aws.ToFloat64(datum.Value)
+			}
+		}
+	}
+
+	// the shards of the two streams are published apart
+	assert.Equal(t, map[string]float64{"stream-a": 1, "stream-b": 2}, published)
+}
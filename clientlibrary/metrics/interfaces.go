@@ -29,6 +29,8 @@
 // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package metrics
 
+import "time"
+
 type MonitoringService interface {
 	Init(appName, streamName, workerID string) error
 	Start() error
@@ -44,7 +46,101 @@ type MonitoringService interface {
 	Shutdown()
 }
 
-// NoopMonitoringService implements MonitoringService by does nothing.
+// The interfaces below are optional extensions of MonitoringService. The worker reports an event only to the
+// monitoring services implementing the matching interface, so that existing implementations of MonitoringService keep
+// compiling as new events are added.
+
+// TimeToFirstRecordReporter is implemented by the monitoring services recording the time between acquiring the lease
+// of a shard and receiving its first record.
+type TimeToFirstRecordReporter interface {
+	TimeToFirstRecord(shard string, d time.Duration)
+}
+
+// ShardStartReporter is implemented by the monitoring services counting the shards started per iterator type.
+type ShardStartReporter interface {
+	ShardStarted(shard string, iteratorType string)
+}
+
+// CheckpointReporter is implemented by the monitoring services counting the successful and failed checkpoints.
+type CheckpointReporter interface {
+	CheckpointSuccess(shard string)
+	CheckpointFailure(shard string, err error)
+}
+
+// DecodeErrorReporter is implemented by the monitoring services counting the records which failed to decode.
+type DecodeErrorReporter interface {
+	DecodeError(shard string)
+}
+
+// CheckpointThrottleReporter is implemented by the monitoring services counting the checkpoints delayed by the
+// checkpoint rate limit.
+type CheckpointThrottleReporter interface {
+	CheckpointThrottled(shard string)
+}
+
+// ProcessorCreateFailureReporter is implemented by the monitoring services counting the record processors which
+// failed to be created.
+type ProcessorCreateFailureReporter interface {
+	ProcessorCreateFailed(shard string)
+}
+
+// GetRecordsBudgetReporter is implemented by the monitoring services counting the polls skipped because the
+// GetRecords budget was exhausted.
+type GetRecordsBudgetReporter interface {
+	GetRecordsBudgetExhausted(shard string)
+}
+
+// CorruptCheckpointReporter is implemented by the monitoring services counting the checkpoints which could not be
+// parsed.
+type CorruptCheckpointReporter interface {
+	CorruptCheckpoint(shard string)
+}
+
+// RecordOrderViolationReporter is implemented by the monitoring services counting the records delivered out of
+// sequence number order.
+type RecordOrderViolationReporter interface {
+	RecordOrderViolation(shard string)
+}
+
+// UnackedRecordsReporter is implemented by the monitoring services recording the number of records delivered to the
+// record processor but not yet checkpointed.
+type UnackedRecordsReporter interface {
+	UnackedRecords(shard string, count int)
+}
+
+// ReshardingReporter is implemented by the monitoring services recording the number of resharding events per interval.
+type ReshardingReporter interface {
+	ReshardingEventsPerInterval(count int)
+}
+
+// WorkerLifetimeReporter is implemented by the monitoring services counting the workers shut down after
+// MaxWorkerLifetimeMillis.
+type WorkerLifetimeReporter interface {
+	WorkerLifetimeExpired()
+}
+
+// WorkerRejoinReporter is implemented by the monitoring services counting the workers rejoining after losing all
+// their leases.
+type WorkerRejoinReporter interface {
+	WorkerRejoined()
+}
+
+// FanOutUpgradeReporter is implemented by the monitoring services counting the workers upgraded from polling to
+// enhanced fan-out.
+type FanOutUpgradeReporter interface {
+	WorkerFanOutUpgraded()
+}
+
+// StreamScoper is implemented by the monitoring services which can be shared by the workers of several streams. The
+// worker reports its metrics through the service scoped to its stream, so that the shards of different streams do not
+// collide.
+type StreamScoper interface {
+	// ForStream returns a monitoring service reporting the metrics of the given stream alongside those of the other
+	// streams. It is initialized, started and shut down on its own.
+	ForStream(streamName string) MonitoringService
+}
+
+// NoopMonitoringService implements MonitoringService and its optional extensions by does nothing.
 type NoopMonitoringService struct{}
 
 func (NoopMonitoringService) Init(_, _, _ string) error { return nil }
@@ -60,3 +156,19 @@ func (NoopMonitoringService) LeaseLost(_ string)                           {}
 func (NoopMonitoringService) LeaseRenewed(_ string)                        {}
 func (NoopMonitoringService) RecordGetRecordsTime(_ string, _ float64)     {}
 func (NoopMonitoringService) RecordProcessRecordsTime(_ string, _ float64) {}
+
+func (NoopMonitoringService) TimeToFirstRecord(_ string, _ time.Duration) {}
+func (NoopMonitoringService) ShardStarted(_ string, _ string)             {}
+func (NoopMonitoringService) CheckpointSuccess(_ string)                  {}
+func (NoopMonitoringService) CheckpointFailure(_ string, _ error)         {}
+func (NoopMonitoringService) DecodeError(_ string)                        {}
+func (NoopMonitoringService) CheckpointThrottled(_ string)                {}
+func (NoopMonitoringService) ProcessorCreateFailed(_ string)              {}
+func (NoopMonitoringService) GetRecordsBudgetExhausted(_ string)          {}
+func (NoopMonitoringService) CorruptCheckpoint(_ string)                  {}
+func (NoopMonitoringService) RecordOrderViolation(_ string)               {}
+func (NoopMonitoringService) UnackedRecords(_ string, _ int)              {}
+func (NoopMonitoringService) ReshardingEventsPerInterval(_ int)           {}
+func (NoopMonitoringService) WorkerLifetimeExpired()                      {}
+func (NoopMonitoringService) WorkerRejoined()                             {}
+func (NoopMonitoringService) WorkerFanOutUpgraded()                       {}
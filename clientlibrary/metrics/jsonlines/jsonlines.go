@@ -0,0 +1,354 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package jsonlines
+// The monitoring service writes the metrics as line-delimited JSON to an io.Writer, e.g. stdout, a file or a socket,
+// for the environments where neither CloudWatch nor Prometheus is available.
+package jsonlines
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
+	"github.com/vmware/vmware-go-kcl-v2/logger"
+)
+
+// DefaultInterval Write a metrics snapshot this often.
+const DefaultInterval = 10 * time.Second
+
+// Snapshot is the line written every interval. Counters and samples cover the interval since the previous snapshot,
+// the leases held are the current count.
+type Snapshot struct {
+	Timestamp  time.Time                `json:"timestamp"`
+	AppName    string                   `json:"appName"`
+	StreamName string                   `json:"streamName"`
+	WorkerID   string                   `json:"workerId"`
+	Shards     map[string]ShardSnapshot `json:"shards"`
+	Worker     WorkerSnapshot           `json:"worker"`
+}
+
+// ShardSnapshot holds the metrics of a shard.
+type ShardSnapshot struct {
+	RecordsProcessed          int64 `json:"recordsProcessed"`
+	BytesProcessed            int64 `json:"bytesProcessed"`
+	LeasesHeld                int64 `json:"leasesHeld"`
+	LeaseRenewals             int64 `json:"leaseRenewals"`
+	Checkpoints               int64 `json:"checkpoints"`
+	CheckpointFailures        int64 `json:"checkpointFailures"`
+	DecodeErrors              int64 `json:"decodeErrors"`
+	ProcessorCreateFailures   int64 `json:"processorCreateFailures"`
+	CheckpointsThrottled      int64 `json:"checkpointsThrottled"`
+	GetRecordsBudgetExhausted int64 `json:"getRecordsBudgetExhausted"`
+	CorruptCheckpoints        int64 `json:"corruptCheckpoints"`
+	RecordOrderViolations     int64 `json:"recordOrderViolations"`
+	// shard starts by shard iterator type
+	ShardStarts map[string]int64 `json:"shardStarts,omitempty"`
+
+	MillisBehindLatest *Stats `json:"millisBehindLatest,omitempty"`
+	GetRecordsTime     *Stats `json:"getRecordsMillis,omitempty"`
+	ProcessRecordsTime *Stats `json:"processRecordsMillis,omitempty"`
+	TimeToFirstRecord  *Stats `json:"timeToFirstRecordMillis,omitempty"`
+	UnackedRecords     *Stats `json:"unackedRecords,omitempty"`
+}
+
+// WorkerSnapshot holds the metrics which are not tied to a shard.
+type WorkerSnapshot struct {
+	LifetimeShutdowns           int64  `json:"lifetimeShutdowns"`
+	Rejoins                     int64  `json:"rejoins"`
+	FanOutUpgrades              int64  `json:"fanOutUpgrades"`
+	ReshardingEventsPerInterval *Stats `json:"reshardingEventsPerInterval,omitempty"`
+}
+
+// Stats summarizes the samples of a metric, like a CloudWatch statistic set.
+type Stats struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// observe adds a sample to the stats, created on the first one.
+func observe(stats **Stats, value float64) {
+	s := *stats
+	if s == nil {
+		*stats = &Stats{Count: 1, Sum: value, Min: value, Max: value}
+		return
+	}
+	s.Count++
+	s.Sum += value
+	if value < s.Min {
+		s.Min = value
+	}
+	if value > s.Max {
+		s.Max = value
+	}
+}
+
+// MonitoringService writes a metrics snapshot to an io.Writer every interval, and a last one on shutdown.
+type MonitoringService struct {
+	appName    string
+	streamName string
+	workerID   string
+	logger     logger.Logger
+
+	interval time.Duration
+	out      *output
+
+	stop          *chan struct{}
+	waitGroup     *sync.WaitGroup
+	shardMetrics  *sync.Map
+	workerMetrics workerMetrics
+}
+
+// output is the writer shared by the monitoring services scoped to a stream, so that their lines do not interleave.
+type output struct {
+	sync.Mutex
+	w io.Writer
+}
+
+type shardMetrics struct {
+	sync.Mutex
+	ShardSnapshot
+}
+
+type workerMetrics struct {
+	sync.Mutex
+	WorkerSnapshot
+}
+
+// NewMonitoringService returns a Monitoring service writing a metrics snapshot to w every DefaultInterval.
+func NewMonitoringService(w io.Writer) *MonitoringService {
+	return NewMonitoringServiceWithOptions(w, DefaultInterval, logger.GetDefaultLogger())
+}
+
+// NewMonitoringServiceWithOptions returns a Monitoring service writing a metrics snapshot to w every interval, logging
+// the write errors with the provided logger.
+func NewMonitoringServiceWithOptions(w io.Writer, interval time.Duration, logger logger.Logger) *MonitoringService {
+	return &MonitoringService{
+		logger:   logger,
+		interval: interval,
+		out:      &output{w: w},
+	}
+}
+
+// ForStream returns a monitoring service writing the metrics of the given stream to the same writer, every interval.
+func (j *MonitoringService) ForStream(streamName string) metrics.MonitoringService {
+	return &MonitoringService{
+		streamName: streamName,
+		logger:     j.logger,
+		interval:   j.interval,
+		out:        j.out,
+	}
+}
+
+func (j *MonitoringService) Init(appName, streamName, workerID string) error {
+	j.appName = appName
+	j.streamName = streamName
+	j.workerID = workerID
+
+	j.shardMetrics = &sync.Map{}
+	stopChan := make(chan struct{})
+	j.stop = &stopChan
+	j.waitGroup = &sync.WaitGroup{}
+	return nil
+}
+
+func (j *MonitoringService) Start() error {
+	j.waitGroup.Add(1)
+	go j.eventloop()
+	return nil
+}
+
+func (j *MonitoringService) Shutdown() {
+	j.logger.Infof("Shutting down json lines metrics system...")
+	close(*j.stop)
+	j.waitGroup.Wait()
+	j.logger.Infof("Json lines metrics system has been shutdown.")
+}
+
+// eventloop writes a snapshot every interval, and a last one once stopped.
+func (j *MonitoringService) eventloop() {
+	defer j.waitGroup.Done()
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-*j.stop:
+			j.flush()
+			return
+		case <-ticker.C:
+			j.flush()
+		}
+	}
+}
+
+// flush writes the snapshot of the metrics, and resets the counters and samples for the next interval.
+func (j *MonitoringService) flush() {
+	snapshot := Snapshot{
+		Timestamp:  time.Now().UTC(),
+		AppName:    j.appName,
+		StreamName: j.streamName,
+		WorkerID:   j.workerID,
+		Shards:     map[string]ShardSnapshot{},
+	}
+	j.shardMetrics.Range(func(k, v interface{}) bool {
+		m := v.(*shardMetrics)
+		m.Lock()
+		defer m.Unlock()
+		snapshot.Shards[k.(string)] = m.ShardSnapshot
+		m.ShardSnapshot = ShardSnapshot{LeasesHeld: m.LeasesHeld}
+		return true
+	})
+	j.workerMetrics.Lock()
+	snapshot.Worker = j.workerMetrics.WorkerSnapshot
+	j.workerMetrics.WorkerSnapshot = WorkerSnapshot{}
+	j.workerMetrics.Unlock()
+
+	line, err := json.Marshal(snapshot)
+	if err != nil {
+		j.logger.Errorf("Error encoding the metrics snapshot. Error: %+v", err)
+		return
+	}
+	j.out.Lock()
+	defer j.out.Unlock()
+	if _, err := j.out.w.Write(append(line, '\n')); err != nil {
+		j.logger.Errorf("Error writing the metrics snapshot. Error: %+v", err)
+	}
+}
+
+// update applies f to the metrics of the shard.
+func (j *MonitoringService) update(shard string, f func(m *ShardSnapshot)) {
+	v, _ := j.shardMetrics.LoadOrStore(shard, &shardMetrics{})
+	m := v.(*shardMetrics)
+	m.Lock()
+	defer m.Unlock()
+	f(&m.ShardSnapshot)
+}
+
+// updateWorker applies f to the worker level metrics.
+func (j *MonitoringService) updateWorker(f func(m *WorkerSnapshot)) {
+	j.workerMetrics.Lock()
+	defer j.workerMetrics.Unlock()
+	f(&j.workerMetrics.WorkerSnapshot)
+}
+
+func (j *MonitoringService) IncrRecordsProcessed(shard string, count int) {
+	j.update(shard, func(m *ShardSnapshot) { m.RecordsProcessed += int64(count) })
+}
+
+func (j *MonitoringService) IncrBytesProcessed(shard string, count int64) {
+	j.update(shard, func(m *ShardSnapshot) { m.BytesProcessed += count })
+}
+
+func (j *MonitoringService) MillisBehindLatest(shard string, milliSeconds float64) {
+	j.update(shard, func(m *ShardSnapshot) { observe(&m.MillisBehindLatest, milliSeconds) })
+}
+
+func (j *MonitoringService) DeleteMetricMillisBehindLatest(shard string) {
+	j.update(shard, func(m *ShardSnapshot) { m.MillisBehindLatest = nil })
+}
+
+func (j *MonitoringService) LeaseGained(shard string) {
+	j.update(shard, func(m *ShardSnapshot) { m.LeasesHeld++ })
+}
+
+func (j *MonitoringService) LeaseLost(shard string) {
+	j.update(shard, func(m *ShardSnapshot) { m.LeasesHeld-- })
+}
+
+func (j *MonitoringService) LeaseRenewed(shard string) {
+	j.update(shard, func(m *ShardSnapshot) { m.LeaseRenewals++ })
+}
+
+func (j *MonitoringService) RecordGetRecordsTime(shard string, time float64) {
+	j.update(shard, func(m *ShardSnapshot) { observe(&m.GetRecordsTime, time) })
+}
+
+func (j *MonitoringService) RecordProcessRecordsTime(shard string, time float64) {
+	j.update(shard, func(m *ShardSnapshot) { observe(&m.ProcessRecordsTime, time) })
+}
+
+func (j *MonitoringService) TimeToFirstRecord(shard string, d time.Duration) {
+	j.update(shard, func(m *ShardSnapshot) { observe(&m.TimeToFirstRecord, float64(d.Milliseconds())) })
+}
+
+func (j *MonitoringService) ShardStarted(shard string, iteratorType string) {
+	j.update(shard, func(m *ShardSnapshot) {
+		if m.ShardStarts == nil {
+			m.ShardStarts = make(map[string]int64)
+		}
+		m.ShardStarts[iteratorType]++
+	})
+}
+
+func (j *MonitoringService) CheckpointSuccess(shard string) {
+	j.update(shard, func(m *ShardSnapshot) { m.Checkpoints++ })
+}
+
+func (j *MonitoringService) CheckpointFailure(shard string, _ error) {
+	j.update(shard, func(m *ShardSnapshot) { m.CheckpointFailures++ })
+}
+
+func (j *MonitoringService) DecodeError(shard string) {
+	j.update(shard, func(m *ShardSnapshot) { m.DecodeErrors++ })
+}
+
+func (j *MonitoringService) ProcessorCreateFailed(shard string) {
+	j.update(shard, func(m *ShardSnapshot) { m.ProcessorCreateFailures++ })
+}
+
+func (j *MonitoringService) CheckpointThrottled(shard string) {
+	j.update(shard, func(m *ShardSnapshot) { m.CheckpointsThrottled++ })
+}
+
+func (j *MonitoringService) GetRecordsBudgetExhausted(shard string) {
+	j.update(shard, func(m *ShardSnapshot) { m.GetRecordsBudgetExhausted++ })
+}
+
+func (j *MonitoringService) CorruptCheckpoint(shard string) {
+	j.update(shard, func(m *ShardSnapshot) { m.CorruptCheckpoints++ })
+}
+
+func (j *MonitoringService) RecordOrderViolation(shard string) {
+	j.update(shard, func(m *ShardSnapshot) { m.RecordOrderViolations++ })
+}
+
+func (j *MonitoringService) UnackedRecords(shard string, count int) {
+	j.update(shard, func(m *ShardSnapshot) { observe(&m.UnackedRecords, float64(count)) })
+}
+
+func (j *MonitoringService) ReshardingEventsPerInterval(count int) {
+	j.updateWorker(func(m *WorkerSnapshot) { observe(&m.ReshardingEventsPerInterval, float64(count)) })
+}
+
+func (j *MonitoringService) WorkerLifetimeExpired() {
+	j.updateWorker(func(m *WorkerSnapshot) { m.LifetimeShutdowns++ })
+}
+
+func (j *MonitoringService) WorkerRejoined() {
+	j.updateWorker(func(m *WorkerSnapshot) { m.Rejoins++ })
+}
+
+func (j *MonitoringService) WorkerFanOutUpgraded() {
+	j.updateWorker(func(m *WorkerSnapshot) { m.FanOutUpgrades++ })
+}
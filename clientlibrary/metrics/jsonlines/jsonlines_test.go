@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package jsonlines
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vmware/vmware-go-kcl-v2/logger"
+)
+
+// lockedBuffer is written by the monitoring service while the test reads it.
+type lockedBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) lines() []string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestSnapshotsWrittenOnInterval(t *testing.T) {
+	out := &lockedBuffer{}
+	j := NewMonitoringServiceWithOptions(out, 20*time.Millisecond, logger.GetDefaultLogger())
+	assert.Nil(t, j.Init("appName", "streamName", "workerID"))
+
+	j.LeaseGained("shard-0")
+	j.IncrRecordsProcessed("shard-0", 3)
+	j.IncrBytesProcessed("shard-0", 30)
+	j.MillisBehindLatest("shard-0", 100)
+	j.MillisBehindLatest("shard-0", 300)
+	j.ShardStarted("shard-0", "TRIM_HORIZON")
+	j.WorkerRejoined()
+	assert.Nil(t, j.Start())
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(out.lines()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	j.Shutdown()
+
+	lines := out.lines()
+	if !assert.True(t, len(lines) >= 2, "no snapshot written on interval") {
+		return
+	}
+	var snapshots []Snapshot
+	for _, line := range lines {
+		var snapshot Snapshot
+		assert.Nil(t, json.Unmarshal([]byte(line), &snapshot), line)
+		snapshots = append(snapshots, snapshot)
+	}
+
+	first := snapshots[0]
+	assert.Equal(t, "appName", first.AppName)
+	assert.Equal(t, "streamName", first.StreamName)
+	assert.Equal(t, "workerID", first.WorkerID)
+	assert.Equal(t, ShardSnapshot{
+		RecordsProcessed:   3,
+		BytesProcessed:     30,
+		LeasesHeld:         1,
+		ShardStarts:        map[string]int64{"TRIM_HORIZON": 1},
+		MillisBehindLatest: &Stats{Count: 2, Sum: 400, Min: 100, Max: 300},
+	}, first.Shards["shard-0"])
+	assert.Equal(t, int64(1), first.Worker.Rejoins)
+
+	// the counters start over every interval, the leases held are kept
+	second := snapshots[1]
+	assert.True(t, second.Timestamp.After(first.Timestamp))
+	assert.Equal(t, ShardSnapshot{LeasesHeld: 1}, second.Shards["shard-0"])
+	assert.Equal(t, WorkerSnapshot{}, second.Worker)
+}
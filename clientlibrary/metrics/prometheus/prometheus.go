@@ -31,10 +31,13 @@ package prometheus
 
 import (
 	"net/http"
+	"sync"
+	"time"
 
 	prom "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
 	"github.com/vmware/vmware-go-kcl-v2/logger"
 )
 
@@ -48,13 +51,42 @@ type MonitoringService struct {
 	region        string
 	logger        logger.Logger
 
-	processedRecords   *prom.CounterVec
-	processedBytes     *prom.CounterVec
-	behindLatestMillis *prom.GaugeVec
-	leasesHeld         *prom.GaugeVec
-	leaseRenewals      *prom.CounterVec
-	getRecordsTime     *prom.HistogramVec
-	processRecordsTime *prom.HistogramVec
+	// shared by the monitoring services scoped to a stream
+	*collectors
+}
+
+// collectors holds the Prometheus metrics. They are registered and served once, whichever the number of workers
+// reporting them.
+type collectors struct {
+	initOnce  sync.Once
+	initErr   error
+	startOnce sync.Once
+
+	// the registry the metrics are registered on, the default Prometheus registry when nil
+	registerer prom.Registerer
+
+	processedRecords          *prom.CounterVec
+	processedBytes            *prom.CounterVec
+	behindLatestMillis        *prom.GaugeVec
+	leasesHeld                *prom.GaugeVec
+	leaseRenewals             *prom.CounterVec
+	getRecordsTime            *prom.HistogramVec
+	processRecordsTime        *prom.HistogramVec
+	timeToFirstRecord         *prom.HistogramVec
+	shardStarts               *prom.CounterVec
+	checkpoints               *prom.CounterVec
+	checkpointFailures        *prom.CounterVec
+	decodeErrors              *prom.CounterVec
+	checkpointsThrottled      *prom.CounterVec
+	processorCreateFailures   *prom.CounterVec
+	getRecordsBudgetExhausted *prom.CounterVec
+	corruptCheckpoints        *prom.CounterVec
+	orderViolations           *prom.CounterVec
+	unackedRecords            *prom.GaugeVec
+	lifetimeShutdowns         *prom.CounterVec
+	rejoins                   *prom.CounterVec
+	fanOutUpgrades            *prom.CounterVec
+	reshardingEvents          *prom.HistogramVec
 }
 
 // NewMonitoringService returns a Monitoring service publishing metrics to Prometheus.
@@ -63,6 +95,19 @@ func NewMonitoringService(listenAddress, region string, logger logger.Logger) *M
 		listenAddress: listenAddress,
 		region:        region,
 		logger:        logger,
+		collectors:    &collectors{},
+	}
+}
+
+// ForStream returns a monitoring service reporting the metrics of the given stream, for a worker of that stream. The
+// metrics are shared with the other streams, and labeled with the stream.
+func (p *MonitoringService) ForStream(streamName string) metrics.MonitoringService {
+	return &MonitoringService{
+		listenAddress: p.listenAddress,
+		streamName:    streamName,
+		region:        p.region,
+		logger:        p.logger,
+		collectors:    p.collectors,
 	}
 }
 
@@ -71,6 +116,14 @@ func (p *MonitoringService) Init(appName, streamName, workerID string) error {
 	p.streamName = streamName
 	p.workerID = workerID
 
+	p.initOnce.Do(func() {
+		p.initErr = p.register()
+	})
+	return p.initErr
+}
+
+// register creates the metrics, named after the application, and registers them.
+func (p *MonitoringService) register() error {
 	p.processedBytes = prom.NewCounterVec(prom.CounterOpts{
 		Name: p.namespace + `_processed_bytes`,
 		Help: "Number of bytes processed",
@@ -100,6 +153,67 @@ func (p *MonitoringService) Init(appName, streamName, workerID string) error {
 		Help: "The time taken to process records",
 	}, []string{"kinesisStream", "shard"})
 
+	p.timeToFirstRecord = prom.NewHistogramVec(prom.HistogramOpts{
+		Name: p.namespace + `_time_to_first_record_milliseconds`,
+		Help: "The time taken from acquiring the lease on a shard to delivering its first record",
+	}, []string{"kinesisStream", "shard"})
+	p.shardStarts = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_shard_starts`,
+		Help: "The number of times a shard started being read, by shard iterator type",
+	}, []string{"kinesisStream", "shard", "iteratorType"})
+	p.checkpoints = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_checkpoints`,
+		Help: "The number of checkpoints committed",
+	}, []string{"kinesisStream", "shard"})
+	p.checkpointFailures = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_checkpoint_failures`,
+		Help: "The number of checkpoints which failed",
+	}, []string{"kinesisStream", "shard"})
+	p.decodeErrors = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_decode_errors`,
+		Help: "The number of records which could not be decoded",
+	}, []string{"kinesisStream", "shard"})
+	p.orderViolations = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_record_order_violations`,
+		Help: "The number of records delivered out of order, with VerifyRecordOrdering",
+	}, []string{"kinesisStream", "shard"})
+	p.corruptCheckpoints = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_corrupt_checkpoints`,
+		Help: "The number of times a shard was found with a checkpoint which is not a sequence number",
+	}, []string{"kinesisStream", "shard"})
+	p.getRecordsBudgetExhausted = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_get_records_budget_exhausted`,
+		Help: "The number of polls held because the GetRecords call budget of the worker was exhausted",
+	}, []string{"kinesisStream", "shard"})
+	p.processorCreateFailures = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_processor_create_failures`,
+		Help: "The number of failures to create the record processor of a shard",
+	}, []string{"kinesisStream", "shard"})
+	p.checkpointsThrottled = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_checkpoints_throttled`,
+		Help: "The number of checkpoints which waited for a free slot under MaxConcurrentCheckpoints",
+	}, []string{"kinesisStream", "shard"})
+	p.unackedRecords = prom.NewGaugeVec(prom.GaugeOpts{
+		Name: p.namespace + `_unacked_records`,
+		Help: "The number of records delivered to the record processor and not checkpointed yet",
+	}, []string{"kinesisStream", "shard"})
+	p.lifetimeShutdowns = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_worker_lifetime_shutdowns`,
+		Help: "The number of worker shutdowns triggered by the maximum worker lifetime",
+	}, []string{"kinesisStream", "workerID"})
+	p.rejoins = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_worker_rejoins`,
+		Help: "The number of times the worker reacquired leases right away after losing all of them",
+	}, []string{"kinesisStream", "workerID"})
+	p.fanOutUpgrades = prom.NewCounterVec(prom.CounterOpts{
+		Name: p.namespace + `_worker_fan_out_upgrades`,
+		Help: "The number of times the worker switched to enhanced fan-out after being throttled",
+	}, []string{"kinesisStream", "workerID"})
+	p.reshardingEvents = prom.NewHistogramVec(prom.HistogramOpts{
+		Name: p.namespace + `_resharding_events_per_interval`,
+		Help: "The number of shards closed per resharding sync interval",
+	}, []string{"kinesisStream", "workerID"})
+
 	metrics := []prom.Collector{
 		p.processedBytes,
 		p.processedRecords,
@@ -108,9 +222,28 @@ func (p *MonitoringService) Init(appName, streamName, workerID string) error {
 		p.leaseRenewals,
 		p.getRecordsTime,
 		p.processRecordsTime,
+		p.timeToFirstRecord,
+		p.shardStarts,
+		p.checkpoints,
+		p.checkpointFailures,
+		p.decodeErrors,
+		p.checkpointsThrottled,
+		p.processorCreateFailures,
+		p.getRecordsBudgetExhausted,
+		p.corruptCheckpoints,
+		p.orderViolations,
+		p.unackedRecords,
+		p.lifetimeShutdowns,
+		p.rejoins,
+		p.fanOutUpgrades,
+		p.reshardingEvents,
+	}
+	registerer := p.registerer
+	if registerer == nil {
+		registerer = prom.DefaultRegisterer
 	}
 	for _, metric := range metrics {
-		err := prom.Register(metric)
+		err := registerer.Register(metric)
 		if err != nil {
 			return err
 		}
@@ -120,15 +253,17 @@ func (p *MonitoringService) Init(appName, streamName, workerID string) error {
 }
 
 func (p *MonitoringService) Start() error {
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		p.logger.Infof("Starting Prometheus listener on %s", p.listenAddress)
-		err := http.ListenAndServe(p.listenAddress, nil)
-		if err != nil {
-			p.logger.Errorf("Error starting Prometheus metrics endpoint. %+v", err)
-		}
-		p.logger.Infof("Stopped metrics server")
-	}()
+	p.startOnce.Do(func() {
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			p.logger.Infof("Starting Prometheus listener on %s", p.listenAddress)
+			err := http.ListenAndServe(p.listenAddress, nil)
+			if err != nil {
+				p.logger.Errorf("Error starting Prometheus metrics endpoint. %+v", err)
+			}
+			p.logger.Infof("Stopped metrics server")
+		}()
+	})
 
 	return nil
 }
@@ -170,3 +305,63 @@ func (p *MonitoringService) RecordGetRecordsTime(shard string, time float64) {
 func (p *MonitoringService) RecordProcessRecordsTime(shard string, time float64) {
 	p.processRecordsTime.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName}).Observe(time)
 }
+
+func (p *MonitoringService) TimeToFirstRecord(shard string, d time.Duration) {
+	p.timeToFirstRecord.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName}).Observe(float64(d.Milliseconds()))
+}
+
+func (p *MonitoringService) ShardStarted(shard string, iteratorType string) {
+	p.shardStarts.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName, "iteratorType": iteratorType}).Inc()
+}
+
+func (p *MonitoringService) CheckpointSuccess(shard string) {
+	p.checkpoints.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName}).Inc()
+}
+
+func (p *MonitoringService) CheckpointFailure(shard string, _ error) {
+	p.checkpointFailures.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName}).Inc()
+}
+
+func (p *MonitoringService) DecodeError(shard string) {
+	p.decodeErrors.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName}).Inc()
+}
+
+func (p *MonitoringService) RecordOrderViolation(shard string) {
+	p.orderViolations.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName}).Inc()
+}
+
+func (p *MonitoringService) CorruptCheckpoint(shard string) {
+	p.corruptCheckpoints.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName}).Inc()
+}
+
+func (p *MonitoringService) GetRecordsBudgetExhausted(shard string) {
+	p.getRecordsBudgetExhausted.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName}).Inc()
+}
+
+func (p *MonitoringService) ProcessorCreateFailed(shard string) {
+	p.processorCreateFailures.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName}).Inc()
+}
+
+func (p *MonitoringService) CheckpointThrottled(shard string) {
+	p.checkpointsThrottled.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName}).Inc()
+}
+
+func (p *MonitoringService) UnackedRecords(shard string, count int) {
+	p.unackedRecords.With(prom.Labels{"shard": shard, "kinesisStream": p.streamName}).Set(float64(count))
+}
+
+func (p *MonitoringService) WorkerLifetimeExpired() {
+	p.lifetimeShutdowns.With(prom.Labels{"kinesisStream": p.streamName, "workerID": p.workerID}).Inc()
+}
+
+func (p *MonitoringService) WorkerRejoined() {
+	p.rejoins.With(prom.Labels{"kinesisStream": p.streamName, "workerID": p.workerID}).Inc()
+}
+
+func (p *MonitoringService) WorkerFanOutUpgraded() {
+	p.fanOutUpgrades.With(prom.Labels{"kinesisStream": p.streamName, "workerID": p.workerID}).Inc()
+}
+
+func (p *MonitoringService) ReshardingEventsPerInterval(count int) {
+	p.reshardingEvents.With(prom.Labels{"kinesisStream": p.streamName, "workerID": p.workerID}).Observe(float64(count))
+}
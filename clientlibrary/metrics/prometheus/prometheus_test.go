@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package prometheus
+
+import (
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vmware/vmware-go-kcl-v2/logger"
+)
+
+func TestMetricsScopedPerStream(t *testing.T) {
+	p := NewMonitoringService(":0", "us-west-2", logger.GetDefaultLogger())
+	p.registerer = prom.NewRegistry()
+	streamA := p.ForStream("stream-a")
+	streamB := p.ForStream("stream-b")
+	// the metrics are registered once for both streams
+	assert.Nil(t, streamA.Init("scopedApp", "stream-a", "workerID"))
+	assert.Nil(t, streamB.Init("scopedApp", "stream-b", "workerID"))
+
+	streamA.IncrRecordsProcessed("shard-0", 1)
+	streamB.IncrRecordsProcessed("shard-0", 2)
+
+	processed := func(stream string) float64 {
+		return testutil.ToFloat64(p.processedRecords.With(prom.Labels{"shard": "shard-0", "kinesisStream": stream}))
+	}
+	assert.Equal(t, float64(1), processed("stream-a"))
+	assert.Equal(t, float64(2), processed("stream-b"))
+}
@@ -48,6 +48,13 @@ type ShardStatus struct {
 	// child shard doesn't have end sequence number
 	EndingSequenceNumber string
 	ClaimRequest         string
+	// Closed is set once GetRecords returned no next shard iterator. During a resharding, ListShards may still
+	// report the shard open for a while (no EndingSequenceNumber) or already report it closed while records can
+	// still be read from it. The GetRecords signal takes precedence: the shard is closed once it is set, and open
+	// until then whatever ListShards reports.
+	Closed bool
+	// LastPollTime is when records were last read from the shard by this worker
+	LastPollTime time.Time
 }
 
 func (ss *ShardStatus) GetLeaseOwner() string {
@@ -86,6 +93,30 @@ func (ss *ShardStatus) SetLeaseTimeout(timeout time.Time) {
 	ss.LeaseTimeout = timeout
 }
 
+func (ss *ShardStatus) IsClosed() bool {
+	ss.Mux.RLock()
+	defer ss.Mux.RUnlock()
+	return ss.Closed
+}
+
+func (ss *ShardStatus) SetClosed() {
+	ss.Mux.Lock()
+	defer ss.Mux.Unlock()
+	ss.Closed = true
+}
+
+func (ss *ShardStatus) GetLastPollTime() time.Time {
+	ss.Mux.RLock()
+	defer ss.Mux.RUnlock()
+	return ss.LastPollTime
+}
+
+func (ss *ShardStatus) SetLastPollTime(t time.Time) {
+	ss.Mux.Lock()
+	defer ss.Mux.Unlock()
+	ss.LastPollTime = t
+}
+
 func (ss *ShardStatus) IsClaimRequestExpired(kclConfig *config.KinesisClientLibConfiguration) bool {
 	if leaseTimeout := ss.GetLeaseTimeout(); leaseTimeout.IsZero() {
 		return false
@@ -24,6 +24,15 @@ import (
 	guuid "github.com/google/uuid"
 )
 
+// IDGenerator generates unique identifiers, e.g. worker IDs.
+type IDGenerator func() string
+
+// NewRandomID generates a random (version 4) UUID from a cryptographically secure source. It is the default
+// IDGenerator.
+func NewRandomID() string {
+	return guuid.Must(guuid.NewRandom()).String()
+}
+
 // MustNewUUID generates a new UUID and panics if failed
 func MustNewUUID() string {
 	id, err := guuid.NewUUID()
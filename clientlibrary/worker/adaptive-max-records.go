@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+const (
+	// bounds of the number of records asked for per GetRecords call with AdaptiveMaxRecords, 10000 being the
+	// most Kinesis returns
+	minAdaptiveMaxRecords = 1
+	maxAdaptiveMaxRecords = 10000
+	// weight of the last response in the average record size, so that the limit follows a lasting change of the
+	// record size rather than a single response
+	recordSizeWeight = 0.3
+)
+
+// adaptiveMaxRecords tunes the number of records asked for per GetRecords call, with AdaptiveMaxRecords: as many
+// records of the average size observed as fit in the MaxBytes a call returns at most. A nil controller keeps the
+// configured MaxRecords.
+type adaptiveMaxRecords struct {
+	limit int
+	// moving average of the size of the records read, 0 until records are read
+	recordSize float64
+}
+
+func newAdaptiveMaxRecords(initial int) *adaptiveMaxRecords {
+	return &adaptiveMaxRecords{limit: clampMaxRecords(initial)}
+}
+
+// maxRecords returns the number of records to ask for, configured when the limit is not adaptive.
+func (a *adaptiveMaxRecords) maxRecords(configured int) int {
+	if a == nil {
+		return configured
+	}
+	return a.limit
+}
+
+// observe updates the limit with the records returned by a GetRecords call. An empty response tells nothing about
+// the size of the records.
+func (a *adaptiveMaxRecords) observe(records []types.Record) {
+	if a == nil || len(records) == 0 {
+		return
+	}
+
+	bytes := 0
+	for _, record := range records {
+		bytes += len(record.Data)
+	}
+	size := float64(bytes) / float64(len(records))
+	if size < 1 {
+		size = 1
+	}
+
+	if a.recordSize == 0 {
+		a.recordSize = size
+	} else {
+		a.recordSize = recordSizeWeight*size + (1-recordSizeWeight)*a.recordSize
+	}
+	a.limit = clampMaxRecords(int(MaxBytes / a.recordSize))
+}
+
+func clampMaxRecords(limit int) int {
+	if limit < minAdaptiveMaxRecords {
+		return minAdaptiveMaxRecords
+	}
+	if limit > maxAdaptiveMaxRecords {
+		return maxAdaptiveMaxRecords
+	}
+	return limit
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+)
+
+// ErrUnknownStage is returned for a stage which was not given to NewCheckpointCoordinator, or has been removed.
+var ErrUnknownStage = errors.New("unknown checkpoint coordinator stage")
+
+// CheckpointCoordinator lets several stages processing the records of a shard in the same process, e.g. a transform
+// and a sink, track their progress independently. Each stage checkpoints through its own checkpointer and the shard
+// is checkpointed at the lowest position committed across the stages, so that no stage loses records on failover.
+//
+// A record processor creates the coordinator with the checkpointer it is given, and hands over the stage
+// checkpointers to its stages.
+type CheckpointCoordinator struct {
+	mux          sync.Mutex
+	checkpointer kcl.IRecordProcessorCheckpointer
+
+	// position committed by each stage, nil until the stage commits
+	stages map[string]*stagePosition
+	// last position checkpointed for the shard
+	committed *stagePosition
+}
+
+// stagePosition is a sequence number, or the end of the shard.
+type stagePosition struct {
+	sequenceNumber string
+	shardEnd       bool
+}
+
+// stageCheckpointer is the checkpointer of a stage of a CheckpointCoordinator.
+type stageCheckpointer struct {
+	coordinator *CheckpointCoordinator
+	stage       string
+}
+
+// NewCheckpointCoordinator creates a coordinator checkpointing the shard with the given checkpointer, for the given
+// stages. All the stages have to commit before the shard is checkpointed.
+func NewCheckpointCoordinator(checkpointer kcl.IRecordProcessorCheckpointer, stages ...string) *CheckpointCoordinator {
+	c := &CheckpointCoordinator{
+		checkpointer: checkpointer,
+		stages:       make(map[string]*stagePosition, len(stages)),
+	}
+	for _, stage := range stages {
+		c.stages[stage] = nil
+	}
+	return c
+}
+
+// Stage returns the checkpointer of a stage given to NewCheckpointCoordinator, or ErrUnknownStage. Checkpointing with
+// a nil sequence number tells the stage is done with the shard: the shard is checkpointed at SHARD_END once all the
+// stages are.
+func (c *CheckpointCoordinator) Stage(stage string) (kcl.IRecordProcessorCheckpointer, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, ok := c.stages[stage]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStage, stage)
+	}
+	return &stageCheckpointer{coordinator: c, stage: stage}, nil
+}
+
+// Position returns the sequence number last committed by the stage, and false if it has not committed yet.
+func (c *CheckpointCoordinator) Position(stage string) (string, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	position := c.stages[stage]
+	if position == nil {
+		return "", false
+	}
+	return position.sequenceNumber, true
+}
+
+// commit records the position of the stage.
+func (c *CheckpointCoordinator) commit(stage string, sequenceNumber *string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if _, ok := c.stages[stage]; !ok {
+		// the stage has been removed
+		return nil
+	}
+	c.stages[stage] = &stagePosition{sequenceNumber: aws.ToString(sequenceNumber), shardEnd: sequenceNumber == nil}
+	return c.checkpointLowest()
+}
+
+// RemoveStage stops tracking a stage, e.g. one which failed, so that it no longer holds the checkpoint of the shard
+// back. The shard is checkpointed at the lowest position of the remaining stages.
+func (c *CheckpointCoordinator) RemoveStage(stage string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	delete(c.stages, stage)
+	if len(c.stages) == 0 {
+		return nil
+	}
+	return c.checkpointLowest()
+}
+
+// checkpointLowest checkpoints the shard at the lowest position of all the stages, if it moved forward.
+func (c *CheckpointCoordinator) checkpointLowest() error {
+	var lowest *stagePosition
+	for _, position := range c.stages {
+		if position == nil {
+			// a stage has not committed anything yet
+			return nil
+		}
+		if lowest == nil || chk.CompareSequenceNumbers(position.checkpoint(), lowest.checkpoint()) < 0 {
+			lowest = position
+		}
+	}
+	if c.committed != nil && chk.CompareSequenceNumbers(c.committed.checkpoint(), lowest.checkpoint()) >= 0 {
+		return nil
+	}
+
+	var checkpoint *string
+	if !lowest.shardEnd {
+		checkpoint = aws.String(lowest.sequenceNumber)
+	}
+	if err := c.checkpointer.Checkpoint(checkpoint); err != nil {
+		return err
+	}
+	c.committed = lowest
+	return nil
+}
+
+// checkpoint returns the position as a checkpoint, SHARD_END being ordered after every sequence number by
+// chk.CompareSequenceNumbers.
+func (p *stagePosition) checkpoint() string {
+	if p.shardEnd {
+		return chk.ShardEnd
+	}
+	return p.sequenceNumber
+}
+
+func (sc *stageCheckpointer) Checkpoint(sequenceNumber *string) error {
+	return sc.coordinator.commit(sc.stage, sequenceNumber)
+}
+
+func (sc *stageCheckpointer) PrepareCheckpoint(sequenceNumber *string) (kcl.IPreparedCheckpointer, error) {
+	return &PreparedCheckpointer{
+		pendingCheckpointSequenceNumber: &kcl.ExtendedSequenceNumber{SequenceNumber: sequenceNumber},
+		checkpointer:                    sc,
+	}, nil
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+)
+
+// recordingCheckpointer records the checkpoints made, and fails them while err is set.
+type recordingCheckpointer struct {
+	checkpoints []string
+	err         error
+}
+
+func (c *recordingCheckpointer) Checkpoint(sequenceNumber *string) error {
+	if c.err != nil {
+		return c.err
+	}
+	if sequenceNumber == nil {
+		c.checkpoints = append(c.checkpoints, chk.ShardEnd)
+	} else {
+		c.checkpoints = append(c.checkpoints, *sequenceNumber)
+	}
+	return nil
+}
+
+func (c *recordingCheckpointer) PrepareCheckpoint(_ *string) (kcl.IPreparedCheckpointer, error) {
+	return &PreparedCheckpointer{}, nil
+}
+
+func TestCheckpointCoordinatorCommitsLowestPosition(t *testing.T) {
+	checkpointer := &recordingCheckpointer{}
+	coordinator := NewCheckpointCoordinator(checkpointer, "transform", "sink")
+	transform, err := coordinator.Stage("transform")
+	assert.Nil(t, err)
+	sink, err := coordinator.Stage("sink")
+	assert.Nil(t, err)
+
+	// the transform commits every record, the sink every third one
+	for i := 1; i <= 10; i++ {
+		assert.Nil(t, transform.Checkpoint(aws.String(strconv.Itoa(i))))
+		if i%3 == 0 {
+			assert.Nil(t, sink.Checkpoint(aws.String(strconv.Itoa(i))))
+		}
+	}
+	assert.Equal(t, []string{"3", "6", "9"}, checkpointer.checkpoints)
+
+	position, ok := coordinator.Position("transform")
+	assert.True(t, ok)
+	assert.Equal(t, "10", position)
+
+	// sequence numbers are compared as numbers
+	assert.Nil(t, sink.Checkpoint(aws.String("10")))
+	assert.Nil(t, transform.Checkpoint(aws.String("100")))
+	assert.Nil(t, sink.Checkpoint(aws.String("99")))
+	assert.Equal(t, []string{"3", "6", "9", "10", "99"}, checkpointer.checkpoints)
+
+	// SHARD_END once every stage is done with the shard
+	assert.Nil(t, transform.Checkpoint(nil))
+	assert.Nil(t, sink.Checkpoint(aws.String("100")))
+	assert.Nil(t, sink.Checkpoint(nil))
+	assert.Equal(t, []string{"3", "6", "9", "10", "99", "100", chk.ShardEnd}, checkpointer.checkpoints)
+}
+
+func TestCheckpointCoordinatorComparesSequenceNumbers(t *testing.T) {
+	checkpointer := &recordingCheckpointer{}
+	coordinator := NewCheckpointCoordinator(checkpointer, "transform", "sink")
+	transform, err := coordinator.Stage("transform")
+	assert.Nil(t, err)
+	sink, err := coordinator.Stage("sink")
+	assert.Nil(t, err)
+
+	// leading zeros do not make a sequence number greater
+	assert.Nil(t, transform.Checkpoint(aws.String("0099")))
+	assert.Nil(t, sink.Checkpoint(aws.String("100")))
+	assert.Equal(t, []string{"0099"}, checkpointer.checkpoints)
+}
+
+func TestCheckpointCoordinatorWaitsForEveryStage(t *testing.T) {
+	checkpointer := &recordingCheckpointer{}
+	coordinator := NewCheckpointCoordinator(checkpointer, "transform", "sink")
+
+	transform, err := coordinator.Stage("transform")
+	assert.Nil(t, err)
+	sink, err := coordinator.Stage("sink")
+	assert.Nil(t, err)
+	assert.Nil(t, transform.Checkpoint(aws.String("5")))
+	assert.Empty(t, checkpointer.checkpoints)
+	_, ok := coordinator.Position("sink")
+	assert.False(t, ok)
+
+	// a failed checkpoint is retried on the next commit
+	checkpointer.err = errors.New("checkpoint failed")
+	assert.Equal(t, checkpointer.err, sink.Checkpoint(aws.String("2")))
+	checkpointer.err = nil
+	prepared, err := sink.PrepareCheckpoint(aws.String("3"))
+	assert.Nil(t, err)
+	assert.Nil(t, prepared.Checkpoint())
+	assert.Equal(t, []string{"3"}, checkpointer.checkpoints)
+
+	_, err = coordinator.Stage("unknown")
+	assert.ErrorIs(t, err, ErrUnknownStage)
+}
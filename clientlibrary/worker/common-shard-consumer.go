@@ -22,6 +22,10 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"sync"
 	"time"
 
@@ -31,12 +35,32 @@ import (
 	deagg "github.com/awslabs/kinesis-aggregation/go/v2/deaggregator"
 
 	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/cloudwatchlogs"
 	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
 	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
 	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
 	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
 )
 
+// errShardEndReached is returned when starting to consume a shard which has already been checkpointed at SHARD_END.
+var errShardEndReached = errors.New("shard has been completely consumed")
+
+// ErrRecordNotDecoded ends the consumer of a shard with a record which cannot be decoded, with FailOnDecodeError or
+// past MaxDecodeErrorsPerBatch.
+var ErrRecordNotDecoded = errors.New("record cannot be decoded")
+
+// ErrRecordInvalid is the error handed over to DecodeErrorDeadLetter, or ending the consumer of the shard, for a record
+// rejected by the RecordValidator.
+var ErrRecordInvalid = errors.New("record failed validation")
+
+// ErrParentShardTimeout ends the consumer of a child shard whose parent shard did not reach SHARD_END within
+// ParentShardWaitTimeoutMillis, with FailAfterParentShardTimeout.
+var ErrParentShardTimeout = errors.New("parent shard did not end in time")
+
+// ErrCheckpointCorrupt ends the consumer of a shard whose checkpoint is not a sequence number, with
+// FailOnCorruptCheckpoint.
+var ErrCheckpointCorrupt = errors.New("checkpoint is not a sequence number")
+
 type shardConsumer interface {
 	getRecords() error
 }
@@ -55,6 +79,135 @@ type commonShardConsumer struct {
 	recordProcessor kcl.IRecordProcessor
 	kclConfig       *config.KinesisClientLibConfiguration
 	mService        metrics.MonitoringService
+	shardCache      *shardMetadataCache
+	// batches the lease renewals of the worker, nil when each consumer renews its own lease
+	leaseRenewer *leaseRenewalBatcher
+	// signals the end of the parent shards consumed by the same worker, nil when not configured
+	shardEnds *shardEndSignals
+	// reports the closure of the shard and throttles the creation of child leases, nil when not configured
+	resharding *reshardingThrottle
+	// caps the checkpoint writes in flight across the shards of the worker, nil when not configured
+	checkpointLimiter *checkpointLimiter
+
+	// last time records were delivered or, with TouchCheckpointOnIdle, the lease of the idle shard was touched
+	lastActive time.Time
+
+	// records buffered until MinBatchRecords are available
+	batch recordBatch
+
+	// when the lease on the shard was acquired, and whether the time to the first record has been reported
+	leaseAcquiredTime   time.Time
+	firstRecordReported bool
+
+	// the configured position the shard was started at, until the user records before its sub-sequence are skipped
+	startAt *kcl.ExtendedSequenceNumber
+
+	// sequence number of the last record delivered to the record processor
+	lastDeliveredSequenceNumber *string
+
+	// highest sequence number read from the shard, with VerifyRecordOrdering
+	highestSequenceNumber string
+
+	// records delivered and not checkpointed yet, tracked with MaxUnackedRecords or ReportUnackedRecords
+	unacked *unackedRecords
+
+	// set while the lag of the shard is over LagThresholdMillis, until back down to LagRecoveryMillis
+	lagExceeded bool
+
+	// last time ProcessTimer was invoked or, before that, the record processor was initialized
+	lastTimer time.Time
+}
+
+// recordBatch accumulates the records of consecutive polls.
+type recordBatch struct {
+	records            []types.Record
+	startTime          time.Time
+	millisBehindLatest *int64
+}
+
+func (b *recordBatch) add(getRecordsStartTime time.Time, records []types.Record, millisBehindLatest *int64) {
+	if b.startTime.IsZero() {
+		b.startTime = getRecordsStartTime
+	}
+	b.records = append(b.records, records...)
+	b.millisBehindLatest = millisBehindLatest
+}
+
+// ready returns true once the batch holds minRecords, or records have been buffered for maxWait.
+func (b *recordBatch) ready(minRecords int, maxWait time.Duration) bool {
+	return len(b.records) >= minRecords || (!b.startTime.IsZero() && time.Since(b.startTime) >= maxWait)
+}
+
+func (b *recordBatch) reset() {
+	b.records = nil
+	b.startTime = time.Time{}
+	b.millisBehindLatest = nil
+}
+
+// trackUnackedRecords starts tracking the records delivered and not checkpointed yet, with MaxUnackedRecords or
+// ReportUnackedRecords. It is called before the record processor checkpointer is created.
+func (sc *commonShardConsumer) trackUnackedRecords() {
+	if sc.kclConfig.MaxUnackedRecords > 0 || sc.kclConfig.ReportUnackedRecords {
+		sc.unacked = &unackedRecords{}
+	}
+}
+
+// newRecordProcessorCheckpointer creates the checkpointer handed over to the record processor.
+func (sc *commonShardConsumer) newRecordProcessorCheckpointer() kcl.IRecordProcessorCheckpointer {
+	return &RecordProcessorCheckpointer{
+		shard:      sc.shard,
+		checkpoint: sc.checkpointer,
+		events:     sc.kclConfig.CheckpointEvents,
+		mService:   sc.mService,
+		unacked:    sc.unacked,
+		renewLease: sc.kclConfig.CheckpointRenewsLease && !sc.kclConfig.EnableLeaseStealing,
+		limiter:    sc.checkpointLimiter,
+	}
+}
+
+// initializationInput returns the input of the record processor initialization: the shard, its checkpoint and its
+// hash key range, read from the shard metadata cache.
+func (sc *commonShardConsumer) initializationInput() *kcl.InitializationInput {
+	input := &kcl.InitializationInput{
+		ShardId:                sc.shard.ID,
+		ExtendedSequenceNumber: &kcl.ExtendedSequenceNumber{SequenceNumber: aws.String(sc.shard.GetCheckpoint())},
+	}
+
+	meta, err := sc.shardCache.get(sc.shard.ID)
+	if err != nil {
+		sc.kclConfig.Logger.Warnf("Unable to read metadata of shard %s: %+v", sc.shard.ID, err)
+	} else if meta != nil && meta.StartingHashKey != "" {
+		input.HashKeyRange = &types.HashKeyRange{
+			StartingHashKey: aws.String(meta.StartingHashKey),
+			EndingHashKey:   aws.String(meta.EndingHashKey),
+		}
+	}
+	return input
+}
+
+// initializeRecordProcessor initializes the record processor. A processor implementing IRecordProcessorInitializer is
+// retried with exponential backoff, up to MaxInitRetries times, while its initialization fails.
+func (sc *commonShardConsumer) initializeRecordProcessor(input *kcl.InitializationInput) error {
+	sc.lastTimer = time.Now()
+	initializer, ok := sc.recordProcessor.(kcl.IRecordProcessorInitializer)
+	if !ok {
+		sc.recordProcessor.Initialize(input)
+		return nil
+	}
+
+	log := sc.kclConfig.Logger
+	var err error
+	for retries := 0; ; retries++ {
+		if err = initializer.InitializeWithError(input); err == nil {
+			return nil
+		}
+		if retries >= sc.kclConfig.MaxInitRetries {
+			log.Errorf("Failed to initialize record processor for shard %s, giving up after %d retries. Error: %+v", sc.shard.ID, retries, err)
+			return err
+		}
+		log.Warnf("Failed to initialize record processor for shard %s, retrying. Error: %+v", sc.shard.ID, err)
+		time.Sleep(time.Duration(math.Exp2(float64(retries))*100) * time.Millisecond)
+	}
 }
 
 // Cleanup the internal lease cache
@@ -74,15 +227,75 @@ func (sc *commonShardConsumer) releaseLease(shard string) {
 	sc.mService.LeaseLost(sc.shard.ID)
 }
 
-// getStartingPosition gets kinesis stating position.
-// First try to fetch checkpoint. If checkpoint is not found use InitialPositionInStream
+// requestShutdown shuts the record processor down with REQUESTED, waiting up to ShutdownGraceMillis for it to return.
+// Checkpoints are written synchronously, so the final checkpoint of the processor is written by then, before the lease
+// on the shard is released. A processor not returning in time is left behind and the lease released regardless.
+func (sc *commonShardConsumer) requestShutdown(recordCheckpointer kcl.IRecordProcessorCheckpointer) {
+	shutdownInput := &kcl.ShutdownInput{ShutdownReason: kcl.REQUESTED, Checkpointer: recordCheckpointer}
+	grace := time.Duration(sc.kclConfig.ShutdownGraceMillis) * time.Millisecond
+	if grace <= 0 {
+		sc.recordProcessor.Shutdown(shutdownInput)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sc.recordProcessor.Shutdown(shutdownInput)
+	}()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		sc.kclConfig.Logger.Warnf("Record processor of shard %s did not shut down within %v, releasing its lease", sc.shard.ID, grace)
+	}
+}
+
+// getStartingPosition gets kinesis stating position, which is logged and reported as a metric with its shard iterator
+// type so that resume position problems show up immediately.
 func (sc *commonShardConsumer) getStartingPosition() (*types.StartingPosition, error) {
+	startPosition, err := sc.startingPosition()
+	if err != nil {
+		return nil, err
+	}
+
+	sc.kclConfig.Logger.Infof("Starting shard: %v with shard iterator type: %v", sc.shard.ID, startPosition.Type)
+	if r, ok := sc.mService.(metrics.ShardStartReporter); ok {
+		r.ShardStarted(sc.shard.ID, string(startPosition.Type))
+	}
+	return startPosition, nil
+}
+
+// startingPosition computes the starting position of the shard.
+// First try to fetch checkpoint. If checkpoint is not found use InitialPositionInStream, with the timestamp of
+// InitialPositionInStreamExtended for AT_TIMESTAMP: a checkpoint always takes precedence over the configured timestamp.
+// A shard checkpointed at SHARD_END has no starting position: errShardEndReached is returned.
+func (sc *commonShardConsumer) startingPosition() (*types.StartingPosition, error) {
 	err := sc.checkpointer.FetchCheckpoint(sc.shard)
 	if err != nil && err != chk.ErrSequenceIDNotFound {
 		return nil, err
 	}
 
 	checkpoint := sc.shard.GetCheckpoint()
+	if checkpoint == chk.ShardEnd {
+		return nil, errShardEndReached
+	}
+	// the configured position only applies to a shard which has not been checkpointed yet, so that the records
+	// processed since are not replayed when the lease is taken again
+	if startAt, ok := sc.kclConfig.StartingSequenceNumbers[sc.shard.ID]; ok && checkpoint == "" {
+		sc.kclConfig.Logger.Infof("Start shard: %v at configured sequence number: %v, sub-sequence: %d",
+			sc.shard.ID, aws.ToString(startAt.SequenceNumber), startAt.SubSequenceNumber)
+		sc.startAt = &startAt
+		return &types.StartingPosition{
+			Type:           types.ShardIteratorTypeAtSequenceNumber,
+			SequenceNumber: startAt.SequenceNumber,
+		}, nil
+	}
+	if checkpoint != "" && !chk.ValidSequenceNumber(checkpoint) {
+		return sc.corruptCheckpointPosition(checkpoint)
+	}
 	if checkpoint != "" {
 		sc.kclConfig.Logger.Debugf("Start shard: %v at checkpoint: %v", sc.shard.ID, checkpoint)
 		return &types.StartingPosition{
@@ -111,17 +324,79 @@ func (sc *commonShardConsumer) getStartingPosition() (*types.StartingPosition, e
 	}, nil
 }
 
-// Need to wait until the parent shard finished
+// corruptCheckpointPosition handles a checkpoint which is not a sequence number according to the
+// CorruptCheckpointPolicy: the shard is either failed or read from TRIM_HORIZON or LATEST, until the record processor
+// checkpoints it again.
+func (sc *commonShardConsumer) corruptCheckpointPosition(checkpoint string) (*types.StartingPosition, error) {
+	log := sc.kclConfig.Logger
+
+	if r, ok := sc.mService.(metrics.CorruptCheckpointReporter); ok {
+		r.CorruptCheckpoint(sc.shard.ID)
+	}
+	var iteratorType types.ShardIteratorType
+	switch sc.kclConfig.CorruptCheckpointPolicy {
+	case config.TrimHorizonOnCorruptCheckpoint:
+		iteratorType = types.ShardIteratorTypeTrimHorizon
+	case config.LatestOnCorruptCheckpoint:
+		iteratorType = types.ShardIteratorTypeLatest
+	default:
+		log.Errorf("Failing shard %s, its checkpoint %q is not a sequence number", sc.shard.ID, checkpoint)
+		return nil, fmt.Errorf("%w: shard %s: %q", ErrCheckpointCorrupt, sc.shard.ID, checkpoint)
+	}
+
+	log.Warnf("Checkpoint %q of shard %s is not a sequence number, starting the shard with %s instead",
+		checkpoint, sc.shard.ID, iteratorType)
+	// the corrupt checkpoint is not to be taken for the position of the shard
+	sc.shard.SetCheckpoint("")
+	return &types.StartingPosition{
+		Type: iteratorType,
+	}, nil
+}
+
+// Need to wait until the parent shard finished. A shard created by a merge has an adjacent parent as well,
+// which is looked up from the shard metadata cache.
 func (sc *commonShardConsumer) waitOnParentShard() error {
 	if len(sc.shard.ParentShardId) == 0 {
 		return nil
 	}
 
+	parents := []string{sc.shard.ParentShardId}
+	meta, err := sc.shardCache.get(sc.shard.ID)
+	if err != nil {
+		sc.kclConfig.Logger.Warnf("Unable to read metadata of shard %s: %+v", sc.shard.ID, err)
+	} else if meta != nil && meta.AdjacentParentShardID != "" {
+		parents = append(parents, meta.AdjacentParentShardID)
+	}
+
+	for _, parent := range parents {
+		// A parent without checkpoint has already been deleted by Kinesis, there is nothing to wait for.
+		if err := sc.waitOnShardEnd(parent); err != nil && err != chk.ErrSequenceIDNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitOnShardEnd blocks until the given shard has been checkpointed at SHARD_END. A shard consumed by the same
+// worker is waited for until its consumer returns, with CoordinateSelfOwnedParentShards.
+func (sc *commonShardConsumer) waitOnShardEnd(shardID string) error {
+	if shardEnd, consumed := sc.shardEnds.waitFor(shardID); shardEnd {
+		sc.kclConfig.Logger.Debugf("Parent shard %s of shard %s ended on this worker", shardID, sc.shard.ID)
+		return nil
+	} else if consumed {
+		sc.kclConfig.Logger.Infof("Parent shard %s of shard %s released before its end, polling for it", shardID, sc.shard.ID)
+	}
+
 	pshard := &par.ShardStatus{
-		ID:  sc.shard.ParentShardId,
+		ID:  shardID,
 		Mux: &sync.RWMutex{},
 	}
 
+	var deadline time.Time
+	if timeout := sc.kclConfig.ParentShardWaitTimeoutMillis; timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+
 	for {
 		if err := sc.checkpointer.FetchCheckpoint(pshard); err != nil {
 			return err
@@ -132,11 +407,46 @@ func (sc *commonShardConsumer) waitOnParentShard() error {
 			return nil
 		}
 
-		time.Sleep(time.Duration(sc.kclConfig.ParentShardPollIntervalMillis) * time.Millisecond)
+		wait := time.Duration(sc.kclConfig.ParentShardPollIntervalMillis) * time.Millisecond
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return sc.parentShardTimedOut(shardID)
+			}
+			if left < wait {
+				wait = left
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+// parentShardTimedOut handles a parent shard which did not end within ParentShardWaitTimeoutMillis, according to
+// ParentShardTimeoutPolicy. A parent missing from the stream, typically the lease of a shard of another stream sharing
+// the lease table, will never end.
+func (sc *commonShardConsumer) parentShardTimedOut(shardID string) error {
+	log := sc.kclConfig.Logger
+
+	reason := "did not reach SHARD_END"
+	if sc.shardCache != nil {
+		if meta, err := sc.shardCache.get(shardID); err == nil && meta == nil {
+			reason = fmt.Sprintf("is not a shard of stream %s", sc.kclConfig.StreamName)
+		}
+	}
+	timeout := time.Duration(sc.kclConfig.ParentShardWaitTimeoutMillis) * time.Millisecond
+
+	if sc.kclConfig.ParentShardTimeoutPolicy == config.FailAfterParentShardTimeout {
+		log.Errorf("Waited %v for parent shard %s of shard %s, which %s. Giving up the shard", timeout, shardID, sc.shard.ID, reason)
+		return fmt.Errorf("%w: parent shard %s of shard %s, which %s", ErrParentShardTimeout, shardID, sc.shard.ID, reason)
 	}
+	log.Errorf("Waited %v for parent shard %s of shard %s, which %s. Consuming the shard without its parent", timeout, shardID, sc.shard.ID, reason)
+	return nil
 }
 
-func (sc *commonShardConsumer) processRecords(getRecordsStartTime time.Time, records []types.Record, millisBehindLatest *int64, recordCheckpointer kcl.IRecordProcessorCheckpointer) {
+// processRecords decodes the records read from the shard and delivers them, or buffers them with MinBatchRecords. An
+// error is returned when the shard is to be failed for records which cannot be decoded, none of the records having been
+// delivered.
+func (sc *commonShardConsumer) processRecords(getRecordsStartTime time.Time, records []types.Record, millisBehindLatest *int64, recordCheckpointer kcl.IRecordProcessorCheckpointer) error {
 	log := sc.kclConfig.Logger
 
 	getRecordsTime := time.Since(getRecordsStartTime).Milliseconds()
@@ -144,17 +454,241 @@ func (sc *commonShardConsumer) processRecords(getRecordsStartTime time.Time, rec
 
 	log.Debugf("Received %d original records.", len(records))
 
-	// De-aggregate the records if they were published by the KPL.
-	dars, err := deagg.DeaggregateRecords(records)
+	sc.checkLag(millisBehindLatest)
+	sc.verifyOrdering(records)
+	dars, err := sc.decodeRecords(records)
 	if err != nil {
-		// The error is caused by bad KPL publisher and just skip the bad records
-		// instead of being stuck here.
-		log.Errorf("Error in de-aggregating KPL records: %+v", err)
+		return err
 	}
 
+	if sc.kclConfig.MinBatchRecords > 1 {
+		sc.batch.add(getRecordsStartTime, dars, millisBehindLatest)
+		if !sc.batch.ready(sc.kclConfig.MinBatchRecords, time.Duration(sc.kclConfig.MaxBatchWaitMillis)*time.Millisecond) {
+			log.Debugf("Buffered %d records, waiting for %d", len(sc.batch.records), sc.kclConfig.MinBatchRecords)
+			return nil
+		}
+		sc.flushBatch(recordCheckpointer)
+		return nil
+	}
+
+	sc.deliverRecords(getRecordsStartTime, dars, millisBehindLatest, recordCheckpointer)
+	return nil
+}
+
+// checkLag calls OnLagThresholdExceeded once the lag of the shard goes over LagThresholdMillis, then OnLagRecovered
+// once it is back down to LagRecoveryMillis.
+func (sc *commonShardConsumer) checkLag(millisBehindLatest *int64) {
+	threshold := sc.kclConfig.LagThresholdMillis
+	if threshold <= 0 || millisBehindLatest == nil {
+		return
+	}
+
+	lag := *millisBehindLatest
+	switch {
+	case !sc.lagExceeded && lag > int64(threshold):
+		sc.lagExceeded = true
+		sc.kclConfig.Logger.Infof("Shard %s is %d ms behind, over the %d ms threshold", sc.shard.ID, lag, threshold)
+		if sc.kclConfig.OnLagThresholdExceeded != nil {
+			sc.kclConfig.OnLagThresholdExceeded(sc.shard.ID, lag)
+		}
+	case sc.lagExceeded && lag <= int64(sc.kclConfig.LagRecoveryMillis):
+		sc.lagExceeded = false
+		sc.kclConfig.Logger.Infof("Shard %s is %d ms behind, recovered", sc.shard.ID, lag)
+		if sc.kclConfig.OnLagRecovered != nil {
+			sc.kclConfig.OnLagRecovered(sc.shard.ID)
+		}
+	}
+}
+
+// processTimerInterval returns ProcessTimerIntervalMillis as a duration, or 0 when the timer is disabled or the record
+// processor does not implement IRecordProcessorTimer.
+func (sc *commonShardConsumer) processTimerInterval() time.Duration {
+	if _, ok := sc.recordProcessor.(kcl.IRecordProcessorTimer); !ok {
+		return 0
+	}
+	return time.Duration(sc.kclConfig.ProcessTimerIntervalMillis) * time.Millisecond
+}
+
+// processTimer invokes ProcessTimer once the interval has elapsed since it was last invoked, and returns how long
+// until it is due again, or 0 when the timer is disabled.
+func (sc *commonShardConsumer) processTimer(recordCheckpointer kcl.IRecordProcessorCheckpointer) time.Duration {
+	interval := sc.processTimerInterval()
+	if interval <= 0 {
+		return 0
+	}
+
+	elapsed := time.Since(sc.lastTimer)
+	if elapsed < interval {
+		return interval - elapsed
+	}
+	sc.recordProcessor.(kcl.IRecordProcessorTimer).ProcessTimer(&kcl.ProcessTimerInput{
+		Checkpointer:   recordCheckpointer,
+		SinceLastTimer: elapsed,
+	})
+	sc.lastTimer = time.Now()
+	return interval
+}
+
+// verifyOrdering checks, with VerifyRecordOrdering, that each record read comes after all the records read from the
+// shard before it. Each record which does not is reported with the RecordOrderViolation metric.
+func (sc *commonShardConsumer) verifyOrdering(records []types.Record) {
+	if !sc.kclConfig.VerifyRecordOrdering {
+		return
+	}
+
+	for _, record := range records {
+		sequenceNumber := aws.ToString(record.SequenceNumber)
+		if sc.highestSequenceNumber != "" && chk.CompareSequenceNumbers(sequenceNumber, sc.highestSequenceNumber) <= 0 {
+			sc.kclConfig.Logger.Errorf("Record %s of shard %s is out of order, record %s has been read before it",
+				sequenceNumber, sc.shard.ID, sc.highestSequenceNumber)
+			if r, ok := sc.mService.(metrics.RecordOrderViolationReporter); ok {
+				r.RecordOrderViolation(sc.shard.ID)
+			}
+			continue
+		}
+		sc.highestSequenceNumber = sequenceNumber
+	}
+}
+
+// decodeRecords de-aggregates the records published by the KPL, and validates the user records with the
+// RecordValidator. Each record which cannot be decoded or fails validation is counted with the DecodeError metric and
+// handled according to the DecodeErrorPolicy: skipped, handed over to the dead letter or, as when there are more than
+// MaxDecodeErrorsPerBatch of them, failing the whole batch.
+func (sc *commonShardConsumer) decodeRecords(records []types.Record) ([]types.Record, error) {
+	decoded := make([]types.Record, 0, len(records))
+	decodeErrors := 0
+	for _, record := range records {
+		dars, err := deagg.DeaggregateRecords([]types.Record{record})
+		if err != nil {
+			decodeErrors++
+			err = fmt.Errorf("%w: record %s of shard %s: %v", ErrRecordNotDecoded, aws.ToString(record.SequenceNumber), sc.shard.ID, err)
+			if err := sc.rejectRecord(record, err, decodeErrors); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		dars = sc.skipSubSequences(record, dars)
+		if sc.kclConfig.DecodeCloudWatchLogs {
+			if dars, err = splitLogEvents(dars); err != nil {
+				decodeErrors++
+				err = fmt.Errorf("%w: record %s of shard %s: %v", ErrRecordNotDecoded, aws.ToString(record.SequenceNumber), sc.shard.ID, err)
+				if err := sc.rejectRecord(record, err, decodeErrors); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		for _, dar := range dars {
+			if validator := sc.kclConfig.RecordValidator; validator != nil {
+				if err := validator(dar); err != nil {
+					decodeErrors++
+					err = fmt.Errorf("%w: record %s of shard %s: %v", ErrRecordInvalid, aws.ToString(dar.SequenceNumber), sc.shard.ID, err)
+					if err := sc.rejectRecord(dar, err, decodeErrors); err != nil {
+						return nil, err
+					}
+					continue
+				}
+			}
+			decoded = append(decoded, dar)
+		}
+	}
+	if len(records) > 0 {
+		sc.startAt = nil
+	}
+	return decoded, nil
+}
+
+// splitLogEvents replaces the CloudWatch Logs subscription envelopes among the records with their log events, one
+// record each, encoded in JSON. The other records are kept as they are.
+func splitLogEvents(records []types.Record) ([]types.Record, error) {
+	split := make([]types.Record, 0, len(records))
+	for _, record := range records {
+		envelope, err := cloudwatchlogs.Decode(record.Data)
+		if errors.Is(err, cloudwatchlogs.ErrNotCloudWatchLogs) {
+			split = append(split, record)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range envelope.Events() {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return nil, err
+			}
+			logEvent := record
+			logEvent.Data = data
+			split = append(split, logEvent)
+		}
+	}
+	return split, nil
+}
+
+// rejectRecord handles a record which is not to be delivered, the decodeErrors-th of the batch, according to the
+// DecodeErrorPolicy. The error returned, if any, fails the batch.
+func (sc *commonShardConsumer) rejectRecord(record types.Record, err error, decodeErrors int) error {
+	log := sc.kclConfig.Logger
+
+	if r, ok := sc.mService.(metrics.DecodeErrorReporter); ok {
+		r.DecodeError(sc.shard.ID)
+	}
+	if sc.kclConfig.DecodeErrorPolicy == config.FailOnDecodeError {
+		log.Errorf("Failing shard %s: %+v", sc.shard.ID, err)
+		return err
+	}
+	if maxErrors := sc.kclConfig.MaxDecodeErrorsPerBatch; maxErrors > 0 && decodeErrors > maxErrors {
+		log.Errorf("Failing shard %s, more than %d records of the batch cannot be decoded: %+v", sc.shard.ID, maxErrors, err)
+		return err
+	}
+	if sc.kclConfig.DecodeErrorPolicy == config.DeadLetterOnDecodeError {
+		log.Warnf("Dead lettering record: %+v", err)
+		sc.kclConfig.DecodeErrorDeadLetter(sc.shard.ID, record, err)
+		return nil
+	}
+	log.Errorf("Skipping record: %+v", err)
+	return nil
+}
+
+// skipSubSequences drops the user records which come before the configured sub-sequence number in the aggregated
+// record the shard was started at. The aggregated record is the first one read, as the shard is read
+// AT_SEQUENCE_NUMBER; its user records share its sequence number, and the sub-sequence number of each is its position
+// in the aggregated record, before any of them is rejected.
+func (sc *commonShardConsumer) skipSubSequences(record types.Record, dars []types.Record) []types.Record {
+	startAt := sc.startAt
+	if startAt == nil || aws.ToString(record.SequenceNumber) != aws.ToString(startAt.SequenceNumber) {
+		return dars
+	}
+
+	kept := make([]types.Record, 0, len(dars))
+	for i, dar := range dars {
+		if subSequenceNumber := int64(i); subSequenceNumber >= startAt.SubSequenceNumber {
+			kept = append(kept, dar)
+		}
+	}
+	return kept
+}
+
+// flushBatch delivers the buffered records, if any, to the record processor. It is called when the batch is
+// ready and before the record processor is shut down, so that no buffered record is lost.
+func (sc *commonShardConsumer) flushBatch(recordCheckpointer kcl.IRecordProcessorCheckpointer) {
+	if sc.batch.startTime.IsZero() {
+		return
+	}
+
+	startTime, records, millisBehindLatest := sc.batch.startTime, sc.batch.records, sc.batch.millisBehindLatest
+	sc.batch.reset()
+	sc.deliverRecords(startTime, records, millisBehindLatest, recordCheckpointer)
+}
+
+// deliverRecords hands de-aggregated records over to the record processor. A nil millisBehindLatest means the lag
+// is unknown: it is passed on as 0 but not reported as a metric.
+func (sc *commonShardConsumer) deliverRecords(getRecordsStartTime time.Time, records []types.Record, millisBehindLatest *int64, recordCheckpointer kcl.IRecordProcessorCheckpointer) {
+	log := sc.kclConfig.Logger
+
 	input := &kcl.ProcessRecordsInput{
-		Records:            dars,
-		MillisBehindLatest: *millisBehindLatest,
+		Records:            records,
+		MillisBehindLatest: aws.ToInt64(millisBehindLatest),
 		Checkpointer:       recordCheckpointer,
 	}
 
@@ -172,12 +706,206 @@ func (sc *commonShardConsumer) processRecords(getRecordsStartTime time.Time, rec
 		// Delivery the events to the record processor
 		input.CacheEntryTime = &getRecordsStartTime
 		input.CacheExitTime = &processRecordsStartTime
+		ctx, cancel := sc.leaseContext()
+		input.Ctx = ctx
+		// tracked before delivery, as the record processor may checkpoint them right away
+		sc.unacked.delivered(input.Records)
 		sc.recordProcessor.ProcessRecords(input)
+		cancel()
+		if sc.kclConfig.ReportUnackedRecords {
+			if r, ok := sc.mService.(metrics.UnackedRecordsReporter); ok {
+				r.UnackedRecords(sc.shard.ID, sc.unacked.count())
+			}
+		}
+		if recordLength > 0 {
+			sc.lastDeliveredSequenceNumber = input.Records[recordLength-1].SequenceNumber
+		}
 		processedRecordsTiming := time.Since(processRecordsStartTime).Milliseconds()
 		sc.mService.RecordProcessRecordsTime(sc.shard.ID, float64(processedRecordsTiming))
 	}
 
+	// time from the lease acquisition to the first record, or to finding the shard caught up
+	caughtUp := millisBehindLatest != nil && *millisBehindLatest == 0
+	if !sc.firstRecordReported && !sc.leaseAcquiredTime.IsZero() && (recordLength > 0 || caughtUp) {
+		sc.firstRecordReported = true
+		if r, ok := sc.mService.(metrics.TimeToFirstRecordReporter); ok {
+			r.TimeToFirstRecord(sc.shard.ID, time.Since(sc.leaseAcquiredTime))
+		}
+	}
+
+	if recordLength > 0 {
+		sc.lastActive = time.Now()
+	} else {
+		sc.touchCheckpointIfIdle()
+	}
+
 	sc.mService.IncrRecordsProcessed(sc.shard.ID, recordLength)
 	sc.mService.IncrBytesProcessed(sc.shard.ID, recordBytes)
-	sc.mService.MillisBehindLatest(sc.shard.ID, float64(*millisBehindLatest))
+	if millisBehindLatest != nil {
+		sc.mService.MillisBehindLatest(sc.shard.ID, float64(*millisBehindLatest))
+	}
+}
+
+// touchCheckpointIfIdle advances the heartbeat of the lease, with TouchCheckpointOnIdle, once the shard has been
+// idle for TouchCheckpointIntervalMillis since it last delivered records or was touched.
+func (sc *commonShardConsumer) touchCheckpointIfIdle() {
+	if !sc.kclConfig.TouchCheckpointOnIdle {
+		return
+	}
+	toucher, ok := sc.checkpointer.(chk.CheckpointToucher)
+	if !ok {
+		return
+	}
+
+	if sc.lastActive.IsZero() {
+		sc.lastActive = time.Now()
+		return
+	}
+	if time.Since(sc.lastActive) < time.Duration(sc.kclConfig.TouchCheckpointIntervalMillis)*time.Millisecond {
+		return
+	}
+	// a failed touch is not retried before the next interval either
+	sc.lastActive = time.Now()
+	if err := toucher.TouchCheckpoint(sc.shard); err != nil {
+		sc.kclConfig.Logger.Warnf("Failed to touch the checkpoint of idle shard %s: %+v", sc.shard.ID, err)
+	}
+}
+
+// skipCompletedShard gives up a shard found checkpointed at SHARD_END when starting to consume it, without any
+// GetShardIterator or SubscribeToShard call nor record processor. Its child shards can already be consumed.
+func (sc *commonShardConsumer) skipCompletedShard() {
+	sc.kclConfig.Logger.Infof("Shard %s has already been completely consumed", sc.shard.ID)
+	sc.shard.SetClosed()
+}
+
+// endShard terminates the record processor of a shard which has been completely read. Buffered records are
+// delivered first and, with CallProcessRecordsOnShardEnd, a final batch flagged IsShardEnd. With
+// CheckpointFinalRecordsAtShardEnd, the last record delivered is checkpointed before the processor gets to checkpoint
+// SHARD_END.
+func (sc *commonShardConsumer) endShard(recordCheckpointer kcl.IRecordProcessorCheckpointer) {
+	sc.kclConfig.Logger.Infof("Shard %s closed", sc.shard.ID)
+	// the stream has been resharded, cached shard metadata is stale
+	sc.shardCache.invalidate()
+	sc.flushBatch(recordCheckpointer)
+
+	if sc.kclConfig.CheckpointFinalRecordsAtShardEnd {
+		if err := sc.checkpointFinalRecords(recordCheckpointer); err != nil {
+			sc.kclConfig.Logger.Errorf("Failed to checkpoint the final records of shard %s, not ending it: %+v", sc.shard.ID, err)
+			sc.requestShutdown(recordCheckpointer)
+			return
+		}
+	}
+
+	// only now is the shard ended for good: its children may start once it is checkpointed at SHARD_END
+	sc.shard.SetClosed()
+	if sc.resharding != nil {
+		sc.resharding.shardClosed()
+	}
+
+	if sc.kclConfig.CallProcessRecordsOnShardEnd {
+		ctx, cancel := sc.leaseContext()
+		sc.recordProcessor.ProcessRecords(&kcl.ProcessRecordsInput{
+			Records:      []types.Record{},
+			Checkpointer: recordCheckpointer,
+			Ctx:          ctx,
+			IsShardEnd:   true,
+		})
+		cancel()
+	}
+
+	shutdownInput := &kcl.ShutdownInput{ShutdownReason: kcl.TERMINATE, Checkpointer: recordCheckpointer}
+	sc.recordProcessor.Shutdown(shutdownInput)
+}
+
+// checkpointFinalRecords checkpoints the last record delivered from the shard, unless it is already.
+func (sc *commonShardConsumer) checkpointFinalRecords(recordCheckpointer kcl.IRecordProcessorCheckpointer) error {
+	last := sc.lastDeliveredSequenceNumber
+	if last == nil {
+		return nil
+	}
+
+	checkpoint := sc.shard.GetCheckpoint()
+	if checkpoint == *last || checkpoint == chk.ShardEnd {
+		return nil
+	}
+	return recordCheckpointer.Checkpoint(last)
+}
+
+// createChildLeases creates the leases of the child shards of the closed shard, when the checkpointer supports it, so
+// that they are in the lease table before the next shard sync. The worker ending a sibling shard may be creating the
+// same lease: the checkpointer treats a lease created concurrently as success.
+func (sc *commonShardConsumer) createChildLeases(childShards []types.ChildShard) {
+	creator, ok := sc.checkpointer.(chk.LeaseCreator)
+	if !ok {
+		return
+	}
+
+	for _, child := range childShards {
+		shard := &par.ShardStatus{ID: aws.ToString(child.ShardId), Mux: &sync.RWMutex{}}
+		if len(child.ParentShards) > 0 {
+			shard.ParentShardId = child.ParentShards[0]
+		}
+		if sc.resharding != nil && !sc.resharding.waitForWrite() {
+			return
+		}
+		if err := creator.CreateLease(shard); err != nil {
+			// the lease is created anyway on the first acquisition after the next shard sync
+			sc.kclConfig.Logger.Warnf("Failed to create lease of child shard %s of shard %s: %+v", shard.ID, sc.shard.ID, err)
+		}
+	}
+}
+
+// leaseRenewalDelay returns how long to wait before renewing the lease on the shard: LeaseRefreshPeriodMillis
+// before it expires, brought forward by ClockSkewToleranceMillis to account for clocks skewed between workers, and
+// no less than MinLeaseRenewalIntervalMillis.
+func (sc *commonShardConsumer) leaseRenewalDelay() time.Duration {
+	ahead := time.Duration(sc.kclConfig.LeaseRefreshPeriodMillis+sc.kclConfig.ClockSkewToleranceMillis) * time.Millisecond
+	return sc.minLeaseRenewalDelay(time.Until(sc.shard.GetLeaseTimeout().Add(-ahead)))
+}
+
+// minLeaseRenewalDelay raises the delay before the next lease renewal to MinLeaseRenewalIntervalMillis.
+func (sc *commonShardConsumer) minLeaseRenewalDelay(delay time.Duration) time.Duration {
+	if floor := time.Duration(sc.kclConfig.MinLeaseRenewalIntervalMillis) * time.Millisecond; delay < floor {
+		return floor
+	}
+	return delay
+}
+
+// renewShardLease renews the lease on the shard, together with the other leases of the worker when renewals are
+// batched.
+func (sc *commonShardConsumer) renewShardLease(assignTo string) error {
+	if sc.leaseRenewer != nil {
+		return sc.leaseRenewer.renew(sc.shard, assignTo)
+	}
+	return sc.checkpointer.GetLease(sc.shard, assignTo)
+}
+
+// leaseContext returns a context which is canceled ProcessingDeadlineMarginMillis before the lease on the shard
+// expires. Lease renewals happening in the meantime push the deadline back.
+func (sc *commonShardConsumer) leaseContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if sc.shard.GetLeaseTimeout().IsZero() {
+		return ctx, cancel
+	}
+
+	margin := time.Duration(sc.kclConfig.ProcessingDeadlineMarginMillis) * time.Millisecond
+	go func() {
+		for {
+			remaining := time.Until(sc.shard.GetLeaseTimeout().Add(-margin))
+			if remaining <= 0 {
+				sc.kclConfig.Logger.Warnf("Lease on shard %s is about to expire, canceling record processing", sc.shard.ID)
+				cancel()
+				return
+			}
+
+			timer := time.NewTimer(remaining)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+	return ctx, cancel
 }
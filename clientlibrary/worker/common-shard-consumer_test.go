@@ -0,0 +1,913 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	rec "github.com/awslabs/kinesis-aggregation/go/v2/records"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/cloudwatchlogs"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+	"github.com/vmware/vmware-go-kcl-v2/logger"
+)
+
+// testRecordProcessor delegates ProcessRecords and Shutdown to test provided functions.
+type testRecordProcessor struct {
+	initialize     func(input *kcl.InitializationInput)
+	processRecords func(input *kcl.ProcessRecordsInput)
+	shutdown       func(input *kcl.ShutdownInput)
+}
+
+func (p *testRecordProcessor) Initialize(input *kcl.InitializationInput) {
+	if p.initialize != nil {
+		p.initialize(input)
+	}
+}
+
+func (p *testRecordProcessor) ProcessRecords(input *kcl.ProcessRecordsInput) {
+	if p.processRecords != nil {
+		p.processRecords(input)
+	}
+}
+
+func (p *testRecordProcessor) Shutdown(input *kcl.ShutdownInput) {
+	if p.shutdown != nil {
+		p.shutdown(input)
+	}
+}
+
+func newTestCommonShardConsumer(kclConfig *config.KinesisClientLibConfiguration, processor kcl.IRecordProcessor) *commonShardConsumer {
+	return &commonShardConsumer{
+		shard:           &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}},
+		recordProcessor: processor,
+		kclConfig:       kclConfig,
+		mService:        metrics.NoopMonitoringService{},
+	}
+}
+
+func TestProcessRecordsContextCanceledBeforeLeaseExpiry(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithProcessingDeadlineMarginMillis(100)
+
+	var canceledAfter time.Duration
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		start := time.Now()
+		select {
+		case <-input.Ctx.Done():
+			canceledAfter = time.Since(start)
+		case <-time.After(5 * time.Second):
+		}
+	}}
+
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+	sc.shard.SetLeaseTimeout(time.Now().Add(300 * time.Millisecond))
+
+	millisBehindLatest := int64(0)
+	sc.processRecords(time.Now(), []types.Record{{Data: []byte("data"), PartitionKey: aws.String("key")}}, &millisBehindLatest, nil)
+
+	assert.NotZero(t, canceledAfter, "context should have been canceled")
+	assert.True(t, canceledAfter >= 150*time.Millisecond, "canceled too early: %v", canceledAfter)
+	assert.True(t, canceledAfter < 2*time.Second, "canceled too late: %v", canceledAfter)
+}
+
+func TestProcessRecordsContextFollowsLeaseRenewal(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithProcessingDeadlineMarginMillis(100)
+
+	var sc *commonShardConsumer
+	var canceledAfter time.Duration
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		start := time.Now()
+		// the lease is renewed while processing
+		sc.shard.SetLeaseTimeout(time.Now().Add(500 * time.Millisecond))
+		select {
+		case <-input.Ctx.Done():
+			canceledAfter = time.Since(start)
+		case <-time.After(5 * time.Second):
+		}
+	}}
+
+	sc = newTestCommonShardConsumer(kclConfig, processor)
+	sc.shard.SetLeaseTimeout(time.Now().Add(200 * time.Millisecond))
+
+	millisBehindLatest := int64(0)
+	sc.processRecords(time.Now(), []types.Record{{Data: []byte("data"), PartitionKey: aws.String("key")}}, &millisBehindLatest, nil)
+
+	assert.True(t, canceledAfter >= 350*time.Millisecond, "renewal was not honored: %v", canceledAfter)
+	assert.True(t, canceledAfter < 2*time.Second, "canceled too late: %v", canceledAfter)
+}
+
+func TestProcessRecordsContextWithoutLease(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+
+	var ctxErr error
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		ctxErr = input.Ctx.Err()
+	}}
+
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+	millisBehindLatest := int64(0)
+	sc.processRecords(time.Now(), []types.Record{{Data: []byte("data"), PartitionKey: aws.String("key")}}, &millisBehindLatest, nil)
+
+	assert.Nil(t, ctxErr)
+}
+
+func TestProcessRecordsBuffersUntilMinBatchRecords(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithMinBatchRecords(3).
+		WithMaxBatchWaitMillis(100)
+
+	var batches [][]types.Record
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		batches = append(batches, input.Records)
+	}}
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+
+	record := types.Record{Data: []byte("data"), PartitionKey: aws.String("key")}
+	millisBehindLatest := int64(0)
+
+	sc.processRecords(time.Now(), []types.Record{record}, &millisBehindLatest, nil)
+	sc.processRecords(time.Now(), []types.Record{}, &millisBehindLatest, nil)
+	sc.processRecords(time.Now(), []types.Record{record}, &millisBehindLatest, nil)
+	assert.Equal(t, 0, len(batches), "records should be buffered")
+
+	sc.processRecords(time.Now(), []types.Record{record, record}, &millisBehindLatest, nil)
+	assert.Equal(t, 1, len(batches))
+	assert.Equal(t, 4, len(batches[0]))
+
+	// flushed once MaxBatchWaitMillis elapsed, even below the threshold
+	sc.processRecords(time.Now(), []types.Record{record}, &millisBehindLatest, nil)
+	assert.Equal(t, 1, len(batches))
+	time.Sleep(150 * time.Millisecond)
+	sc.processRecords(time.Now(), []types.Record{}, &millisBehindLatest, nil)
+	assert.Equal(t, 2, len(batches))
+	assert.Equal(t, 1, len(batches[1]))
+
+	// remaining records are flushed before shutdown
+	sc.processRecords(time.Now(), []types.Record{record}, &millisBehindLatest, nil)
+	sc.flushBatch(nil)
+	assert.Equal(t, 3, len(batches))
+	sc.flushBatch(nil)
+	assert.Equal(t, 3, len(batches))
+}
+
+func TestProcessRecordsWithoutMillisBehindLatest(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithCallProcessRecordsEvenForEmptyRecordList(true)
+
+	var calls int
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		calls++
+		assert.Equal(t, int64(0), input.MillisBehindLatest)
+	}}
+
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+	sc.processRecords(time.Now(), []types.Record{}, nil, nil)
+	assert.Equal(t, 1, calls)
+}
+
+func TestEndShardDeliversShardEndBatchBeforeTerminate(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithMinBatchRecords(3).
+		WithCallProcessRecordsOnShardEnd(true)
+
+	var events []string
+	processor := &testRecordProcessor{
+		processRecords: func(input *kcl.ProcessRecordsInput) {
+			if !input.IsShardEnd {
+				events = append(events, fmt.Sprintf("records:%d", len(input.Records)))
+				return
+			}
+			events = append(events, "shard end")
+			assert.Nil(t, input.Checkpointer.Checkpoint(nil))
+		},
+		shutdown: func(input *kcl.ShutdownInput) {
+			events = append(events, "shutdown:"+aws.ToString(kcl.ShutdownReasonMessage(input.ShutdownReason)))
+		},
+	}
+
+	checkpointer := newTestCheckpointer(map[string]*testLease{})
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+	sc.checkpointer = checkpointer
+	recordCheckpointer := sc.newRecordProcessorCheckpointer()
+	millisBehindLatest := int64(0)
+	sc.processRecords(time.Now(), []types.Record{{Data: []byte("data"), PartitionKey: aws.String("key")}}, &millisBehindLatest, recordCheckpointer)
+	sc.endShard(recordCheckpointer)
+
+	// buffered records first, then the shard end flush and only then TERMINATE
+	assert.Equal(t, []string{"records:1", "shard end", "shutdown:TERMINATE"}, events)
+	assert.Equal(t, chk.ShardEnd, checkpointer.leases["shard-0"].checkpoint)
+	assert.True(t, sc.shard.IsClosed())
+}
+
+// firstRecordMonitoringService records the reported times to the first record.
+type firstRecordMonitoringService struct {
+	metrics.NoopMonitoringService
+	durations []time.Duration
+}
+
+func (m *firstRecordMonitoringService) TimeToFirstRecord(shard string, d time.Duration) {
+	m.durations = append(m.durations, d)
+}
+
+func TestTimeToFirstRecordReportedOnce(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {}}
+	mService := &firstRecordMonitoringService{}
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+	sc.mService = mService
+
+	initialized := time.Now()
+	sc.leaseAcquiredTime = initialized
+	time.Sleep(100 * time.Millisecond)
+
+	millisBehindLatest := int64(1000)
+	records := []types.Record{{Data: []byte("data"), PartitionKey: aws.String("key")}}
+	sc.processRecords(time.Now(), records, &millisBehindLatest, nil)
+	elapsed := time.Since(initialized)
+	sc.processRecords(time.Now(), records, &millisBehindLatest, nil)
+
+	if assert.Len(t, mService.durations, 1) {
+		assert.GreaterOrEqual(t, mService.durations[0], 100*time.Millisecond)
+		assert.LessOrEqual(t, mService.durations[0], elapsed)
+	}
+}
+
+// failingInitRecordProcessor fails its first initializations.
+type failingInitRecordProcessor struct {
+	testRecordProcessor
+	failures int
+	attempts int
+}
+
+func (p *failingInitRecordProcessor) InitializeWithError(_ *kcl.InitializationInput) error {
+	p.attempts++
+	if p.attempts <= p.failures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestInitializeRecordProcessorRetried(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+
+	processor := &failingInitRecordProcessor{failures: 2}
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+	assert.Nil(t, sc.initializeRecordProcessor(&kcl.InitializationInput{ShardId: "shard-0"}))
+	assert.Equal(t, 3, processor.attempts)
+}
+
+func TestInitializeRecordProcessorGivesUp(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithMaxInitRetries(1)
+
+	processor := &failingInitRecordProcessor{failures: 5}
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, processor, newFakeKinesis("shard-0"), checkpointer)
+
+	// the lease is released for another worker to try
+	assert.NotNil(t, sc.getRecords())
+	assert.Equal(t, 2, processor.attempts)
+	assert.Equal(t, 1, checkpointer.called("RemoveLeaseOwner", "shard-0"))
+}
+
+// aggregateRecord encodes the given user records as a KPL aggregated record.
+// https://github.com/awslabs/amazon-kinesis-producer/blob/master/aggregation-format.md
+func aggregateRecord(sequenceNumber string, data ...string) types.Record {
+	aggr := &rec.AggregatedRecord{}
+	for i, d := range data {
+		partKey := uint64(i)
+		aggr.Records = append(aggr.Records, &rec.Record{PartitionKeyIndex: &partKey, Data: []byte(d)})
+		aggr.PartitionKeyTable = append(aggr.PartitionKeyTable, fmt.Sprint(i))
+	}
+
+	payload, _ := proto.Marshal(aggr)
+	md5Hash := md5.Sum(payload)
+	encoded := append([]byte("\xf3\x89\x9a\xc2"), payload...)
+	encoded = append(encoded, md5Hash[:]...)
+	return types.Record{Data: encoded, PartitionKey: aws.String("0"), SequenceNumber: aws.String(sequenceNumber)}
+}
+
+func TestStartAtSubSequenceNumber(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithStartingSequenceNumber("shard-0", kcl.ExtendedSequenceNumber{SequenceNumber: aws.String("100"), SubSequenceNumber: 2})
+
+	var delivered []string
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		for _, r := range input.Records {
+			delivered = append(delivered, string(r.Data))
+		}
+	}}
+
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+	sc.checkpointer = newTestCheckpointer(map[string]*testLease{"shard-0": {}})
+
+	// the shard has no checkpoint, it starts at the configured position
+	startPosition, err := sc.getStartingPosition()
+	assert.Nil(t, err)
+	assert.Equal(t, types.ShardIteratorTypeAtSequenceNumber, startPosition.Type)
+	assert.Equal(t, "100", aws.ToString(startPosition.SequenceNumber))
+
+	millisBehindLatest := int64(0)
+	sc.processRecords(time.Now(), []types.Record{
+		aggregateRecord("100", "a0", "a1", "a2", "a3"),
+		aggregateRecord("101", "b0", "b1"),
+	}, &millisBehindLatest, nil)
+	assert.Equal(t, []string{"a2", "a3", "b0", "b1"}, delivered)
+
+	// only the records of the starting aggregated record are skipped
+	delivered = nil
+	sc.processRecords(time.Now(), []types.Record{aggregateRecord("102", "c0", "c1", "c2")}, &millisBehindLatest, nil)
+	assert.Equal(t, []string{"c0", "c1", "c2"}, delivered)
+}
+
+func TestStartAtSubSequenceNumberWithRejectedRecords(t *testing.T) {
+	// the user records before the starting sub-sequence number are skipped whether they are valid or not
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithStartingSequenceNumber("shard-0", kcl.ExtendedSequenceNumber{SequenceNumber: aws.String("100"), SubSequenceNumber: 2}).
+		WithRecordValidator(func(record types.Record) error {
+			if string(record.Data) == "a0" || string(record.Data) == "a3" {
+				return errors.New("invalid record")
+			}
+			return nil
+		})
+
+	var delivered []string
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		for _, r := range input.Records {
+			delivered = append(delivered, string(r.Data))
+		}
+	}}
+
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+	sc.checkpointer = newTestCheckpointer(map[string]*testLease{"shard-0": {}})
+	_, err := sc.getStartingPosition()
+	assert.Nil(t, err)
+
+	millisBehindLatest := int64(0)
+	sc.processRecords(time.Now(), []types.Record{
+		aggregateRecord("100", "a0", "a1", "a2", "a3", "a4"),
+		aggregateRecord("101", "b0"),
+	}, &millisBehindLatest, nil)
+	assert.Equal(t, []string{"a2", "a4", "b0"}, delivered)
+}
+
+func TestEmptyBatchesNotCheckpointed(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithCallProcessRecordsEvenForEmptyRecordList(true)
+	// the processor checkpoints the last record it got on every batch, empty ones included
+	var last *string
+	sc := newTestCommonShardConsumer(kclConfig, &testRecordProcessor{
+		processRecords: func(input *kcl.ProcessRecordsInput) {
+			if n := len(input.Records); n > 0 {
+				last = input.Records[n-1].SequenceNumber
+			}
+			assert.Nil(t, input.Checkpointer.Checkpoint(last))
+		},
+	})
+	checkpointer := newTestCheckpointer(map[string]*testLease{})
+	sc.checkpointer = checkpointer
+	recordCheckpointer := sc.newRecordProcessorCheckpointer()
+
+	sc.deliverRecords(time.Now(), []types.Record{{SequenceNumber: aws.String("100")}}, aws.Int64(0), recordCheckpointer)
+	for i := 0; i < 3; i++ {
+		sc.deliverRecords(time.Now(), nil, aws.Int64(0), recordCheckpointer)
+	}
+	assert.Equal(t, 1, checkpointer.called("CheckpointSequence", "shard-0"))
+
+	sc.deliverRecords(time.Now(), []types.Record{{SequenceNumber: aws.String("200")}}, aws.Int64(0), recordCheckpointer)
+	assert.Equal(t, 2, checkpointer.called("CheckpointSequence", "shard-0"))
+	assert.Equal(t, "200", checkpointer.leases["shard-0"].checkpoint)
+}
+
+// touchingCheckpointer counts the checkpoints touched.
+type touchingCheckpointer struct {
+	*testCheckpointer
+}
+
+func (c touchingCheckpointer) TouchCheckpoint(shard *par.ShardStatus) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.record("TouchCheckpoint", shard.ID)
+	return nil
+}
+
+func TestTouchCheckpointOnIdle(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithTouchCheckpointOnIdle(true).
+		WithTouchCheckpointIntervalMillis(100)
+	sc := newTestCommonShardConsumer(kclConfig, &testRecordProcessor{})
+	checkpointer := touchingCheckpointer{newTestCheckpointer(map[string]*testLease{})}
+	sc.checkpointer = checkpointer
+	recordCheckpointer := sc.newRecordProcessorCheckpointer()
+	idle := func() {
+		sc.deliverRecords(time.Now(), nil, aws.Int64(0), recordCheckpointer)
+	}
+
+	// the shard only counts as idle from its first empty poll
+	idle()
+	assert.Equal(t, 0, checkpointer.called("TouchCheckpoint", "shard-0"))
+	time.Sleep(120 * time.Millisecond)
+	idle()
+	idle()
+	assert.Equal(t, 1, checkpointer.called("TouchCheckpoint", "shard-0"))
+
+	// records delivered postpone the next touch
+	time.Sleep(60 * time.Millisecond)
+	sc.deliverRecords(time.Now(), []types.Record{{SequenceNumber: aws.String("100")}}, aws.Int64(0), recordCheckpointer)
+	time.Sleep(60 * time.Millisecond)
+	idle()
+	assert.Equal(t, 1, checkpointer.called("TouchCheckpoint", "shard-0"))
+	time.Sleep(70 * time.Millisecond)
+	idle()
+	assert.Equal(t, 2, checkpointer.called("TouchCheckpoint", "shard-0"))
+	// touching never writes the checkpoint
+	assert.Equal(t, 0, checkpointer.called("CheckpointSequence", "shard-0"))
+
+	// idle shards are left alone by default
+	sc = newTestCommonShardConsumer(config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID"), &testRecordProcessor{})
+	sc.checkpointer = checkpointer
+	sc.lastActive = time.Now().Add(-time.Hour)
+	sc.deliverRecords(time.Now(), nil, aws.Int64(0), recordCheckpointer)
+	assert.Equal(t, 2, checkpointer.called("TouchCheckpoint", "shard-0"))
+}
+
+// capturingLogger keeps the messages logged at info level.
+type capturingLogger struct {
+	logger.Logger
+	mux   sync.Mutex
+	infos []string
+}
+
+func (l *capturingLogger) Infof(format string, args ...interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+
+func (l *capturingLogger) WithFields(_ logger.Fields) logger.Logger {
+	return l
+}
+
+// startMonitoringService records the shard iterator type each shard started with.
+type startMonitoringService struct {
+	metrics.NoopMonitoringService
+	started map[string]string
+}
+
+func (m *startMonitoringService) ShardStarted(shard string, iteratorType string) {
+	m.started[shard] = iteratorType
+}
+
+func TestStartingPositionReported(t *testing.T) {
+	timestamp := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name       string
+		checkpoint string
+		configure  func(*config.KinesisClientLibConfiguration)
+		want       types.ShardIteratorType
+	}{
+		{"trim horizon", "", func(c *config.KinesisClientLibConfiguration) {
+			c.WithInitialPositionInStream(config.TRIM_HORIZON)
+		}, types.ShardIteratorTypeTrimHorizon},
+		{"latest", "", func(c *config.KinesisClientLibConfiguration) {
+			c.WithInitialPositionInStream(config.LATEST)
+		}, types.ShardIteratorTypeLatest},
+		{"at timestamp", "", func(c *config.KinesisClientLibConfiguration) {
+			c.WithTimestampAtInitialPositionInStream(&timestamp)
+		}, types.ShardIteratorTypeAtTimestamp},
+		{"checkpointed", "100", func(c *config.KinesisClientLibConfiguration) {
+			c.WithInitialPositionInStream(config.TRIM_HORIZON)
+		}, types.ShardIteratorTypeAfterSequenceNumber},
+		{"configured sequence number", "", func(c *config.KinesisClientLibConfiguration) {
+			c.WithStartingSequenceNumber("shard-0", kcl.ExtendedSequenceNumber{SequenceNumber: aws.String("50")})
+		}, types.ShardIteratorTypeAtSequenceNumber},
+		{"checkpointed with configured sequence number", "100", func(c *config.KinesisClientLibConfiguration) {
+			c.WithStartingSequenceNumber("shard-0", kcl.ExtendedSequenceNumber{SequenceNumber: aws.String("50")})
+		}, types.ShardIteratorTypeAfterSequenceNumber},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := &capturingLogger{Logger: logger.GetDefaultLogger()}
+			kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+				WithLogger(log)
+			test.configure(kclConfig)
+			mService := &startMonitoringService{started: map[string]string{}}
+			sc := newTestCommonShardConsumer(kclConfig, &testRecordProcessor{})
+			sc.mService = mService
+			sc.checkpointer = newTestCheckpointer(map[string]*testLease{"shard-0": {checkpoint: test.checkpoint}})
+
+			startPosition, err := sc.getStartingPosition()
+			assert.Nil(t, err)
+			assert.Equal(t, test.want, startPosition.Type)
+			assert.Equal(t, string(test.want), mService.started["shard-0"])
+
+			logged := false
+			for _, info := range log.infos {
+				if strings.Contains(info, "shard iterator type: "+string(test.want)) {
+					logged = true
+				}
+			}
+			assert.True(t, logged, "%v not logged in %v", test.want, log.infos)
+		})
+	}
+}
+
+func TestStartingPositionAtTimestamp(t *testing.T) {
+	timestamp := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithTimestampAtInitialPositionInStream(&timestamp)
+
+	// a fresh shard starts at the configured time
+	sc := newTestCommonShardConsumer(kclConfig, &testRecordProcessor{})
+	sc.checkpointer = newTestCheckpointer(map[string]*testLease{})
+	startPosition, err := sc.getStartingPosition()
+	assert.Nil(t, err)
+	assert.Equal(t, types.ShardIteratorTypeAtTimestamp, startPosition.Type)
+	if assert.NotNil(t, startPosition.Timestamp) {
+		assert.True(t, timestamp.Equal(*startPosition.Timestamp))
+	}
+	assert.Nil(t, startPosition.SequenceNumber)
+
+	// a resumed shard starts after its checkpoint, whatever the configured time
+	sc = newTestCommonShardConsumer(kclConfig, &testRecordProcessor{})
+	sc.checkpointer = newTestCheckpointer(map[string]*testLease{"shard-0": {checkpoint: "100"}})
+	startPosition, err = sc.getStartingPosition()
+	assert.Nil(t, err)
+	assert.Equal(t, types.ShardIteratorTypeAfterSequenceNumber, startPosition.Type)
+	assert.Equal(t, "100", aws.ToString(startPosition.SequenceNumber))
+	assert.Nil(t, startPosition.Timestamp)
+}
+
+// corruptAggregateRecord is a KPL aggregated record whose checksum matches but whose payload is not a valid
+// aggregated record.
+func corruptAggregateRecord(sequenceNumber string) types.Record {
+	payload := []byte{0x0a, 0xff}
+	md5Hash := md5.Sum(payload)
+	encoded := append([]byte("\xf3\x89\x9a\xc2"), payload...)
+	encoded = append(encoded, md5Hash[:]...)
+	return types.Record{Data: encoded, PartitionKey: aws.String("0"), SequenceNumber: aws.String(sequenceNumber)}
+}
+
+type decodeErrorMonitoringService struct {
+	metrics.NoopMonitoringService
+	decodeErrors int
+}
+
+func (m *decodeErrorMonitoringService) DecodeError(_ string) {
+	m.decodeErrors++
+}
+
+func TestDecodeErrorPolicies(t *testing.T) {
+	records := []types.Record{
+		aggregateRecord("100", "a0", "a1"),
+		corruptAggregateRecord("101"),
+		{Data: []byte("b"), PartitionKey: aws.String("0"), SequenceNumber: aws.String("102")},
+		corruptAggregateRecord("103"),
+	}
+
+	tests := []struct {
+		name         string
+		configure    func(*config.KinesisClientLibConfiguration, *[]string)
+		delivered    []string
+		deadLettered []string
+		failed       bool
+		decodeErrors int
+	}{
+		{
+			name:         "skip",
+			configure:    func(*config.KinesisClientLibConfiguration, *[]string) {},
+			delivered:    []string{"a0", "a1", "b"},
+			decodeErrors: 2,
+		},
+		{
+			name: "dead letter",
+			configure: func(c *config.KinesisClientLibConfiguration, deadLettered *[]string) {
+				c.WithDecodeErrorDeadLetter(func(shardID string, record types.Record, err error) {
+					assert.Equal(t, "shard-0", shardID)
+					assert.ErrorIs(t, err, ErrRecordNotDecoded)
+					*deadLettered = append(*deadLettered, aws.ToString(record.SequenceNumber))
+				})
+			},
+			delivered:    []string{"a0", "a1", "b"},
+			deadLettered: []string{"101", "103"},
+			decodeErrors: 2,
+		},
+		{
+			name: "fail",
+			configure: func(c *config.KinesisClientLibConfiguration, _ *[]string) {
+				c.WithDecodeErrorPolicy(config.FailOnDecodeError)
+			},
+			failed:       true,
+			decodeErrors: 1,
+		},
+		{
+			name: "within tolerance",
+			configure: func(c *config.KinesisClientLibConfiguration, _ *[]string) {
+				c.WithMaxDecodeErrorsPerBatch(2)
+			},
+			delivered:    []string{"a0", "a1", "b"},
+			decodeErrors: 2,
+		},
+		{
+			name: "past tolerance",
+			configure: func(c *config.KinesisClientLibConfiguration, deadLettered *[]string) {
+				c.WithMaxDecodeErrorsPerBatch(1).
+					WithDecodeErrorDeadLetter(func(_ string, record types.Record, _ error) {
+						*deadLettered = append(*deadLettered, aws.ToString(record.SequenceNumber))
+					})
+			},
+			deadLettered: []string{"101"},
+			failed:       true,
+			decodeErrors: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var delivered, deadLettered []string
+			kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+			test.configure(kclConfig, &deadLettered)
+
+			processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+				for _, r := range input.Records {
+					delivered = append(delivered, string(r.Data))
+				}
+			}}
+			sc := newTestCommonShardConsumer(kclConfig, processor)
+			mService := &decodeErrorMonitoringService{}
+			sc.mService = mService
+
+			millisBehindLatest := int64(0)
+			err := sc.processRecords(time.Now(), records, &millisBehindLatest, nil)
+			if test.failed {
+				assert.ErrorIs(t, err, ErrRecordNotDecoded)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, test.delivered, delivered)
+			assert.Equal(t, test.deadLettered, deadLettered)
+			assert.Equal(t, test.decodeErrors, mService.decodeErrors)
+		})
+	}
+}
+
+func TestRecordValidator(t *testing.T) {
+	records := []types.Record{
+		aggregateRecord("100", `{"id":1}`, `{"id":`),
+		{Data: []byte("not json"), PartitionKey: aws.String("0"), SequenceNumber: aws.String("101")},
+		{Data: []byte(`{"id":2}`), PartitionKey: aws.String("0"), SequenceNumber: aws.String("102")},
+	}
+	validator := func(record types.Record) error {
+		if !json.Valid(record.Data) {
+			return errors.New("malformed JSON")
+		}
+		return nil
+	}
+
+	var deadLettered []string
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithRecordValidator(validator).
+		WithDecodeErrorDeadLetter(func(_ string, record types.Record, err error) {
+			assert.ErrorIs(t, err, ErrRecordInvalid)
+			deadLettered = append(deadLettered, string(record.Data))
+		})
+
+	var delivered []string
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		for _, r := range input.Records {
+			delivered = append(delivered, string(r.Data))
+		}
+	}}
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+	mService := &decodeErrorMonitoringService{}
+	sc.mService = mService
+
+	millisBehindLatest := int64(0)
+	assert.Nil(t, sc.processRecords(time.Now(), records, &millisBehindLatest, nil))
+	// the user records of an aggregated record are validated one by one
+	assert.Equal(t, []string{`{"id":1}`, `{"id":2}`}, delivered)
+	assert.Equal(t, []string{`{"id":`, "not json"}, deadLettered)
+	assert.Equal(t, 2, mService.decodeErrors)
+
+	// or fail the shard
+	kclConfig.WithDecodeErrorPolicy(config.FailOnDecodeError)
+	delivered = nil
+	assert.ErrorIs(t, sc.processRecords(time.Now(), records, &millisBehindLatest, nil), ErrRecordInvalid)
+	assert.Empty(t, delivered)
+}
+
+type orderViolationMonitoringService struct {
+	metrics.NoopMonitoringService
+	violations int
+}
+
+func (m *orderViolationMonitoringService) RecordOrderViolation(_ string) {
+	m.violations++
+}
+
+func TestVerifyRecordOrdering(t *testing.T) {
+	record := func(sequenceNumber string) types.Record {
+		return types.Record{Data: []byte(sequenceNumber), PartitionKey: aws.String("0"), SequenceNumber: aws.String(sequenceNumber)}
+	}
+
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithVerifyRecordOrdering(true)
+	var delivered []string
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		for _, r := range input.Records {
+			delivered = append(delivered, string(r.Data))
+		}
+	}}
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+	mService := &orderViolationMonitoringService{}
+	sc.mService = mService
+
+	// the user records of an aggregated record share its sequence number, and sequence numbers compare numerically
+	millisBehindLatest := int64(0)
+	assert.Nil(t, sc.processRecords(time.Now(), []types.Record{aggregateRecord("9", "a0", "a1"), record("10")}, &millisBehindLatest, nil))
+	assert.Nil(t, sc.processRecords(time.Now(), []types.Record{record("11"), record("100")}, &millisBehindLatest, nil))
+	assert.Equal(t, 0, mService.violations)
+
+	// records going backwards, or read again, are reported and still delivered
+	assert.Nil(t, sc.processRecords(time.Now(), []types.Record{record("12"), record("100"), record("101")}, &millisBehindLatest, nil))
+	assert.Equal(t, 2, mService.violations)
+	assert.Equal(t, []string{"a0", "a1", "10", "11", "100", "12", "100", "101"}, delivered)
+}
+
+type corruptCheckpointMonitoringService struct {
+	metrics.NoopMonitoringService
+	corruptCheckpoints int
+}
+
+func (m *corruptCheckpointMonitoringService) CorruptCheckpoint(_ string) {
+	m.corruptCheckpoints++
+}
+
+func TestCorruptCheckpointPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy config.CorruptCheckpointPolicy
+		want   types.ShardIteratorType
+	}{
+		{"fail", config.FailOnCorruptCheckpoint, ""},
+		{"trim horizon", config.TrimHorizonOnCorruptCheckpoint, types.ShardIteratorTypeTrimHorizon},
+		{"latest", config.LatestOnCorruptCheckpoint, types.ShardIteratorTypeLatest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+				WithInitialPositionInStream(config.AT_TIMESTAMP).
+				WithCorruptCheckpointPolicy(test.policy)
+			mService := &corruptCheckpointMonitoringService{}
+			sc := newTestCommonShardConsumer(kclConfig, &testRecordProcessor{})
+			sc.mService = mService
+			sc.checkpointer = newTestCheckpointer(map[string]*testLease{"shard-0": {checkpoint: "49590338271490256608559692538361571095921575989136588898\n"}})
+
+			startPosition, err := sc.startingPosition()
+			assert.Equal(t, 1, mService.corruptCheckpoints)
+			if test.want == "" {
+				assert.ErrorIs(t, err, ErrCheckpointCorrupt)
+				return
+			}
+			assert.Nil(t, err)
+			// rather than the initial position in stream
+			assert.Equal(t, test.want, startPosition.Type)
+			assert.Nil(t, startPosition.SequenceNumber)
+			assert.Empty(t, sc.shard.GetCheckpoint())
+		})
+	}
+}
+
+func TestLagThresholdCallbacks(t *testing.T) {
+	var events []string
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithLagThresholdMillis(10000).
+		WithLagRecoveryMillis(2000).
+		WithOnLagThresholdExceeded(func(shardID string, millisBehindLatest int64) {
+			events = append(events, fmt.Sprintf("exceeded %s %d", shardID, millisBehindLatest))
+		}).
+		WithOnLagRecovered(func(shardID string) {
+			events = append(events, "recovered "+shardID)
+		})
+	sc := newTestCommonShardConsumer(kclConfig, &testRecordProcessor{})
+
+	// the lag hovering around the threshold, or between the recovery and the threshold, fires no more callbacks
+	for _, lag := range []int64{5000, 10000, 12000, 9000, 11000, 3000, 2000, 9000, 10000, 10001, 0} {
+		assert.Nil(t, sc.processRecords(time.Now(), nil, aws.Int64(lag), nil))
+	}
+	// nor does an unknown lag
+	assert.Nil(t, sc.processRecords(time.Now(), nil, nil, nil))
+	assert.Equal(t, []string{
+		"exceeded shard-0 12000",
+		"recovered shard-0",
+		"exceeded shard-0 10001",
+		"recovered shard-0",
+	}, events)
+}
+
+func TestDecodeCloudWatchLogs(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write([]byte(`{"messageType":"DATA_MESSAGE","owner":"111111111111","logGroup":"group","logStream":"stream",
+		"subscriptionFilters":["filter"],"logEvents":[{"id":"1","timestamp":1432826855000,"message":"first"},
+		{"id":"2","timestamp":1432826855001,"message":"second"}]}`))
+	_ = writer.Close()
+
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithDecodeCloudWatchLogs(true)
+	var delivered []kcl.ProcessRecordsInput
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		delivered = append(delivered, *input)
+	}}
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+
+	// the log events of the envelope are delivered one by one, other records as they are
+	assert.Nil(t, sc.processRecords(time.Now(), []types.Record{
+		{Data: compressed.Bytes(), PartitionKey: aws.String("key"), SequenceNumber: aws.String("1")},
+		{Data: []byte("plain"), PartitionKey: aws.String("key"), SequenceNumber: aws.String("2")},
+	}, aws.Int64(0), nil))
+	assert.Len(t, delivered, 1)
+	var messages []string
+	for _, record := range delivered[0].Records {
+		var event cloudwatchlogs.LogEvent
+		if json.Unmarshal(record.Data, &event) == nil && event.LogGroup == "group" {
+			messages = append(messages, event.Message+"@"+aws.ToString(record.SequenceNumber))
+		} else {
+			messages = append(messages, string(record.Data)+"@"+aws.ToString(record.SequenceNumber))
+		}
+	}
+	assert.Equal(t, []string{"first@1", "second@1", "plain@2"}, messages)
+
+	// a corrupt envelope is handled by the decode error policy
+	kclConfig.WithDecodeErrorPolicy(config.FailOnDecodeError)
+	err := sc.processRecords(time.Now(), []types.Record{
+		{Data: compressed.Bytes()[:20], PartitionKey: aws.String("key"), SequenceNumber: aws.String("3")},
+	}, aws.Int64(0), nil)
+	assert.True(t, errors.Is(err, ErrRecordNotDecoded))
+}
+
+func TestReportUnackedRecords(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithReportUnackedRecords(true)
+	mService := &unackedMonitoringService{}
+	var checkpointer kcl.IRecordProcessorCheckpointer
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		// only the first record is durable yet
+		assert.Nil(t, input.Checkpointer.Checkpoint(input.Records[0].SequenceNumber))
+		checkpointer = input.Checkpointer
+	}}
+	sc := newTestCommonShardConsumer(kclConfig, processor)
+	sc.mService = mService
+	sc.checkpointer = newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc.trackUnackedRecords()
+
+	var records []types.Record
+	for _, seq := range []string{"1", "2", "3"} {
+		records = append(records, types.Record{SequenceNumber: aws.String(seq), Data: []byte(seq)})
+	}
+	assert.Nil(t, sc.processRecords(time.Now(), records, aws.Int64(0), sc.newRecordProcessorCheckpointer()))
+	// the records which would be delivered again after a failover
+	assert.Equal(t, 2, mService.unacked)
+
+	assert.Nil(t, checkpointer.Checkpoint(aws.String("3")))
+	assert.Equal(t, 0, mService.unacked)
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// consumerPool polls many shards with a fixed number of goroutines, instead of one goroutine per shard. Every
+// goroutine takes the shard whose next poll is due first, polls it once and schedules its next poll after the wait
+// returned by the consumer, for its rate limits, a backoff or because the shard is idle.
+//
+// Getting a shard ready to be polled may wait for its parent shard to be finished: it is done by a goroutine of
+// its own, which ends once the shard is handed over to the pool.
+type consumerPool struct {
+	size int
+	stop *chan struct{}
+
+	mux   sync.Mutex
+	tasks pollTasks
+	// shards submitted and not finished yet, whether being started or polled
+	active int
+	// signaled, without blocking, when a shard is scheduled or finished
+	wake chan struct{}
+}
+
+// pollTask is a shard polled by the pool.
+type pollTask struct {
+	consumer *PollingShardConsumer
+	state    *pollState
+	due      time.Time
+	// called with the error which ended the polling of the shard, if any
+	done func(error)
+}
+
+func newConsumerPool(size int, stop *chan struct{}) *consumerPool {
+	return &consumerPool{
+		size: size,
+		stop: stop,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// start starts the goroutines of the pool. They return once the worker stops and every shard submitted is
+// finished; wg is done for each of them.
+func (p *consumerPool) start(wg *sync.WaitGroup) {
+	for i := 0; i < p.size; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.run()
+		}()
+	}
+}
+
+// submit polls the shard of the consumer on the pool. done is called once the shard is not polled anymore.
+func (p *consumerPool) submit(sc *PollingShardConsumer, done func(error)) {
+	p.mux.Lock()
+	p.active++
+	p.mux.Unlock()
+
+	go func() {
+		state, err := sc.startPolling()
+		if state == nil {
+			p.finish(done, err)
+			return
+		}
+		p.schedule(&pollTask{consumer: sc, state: state, due: time.Now(), done: done})
+	}()
+}
+
+func (p *consumerPool) schedule(task *pollTask) {
+	p.mux.Lock()
+	heap.Push(&p.tasks, task)
+	p.mux.Unlock()
+	p.signal()
+}
+
+func (p *consumerPool) finish(done func(error), err error) {
+	p.mux.Lock()
+	p.active--
+	p.mux.Unlock()
+	p.signal()
+	done(err)
+}
+
+func (p *consumerPool) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *consumerPool) stopped() bool {
+	select {
+	case <-*p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *consumerPool) run() {
+	for {
+		stopped := p.stopped()
+		p.mux.Lock()
+		if stopped && p.active == 0 {
+			p.mux.Unlock()
+			// pass the wake up on to the other goroutines
+			p.signal()
+			return
+		}
+		var task *pollTask
+		wait := time.Duration(-1)
+		if len(p.tasks) > 0 {
+			wait = time.Until(p.tasks[0].due)
+			if wait <= 0 {
+				task = heap.Pop(&p.tasks).(*pollTask)
+			}
+		}
+		p.mux.Unlock()
+
+		if task == nil {
+			p.sleep(wait, stopped)
+			continue
+		}
+
+		wait, done, err := task.consumer.poll(task.state)
+		if done {
+			task.consumer.stopPolling(task.state)
+			p.finish(task.done, err)
+			continue
+		}
+		task.due = time.Now().Add(wait)
+		p.schedule(task)
+	}
+}
+
+// sleep waits for a shard to be scheduled or finished, for the worker to stop and, unless negative, for wait.
+func (p *consumerPool) sleep(wait time.Duration, stopped bool) {
+	var timeout <-chan time.Time
+	if wait >= 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var stop <-chan struct{}
+	if !stopped {
+		stop = *p.stop
+	}
+
+	select {
+	case <-p.wake:
+	case <-timeout:
+	case <-stop:
+	}
+}
+
+// pollTasks is a min-heap of the shards polled by the pool, by time of their next poll.
+type pollTasks []*pollTask
+
+func (t pollTasks) Len() int            { return len(t) }
+func (t pollTasks) Less(i, j int) bool  { return t[i].due.Before(t[j].due) }
+func (t pollTasks) Swap(i, j int)       { t[i], t[j] = t[j], t[i] }
+func (t *pollTasks) Push(x interface{}) { *t = append(*t, x.(*pollTask)) }
+
+func (t *pollTasks) Pop() interface{} {
+	old := *t
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	*t = old[:n-1]
+	return task
+}
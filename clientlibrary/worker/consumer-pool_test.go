@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+)
+
+// pollTrackingKinesis records the times of the GetRecords calls of every shard and how many are in flight at once.
+type pollTrackingKinesis struct {
+	*fakeKinesis
+	mux         sync.Mutex
+	calls       map[string][]time.Time
+	inFlight    int
+	maxInFlight int
+}
+
+func (k *pollTrackingKinesis) GetRecords(ctx context.Context, params *kinesis.GetRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.GetRecordsOutput, error) {
+	k.mux.Lock()
+	k.calls[aws.ToString(params.ShardIterator)] = append(k.calls[aws.ToString(params.ShardIterator)], time.Now())
+	k.inFlight++
+	if k.inFlight > k.maxInFlight {
+		k.maxInFlight = k.inFlight
+	}
+	k.mux.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+	defer func() {
+		k.mux.Lock()
+		k.inFlight--
+		k.mux.Unlock()
+	}()
+	return k.fakeKinesis.GetRecords(ctx, params, optFns...)
+}
+
+func TestConsumerPoolServicesEveryShard(t *testing.T) {
+	const shards = 12
+	var shardIDs []string
+	for i := 0; i < shards; i++ {
+		shardIDs = append(shardIDs, fmt.Sprintf("shard-%d", i))
+	}
+	kc := &pollTrackingKinesis{fakeKinesis: newFakeKinesis(shardIDs...), calls: map[string][]time.Time{}}
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithConsumerPoolSize(2).
+		WithIdleTimeBetweenReadsInMillis(100)
+	w := startTestWorker(t, kclConfig, kc, newTestCheckpointer(map[string]*testLease{}))
+	assert.Nil(t, w.Rebalance())
+	time.Sleep(time.Second)
+	w.Shutdown()
+
+	kc.mux.Lock()
+	defer kc.mux.Unlock()
+	// never more shards polled at once than goroutines in the pool
+	assert.LessOrEqual(t, kc.maxInFlight, 2)
+	for _, id := range shardIDs {
+		calls := kc.calls[id]
+		assert.GreaterOrEqual(t, len(calls), 3, "shard %s starved", id)
+		// within the GetRecords limit of the shard over any second
+		for i := kinesisReadTPSLimit; i < len(calls); i++ {
+			assert.GreaterOrEqual(t, calls[i].Sub(calls[i-kinesisReadTPSLimit]), time.Second-10*time.Millisecond, "shard %s over its rate limit", id)
+		}
+	}
+}
+
+func TestConsumerPoolStopsWithWorker(t *testing.T) {
+	stop := make(chan struct{})
+	pool := newConsumerPool(1, &stop)
+	wg := &sync.WaitGroup{}
+	pool.start(wg)
+
+	// the shards polled are shut down once the worker stops, then the goroutines of the pool return
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	var reason kcl.ShutdownReason
+	processor := &testRecordProcessor{shutdown: func(input *kcl.ShutdownInput) { reason = input.ShutdownReason }}
+	sc := newTestPollingShardConsumer(kclConfig, processor, newFakeKinesis("shard-0"), newTestCheckpointer(map[string]*testLease{}))
+	sc.stop = &stop
+	finished := make(chan error, 1)
+	pool.submit(sc, func(err error) { finished <- err })
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+
+	select {
+	case err := <-finished:
+		assert.Nil(t, err)
+		assert.Equal(t, kcl.REQUESTED, reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shard not finished after the worker stopped")
+	}
+	wg.Wait()
+}
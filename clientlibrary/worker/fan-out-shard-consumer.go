@@ -30,9 +30,24 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 
 	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
-	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
 )
 
+// shardEventStream is the event stream of a shard subscription.
+type shardEventStream interface {
+	Events() <-chan types.SubscribeToShardEventStream
+	Close() error
+}
+
+// subscriptionEventStream returns the event stream of a subscription. It is a variable for unit testing, as the
+// event stream of a SubscribeToShardOutput cannot be set outside of the SDK.
+var subscriptionEventStream = func(out *kinesis.SubscribeToShardOutput) shardEventStream {
+	if out == nil || out.GetStream() == nil {
+		return nil
+	}
+	return out.GetStream()
+}
+
 // FanOutShardConsumer is  responsible for consuming data records of a (specified) shard.
 // Note: FanOutShardConsumer only deal with one shard.
 // For more info see: https://docs.aws.amazon.com/streams/latest/dev/enhanced-consumers.html
@@ -50,6 +65,12 @@ func (sc *FanOutShardConsumer) getRecords() error {
 
 	log := sc.kclConfig.Logger
 
+	// a consumer created without stop channel is never asked to stop
+	if sc.stop == nil {
+		stop := make(chan struct{})
+		sc.stop = &stop
+	}
+
 	// If the shard is child shard, need to wait until the parent finished.
 	if err := sc.waitOnParentShard(); err != nil {
 		// If parent shard has been deleted by Kinesis system already, just ignore the error.
@@ -59,41 +80,98 @@ func (sc *FanOutShardConsumer) getRecords() error {
 		}
 	}
 
-	shardSub, err := sc.subscribeToShard()
+	stream, err := sc.subscribeToShard()
+	if errors.Is(err, errShardEndReached) {
+		sc.skipCompletedShard()
+		return nil
+	}
 	if err != nil {
 		log.Errorf("Unable to subscribe to shard %s: %v", sc.shard.ID, err)
 		return err
 	}
 	defer func() {
-		if shardSub == nil || shardSub.GetStream() == nil {
+		if stream == nil {
 			log.Debugf("Nothing to close, EventStream is nil")
 			return
 		}
-		err = shardSub.GetStream().Close()
+		err = stream.Close()
 		if err != nil {
 			log.Errorf("Unable to close event stream for %s: %v", sc.shard.ID, err)
 		}
 	}()
 
-	input := &kcl.InitializationInput{
-		ShardId:                sc.shard.ID,
-		ExtendedSequenceNumber: &kcl.ExtendedSequenceNumber{SequenceNumber: aws.String(sc.shard.GetCheckpoint())},
+	input := sc.initializationInput()
+	if err := sc.initializeRecordProcessor(input); err != nil {
+		return err
 	}
-	sc.recordProcessor.Initialize(input)
-	recordCheckpointer := NewRecordProcessorCheckpoint(sc.shard, sc.checkpointer)
+	sc.trackUnackedRecords()
+	recordCheckpointer := sc.newRecordProcessorCheckpointer()
 
 	var continuationSequenceNumber *string
-	refreshLeaseTimer := time.After(time.Until(sc.shard.LeaseTimeout.Add(-time.Duration(sc.kclConfig.LeaseRefreshPeriodMillis) * time.Millisecond)))
+	// sequence number of the last record delivered, used to drop records delivered again across subscriptions
+	var lastSequenceNumber string
+	refreshLeaseTimer := time.After(sc.leaseRenewalDelay())
+	// A subscription expires after 5 minutes. It is renewed beforehand, from the last continuation sequence
+	// number, rather than waiting for the event stream to end.
+	renewalPeriod := time.Duration(sc.kclConfig.SubscriptionRenewalMillis) * time.Millisecond
+	renewSubscriptionTimer := time.After(renewalPeriod)
+	var processTimer <-chan time.Time
+	if interval := sc.processTimerInterval(); interval > 0 {
+		processTimer = time.After(interval)
+	}
+	// since when the events are left unread, too many records waiting for a checkpoint
+	var heldSince time.Time
+	backpressureTimeout := time.Duration(sc.kclConfig.BackpressureSubscriptionTimeoutMillis) * time.Millisecond
 	for {
+		var events <-chan types.SubscribeToShardEventStream
+		var backpressureCheck <-chan time.Time
+		if unacked, full := sc.unackedFull(); full {
+			if heldSince.IsZero() {
+				log.Infof("Reading of shard %s held, %d records are waiting for a checkpoint", sc.shard.ID, unacked)
+				heldSince = time.Now()
+			}
+			if backpressureTimeout > 0 && stream != nil && time.Since(heldSince) >= backpressureTimeout {
+				log.Infof("Closing the subscription to shard %s, held for %v", sc.shard.ID, time.Since(heldSince))
+				if err := stream.Close(); err != nil {
+					log.Errorf("Unable to close event stream for %s: %v", sc.shard.ID, err)
+				}
+				stream = nil
+			}
+			backpressureCheck = time.After(time.Duration(sc.kclConfig.IdleTimeBetweenReadsInMillis) * time.Millisecond)
+		} else {
+			if !heldSince.IsZero() {
+				log.Infof("Reading of shard %s resumed, %d records are waiting for a checkpoint", sc.shard.ID, unacked)
+				heldSince = time.Time{}
+			}
+			if stream == nil {
+				// the subscription was closed while held, subscribe again from where it was left
+				stream, err = sc.reopenSubscription(continuationSequenceNumber)
+				if errors.Is(err, errShardEndReached) {
+					sc.skipCompletedShard()
+					return nil
+				}
+				if err != nil {
+					log.Errorf("Unable to subscribe to shard %s: %v", sc.shard.ID, err)
+					return err
+				}
+				renewSubscriptionTimer = time.After(renewalPeriod)
+			}
+			events = stream.Events()
+		}
+
 		getRecordsStartTime := time.Now()
 		select {
 		case <-*sc.stop:
-			shutdownInput := &kcl.ShutdownInput{ShutdownReason: kcl.REQUESTED, Checkpointer: recordCheckpointer}
-			sc.recordProcessor.Shutdown(shutdownInput)
+			sc.flushBatch(recordCheckpointer)
+			sc.requestShutdown(recordCheckpointer)
 			return nil
 		case <-refreshLeaseTimer:
 			log.Debugf("Refreshing lease on shard: %s for worker: %s", sc.shard.ID, sc.consumerID)
-			err = sc.checkpointer.GetLease(sc.shard, sc.consumerID)
+			err = sc.renewShardLease(sc.consumerID)
+			if errors.Is(err, errLeaseRenewalStopped) {
+				// the worker is shutting down, the stop channel is closed
+				continue
+			}
 			if err != nil {
 				if errors.As(err, &chk.ErrLeaseNotAcquired{}) {
 					log.Warnf("Failed in acquiring lease on shard: %s for worker: %s", sc.shard.ID, sc.consumerID)
@@ -102,10 +180,28 @@ func (sc *FanOutShardConsumer) getRecords() error {
 				log.Errorf("Error in refreshing lease on shard: %s for worker: %s. Error: %+v", sc.shard.ID, sc.consumerID, err)
 				return err
 			}
-			refreshLeaseTimer = time.After(time.Until(sc.shard.LeaseTimeout.Add(-time.Duration(sc.kclConfig.LeaseRefreshPeriodMillis) * time.Millisecond)))
+			refreshLeaseTimer = time.After(sc.leaseRenewalDelay())
 			// log metric for renewed lease for worker
 			sc.mService.LeaseRenewed(sc.shard.ID)
-		case event, ok := <-shardSub.GetStream().Events():
+		case <-processTimer:
+			processTimer = time.After(sc.processTimer(recordCheckpointer))
+		case <-backpressureCheck:
+		case <-renewSubscriptionTimer:
+			renewSubscriptionTimer = time.After(renewalPeriod)
+			if stream == nil {
+				// closed while held, the subscription is reopened once the records are checkpointed
+				continue
+			}
+			if continuationSequenceNumber == nil || *continuationSequenceNumber == "" {
+				// nothing received yet, the subscription is renewed once the event stream ends
+				continue
+			}
+			log.Debugf("Renewing subscription on shard: %s for worker: %s", sc.shard.ID, sc.consumerID)
+			stream, err = sc.resubscribe(stream, continuationSequenceNumber)
+			if err != nil {
+				return err
+			}
+		case event, ok := <-events:
 			if !ok {
 				// need to resubscribe to shard
 				log.Debugf("Event stream ended, refreshing subscription on shard: %s for worker: %s", sc.shard.ID, sc.consumerID)
@@ -113,10 +209,11 @@ func (sc *FanOutShardConsumer) getRecords() error {
 					log.Debugf("No continuation sequence number")
 					return nil
 				}
-				shardSub, err = sc.resubscribe(shardSub, continuationSequenceNumber)
+				stream, err = sc.resubscribe(stream, continuationSequenceNumber)
 				if err != nil {
 					return err
 				}
+				renewSubscriptionTimer = time.After(renewalPeriod)
 				continue
 			}
 			subEvent, ok := event.(*types.SubscribeToShardEventStreamMemberSubscribeToShardEvent)
@@ -125,43 +222,94 @@ func (sc *FanOutShardConsumer) getRecords() error {
 				continue
 			}
 			continuationSequenceNumber = subEvent.Value.ContinuationSequenceNumber
-			sc.processRecords(getRecordsStartTime, subEvent.Value.Records, subEvent.Value.MillisBehindLatest, recordCheckpointer)
+			sc.shard.SetLastPollTime(time.Now())
+			var records []types.Record
+			records, lastSequenceNumber = dropDeliveredRecords(subEvent.Value.Records, lastSequenceNumber)
+			if err := sc.processRecords(getRecordsStartTime, records, subEvent.Value.MillisBehindLatest, recordCheckpointer); err != nil {
+				return err
+			}
 
 			// The shard has been closed, so no new records can be read from it
 			if continuationSequenceNumber == nil {
-				log.Infof("Shard %s closed", sc.shard.ID)
-				shutdownInput := &kcl.ShutdownInput{ShutdownReason: kcl.TERMINATE, Checkpointer: recordCheckpointer}
-				sc.recordProcessor.Shutdown(shutdownInput)
+				sc.createChildLeases(subEvent.Value.ChildShards)
+				sc.endShard(recordCheckpointer)
 				return nil
 			}
 		}
 	}
 }
 
-func (sc *FanOutShardConsumer) subscribeToShard() (*kinesis.SubscribeToShardOutput, error) {
+// dropDeliveredRecords removes the records at or before the last delivered sequence number, which a renewed
+// subscription may send again, and returns the sequence number of the last record kept.
+func dropDeliveredRecords(records []types.Record, lastSequenceNumber string) ([]types.Record, string) {
+	kept := records[:0:0]
+	for _, r := range records {
+		seq := aws.ToString(r.SequenceNumber)
+		if !chk.ValidSequenceNumber(seq) {
+			kept = append(kept, r)
+			continue
+		}
+		if lastSequenceNumber != "" && chk.CompareSequenceNumbers(seq, lastSequenceNumber) <= 0 {
+			continue
+		}
+		kept = append(kept, r)
+		lastSequenceNumber = seq
+	}
+	return kept, lastSequenceNumber
+}
+
+func (sc *FanOutShardConsumer) subscribeToShard() (shardEventStream, error) {
 	startPosition, err := sc.getStartingPosition()
 	if err != nil {
 		return nil, err
 	}
 
-	return sc.kc.SubscribeToShard(context.TODO(), &kinesis.SubscribeToShardInput{
+	out, err := sc.kc.SubscribeToShard(context.TODO(), &kinesis.SubscribeToShardInput{
 		ConsumerARN:      &sc.consumerARN,
 		ShardId:          &sc.shard.ID,
 		StartingPosition: startPosition,
 	})
-}
-
-func (sc *FanOutShardConsumer) resubscribe(shardSub *kinesis.SubscribeToShardOutput, continuationSequence *string) (*kinesis.SubscribeToShardOutput, error) {
-	err := shardSub.GetStream().Close()
 	if err != nil {
-		sc.kclConfig.Logger.Errorf("Unable to close event stream for %s: %v", sc.shard.ID, err)
 		return nil, err
 	}
+	return subscriptionEventStream(out), nil
+}
+
+// unackedFull returns the number of records waiting for a checkpoint, and whether they reach MaxUnackedRecords.
+func (sc *FanOutShardConsumer) unackedFull() (int, bool) {
+	maxUnacked := sc.kclConfig.MaxUnackedRecords
+	if maxUnacked <= 0 {
+		return 0, false
+	}
+	unacked := sc.unacked.count()
+	if r, ok := sc.mService.(metrics.UnackedRecordsReporter); ok {
+		r.UnackedRecords(sc.shard.ID, unacked)
+	}
+	return unacked, unacked >= maxUnacked
+}
+
+// reopenSubscription subscribes to the shard again after its subscription was closed, after the continuation sequence
+// number or, before any event was received, from the checkpoint.
+func (sc *FanOutShardConsumer) reopenSubscription(continuationSequence *string) (shardEventStream, error) {
+	if continuationSequence == nil || *continuationSequence == "" {
+		return sc.subscribeToShard()
+	}
+	return sc.resubscribe(nil, continuationSequence)
+}
+
+// resubscribe closes the event stream, if any, and subscribes to the shard again after the continuation sequence number.
+func (sc *FanOutShardConsumer) resubscribe(stream shardEventStream, continuationSequence *string) (shardEventStream, error) {
+	if stream != nil {
+		if err := stream.Close(); err != nil {
+			sc.kclConfig.Logger.Errorf("Unable to close event stream for %s: %v", sc.shard.ID, err)
+			return nil, err
+		}
+	}
 	startPosition := &types.StartingPosition{
 		Type:           types.ShardIteratorTypeAfterSequenceNumber,
 		SequenceNumber: continuationSequence,
 	}
-	shardSub, err = sc.kc.SubscribeToShard(context.TODO(), &kinesis.SubscribeToShardInput{
+	out, err := sc.kc.SubscribeToShard(context.TODO(), &kinesis.SubscribeToShardInput{
 		ConsumerARN:      &sc.consumerARN,
 		ShardId:          &sc.shard.ID,
 		StartingPosition: startPosition,
@@ -170,5 +318,5 @@ func (sc *FanOutShardConsumer) resubscribe(shardSub *kinesis.SubscribeToShardOut
 		sc.kclConfig.Logger.Errorf("Unable to resubscribe to shard %s: %v", sc.shard.ID, err)
 		return nil, err
 	}
-	return shardSub, nil
+	return subscriptionEventStream(out), nil
 }
@@ -0,0 +1,270 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+// fakeEventStream is a shard subscription event stream fed by the test.
+type fakeEventStream struct {
+	events chan types.SubscribeToShardEventStream
+	closed bool
+}
+
+func newFakeEventStream(events ...types.SubscribeToShardEventStream) *fakeEventStream {
+	stream := &fakeEventStream{events: make(chan types.SubscribeToShardEventStream, len(events))}
+	for _, e := range events {
+		stream.events <- e
+	}
+	return stream
+}
+
+func (s *fakeEventStream) Events() <-chan types.SubscribeToShardEventStream {
+	return s.events
+}
+
+func (s *fakeEventStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+// fakeSubscriber records the SubscribeToShard requests.
+type fakeSubscriber struct {
+	MockKinesisSubscriberGetter
+	mux      sync.Mutex
+	requests []*kinesis.SubscribeToShardInput
+}
+
+func (f *fakeSubscriber) SubscribeToShard(_ context.Context, params *kinesis.SubscribeToShardInput, _ ...func(*kinesis.Options)) (*kinesis.SubscribeToShardOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.requests = append(f.requests, params)
+	return &kinesis.SubscribeToShardOutput{}, nil
+}
+
+func subscribeEvent(continuationSequenceNumber *string, sequenceNumbers ...string) types.SubscribeToShardEventStream {
+	var records []types.Record
+	for _, seq := range sequenceNumbers {
+		records = append(records, types.Record{
+			Data:           []byte("data-" + seq),
+			PartitionKey:   aws.String("key"),
+			SequenceNumber: aws.String(seq),
+		})
+	}
+	return &types.SubscribeToShardEventStreamMemberSubscribeToShardEvent{
+		Value: types.SubscribeToShardEvent{
+			ContinuationSequenceNumber: continuationSequenceNumber,
+			MillisBehindLatest:         aws.Int64(0),
+			Records:                    records,
+		},
+	}
+}
+
+func TestFanOutShardConsumerRenewsSubscription(t *testing.T) {
+	// the first subscription stays open, it is renewed before it expires
+	first := newFakeEventStream(subscribeEvent(aws.String("2"), "1", "2"))
+	// the renewed subscription sends record 2 again
+	second := newFakeEventStream(
+		subscribeEvent(aws.String("3"), "2", "3"),
+		subscribeEvent(nil, "4"),
+	)
+	streams := []*fakeEventStream{first, second}
+	defer func(f func(out *kinesis.SubscribeToShardOutput) shardEventStream) {
+		subscriptionEventStream = f
+	}(subscriptionEventStream)
+	subscriptionEventStream = func(_ *kinesis.SubscribeToShardOutput) shardEventStream {
+		stream := streams[0]
+		streams = streams[1:]
+		return stream
+	}
+
+	var delivered []string
+	var shutdownReason kcl.ShutdownReason
+	processor := &testRecordProcessor{
+		processRecords: func(input *kcl.ProcessRecordsInput) {
+			for _, r := range input.Records {
+				delivered = append(delivered, aws.ToString(r.SequenceNumber))
+			}
+		},
+		shutdown: func(input *kcl.ShutdownInput) {
+			shutdownReason = input.ShutdownReason
+		},
+	}
+
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithSubscriptionRenewalMillis(50)
+	subscriber := &fakeSubscriber{}
+	stop := make(chan struct{})
+	sc := &FanOutShardConsumer{
+		commonShardConsumer: commonShardConsumer{
+			shard:           &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}, LeaseTimeout: time.Now().Add(time.Minute)},
+			kc:              subscriber,
+			checkpointer:    newTestCheckpointer(map[string]*testLease{}),
+			recordProcessor: processor,
+			kclConfig:       kclConfig,
+			mService:        metrics.NoopMonitoringService{},
+		},
+		consumerARN: "consumerARN",
+		consumerID:  "workerID",
+		stop:        &stop,
+	}
+
+	assert.Nil(t, sc.getRecords())
+
+	assert.Equal(t, []string{"1", "2", "3", "4"}, delivered)
+	assert.Equal(t, kcl.TERMINATE, shutdownReason)
+	assert.True(t, first.closed)
+	assert.True(t, second.closed)
+
+	assert.Equal(t, 2, len(subscriber.requests))
+	renewal := subscriber.requests[1].StartingPosition
+	assert.Equal(t, types.ShardIteratorTypeAfterSequenceNumber, renewal.Type)
+	assert.Equal(t, "2", aws.ToString(renewal.SequenceNumber))
+}
+
+func TestFanOutShardConsumerBackpressure(t *testing.T) {
+	// the events after the first are left unread while the records wait for a checkpoint
+	first := newFakeEventStream(subscribeEvent(aws.String("2"), "1", "2"), subscribeEvent(aws.String("4"), "3", "4"))
+	second := newFakeEventStream(subscribeEvent(nil, "3", "4"))
+	streams := []*fakeEventStream{first, second}
+	defer func(f func(out *kinesis.SubscribeToShardOutput) shardEventStream) {
+		subscriptionEventStream = f
+	}(subscriptionEventStream)
+	subscriptionEventStream = func(_ *kinesis.SubscribeToShardOutput) shardEventStream {
+		stream := streams[0]
+		streams = streams[1:]
+		return stream
+	}
+
+	// the record processor checkpoints asynchronously, once slow processing is over
+	var mux sync.Mutex
+	var delivered []string
+	checkpointers := make(chan kcl.IRecordProcessorCheckpointer, 2)
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		mux.Lock()
+		defer mux.Unlock()
+		for _, r := range input.Records {
+			delivered = append(delivered, aws.ToString(r.SequenceNumber))
+		}
+		checkpointers <- input.Checkpointer
+	}}
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithMaxUnackedRecords(2).
+		WithBackpressureSubscriptionTimeoutMillis(50).
+		WithIdleTimeBetweenReadsInMillis(10)
+	subscriber := &fakeSubscriber{}
+	stop := make(chan struct{})
+	sc := &FanOutShardConsumer{
+		commonShardConsumer: commonShardConsumer{
+			shard:           &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}, LeaseTimeout: time.Now().Add(time.Minute)},
+			kc:              subscriber,
+			checkpointer:    newTestCheckpointer(map[string]*testLease{}),
+			recordProcessor: processor,
+			kclConfig:       kclConfig,
+			mService:        metrics.NoopMonitoringService{},
+		},
+		consumerARN: "consumerARN",
+		consumerID:  "workerID",
+		stop:        &stop,
+	}
+	done := make(chan error)
+	go func() { done <- sc.getRecords() }()
+
+	checkpointer := <-checkpointers
+	time.Sleep(150 * time.Millisecond)
+	mux.Lock()
+	assert.Equal(t, []string{"1", "2"}, delivered)
+	mux.Unlock()
+	assert.Nil(t, checkpointer.Checkpoint(aws.String("2")))
+
+	// the subscription closed while held is reopened from the last continuation sequence number
+	assert.Nil(t, <-done)
+	assert.Equal(t, []string{"1", "2", "3", "4"}, delivered)
+	assert.True(t, first.closed)
+	assert.Len(t, first.events, 1)
+	assert.Equal(t, 2, len(subscriber.requests))
+	reopened := subscriber.requests[1].StartingPosition
+	assert.Equal(t, types.ShardIteratorTypeAfterSequenceNumber, reopened.Type)
+	assert.Equal(t, "2", aws.ToString(reopened.SequenceNumber))
+}
+
+func TestFanOutShardConsumerShutdownRequested(t *testing.T) {
+	// the subscription stays open after its first event
+	stream := newFakeEventStream(subscribeEvent(aws.String("2"), "1", "2"))
+	defer func(f func(out *kinesis.SubscribeToShardOutput) shardEventStream) {
+		subscriptionEventStream = f
+	}(subscriptionEventStream)
+	subscriptionEventStream = func(_ *kinesis.SubscribeToShardOutput) shardEventStream {
+		return stream
+	}
+
+	delivered := make(chan struct{})
+	var shutdownReason kcl.ShutdownReason
+	processor := &testRecordProcessor{
+		processRecords: func(input *kcl.ProcessRecordsInput) {
+			assert.Nil(t, input.Checkpointer.Checkpoint(input.Records[len(input.Records)-1].SequenceNumber))
+			close(delivered)
+		},
+		shutdown: func(input *kcl.ShutdownInput) {
+			shutdownReason = input.ShutdownReason
+		},
+	}
+
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	checkpointer := newTestCheckpointer(map[string]*testLease{})
+	stop := make(chan struct{})
+	sc := &FanOutShardConsumer{
+		commonShardConsumer: commonShardConsumer{
+			shard:           &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}, LeaseTimeout: time.Now().Add(time.Minute)},
+			kc:              &fakeSubscriber{},
+			checkpointer:    checkpointer,
+			recordProcessor: processor,
+			kclConfig:       kclConfig,
+			mService:        metrics.NoopMonitoringService{},
+		},
+		consumerARN: "consumerARN",
+		consumerID:  "workerID",
+		stop:        &stop,
+	}
+	done := make(chan error)
+	go func() { done <- sc.getRecords() }()
+
+	// the records of the event are processed and checkpointed, then the worker stops
+	<-delivered
+	close(stop)
+	assert.Nil(t, <-done)
+	assert.Equal(t, kcl.REQUESTED, shutdownReason)
+	assert.True(t, stream.closed)
+	assert.Equal(t, "2", checkpointer.leases["shard-0"].checkpoint)
+}
@@ -32,8 +32,11 @@ package worker
 import (
 	"context"
 	"errors"
-	log "github.com/sirupsen/logrus"
+	"fmt"
+	"hash/fnv"
 	"math"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -41,6 +44,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 
 	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
 	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
 	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
 )
@@ -55,23 +59,109 @@ const (
 var (
 	rateLimitTimeNow      = time.Now
 	rateLimitTimeSince    = time.Since
+	rateLimitAfter        = time.After
 	localTPSExceededError = errors.New("Error GetRecords TPS Exceeded")
 	maxBytesExceededError = errors.New("Error GetRecords Max Bytes For Call Period Exceeded")
+	budgetExhaustedError  = errors.New("Error GetRecords Call Budget Of The Worker Exhausted")
+
+	// jitterSource draws the number in [0, 1) the waits of a consumer are randomized with
+	jitterSource = (*rand.Rand).Float64
+
+	// nilShardIteratorRetryDelay is the wait before calling GetShardIterator again after a response without iterator
+	nilShardIteratorRetryDelay = 100 * time.Millisecond
+
+	// ErrLeaseLost ends the consumer of a shard whose lease was found taken over by another worker after the consumer
+	// was paused, with LeaseVerificationGapMillis.
+	ErrLeaseLost = errors.New("lease lost while the consumer was paused")
+
+	// ErrNilShardIterator ends the consumer of a shard when GetShardIterator keeps returning no shard iterator.
+	ErrNilShardIterator = errors.New("GetShardIterator returned no shard iterator")
+
+	// ErrKMSKeyUnusable ends the consumer of a shard whose records cannot be decrypted because the KMS key of the
+	// stream is disabled or pending deletion. Retrying does not help until the key is usable again.
+	ErrKMSKeyUnusable = errors.New("the KMS key of the stream is not usable, it may be disabled or pending deletion")
+	// ErrKMSOptInRequired ends the consumer of a shard of an encrypted stream when the AWS account of the worker is
+	// not subscribed to KMS, which is a configuration error.
+	ErrKMSOptInRequired = errors.New("the AWS account is not subscribed to KMS, which the encrypted stream requires")
 )
 
+// kmsError is a KMS error classified as one of ErrKMSKeyUnusable or ErrKMSOptInRequired. It still unwraps to the
+// error returned by Kinesis.
+type kmsError struct {
+	kind error
+	err  error
+}
+
+func (e kmsError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e kmsError) Unwrap() error {
+	return e.err
+}
+
+func (e kmsError) Is(target error) bool {
+	return target == e.kind
+}
+
+// RateLimiterStats is a snapshot of the local rate limiter of a polling shard consumer.
+type RateLimiterStats struct {
+	// CallsLeft is the number of GetRecords calls left in the current one second window
+	CallsLeft int
+	// WindowStart is when the current one second window started, the oldest call of the rolling second with
+	// SlidingWindowTPSLimit
+	WindowStart time.Time
+	// BytesRead is the size of the records returned by the last GetRecords call
+	BytesRead int
+	// RemainingBytes is what is left of the read byte budget
+	RemainingBytes int
+	// LastCheckTime is when the byte budget was last replenished
+	LastCheckTime time.Time
+}
+
 // PollingShardConsumer is responsible for polling data records from a (specified) shard.
 // Note: PollingShardConsumer only deal with one shard.
 type PollingShardConsumer struct {
 	commonShardConsumer
-	streamName    string
-	stop          *chan struct{}
-	consumerID    string
-	mService      metrics.MonitoringService
+	streamName string
+	streamARN  string
+	stop       *chan struct{}
+	// the context of the Kinesis calls, derived from the one of the worker and canceled once the stop channel is closed
+	ctx        context.Context
+	consumerID string
+	mService   metrics.MonitoringService
+
+	// guards the local rate limiter state below, read by Stats
+	rateLimitMux  sync.Mutex
 	currTime      time.Time
 	callsLeft     int
 	remBytes      int
 	lastCheckTime time.Time
 	bytesRead     int
+
+	// wait for the next rate limit window instead of returning localTPSExceededError
+	blockOnTPSExceeded bool
+	// limit the calls over a rolling second, whose calls are in callTimes, rather than over fixed windows
+	slidingWindowTPS bool
+	callTimes        []time.Time
+
+	// caps the GetRecords calls in flight across the worker, nil when unbounded
+	pollScheduler *pollScheduler
+	// caps the GetRecords calls of the worker over time with MaxGetRecordsCalls, nil when unbounded
+	getRecordsBudget *getRecordsBudget
+	// caps the records read and not processed yet across the worker with MaxRecordsInFlight, nil when unbounded
+	recordsInFlight *recordsInFlight
+	// tunes the records asked for per GetRecords call with AdaptiveMaxRecords, nil otherwise
+	adaptiveMaxRecords *adaptiveMaxRecords
+	// switches the worker to enhanced fan-out when throttled, nil when not configured
+	fanOutUpgrade *fanOutUpgrade
+
+	// the outcome of the last poll, read by Dump
+	pollStatsMux sync.Mutex
+	pollStats    PollStats
+
+	// source of the idle time jitter
+	rand *rand.Rand
 }
 
 func (sc *PollingShardConsumer) getShardIterator() (*string, error) {
@@ -79,170 +169,671 @@ func (sc *PollingShardConsumer) getShardIterator() (*string, error) {
 	if err != nil {
 		return nil, err
 	}
+	return sc.shardIteratorAt(startPosition)
+}
+
+// refreshShardIterator derives a new shard iterator, after the last record read from the shard or at its starting
+// position when none was read yet.
+func (sc *PollingShardConsumer) refreshShardIterator(state *pollState) (*string, error) {
+	if state.lastSequenceNumber != nil {
+		return sc.shardIteratorAt(&types.StartingPosition{
+			Type:           types.ShardIteratorTypeAfterSequenceNumber,
+			SequenceNumber: state.lastSequenceNumber,
+		})
+	}
 
+	startPosition, err := sc.startingPosition()
+	if err != nil {
+		return nil, err
+	}
+	return sc.shardIteratorAt(startPosition)
+}
+
+func (sc *PollingShardConsumer) shardIteratorAt(startPosition *types.StartingPosition) (*string, error) {
 	shardIterArgs := &kinesis.GetShardIteratorInput{
 		ShardId:                &sc.shard.ID,
 		ShardIteratorType:      startPosition.Type,
 		StartingSequenceNumber: startPosition.SequenceNumber,
 		Timestamp:              startPosition.Timestamp,
 		StreamName:             &sc.streamName,
+		StreamARN:              sc.streamARNInput(),
 	}
 
-	iterResp, err := sc.kc.GetShardIterator(context.TODO(), shardIterArgs)
-	if err != nil {
-		return nil, err
+	// a response without shard iterator is retried up to MaxRetryCount times rather than passed on to GetRecords
+	for retries := 0; ; retries++ {
+		iterResp, err := sc.kc.GetShardIterator(sc.ctx, shardIterArgs)
+		if err != nil {
+			return nil, err
+		}
+		if iterResp.ShardIterator != nil {
+			return iterResp.ShardIterator, nil
+		}
+
+		if retries >= sc.kclConfig.MaxRetryCount {
+			return nil, fmt.Errorf("%w: shard %s, %s, after %d retries", ErrNilShardIterator, sc.shard.ID, startPosition.Type, retries)
+		}
+		sc.kclConfig.Logger.Warnf("GetShardIterator returned no shard iterator for shard %s, retrying", sc.shard.ID)
+		timer := time.NewTimer(nilShardIteratorRetryDelay)
+		select {
+		case <-timer.C:
+		case <-sc.ctx.Done():
+			timer.Stop()
+			return nil, sc.ctx.Err()
+		}
 	}
+}
 
-	return iterResp.ShardIterator, nil
+// streamARNInput returns the ARN of the stream to set on the GetShardIterator and GetRecords calls, so that the shard
+// is not mistaken for a shard with the same ID of another stream. It is nil when the ARN is unknown.
+func (sc *PollingShardConsumer) streamARNInput() *string {
+	if sc.streamARN == "" {
+		return nil
+	}
+	return aws.String(sc.streamARN)
+}
+
+// pollState is the state of the polling loop of a shard, kept from one poll to the next.
+type pollState struct {
+	shardIterator      *string
+	recordCheckpointer kcl.IRecordProcessorCheckpointer
+	retriedErrors      int
+	emptyPolls         int
+	// lag of the shard, unknown until the first response
+	lag int64
+	// set after a successful poll: the worker stopping and the lease renewal failing are checked before the next one
+	polled bool
+	// set while the PauseController holds the polling
+	paused bool
+	// set while MaxUnackedRecords records wait for a checkpoint
+	unackedFull bool
+	// records read and not processed yet, counted under MaxRecordsInFlight
+	heldRecords int
+	// when the last poll returned and the wait it asked for, to detect the process being paused in between
+	lastPollEnd time.Time
+	lastWait    time.Duration
+	// when the shard iterator was last returned by Kinesis, and the last record read with it
+	iteratorTime       time.Time
+	lastSequenceNumber *string
+	// the GetRecords call made ahead with EnablePrefetch, nil when none
+	prefetch *prefetch
+
+	leaseRenewalErrChan chan error
+	// cancels renewLease()
+	cancel context.CancelFunc
+	// cancels the context of the Kinesis calls
+	cancelCalls context.CancelFunc
 }
 
 // getRecords continuously poll one shard for data record
 // Precondition: it currently has the lease on the shard.
 func (sc *PollingShardConsumer) getRecords() error {
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	defer func() {
-		// cancel renewLease()
-		cancelFunc()
-		sc.releaseLease(sc.shard.ID)
-	}()
+	state, err := sc.startPolling()
+	if state == nil {
+		return err
+	}
+	defer sc.stopPolling(state)
+
+	for {
+		wait, done, err := sc.poll(state)
+		if done {
+			return err
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
 
+// startPolling gets the shard ready to be polled: it waits for the parent shard to be finished, gets the shard
+// iterator, initializes the record processor and starts renewing the lease. A nil state is returned when the shard is
+// not to be polled, in which case the lease has been released already.
+func (sc *PollingShardConsumer) startPolling() (state *pollState, err error) {
 	log := sc.kclConfig.Logger
 
+	// a consumer created without stop channel is never asked to stop
+	if sc.stop == nil {
+		stop := make(chan struct{})
+		sc.stop = &stop
+	}
+
+	// the Kinesis calls in flight are aborted as soon as the worker stops
+	var cancelCalls context.CancelFunc
+	sc.ctx, cancelCalls = contextUntilStop(sc.ctx, *sc.stop)
+	defer func() {
+		if state == nil {
+			cancelCalls()
+		}
+	}()
+
 	// If the shard is child shard, need to wait until the parent finished.
 	if err := sc.waitOnParentShard(); err != nil {
 		// If parent shard has been deleted by Kinesis system already, just ignore the error.
 		if err != chk.ErrSequenceIDNotFound {
 			log.Errorf("Error in waiting for parent shard: %v to finish. Error: %+v", sc.shard.ParentShardId, err)
-			return err
+			sc.releaseLease(sc.shard.ID)
+			return nil, err
 		}
 	}
 
 	shardIterator, err := sc.getShardIterator()
+	if errors.Is(err, errShardEndReached) {
+		sc.skipCompletedShard()
+		sc.releaseLease(sc.shard.ID)
+		return nil, nil
+	}
 	if err != nil {
 		log.Errorf("Unable to get shard iterator for %s: %v", sc.shard.ID, err)
-		return err
+		sc.releaseLease(sc.shard.ID)
+		return nil, err
 	}
 
 	// Start processing events and notify record processor on shard and starting checkpoint
-	input := &kcl.InitializationInput{
-		ShardId:                sc.shard.ID,
-		ExtendedSequenceNumber: &kcl.ExtendedSequenceNumber{SequenceNumber: aws.String(sc.shard.GetCheckpoint())},
+	input := sc.initializationInput()
+	if err := sc.initializeRecordProcessor(input); err != nil {
+		sc.releaseLease(sc.shard.ID)
+		return nil, err
 	}
-	sc.recordProcessor.Initialize(input)
-
-	recordCheckpointer := NewRecordProcessorCheckpoint(sc.shard, sc.checkpointer)
-	retriedErrors := 0
 
 	// define API call rate limit starting window
-	sc.currTime = rateLimitTimeNow()
-	sc.callsLeft = kinesisReadTPSLimit
-	sc.bytesRead = 0
-	sc.remBytes = MaxBytes
+	sc.ResetRateLimiter()
+
+	sc.trackUnackedRecords()
+	if sc.kclConfig.AdaptiveMaxRecords {
+		sc.adaptiveMaxRecords = newAdaptiveMaxRecords(sc.kclConfig.MaxRecords)
+	}
 
 	// starting async lease renewal thread
-	leaseRenewalErrChan := make(chan error, 1)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	state = &pollState{
+		shardIterator:       shardIterator,
+		iteratorTime:        time.Now(),
+		recordCheckpointer:  sc.newRecordProcessorCheckpointer(),
+		lag:                 int64(math.MaxInt64),
+		leaseRenewalErrChan: make(chan error, 1),
+		cancel:              cancelFunc,
+		cancelCalls:         cancelCalls,
+	}
 	go func() {
-		leaseRenewalErrChan <- sc.renewLease(ctx)
+		state.leaseRenewalErrChan <- sc.renewLease(ctx)
 	}()
-	for {
-		getRecordsStartTime := time.Now()
+	return state, nil
+}
+
+// contextUntilStop derives a context from parent, the background context when nil, which is canceled once stop is
+// closed.
+func contextUntilStop(parent context.Context, stop <-chan struct{}) (context.Context, context.CancelFunc) {
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// stopPolling stops renewing the lease of the shard and releases it.
+func (sc *PollingShardConsumer) stopPolling(state *pollState) {
+	state.cancel()
+	state.cancelCalls()
+	sc.releaseRecordsInFlight(state)
+	sc.releaseLease(sc.shard.ID)
+}
+
+// releaseRecordsInFlight gives back the records of the shard counted under MaxRecordsInFlight, once processed.
+func (sc *PollingShardConsumer) releaseRecordsInFlight(state *pollState) {
+	if sc.recordsInFlight != nil && state.heldRecords > 0 {
+		sc.recordsInFlight.release(state.heldRecords)
+		state.heldRecords = 0
+	}
+}
+
+// shutdownRequested delivers the buffered records and shuts the record processor down, the lease being given up.
+func (sc *PollingShardConsumer) shutdownRequested(state *pollState) {
+	sc.flushBatch(state.recordCheckpointer)
+	sc.requestShutdown(state.recordCheckpointer)
+}
+
+// poll reads the shard once and hands the records over to the record processor. Rather than sleeping, it returns
+// how long to wait before the next poll: for the rate limits, a backoff or because the shard is idle. done is
+// returned once the shard is not to be polled anymore, with the error which ended it, if any.
+func (sc *PollingShardConsumer) poll(state *pollState) (wait time.Duration, done bool, err error) {
+	log := sc.kclConfig.Logger
+	defer func() {
+		if !done {
+			// invoke ProcessTimer between polls, and wait no longer than until it is due again
+			if untilTimer := sc.processTimer(state.recordCheckpointer); untilTimer > 0 && wait > untilTimer {
+				wait = untilTimer
+			}
+		}
+		state.lastPollEnd = time.Now()
+		state.lastWait = wait
+		sc.recordPollStats(state)
+	}()
+
+	if state.polled {
+		state.polled = false
+		select {
+		case <-sc.ctx.Done():
+			sc.shutdownRequested(state)
+			return 0, true, nil
+		case leaseRenewalErr := <-state.leaseRenewalErrChan:
+			return 0, true, leaseRenewalErr
+		default:
+		}
+	}
 
-		log.Debugf("Trying to read %d record from iterator: %v", sc.kclConfig.MaxRecords, aws.ToString(shardIterator))
+	// the worker switched to enhanced fan-out, the shard is to be consumed by a fan-out consumer
+	if sc.fanOutUpgrade.handingOver() {
+		log.Infof("Handing shard %s over to an enhanced fan-out consumer", sc.shard.ID)
+		sc.shutdownRequested(state)
+		return 0, true, nil
+	}
+
+	if controller := sc.kclConfig.PauseController; controller != nil && controller.Paused() {
+		if !state.paused {
+			log.Infof("Polling of shard %s paused", sc.shard.ID)
+			state.paused = true
+		}
+		// the stop and lease renewal are checked again before the next poll
+		state.polled = true
+		return time.Duration(sc.kclConfig.IdleTimeBetweenReadsInMillis) * time.Millisecond, false, nil
+	}
+	if state.paused {
+		log.Infof("Polling of shard %s resumed", sc.shard.ID)
+		state.paused = false
+	}
 
-		// Get records from stream and retry as needed
-		getRecordsArgs := &kinesis.GetRecordsInput{
-			Limit:         aws.Int32(int32(sc.kclConfig.MaxRecords)),
-			ShardIterator: shardIterator,
+	// hold on while the record processor has too many records waiting for a checkpoint
+	limit := sc.adaptiveMaxRecords.maxRecords(sc.kclConfig.MaxRecords)
+	unackedLeft := math.MaxInt
+	if maxUnacked := sc.kclConfig.MaxUnackedRecords; maxUnacked > 0 {
+		unacked := sc.unacked.count()
+		if r, ok := sc.mService.(metrics.UnackedRecordsReporter); ok {
+			r.UnackedRecords(sc.shard.ID, unacked)
 		}
-		getResp, coolDownPeriod, err := sc.callGetRecordsAPI(getRecordsArgs)
+		if unacked >= maxUnacked {
+			if !state.unackedFull {
+				log.Infof("Polling of shard %s held, %d records are waiting for a checkpoint", sc.shard.ID, unacked)
+				state.unackedFull = true
+			}
+			state.polled = true
+			return time.Duration(sc.kclConfig.IdleTimeBetweenReadsInMillis) * time.Millisecond, false, nil
+		}
+		if state.unackedFull {
+			log.Infof("Polling of shard %s resumed, %d records are waiting for a checkpoint", sc.shard.ID, unacked)
+			state.unackedFull = false
+		}
+		unackedLeft = maxUnacked - unacked
+		if unackedLeft < limit {
+			limit = unackedLeft
+		}
+	}
+
+	// shard iterators expire after 5 minutes, refresh an iterator idle for too long rather than hitting
+	// ExpiredIteratorException
+	if refresh := time.Duration(sc.kclConfig.ShardIteratorRefreshMillis) * time.Millisecond; refresh > 0 && time.Since(state.iteratorTime) > refresh {
+		log.Infof("No GetRecords call on shard %s for %v, refreshing its shard iterator", sc.shard.ID, time.Since(state.iteratorTime))
+		shardIterator, err := sc.refreshShardIterator(state)
 		if err != nil {
-			//aws-sdk-go-v2 https://github.com/aws/aws-sdk-go-v2/blob/main/CHANGELOG.md#error-handling
-			var throughputExceededErr *types.ProvisionedThroughputExceededException
-			var kmsThrottlingErr *types.KMSThrottlingException
-			if errors.As(err, &throughputExceededErr) {
-				retriedErrors++
-				if retriedErrors > sc.kclConfig.MaxRetryCount {
-					log.Errorf("message", "Throughput Exceeded Error: "+
-						"reached max retry count getting records from shard",
-						"shardId", sc.shard.ID,
-						"retryCount", retriedErrors,
-						"error", err)
-					return err
-				}
-				// If there is insufficient provisioned throughput on the stream,
-				// subsequent calls made within the next 1 second throw ProvisionedThroughputExceededException.
-				// ref: https://docs.aws.amazon.com/streams/latest/dev/service-sizes-and-limits.html
-				sc.waitASecond(sc.currTime)
-				continue
+			log.Errorf("Unable to refresh shard iterator for %s: %v", sc.shard.ID, err)
+			return 0, true, err
+		}
+		state.shardIterator = shardIterator
+		state.iteratorTime = time.Now()
+	}
+
+	// hold on while too many records are read and not processed yet across the worker, unless records of the shard are
+	// buffered for a batch, which takes more reads to complete
+	if sc.recordsInFlight != nil && state.heldRecords == 0 && !sc.recordsInFlight.wait(sc.ctx.Done()) {
+		sc.shutdownRequested(state)
+		return 0, true, nil
+	}
+
+	getRecordsStartTime := time.Now()
+
+	log.Debugf("Trying to read %d record from iterator: %v", limit, aws.ToString(state.shardIterator))
+
+	// Get records from stream and retry as needed
+	getRecordsArgs := &kinesis.GetRecordsInput{
+		Limit:         aws.Int32(int32(limit)),
+		ShardIterator: state.shardIterator,
+		StreamARN:     sc.streamARNInput(),
+	}
+	result := sc.fetchRecords(state, getRecordsArgs)
+	if result.stopped || (result.err != nil && sc.ctx.Err() != nil) {
+		// the worker is shutting down, the call was aborted
+		sc.shutdownRequested(state)
+		return 0, true, nil
+	}
+	getResp, coolDownPeriod, err := result.resp, result.coolDownPeriod, result.err
+	if !result.startTime.IsZero() {
+		getRecordsStartTime = result.startTime
+	}
+	if err != nil {
+		//aws-sdk-go-v2 https://github.com/aws/aws-sdk-go-v2/blob/main/CHANGELOG.md#error-handling
+		var throughputExceededErr *types.ProvisionedThroughputExceededException
+		var kmsThrottlingErr *types.KMSThrottlingException
+		if errors.As(err, &throughputExceededErr) {
+			sc.fanOutUpgrade.throttled()
+			state.retriedErrors++
+			if state.retriedErrors > sc.kclConfig.MaxRetryCount {
+				log.Errorf("Throughput Exceeded Error: reached max retry count getting records from shard %s, retryCount: %d, error: %+v",
+					sc.shard.ID, state.retriedErrors, err)
+				return 0, true, err
 			}
-			if err == localTPSExceededError {
-				log.Infof("localTPSExceededError so sleep for a second")
-				sc.waitASecond(sc.currTime)
-				continue
+			// If there is insufficient provisioned throughput on the stream,
+			// subsequent calls made within the next 1 second throw ProvisionedThroughputExceededException.
+			// ref: https://docs.aws.amazon.com/streams/latest/dev/service-sizes-and-limits.html
+			return sc.backoff(sc.kclConfig.ThroughputExceededBackoff, state.retriedErrors), false, nil
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			state.retriedErrors++
+			if state.retriedErrors > sc.kclConfig.MaxRetryCount {
+				log.Errorf("GetRecords timed out: reached max retry count getting records from shard %s, retryCount: %d, error: %+v",
+					sc.shard.ID, state.retriedErrors, err)
+				return 0, true, err
 			}
-			if err == maxBytesExceededError {
-				log.Infof("maxBytesExceededError so sleep for %+v seconds", coolDownPeriod)
-				time.Sleep(time.Duration(coolDownPeriod) * time.Second)
-				continue
+			log.Warnf("GetRecords on shard %s timed out after %d ms, retrying: %+v", sc.shard.ID, sc.kclConfig.GetRecordsTimeoutMillis, err)
+			return sc.backoff(sc.kclConfig.GetRecordsTimeoutBackoff, state.retriedErrors), false, nil
+		}
+		if err == localTPSExceededError {
+			log.Infof("localTPSExceededError so sleep for a second")
+			return sc.untilNextSecond(sc.currTime), false, nil
+		}
+		if err == budgetExhaustedError {
+			log.Infof("GetRecords call budget of the worker exhausted, polling of shard %s paused for %v", sc.shard.ID, result.budgetWait)
+			if r, ok := sc.mService.(metrics.GetRecordsBudgetReporter); ok {
+				r.GetRecordsBudgetExhausted(sc.shard.ID)
 			}
-			if errors.As(err, &kmsThrottlingErr) {
-				log.Errorf("Error getting records from shard %v: %+v", sc.shard.ID, err)
-				retriedErrors++
-				// Greater than MaxRetryCount so we get the last retry
-				if retriedErrors > sc.kclConfig.MaxRetryCount {
-					log.Errorf("message", "KMS Throttling Error: "+
-						"reached max retry count getting records from shard",
-						"shardId", sc.shard.ID,
-						"retryCount", retriedErrors,
-						"error", err)
-					return err
-				}
-				// exponential backoff
-				// https://docs.aws.amazon.com/amazondynamodb/latest/developerguide/Programming.Errors.html#Programming.Errors.RetryAndBackoff
-				time.Sleep(time.Duration(math.Exp2(float64(retriedErrors))*100) * time.Millisecond)
-				continue
+			return result.budgetWait, false, nil
+		}
+		if err == maxBytesExceededError {
+			log.Infof("maxBytesExceededError so sleep for %+v seconds", coolDownPeriod)
+			return time.Duration(coolDownPeriod) * time.Second, false, nil
+		}
+		if errors.As(err, &kmsThrottlingErr) {
+			log.Errorf("Error getting records from shard %v: %+v", sc.shard.ID, err)
+			state.retriedErrors++
+			// Greater than MaxRetryCount so we get the last retry
+			if state.retriedErrors > sc.kclConfig.MaxRetryCount {
+				log.Errorf("KMS Throttling Error: reached max retry count getting records from shard %s, retryCount: %d, error: %+v",
+					sc.shard.ID, state.retriedErrors, err)
+				return 0, true, err
 			}
-			log.Errorf("Error getting records from Kinesis that cannot be retried: %+v Request: %s", err, getRecordsArgs)
-			return err
+			return sc.backoff(sc.kclConfig.KMSThrottlingBackoff, state.retriedErrors), false, nil
+		}
+		var kmsInvalidStateErr *types.KMSInvalidStateException
+		if errors.As(err, &kmsInvalidStateErr) {
+			log.Errorf("Cannot read shard %s, the KMS key of stream %s is disabled or pending deletion, enable the key to resume: %+v",
+				sc.shard.ID, sc.streamName, err)
+			return 0, true, kmsError{kind: ErrKMSKeyUnusable, err: err}
 		}
-		// reset the retry count after success
-		retriedErrors = 0
+		var kmsOptInErr *types.KMSOptInRequired
+		if errors.As(err, &kmsOptInErr) {
+			log.Errorf("Cannot read shard %s, stream %s is encrypted and the AWS account is not subscribed to KMS: %+v",
+				sc.shard.ID, sc.streamName, err)
+			return 0, true, kmsError{kind: ErrKMSOptInRequired, err: err}
+		}
+		log.Errorf("Error getting records from Kinesis that cannot be retried: %+v Request: %s", err, getRecordsArgs)
+		return 0, true, err
+	}
+	// reset the retry count after success
+	state.retriedErrors = 0
+	state.iteratorTime = time.Now()
+	if len(getResp.Records) > 0 {
+		state.lastSequenceNumber = getResp.Records[len(getResp.Records)-1].SequenceNumber
+	}
+	sc.shard.SetLastPollTime(time.Now())
+	sc.adaptiveMaxRecords.observe(getResp.Records)
+	if sc.recordsInFlight != nil {
+		sc.recordsInFlight.add(len(getResp.Records))
+		state.heldRecords += len(getResp.Records)
+	}
+	if getResp.MillisBehindLatest != nil {
+		state.lag = *getResp.MillisBehindLatest
+	}
 
-		sc.processRecords(getRecordsStartTime, getResp.Records, getResp.MillisBehindLatest, recordCheckpointer)
+	// after a long pause of the process, e.g. a GC pause, the lease may have been lost without the lease renewal
+	// noticing yet: make sure it is still held before processing the records
+	if threshold := time.Duration(sc.kclConfig.LeaseVerificationGapMillis) * time.Millisecond; threshold > 0 && !state.lastPollEnd.IsZero() {
+		if gap := time.Since(state.lastPollEnd) - state.lastWait; gap > threshold {
+			if err := sc.verifyLease(state, gap); err != nil {
+				return 0, true, err
+			}
+		}
+	}
 
-		// The shard has been closed, so no new records can be read from it
-		if getResp.NextShardIterator == nil {
-			log.Infof("Shard %s closed", sc.shard.ID)
-			shutdownInput := &kcl.ShutdownInput{ShutdownReason: kcl.TERMINATE, Checkpointer: recordCheckpointer}
-			sc.recordProcessor.Shutdown(shutdownInput)
-			return nil
+	if sc.kclConfig.OnGetRecordsResponse != nil {
+		sc.kclConfig.OnGetRecordsResponse(sc.shard.ID, getResp)
+	}
+
+	// read the next records while these are processed, within what the unacknowledged records leave
+	if sc.kclConfig.EnablePrefetch && len(getResp.Records) > 0 && getResp.NextShardIterator != nil {
+		prefetchLimit := sc.adaptiveMaxRecords.maxRecords(sc.kclConfig.MaxRecords)
+		if left := unackedLeft - len(getResp.Records); left < prefetchLimit {
+			prefetchLimit = left
+		}
+		if prefetchLimit > 0 {
+			sc.startPrefetch(state, &kinesis.GetRecordsInput{
+				Limit:         aws.Int32(int32(prefetchLimit)),
+				ShardIterator: getResp.NextShardIterator,
+				StreamARN:     sc.streamARNInput(),
+			})
 		}
-		shardIterator = getResp.NextShardIterator
+	}
+
+	if err := sc.processRecords(getRecordsStartTime, getResp.Records, getResp.MillisBehindLatest, state.recordCheckpointer); err != nil {
+		return 0, true, err
+	}
+	if sc.batch.startTime.IsZero() {
+		sc.releaseRecordsInFlight(state)
+	}
 
-		// Idle between each read, the user is responsible for checkpoint the progress
-		// This value is only used when no records are returned; if records are returned, it should immediately
-		// retrieve the next set of records.
-		if len(getResp.Records) == 0 && aws.ToInt64(getResp.MillisBehindLatest) < int64(sc.kclConfig.IdleTimeBetweenReadsInMillis) {
-			time.Sleep(time.Duration(sc.kclConfig.IdleTimeBetweenReadsInMillis) * time.Millisecond)
+	// The shard has been closed, so no new records can be read from it
+	if getResp.NextShardIterator == nil {
+		sc.createChildLeases(getResp.ChildShards)
+		sc.endShard(state.recordCheckpointer)
+		return 0, true, nil
+	}
+	state.shardIterator = getResp.NextShardIterator
+
+	if len(getResp.Records) > 0 {
+		state.emptyPolls = 0
+	} else {
+		state.emptyPolls++
+	}
+	// release a shard which stays quiet, so that it can be redistributed
+	if sc.kclConfig.MaxConsecutiveEmptyPollsBeforeRelease > 0 && state.emptyPolls >= sc.kclConfig.MaxConsecutiveEmptyPollsBeforeRelease {
+		log.Infof("No record read from shard %s in %d polls, releasing its lease", sc.shard.ID, state.emptyPolls)
+		sc.shutdownRequested(state)
+		return 0, true, nil
+	}
+
+	state.polled = true
+	// Idle between each read, the user is responsible for checkpoint the progress
+	// This value is only used when no records are returned; if records are returned, it should immediately
+	// retrieve the next set of records.
+	if sc.idleBeforeNextRead(len(getResp.Records), getResp.MillisBehindLatest) {
+		return sc.idleTime(), false, nil
+	}
+	return 0, false, nil
+}
+
+// getRecordsResult is the outcome of a GetRecords call. stopped is set when the call was not made, the worker
+// stopping.
+type getRecordsResult struct {
+	resp           *kinesis.GetRecordsOutput
+	coolDownPeriod int
+	err            error
+	stopped        bool
+	// until the next window of the GetRecords call budget, with budgetExhaustedError
+	budgetWait time.Duration
+	// when a prefetched call was made
+	startTime time.Time
+}
+
+// prefetch is a GetRecords call made with the next shard iterator while the records read last are processed.
+type prefetch struct {
+	shardIterator *string
+	result        chan getRecordsResult
+}
+
+// fetchRecords calls GetRecords, unless the call was prefetched already with the same shard iterator, in which case
+// its result is returned. A prefetched call made with another shard iterator, e.g. refreshed meanwhile, is discarded.
+func (sc *PollingShardConsumer) fetchRecords(state *pollState, gri *kinesis.GetRecordsInput) getRecordsResult {
+	if p := state.prefetch; p != nil {
+		state.prefetch = nil
+		result := <-p.result
+		if aws.ToString(p.shardIterator) == aws.ToString(gri.ShardIterator) {
+			return result
 		}
+	}
+	return sc.callGetRecords(state.lag, gri)
+}
 
-		select {
-		case <-*sc.stop:
-			shutdownInput := &kcl.ShutdownInput{ShutdownReason: kcl.REQUESTED, Checkpointer: recordCheckpointer}
-			sc.recordProcessor.Shutdown(shutdownInput)
-			return nil
-		case leaseRenewalErr := <-leaseRenewalErrChan:
-			return leaseRenewalErr
-		default:
+// startPrefetch makes the GetRecords call in the background, for the next poll to pick its result up. The records
+// read are not seen by the record processor, nor checkpointed, until then.
+func (sc *PollingShardConsumer) startPrefetch(state *pollState, gri *kinesis.GetRecordsInput) {
+	p := &prefetch{shardIterator: gri.ShardIterator, result: make(chan getRecordsResult, 1)}
+	lag := state.lag
+	go func() {
+		startTime := time.Now()
+		result := sc.callGetRecords(lag, gri)
+		result.startTime = startTime
+		// buffered: a result left behind when polling stops is dropped with the channel
+		p.result <- result
+	}()
+	state.prefetch = p
+}
+
+// callGetRecords calls GetRecords once the poll scheduler, if any, lets it, and within the call budget of the worker.
+func (sc *PollingShardConsumer) callGetRecords(lag int64, gri *kinesis.GetRecordsInput) getRecordsResult {
+	if sc.getRecordsBudget != nil {
+		if wait, ok := sc.getRecordsBudget.take(); !ok {
+			return getRecordsResult{err: budgetExhaustedError, budgetWait: wait}
+		}
+	}
+	if sc.pollScheduler != nil {
+		if !sc.pollScheduler.acquire(lag, sc.ctx.Done()) {
+			return getRecordsResult{stopped: true}
 		}
+		defer sc.pollScheduler.release()
+	}
+	ctx, cancel := context.WithTimeout(sc.ctx, time.Duration(sc.kclConfig.GetRecordsTimeoutMillis)*time.Millisecond)
+	defer cancel()
+	resp, coolDownPeriod, err := sc.callGetRecordsAPI(ctx, gri)
+	return getRecordsResult{resp: resp, coolDownPeriod: coolDownPeriod, err: err}
+}
+
+// verifyLease reads the owner of the lease after the consumer was paused for gap. When the lease was lost, the
+// record processor is shut down with ZOMBIE and ErrLeaseLost returned, the records read not being processed.
+func (sc *PollingShardConsumer) verifyLease(state *pollState, gap time.Duration) error {
+	log := sc.kclConfig.Logger
+	log.Warnf("Shard %s was not polled for %v longer than expected, verifying its lease", sc.shard.ID, gap)
+
+	owner, err := sc.checkpointer.GetLeaseOwner(sc.shard.ID)
+	if err != nil && !errors.Is(err, chk.NoLeaseOwnerErr) {
+		log.Errorf("Unable to verify the lease on shard %s: %+v", sc.shard.ID, err)
+		return err
+	}
+	if owner == sc.consumerID {
+		return nil
+	}
+
+	log.Warnf("Lease on shard %s was lost during the pause, now owned by %q, shutting down its record processor", sc.shard.ID, owner)
+	sc.recordProcessor.Shutdown(&kcl.ShutdownInput{ShutdownReason: kcl.ZOMBIE, Checkpointer: state.recordCheckpointer})
+	return fmt.Errorf("%w: shard %s, after a %v pause", ErrLeaseLost, sc.shard.ID, gap)
+}
+
+// Stats returns the state of the local rate limiter of the consumer, for diagnostics. It waits for a GetRecords call in
+// progress to complete.
+func (sc *PollingShardConsumer) Stats() RateLimiterStats {
+	sc.rateLimitMux.Lock()
+	defer sc.rateLimitMux.Unlock()
+	return RateLimiterStats{
+		CallsLeft:      sc.callsLeft,
+		WindowStart:    sc.currTime,
+		BytesRead:      sc.bytesRead,
+		RemainingBytes: sc.remBytes,
+		LastCheckTime:  sc.lastCheckTime,
 	}
 }
 
-func (sc *PollingShardConsumer) waitASecond(timePassed time.Time) {
+// PollStats is a snapshot of the polling of a shard, as of the end of the last poll.
+type PollStats struct {
+	// LastPollEnd is when the last poll returned
+	LastPollEnd time.Time
+	// LastWait is how long the consumer waited after the last poll, for the rate limits, a backoff or an idle shard
+	LastWait time.Duration
+	// RetriedErrors is the number of consecutive GetRecords errors retried
+	RetriedErrors int
+	// EmptyPolls is the number of consecutive GetRecords responses without records
+	EmptyPolls int
+	// MillisBehindLatest is the lag of the shard, nil until known
+	MillisBehindLatest *int64
+	// Paused is set while the PauseController or MaxUnackedRecords holds the polling
+	Paused bool
+}
+
+// PollStats returns the outcome of the last poll of the shard, for diagnostics.
+func (sc *PollingShardConsumer) PollStats() PollStats {
+	sc.pollStatsMux.Lock()
+	defer sc.pollStatsMux.Unlock()
+	return sc.pollStats
+}
+
+// recordPollStats keeps the outcome of a poll for PollStats.
+func (sc *PollingShardConsumer) recordPollStats(state *pollState) {
+	stats := PollStats{
+		LastPollEnd:   state.lastPollEnd,
+		LastWait:      state.lastWait,
+		RetriedErrors: state.retriedErrors,
+		EmptyPolls:    state.emptyPolls,
+		Paused:        state.paused || state.unackedFull,
+	}
+	if state.lag != math.MaxInt64 {
+		lag := state.lag
+		stats.MillisBehindLatest = &lag
+	}
+
+	sc.pollStatsMux.Lock()
+	defer sc.pollStatsMux.Unlock()
+	sc.pollStats = stats
+}
+
+// ResetRateLimiter starts the local rate limiter of the consumer afresh: a new one second window with all its calls,
+// and the whole byte budget.
+func (sc *PollingShardConsumer) ResetRateLimiter() {
+	sc.rateLimitMux.Lock()
+	defer sc.rateLimitMux.Unlock()
+	sc.currTime = rateLimitTimeNow()
+	sc.callsLeft = kinesisReadTPSLimit
+	sc.callTimes = nil
+	sc.bytesRead = 0
+	sc.remBytes = MaxBytes
+	sc.lastCheckTime = time.Time{}
+}
+
+// untilNextSecond returns how long is left of the second started at timePassed.
+func (sc *PollingShardConsumer) untilNextSecond(timePassed time.Time) time.Duration {
 	waitTime := time.Since(timePassed)
 	if waitTime < time.Second {
-		time.Sleep(time.Second - waitTime)
+		return time.Second - waitTime
 	}
+	return 0
+}
+
+// backoff returns how long to wait after the given number of consecutive errors under the policy, jitter included.
+func (sc *PollingShardConsumer) backoff(policy config.BackoffPolicy, retries int) time.Duration {
+	if policy.JitterMode == config.SpreadJitter && policy.Jitter <= 0 {
+		return policy.Backoff(retries, 0.5)
+	}
+	return policy.Backoff(retries, sc.random())
 }
 
 func (sc *PollingShardConsumer) checkCoolOffPeriod() (int, error) {
@@ -271,25 +862,43 @@ func (sc *PollingShardConsumer) checkCoolOffPeriod() (int, error) {
 	return 0, nil
 }
 
-func (sc *PollingShardConsumer) callGetRecordsAPI(gri *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, int, error) {
+func (sc *PollingShardConsumer) callGetRecordsAPI(ctx context.Context, gri *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, int, error) {
+	sc.rateLimitMux.Lock()
+	defer sc.rateLimitMux.Unlock()
+
 	if sc.bytesRead != 0 {
 		coolDownPeriod, err := sc.checkCoolOffPeriod()
 		if err != nil {
 			return nil, coolDownPeriod, err
 		}
 	}
-	// every new second, we get a fresh set of calls
-	if rateLimitTimeSince(sc.currTime) > time.Second {
-		sc.callsLeft = kinesisReadTPSLimit
-		sc.currTime = rateLimitTimeNow()
-	}
+	for {
+		takeCall := sc.takeFixedWindowCall
+		if sc.slidingWindowTPS {
+			takeCall = sc.takeSlidingWindowCall
+		}
+		wait, err := takeCall()
+		if err != nil {
+			return nil, 0, err
+		}
+		if wait == 0 {
+			break
+		}
 
-	if sc.callsLeft < 1 {
-		return nil, 0, localTPSExceededError
+		// the rate limiter is not held while waiting, and the wait ends with the consumer
+		sc.rateLimitMux.Unlock()
+		select {
+		case <-rateLimitAfter(wait):
+			err = nil
+		case <-sc.ctx.Done():
+			err = sc.ctx.Err()
+		}
+		sc.rateLimitMux.Lock()
+		if err != nil {
+			return nil, 0, err
+		}
 	}
-	getResp, err := sc.kc.GetRecords(context.TODO(), gri)
-	sc.callsLeft--
-
+	getResp, err := sc.kc.GetRecords(ctx, gri)
 	if err != nil {
 		return getResp, 0, err
 	}
@@ -299,6 +908,13 @@ func (sc *PollingShardConsumer) callGetRecordsAPI(gri *kinesis.GetRecordsInput)
 	for _, record := range getResp.Records {
 		sc.bytesRead += len(record.Data)
 	}
+	if sc.bytesRead > MaxBytes {
+		// A call returns MaxBytes at most. Charging more would run the byte budget into a deficit, and the shard into a
+		// cool-off, beyond the 5 seconds Kinesis itself requires after a 10 MB read.
+		sc.kclConfig.Logger.Warnf("GetRecords returned %d bytes from shard %s, more than the %d bytes a call can return, counting %d",
+			sc.bytesRead, sc.shard.ID, MaxBytes, MaxBytes)
+		sc.bytesRead = MaxBytes
+	}
 	if sc.lastCheckTime.IsZero() {
 		sc.lastCheckTime = rateLimitTimeNow()
 	}
@@ -306,14 +922,127 @@ func (sc *PollingShardConsumer) callGetRecordsAPI(gri *kinesis.GetRecordsInput)
 	return getResp, 0, err
 }
 
+// takeFixedWindowCall takes one of the calls of the current one second window, which starts with its first call. When
+// blocking on TPS exceeded, it returns how long is left of the window if its calls are used up.
+func (sc *PollingShardConsumer) takeFixedWindowCall() (time.Duration, error) {
+	// every new second, we get a fresh set of calls
+	if rateLimitTimeSince(sc.currTime) > time.Second {
+		sc.callsLeft = kinesisReadTPSLimit
+		sc.currTime = rateLimitTimeNow()
+	}
+
+	if sc.callsLeft < 1 {
+		if !sc.blockOnTPSExceeded {
+			return 0, localTPSExceededError
+		}
+		if waitTime := time.Second - rateLimitTimeSince(sc.currTime); waitTime > 0 {
+			return waitTime, nil
+		}
+		sc.callsLeft = kinesisReadTPSLimit
+		sc.currTime = rateLimitTimeNow()
+	}
+	sc.callsLeft--
+	return 0, nil
+}
+
+// takeSlidingWindowCall takes a call if less than kinesisReadTPSLimit calls were made within the last second. The
+// window then starts with the oldest of these calls, which is when the next call can be made once they are used up:
+// when blocking on TPS exceeded, it returns how long is left until then.
+func (sc *PollingShardConsumer) takeSlidingWindowCall() (time.Duration, error) {
+	now := rateLimitTimeNow()
+	sc.expireCallTimes(now)
+	if len(sc.callTimes) >= kinesisReadTPSLimit {
+		if !sc.blockOnTPSExceeded {
+			return 0, localTPSExceededError
+		}
+		return sc.callTimes[0].Add(time.Second).Sub(now), nil
+	}
+
+	sc.callTimes = append(sc.callTimes, now)
+	sc.callsLeft = kinesisReadTPSLimit - len(sc.callTimes)
+	sc.currTime = sc.callTimes[0]
+	return 0, nil
+}
+
+// expireCallTimes forgets the calls made a second or more before now.
+func (sc *PollingShardConsumer) expireCallTimes(now time.Time) {
+	expired := 0
+	for expired < len(sc.callTimes) && now.Sub(sc.callTimes[expired]) >= time.Second {
+		expired++
+	}
+	sc.callTimes = sc.callTimes[expired:]
+}
+
+// idleBeforeNextRead returns true when no record was read and the consumer is close to the tip of the stream. When
+// GetRecords does not tell how far behind the consumer is, UnknownLagPolicy decides.
+func (sc *PollingShardConsumer) idleBeforeNextRead(recordCount int, millisBehindLatest *int64) bool {
+	if recordCount > 0 {
+		return false
+	}
+	if millisBehindLatest == nil {
+		return sc.kclConfig.UnknownLagPolicy != config.ReadOnUnknownLag
+	}
+	return *millisBehindLatest < int64(sc.kclConfig.IdleTimeBetweenReadsInMillis)
+}
+
+// newShardRand returns a random source for the shard derived from the given seed, so that the shards of a worker do
+// not draw the same sequence.
+func newShardRand(seed int64, shardID string) *rand.Rand {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(shardID))
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+}
+
+// idleTime returns the time to sleep before reading an idle shard again: IdleTimeBetweenReadsInMillis, spread by up to
+// IdleTimeBetweenReadsJitter either way.
+func (sc *PollingShardConsumer) idleTime() time.Duration {
+	idle := time.Duration(sc.kclConfig.IdleTimeBetweenReadsInMillis) * time.Millisecond
+	return sc.jitter(idle, sc.kclConfig.IdleTimeBetweenReadsJitter)
+}
+
+// jitter randomly spreads d by up to the given fraction of it, either way.
+func (sc *PollingShardConsumer) jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	spread := (2*sc.random() - 1) * fraction
+	return time.Duration(float64(d) * (1 + spread))
+}
+
+// random draws a number in [0, 1) from the jitter source.
+func (sc *PollingShardConsumer) random() float64 {
+	if sc.rand == nil {
+		sc.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return jitterSource(sc.rand)
+}
+
 func (sc *PollingShardConsumer) renewLease(ctx context.Context) error {
+	log := sc.kclConfig.Logger
 	renewDuration := time.Duration(sc.kclConfig.LeaseRefreshWaitTime) * time.Millisecond
 	for {
-		timer := time.NewTimer(renewDuration)
+		delay := renewDuration
+		// renew earlier when the lease would otherwise expire, skew included, before the next refresh
+		if !sc.shard.GetLeaseTimeout().IsZero() {
+			if untilRefresh := sc.leaseRenewalDelay(); untilRefresh < delay {
+				delay = untilRefresh
+			}
+		}
+		leaseTimeout := sc.shard.GetLeaseTimeout()
+		timer := time.NewTimer(sc.minLeaseRenewalDelay(delay))
 		select {
 		case <-timer.C:
+			if sc.kclConfig.CheckpointRenewsLease && sc.shard.GetLeaseTimeout().After(leaseTimeout) {
+				// a checkpoint extended the lease meanwhile
+				continue
+			}
 			log.Debugf("Refreshing lease on shard: %s for worker: %s", sc.shard.ID, sc.consumerID)
-			err := sc.checkpointer.GetLease(sc.shard, sc.consumerID)
+			err := sc.renewShardLease(sc.consumerID)
+			if errors.Is(err, errLeaseRenewalStopped) {
+				// the worker is shutting down, leave it to the consumer loop
+				<-ctx.Done()
+				return nil
+			}
 			if err != nil {
 				// log and return error
 				log.Errorf("Error in refreshing lease on shard: %s for worker: %s. Error: %+v",
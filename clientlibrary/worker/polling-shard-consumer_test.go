@@ -22,13 +22,21 @@ package worker
 import (
 	"context"
 	"errors"
+	"math/rand"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
 )
 
 var (
@@ -46,7 +54,7 @@ func TestCallGetRecordsAPI(t *testing.T) {
 	gri := kinesis.GetRecordsInput{
 		ShardIterator: aws.String("shard-iterator-01"),
 	}
-	out, _, err := psc.callGetRecordsAPI(&gri)
+	out, _, err := psc.callGetRecordsAPI(context.Background(), &gri)
 	assert.Nil(t, err)
 	assert.Equal(t, &ret, out)
 	m1.AssertExpectations(t)
@@ -60,7 +68,7 @@ func TestCallGetRecordsAPI(t *testing.T) {
 	rateLimitTimeSince = func(t time.Time) time.Duration {
 		return 500 * time.Millisecond
 	}
-	out2, _, err2 := psc2.callGetRecordsAPI(&gri)
+	out2, _, err2 := psc2.callGetRecordsAPI(context.Background(), &gri)
 	assert.Nil(t, out2)
 	assert.ErrorIs(t, err2, localTPSExceededError)
 	m2.AssertExpectations(t)
@@ -77,7 +85,7 @@ func TestCallGetRecordsAPI(t *testing.T) {
 	rateLimitTimeSince = func(t time.Time) time.Duration {
 		return 2 * time.Second
 	}
-	out3, checkSleepVal, err3 := psc3.callGetRecordsAPI(&gri)
+	out3, checkSleepVal, err3 := psc3.callGetRecordsAPI(context.Background(), &gri)
 	assert.Nil(t, err3)
 	assert.Equal(t, checkSleepVal, 0)
 	assert.Equal(t, &ret3, out3)
@@ -101,7 +109,7 @@ func TestCallGetRecordsAPI(t *testing.T) {
 	rateLimitTimeNow = func() time.Time {
 		return testTime.Add(time.Second)
 	}
-	out4, checkSleepVal2, err4 := psc4.callGetRecordsAPI(&gri)
+	out4, checkSleepVal2, err4 := psc4.callGetRecordsAPI(context.Background(), &gri)
 	assert.Nil(t, err4)
 	assert.Equal(t, &ret4, out4)
 	m4.AssertExpectations(t)
@@ -127,7 +135,7 @@ func TestCallGetRecordsAPI(t *testing.T) {
 	rateLimitTimeNow = func() time.Time {
 		return testTime2.Add(time.Second * 3)
 	}
-	out5, checkSleepVal3, err5 := psc5.callGetRecordsAPI(&gri)
+	out5, checkSleepVal3, err5 := psc5.callGetRecordsAPI(context.Background(), &gri)
 	assert.Nil(t, err5)
 	assert.Equal(t, checkSleepVal3, 0)
 	assert.Equal(t, &ret5, out5)
@@ -151,7 +159,7 @@ func TestCallGetRecordsAPI(t *testing.T) {
 	rateLimitTimeNow = func() time.Time {
 		return testTime3.Add(time.Second / 5)
 	}
-	out6, checkSleepVal4, err6 := psc6.callGetRecordsAPI(&gri)
+	out6, checkSleepVal4, err6 := psc6.callGetRecordsAPI(context.Background(), &gri)
 	assert.Nil(t, err6)
 	assert.Equal(t, &ret6, out6)
 	m5.AssertExpectations(t)
@@ -171,7 +179,7 @@ func TestCallGetRecordsAPI(t *testing.T) {
 	rateLimitTimeSince = func(t time.Time) time.Duration {
 		return 2 * time.Second
 	}
-	out7, checkSleepVal7, err7 := psc7.callGetRecordsAPI(&gri)
+	out7, checkSleepVal7, err7 := psc7.callGetRecordsAPI(context.Background(), &gri)
 	assert.Equal(t, err7, testGetRecordsError)
 	assert.Equal(t, checkSleepVal7, 0)
 	assert.Equal(t, out7, &ret7)
@@ -353,3 +361,1464 @@ func TestPollingShardConsumer_checkCoolOffPeriod(t *testing.T) {
 	// restore original time.Now
 	rateLimitTimeNow = time.Now
 }
+
+func TestCallGetRecordsAPIBlockOnTPSExceeded(t *testing.T) {
+	defer func() {
+		rateLimitTimeNow = time.Now
+		rateLimitTimeSince = time.Since
+		rateLimitAfter = time.After
+	}()
+
+	start := time.Now()
+	now := start
+	var waited time.Duration
+	rateLimitAfter = func(d time.Duration) <-chan time.Time {
+		waited += d
+		now = now.Add(d)
+		after := make(chan time.Time, 1)
+		after <- now
+		return after
+	}
+	rateLimitTimeSince = func(t time.Time) time.Duration {
+		return now.Sub(t)
+	}
+	rateLimitTimeNow = func() time.Time {
+		return now
+	}
+
+	m := MockKinesisSubscriberGetter{}
+	ret := kinesis.GetRecordsOutput{}
+	m.On("GetRecords", mock.Anything, mock.Anything, mock.Anything).Return(&ret, nil)
+	psc := PollingShardConsumer{
+		commonShardConsumer: commonShardConsumer{kc: &m},
+		ctx:                 context.Background(),
+		currTime:            start.Add(-400 * time.Millisecond),
+		callsLeft:           0,
+		blockOnTPSExceeded:  true,
+	}
+	gri := kinesis.GetRecordsInput{
+		ShardIterator: aws.String("shard-iterator-01"),
+	}
+
+	out, _, err := psc.callGetRecordsAPI(context.Background(), &gri)
+	assert.Nil(t, err)
+	assert.Equal(t, &ret, out)
+	assert.Equal(t, 600*time.Millisecond, waited)
+	assert.Equal(t, kinesisReadTPSLimit-1, psc.callsLeft)
+	assert.Equal(t, start.Add(600*time.Millisecond), psc.currTime)
+	m.AssertExpectations(t)
+}
+
+func TestCallGetRecordsAPIBlockOnTPSExceededUntilStopped(t *testing.T) {
+	defer func() { rateLimitAfter = time.After }()
+	waiting := make(chan struct{})
+	rateLimitAfter = func(time.Duration) <-chan time.Time {
+		close(waiting)
+		return nil
+	}
+
+	m := MockKinesisSubscriberGetter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	psc := PollingShardConsumer{
+		commonShardConsumer: commonShardConsumer{kc: &m},
+		ctx:                 ctx,
+		currTime:            time.Now(),
+		callsLeft:           0,
+		blockOnTPSExceeded:  true,
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, _, err := psc.callGetRecordsAPI(context.Background(), &kinesis.GetRecordsInput{ShardIterator: aws.String("shard-iterator-01")})
+		errs <- err
+	}()
+	<-waiting
+
+	// the rate limiter is not held during the wait
+	assert.Equal(t, 0, psc.Stats().CallsLeft)
+	cancel()
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("the wait for the rate limit window did not end with the consumer")
+	}
+	m.AssertNotCalled(t, "GetRecords", mock.Anything, mock.Anything, mock.Anything)
+}
+
+// newTestPollingShardConsumer returns a consumer of shard "shard-0" for the worker "workerID".
+func newTestPollingShardConsumer(kclConfig *config.KinesisClientLibConfiguration, processor kcl.IRecordProcessor,
+	kc KinesisSubscriberGetter, checkpointer chk.Checkpointer) *PollingShardConsumer {
+	stop := make(chan struct{})
+	sc := &PollingShardConsumer{
+		commonShardConsumer: *newTestCommonShardConsumer(kclConfig, processor),
+		consumerID:          "workerID",
+		stop:                &stop,
+	}
+	sc.kc = kc
+	sc.checkpointer = checkpointer
+	sc.mService = sc.commonShardConsumer.mService
+	return sc
+}
+
+func TestRenewLeaseEarlierWithClockSkewTolerance(t *testing.T) {
+	renewals := func(kclConfig *config.KinesisClientLibConfiguration) int {
+		checkpointer := newTestCheckpointer(map[string]*testLease{})
+		sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, newFakeKinesis("shard-0"), checkpointer)
+		sc.shard.SetLeaseTimeout(time.Now().Add(300 * time.Millisecond))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- sc.renewLease(ctx) }()
+		time.Sleep(120 * time.Millisecond)
+		cancel()
+		assert.Nil(t, <-done)
+		return checkpointer.called("GetLease", "shard-0")
+	}
+
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithLeaseRefreshWaitTime(10000).
+		WithLeaseRefreshPeriodMillis(100)
+	// without tolerance the lease is renewed 100ms before it expires
+	assert.Equal(t, 0, renewals(kclConfig))
+
+	// a tolerated skew of 150ms brings the renewal forward, 250ms before the lease expires by the local clock
+	assert.Equal(t, 1, renewals(kclConfig.WithClockSkewToleranceMillis(150)))
+}
+
+func TestIdleBeforeNextReadWithUnknownLag(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(1000)
+	sc := &PollingShardConsumer{commonShardConsumer: commonShardConsumer{kclConfig: kclConfig}}
+
+	// an unknown lag is not taken for caught up, the policy decides
+	assert.True(t, sc.idleBeforeNextRead(0, nil))
+	kclConfig.WithUnknownLagPolicy(config.ReadOnUnknownLag)
+	assert.False(t, sc.idleBeforeNextRead(0, nil))
+
+	assert.True(t, sc.idleBeforeNextRead(0, aws.Int64(0)))
+	assert.False(t, sc.idleBeforeNextRead(0, aws.Int64(5000)))
+	assert.False(t, sc.idleBeforeNextRead(1, nil))
+}
+
+func TestGetRecordsReleasesLeaseAfterEmptyPolls(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(1).
+		WithMaxConsecutiveEmptyPollsBeforeRelease(3)
+
+	var shutdownReason kcl.ShutdownReason
+	processor := &testRecordProcessor{shutdown: func(input *kcl.ShutdownInput) {
+		shutdownReason = input.ShutdownReason
+	}}
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, processor, newFakeKinesis("shard-0"), checkpointer)
+
+	// the shard never returns any record, its lease is given up after the third poll
+	assert.Nil(t, sc.getRecords())
+	assert.Equal(t, kcl.REQUESTED, shutdownReason)
+	assert.Equal(t, 1, checkpointer.called("RemoveLeaseOwner", "shard-0"))
+	assert.Equal(t, "", checkpointer.leases["shard-0"].owner)
+}
+
+func TestRequestedShutdownCheckpointsBeforeReleasingLease(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(1).
+		WithMaxConsecutiveEmptyPollsBeforeRelease(1)
+
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	var releasedBeforeCheckpoint int
+	processor := &testRecordProcessor{shutdown: func(input *kcl.ShutdownInput) {
+		// a processor taking its time to drain before writing its final checkpoint
+		time.Sleep(50 * time.Millisecond)
+		assert.Nil(t, input.Checkpointer.Checkpoint(aws.String("49590338271490256608559692538361571095921575989136588898")))
+		releasedBeforeCheckpoint = checkpointer.called("RemoveLeaseOwner", "shard-0")
+	}}
+	sc := newTestPollingShardConsumer(kclConfig, processor, newFakeKinesis("shard-0"), checkpointer)
+
+	assert.Nil(t, sc.getRecords())
+	assert.Equal(t, 0, releasedBeforeCheckpoint)
+	assert.Equal(t, 1, checkpointer.called("CheckpointSequence", "shard-0"))
+	assert.Equal(t, 1, checkpointer.called("RemoveLeaseOwner", "shard-0"))
+}
+
+func TestRequestedShutdownReleasesLeaseAfterGrace(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(1).
+		WithMaxConsecutiveEmptyPollsBeforeRelease(1).
+		WithShutdownGraceMillis(100)
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	processor := &testRecordProcessor{shutdown: func(input *kcl.ShutdownInput) { <-unblock }}
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, processor, newFakeKinesis("shard-0"), checkpointer)
+
+	// the processor never returns, the lease is released once the grace period is over
+	start := time.Now()
+	assert.Nil(t, sc.getRecords())
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, 1, checkpointer.called("RemoveLeaseOwner", "shard-0"))
+	assert.Equal(t, "", checkpointer.leases["shard-0"].owner)
+}
+
+func TestGetRecordsShortCircuitsCompletedShard(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	processor := &testRecordProcessor{
+		processRecords: func(_ *kcl.ProcessRecordsInput) { t.Error("records delivered for a completed shard") },
+		shutdown:       func(_ *kcl.ShutdownInput) { t.Error("record processor shut down for a completed shard") },
+	}
+	kc := newFakeKinesis("shard-0", "shard-1")
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {checkpoint: chk.ShardEnd, owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, checkpointer)
+
+	assert.Nil(t, sc.getRecords())
+	assert.Equal(t, 0, kc.shardIteratorRequests)
+	assert.True(t, sc.shard.IsClosed())
+	assert.Equal(t, 1, checkpointer.called("RemoveLeaseOwner", "shard-0"))
+
+	// the child shard does not wait for its parent
+	child := newTestPollingShardConsumer(kclConfig, processor, kc, checkpointer)
+	child.shard.ID = "shard-1"
+	child.shard.ParentShardId = "shard-0"
+	done := make(chan error)
+	go func() { done <- child.waitOnParentShard() }()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("child shard still waiting on its completed parent")
+	}
+}
+
+func TestUnresolvableParentShard(t *testing.T) {
+	kc := newFakeKinesis("shard-0")
+	// the lease of a shard of another stream, which is never consumed to its end
+	checkpointer := newTestCheckpointer(map[string]*testLease{
+		"shard-0":     {owner: "workerID"},
+		"other-shard": {checkpoint: "49590338271490256608559692538361571095921575989136588898"},
+	})
+	newChild := func(kclConfig *config.KinesisClientLibConfiguration) *PollingShardConsumer {
+		sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, kc, checkpointer)
+		sc.shard.ParentShardId = "other-shard"
+		sc.shardCache = newShardMetadataCache(time.Minute, func() ([]types.Shard, error) { return kc.shards, nil })
+		return sc
+	}
+
+	// the child shard is consumed after a bounded wait
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithParentShardWaitTimeoutMillis(200)
+	kclConfig.ParentShardPollIntervalMillis = 50
+	sc := newChild(kclConfig)
+	start := time.Now()
+	state, err := sc.startPolling()
+	assert.Nil(t, err)
+	assert.NotNil(t, state)
+	sc.stopPolling(state)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// or given up
+	kclConfig.WithParentShardTimeoutPolicy(config.FailAfterParentShardTimeout)
+	sc = newChild(kclConfig)
+	assert.ErrorIs(t, sc.getRecords(), ErrParentShardTimeout)
+	// the shard is not read, its lease is released
+	assert.Equal(t, 1, kc.shardIteratorRequests)
+	assert.Equal(t, 2, checkpointer.called("RemoveLeaseOwner", "shard-0"))
+}
+
+func TestGetRecordsResponsesObserved(t *testing.T) {
+	var shardIDs []string
+	var responses []*kinesis.GetRecordsOutput
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(1).
+		WithMaxConsecutiveEmptyPollsBeforeRelease(3).
+		WithOnGetRecordsResponse(func(shardID string, resp *kinesis.GetRecordsOutput) {
+			shardIDs = append(shardIDs, shardID)
+			responses = append(responses, resp)
+		})
+
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, newFakeKinesis("shard-0"), checkpointer)
+	assert.Nil(t, sc.getRecords())
+
+	// one call per poll before the lease is released
+	assert.Equal(t, []string{"shard-0", "shard-0", "shard-0"}, shardIDs)
+	for _, resp := range responses {
+		assert.Equal(t, int64(0), aws.ToInt64(resp.MillisBehindLatest))
+	}
+}
+
+func TestGetRecordsWithoutStopChannel(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(1).
+		WithMaxConsecutiveEmptyPollsBeforeRelease(3)
+
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, newFakeKinesis("shard-0"), checkpointer)
+	sc.stop = nil
+
+	// polls until the lease is released instead of dereferencing the nil stop channel
+	assert.NotPanics(t, func() { assert.Nil(t, sc.getRecords()) })
+	assert.Equal(t, 1, checkpointer.called("RemoveLeaseOwner", "shard-0"))
+}
+
+func TestRenewLeaseRespectsMinInterval(t *testing.T) {
+	renewals := func(kclConfig *config.KinesisClientLibConfiguration) int {
+		checkpointer := newTestCheckpointer(map[string]*testLease{})
+		sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, newFakeKinesis("shard-0"), checkpointer)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- sc.renewLease(ctx) }()
+		time.Sleep(350 * time.Millisecond)
+		cancel()
+		assert.Nil(t, <-done)
+		return checkpointer.called("GetLease", "shard-0")
+	}
+
+	// the refresh wait time alone renews every 10ms
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithLeaseRefreshWaitTime(10)
+	assert.Greater(t, renewals(kclConfig), 10)
+
+	// the floor holds renewals to one every 100ms
+	assert.LessOrEqual(t, renewals(kclConfig.WithMinLeaseRenewalIntervalMillis(100)), 3)
+}
+
+func TestMinLeaseRenewalIntervalLettingLeasesExpire(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithFailoverTimeMillis(10000).
+		WithClockSkewToleranceMillis(1000).
+		WithMinLeaseRenewalIntervalMillis(9000)
+	w := NewWorker(testRecordProcessorFactory{}, kclConfig).WithCheckpointer(newTestCheckpointer(map[string]*testLease{}))
+	w.kc = newFakeKinesis("shard-0")
+	assert.NotNil(t, w.Start())
+}
+
+func TestIdleTimeJittered(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(1000)
+	sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, newFakeKinesis("shard-0"), nil)
+	assert.Equal(t, time.Second, sc.idleTime())
+
+	kclConfig.WithIdleTimeBetweenReadsJitter(0.2)
+	sc.rand = newShardRand(42, "shard-0")
+	other := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, newFakeKinesis("shard-1"), nil)
+	other.rand = newShardRand(42, "shard-1")
+
+	var idleTimes, otherIdleTimes []time.Duration
+	for i := 0; i < 100; i++ {
+		idle := sc.idleTime()
+		assert.GreaterOrEqual(t, idle, 800*time.Millisecond)
+		assert.LessOrEqual(t, idle, 1200*time.Millisecond)
+		idleTimes = append(idleTimes, idle)
+		otherIdleTimes = append(otherIdleTimes, other.idleTime())
+	}
+
+	// the same seed gives the same idle times, another shard other ones
+	sc.rand = newShardRand(42, "shard-0")
+	assert.Equal(t, idleTimes[0], sc.idleTime())
+	assert.NotEqual(t, idleTimes, otherIdleTimes)
+}
+
+func TestRateLimiterStats(t *testing.T) {
+	defer func() {
+		rateLimitTimeNow = time.Now
+	}()
+	testTime := time.Now()
+	rateLimitTimeNow = func() time.Time {
+		return testTime
+	}
+
+	m := MockKinesisSubscriberGetter{}
+	ret := kinesis.GetRecordsOutput{Records: []types.Record{{Data: []byte("0123456789")}}}
+	m.On("GetRecords", mock.Anything, mock.Anything, mock.Anything).Return(&ret, nil)
+	psc := PollingShardConsumer{
+		commonShardConsumer: commonShardConsumer{kc: &m},
+	}
+	psc.ResetRateLimiter()
+	assert.Equal(t, RateLimiterStats{CallsLeft: kinesisReadTPSLimit, WindowStart: testTime, RemainingBytes: MaxBytes}, psc.Stats())
+
+	_, _, err := psc.callGetRecordsAPI(context.Background(), &kinesis.GetRecordsInput{ShardIterator: aws.String("shard-iterator-01")})
+	assert.Nil(t, err)
+	_, _, err = psc.callGetRecordsAPI(context.Background(), &kinesis.GetRecordsInput{ShardIterator: aws.String("shard-iterator-01")})
+	assert.Nil(t, err)
+
+	// two calls spent, the second one charged with the bytes read by the first one
+	stats := psc.Stats()
+	assert.Equal(t, kinesisReadTPSLimit-2, stats.CallsLeft)
+	assert.Equal(t, 10, stats.BytesRead)
+	assert.Equal(t, MaxBytes-10, stats.RemainingBytes)
+	assert.Equal(t, testTime, stats.LastCheckTime)
+
+	psc.ResetRateLimiter()
+	assert.Equal(t, RateLimiterStats{CallsLeft: kinesisReadTPSLimit, WindowStart: testTime, RemainingBytes: MaxBytes}, psc.Stats())
+}
+
+func TestCallGetRecordsAPIOverMaxBytes(t *testing.T) {
+	defer func() {
+		rateLimitTimeNow = time.Now
+	}()
+	testTime := time.Now()
+	rateLimitTimeNow = func() time.Time {
+		return testTime
+	}
+
+	m := MockKinesisSubscriberGetter{}
+	ret := kinesis.GetRecordsOutput{Records: []types.Record{{Data: make([]byte, MaxBytes+MaxBytesPerSecond*3)}}}
+	m.On("GetRecords", mock.Anything, mock.Anything, mock.Anything).Return(&ret, nil)
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	psc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, &m, nil)
+	psc.ResetRateLimiter()
+
+	gri := &kinesis.GetRecordsInput{ShardIterator: aws.String("shard-iterator-01")}
+	_, _, err := psc.callGetRecordsAPI(context.Background(), gri)
+	assert.Nil(t, err)
+	assert.Equal(t, MaxBytes, psc.Stats().BytesRead)
+
+	// the next call is charged with a 10 MB read, which spends the whole byte budget
+	_, _, err = psc.callGetRecordsAPI(context.Background(), gri)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, psc.Stats().RemainingBytes)
+
+	// the cool-off is the one of a 10 MB read
+	_, coolDown, err := psc.callGetRecordsAPI(context.Background(), gri)
+	assert.Equal(t, maxBytesExceededError, err)
+	assert.Equal(t, MaxBytes/MaxBytesPerSecond, coolDown)
+
+	// and reading resumes once it is over
+	testTime = testTime.Add(time.Duration(coolDown) * time.Second)
+	_, coolDown, err = psc.callGetRecordsAPI(context.Background(), gri)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, coolDown)
+}
+
+func TestGetRecordsCheckpointsFinalRecordsBeforeShardEnd(t *testing.T) {
+	events := make(chan config.CheckpointEvent, 10)
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithCheckpointEvents(events).
+		WithCheckpointFinalRecordsAtShardEnd(true)
+
+	var delivered []string
+	var reasons []kcl.ShutdownReason
+	processor := &testRecordProcessor{
+		processRecords: func(input *kcl.ProcessRecordsInput) {
+			for _, r := range input.Records {
+				delivered = append(delivered, aws.ToString(r.SequenceNumber))
+			}
+		},
+		shutdown: func(input *kcl.ShutdownInput) {
+			reasons = append(reasons, input.ShutdownReason)
+			if input.ShutdownReason == kcl.TERMINATE {
+				assert.Nil(t, input.Checkpointer.Checkpoint(nil))
+			}
+		},
+	}
+
+	// the final records come with the response telling the shard is closed
+	kc := newFakeKinesis("shard-0")
+	kc.closedShards["shard-0"] = true
+	kc.pendingRecords["shard-0"] = []types.Record{
+		{Data: []byte("1"), PartitionKey: aws.String("key"), SequenceNumber: aws.String("1")},
+		{Data: []byte("2"), PartitionKey: aws.String("key"), SequenceNumber: aws.String("2")},
+	}
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, checkpointer)
+	assert.Nil(t, sc.getRecords())
+	close(events)
+
+	var checkpoints []string
+	for event := range events {
+		checkpoints = append(checkpoints, event.SequenceNumber)
+	}
+	assert.Equal(t, []string{"1", "2"}, delivered)
+	assert.Equal(t, []string{"2", chk.ShardEnd}, checkpoints)
+	assert.Equal(t, []kcl.ShutdownReason{kcl.TERMINATE}, reasons)
+	assert.True(t, sc.shard.IsClosed())
+
+	// the shard is not ended when the final records cannot be checkpointed
+	reasons = nil
+	kc.pendingRecords["shard-0"] = []types.Record{{Data: []byte("1"), PartitionKey: aws.String("key"), SequenceNumber: aws.String("1")}}
+	sc = newTestPollingShardConsumer(kclConfig.WithCheckpointEvents(nil), processor, kc, failingCheckpointer{newTestCheckpointer(map[string]*testLease{})})
+	assert.Nil(t, sc.getRecords())
+	assert.Equal(t, []kcl.ShutdownReason{kcl.REQUESTED}, reasons)
+	assert.False(t, sc.shard.IsClosed())
+}
+
+func TestGetRecordsBackoffPerErrorClass(t *testing.T) {
+	elapsed := func(getRecordsErr error) time.Duration {
+		kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+			WithMaxRetryCount(3).
+			WithThroughputExceededBackoff(config.BackoffPolicy{BaseMillis: 10, Multiplier: 2, MaxMillis: 25}).
+			WithKMSThrottlingBackoff(config.BackoffPolicy{BaseMillis: 20, Multiplier: 3})
+
+		kc := newFakeKinesis("shard-0")
+		kc.getRecordsErr = getRecordsErr
+		checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+		sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, kc, checkpointer)
+
+		start := time.Now()
+		assert.ErrorIs(t, sc.getRecords(), getRecordsErr)
+		return time.Since(start)
+	}
+
+	// 10ms, 20ms, then capped to 25ms
+	throughput := elapsed(&types.ProvisionedThroughputExceededException{})
+	assert.True(t, throughput >= 55*time.Millisecond, "backoff too short: %v", throughput)
+	assert.True(t, throughput < 200*time.Millisecond, "backoff too long: %v", throughput)
+
+	// 20ms, 60ms, 180ms
+	kms := elapsed(&types.KMSThrottlingException{})
+	assert.True(t, kms >= 260*time.Millisecond, "backoff too short: %v", kms)
+	assert.True(t, kms < time.Second, "backoff too long: %v", kms)
+}
+
+func TestKMSErrorClassification(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		kind     error
+		retried  bool
+		terminal bool
+	}{
+		{name: "throttling", err: &types.KMSThrottlingException{}, retried: true},
+		{name: "invalid state", err: &types.KMSInvalidStateException{}, kind: ErrKMSKeyUnusable, terminal: true},
+		{name: "opt-in required", err: &types.KMSOptInRequired{}, kind: ErrKMSOptInRequired, terminal: true},
+		{name: "access denied", err: &types.KMSAccessDeniedException{}, terminal: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+				WithMaxRetryCount(1).
+				WithKMSThrottlingBackoff(config.BackoffPolicy{BaseMillis: 1, Multiplier: 1})
+
+			kc := newFakeKinesis("shard-0")
+			kc.getRecordsErr = test.err
+			checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+			sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, kc, checkpointer)
+
+			state, err := sc.startPolling()
+			assert.Nil(t, err)
+			defer sc.stopPolling(state)
+
+			_, done, err := sc.poll(state)
+			assert.Equal(t, test.terminal, done)
+			if test.retried {
+				assert.Nil(t, err)
+				return
+			}
+			// the error returned by Kinesis is kept along with its classification
+			assert.ErrorIs(t, err, test.err)
+			if test.kind != nil {
+				assert.ErrorIs(t, err, test.kind)
+			} else {
+				assert.False(t, errors.Is(err, ErrKMSKeyUnusable) || errors.Is(err, ErrKMSOptInRequired))
+			}
+		})
+	}
+}
+
+func TestShardIteratorRefreshedAfterIdle(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithShardIteratorRefreshMillis(60000)
+
+	kc := newFakeKinesis("shard-0")
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID", checkpoint: "5"}})
+	sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, kc, checkpointer)
+
+	state, err := sc.startPolling()
+	assert.Nil(t, err)
+	defer sc.stopPolling(state)
+	assert.Equal(t, 1, kc.shardIteratorRequests)
+
+	// within the threshold, the iterator returned by the last call is used
+	_, done, err := sc.poll(state)
+	assert.False(t, done)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, kc.shardIteratorRequests)
+
+	// nothing read yet: the iterator is derived again from the checkpoint
+	state.iteratorTime = state.iteratorTime.Add(-61 * time.Second)
+	_, _, err = sc.poll(state)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, kc.shardIteratorRequests)
+	assert.Equal(t, types.ShardIteratorTypeAfterSequenceNumber, kc.lastShardIteratorRequest.ShardIteratorType)
+	assert.Equal(t, "5", aws.ToString(kc.lastShardIteratorRequest.StartingSequenceNumber))
+
+	// then from the last record read
+	kc.mux.Lock()
+	kc.pendingRecords["shard-0"] = []types.Record{{SequenceNumber: aws.String("7"), Data: []byte("data")}}
+	kc.mux.Unlock()
+	_, _, err = sc.poll(state)
+	assert.Nil(t, err)
+	state.iteratorTime = state.iteratorTime.Add(-61 * time.Second)
+	_, _, err = sc.poll(state)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, kc.shardIteratorRequests)
+	assert.Equal(t, types.ShardIteratorTypeAfterSequenceNumber, kc.lastShardIteratorRequest.ShardIteratorType)
+	assert.Equal(t, "7", aws.ToString(kc.lastShardIteratorRequest.StartingSequenceNumber))
+}
+
+func TestNilShardIteratorRetried(t *testing.T) {
+	defer func(delay time.Duration) { nilShardIteratorRetryDelay = delay }(nilShardIteratorRetryDelay)
+	nilShardIteratorRetryDelay = time.Millisecond
+
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithMaxRetryCount(2)
+
+	// recovered within the retries
+	kc := newFakeKinesis("shard-0")
+	kc.nilShardIterators = 2
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, kc, checkpointer)
+	state, err := sc.startPolling()
+	assert.Nil(t, err)
+	assert.Equal(t, "shard-0", aws.ToString(state.shardIterator))
+	assert.Equal(t, 3, kc.shardIteratorRequests)
+	sc.stopPolling(state)
+
+	// given up on, without reading the shard
+	kc = newFakeKinesis("shard-0")
+	kc.nilShardIterators = 3
+	kc.getRecordsErr = errors.New("GetRecords called without shard iterator")
+	sc = newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, kc, checkpointer)
+	assert.ErrorIs(t, sc.getRecords(), ErrNilShardIterator)
+	assert.Equal(t, 3, kc.shardIteratorRequests)
+}
+
+func TestNilShardIteratorRetryCanceled(t *testing.T) {
+	defer func(delay time.Duration) { nilShardIteratorRetryDelay = delay }(nilShardIteratorRetryDelay)
+	nilShardIteratorRetryDelay = time.Hour
+
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithMaxRetryCount(2)
+	kc := newFakeKinesis("shard-0")
+	kc.nilShardIterators = 3
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, kc, checkpointer)
+	ctx, cancel := context.WithCancel(context.Background())
+	sc.ctx = ctx
+
+	// the wait between the retries ends with the consumer
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := sc.getShardIterator()
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Minute)
+	assert.Equal(t, 1, kc.shardIteratorRequests)
+}
+
+func TestStreamARNPerConsumer(t *testing.T) {
+	kc := newFakeKinesis("shard-0")
+	for _, stream := range []string{"stream-a", "stream-b"} {
+		kclConfig := config.NewKinesisClientLibConfig("appName", stream, "us-west-2", "workerID")
+		checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+		w := newTestWorker(kclConfig, checkpointer, "shard-0")
+		w.kc = kc
+		assert.Nil(t, w.checkStreamStatus())
+
+		sc := w.newShardConsumer(w.shardStatus["shard-0"], &testRecordProcessor{}).(*PollingShardConsumer)
+		state, err := sc.startPolling()
+		assert.Nil(t, err)
+		_, _, err = sc.poll(state)
+		assert.Nil(t, err)
+		sc.stopPolling(state)
+
+		// the calls of each consumer are scoped to the stream of its worker, though the shard IDs are the same
+		streamARN := config.StreamARN("us-west-2", "123456789012", stream)
+		assert.Equal(t, streamARN, aws.ToString(kc.lastShardIteratorRequest.StreamARN))
+		assert.Equal(t, streamARN, kc.getRecordsStreamARNs[len(kc.getRecordsStreamARNs)-1])
+	}
+}
+
+func TestPauseController(t *testing.T) {
+	pause := &config.PauseSwitch{}
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(50).
+		WithPauseController(pause)
+
+	var delivered []string
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		for _, r := range input.Records {
+			delivered = append(delivered, string(r.Data))
+		}
+	}}
+	kc := newFakeKinesis("shard-0")
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, checkpointer)
+
+	state, err := sc.startPolling()
+	assert.Nil(t, err)
+	defer sc.stopPolling(state)
+
+	pending := func() int {
+		kc.mux.Lock()
+		defer kc.mux.Unlock()
+		return len(kc.pendingRecords["shard-0"])
+	}
+	kc.mux.Lock()
+	kc.pendingRecords["shard-0"] = []types.Record{{SequenceNumber: aws.String("1"), Data: []byte("a")}}
+	kc.mux.Unlock()
+
+	// while paused, the shard is not read
+	pause.Pause()
+	for i := 0; i < 3; i++ {
+		wait, done, err := sc.poll(state)
+		assert.Nil(t, err)
+		assert.False(t, done)
+		assert.Equal(t, 50*time.Millisecond, wait)
+	}
+	assert.Equal(t, 1, pending())
+	assert.Empty(t, delivered)
+
+	// and is read again once resumed
+	pause.Resume()
+	_, done, err := sc.poll(state)
+	assert.Nil(t, err)
+	assert.False(t, done)
+	assert.Equal(t, 0, pending())
+	assert.Equal(t, []string{"a"}, delivered)
+}
+
+func TestLeaseVerifiedAfterPause(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithLeaseVerificationGapMillis(5000)
+
+	var delivered []string
+	var shutdownReason kcl.ShutdownReason
+	processor := &testRecordProcessor{
+		processRecords: func(input *kcl.ProcessRecordsInput) {
+			for _, r := range input.Records {
+				delivered = append(delivered, string(r.Data))
+			}
+		},
+		shutdown: func(input *kcl.ShutdownInput) { shutdownReason = input.ShutdownReason },
+	}
+	kc := newFakeKinesis("shard-0")
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, checkpointer)
+
+	state, err := sc.startPolling()
+	assert.Nil(t, err)
+	defer state.cancel()
+	pushRecord := func(data string) {
+		kc.mux.Lock()
+		defer kc.mux.Unlock()
+		kc.pendingRecords["shard-0"] = []types.Record{{SequenceNumber: aws.String(data), Data: []byte(data)}}
+	}
+
+	// polls in a row do not read the lease
+	for _, data := range []string{"1", "2"} {
+		pushRecord(data)
+		_, _, err = sc.poll(state)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 0, checkpointer.called("GetLeaseOwner", "shard-0"))
+
+	// after the clock jumped, the lease is read and still held
+	state.lastPollEnd = state.lastPollEnd.Add(-10 * time.Second)
+	pushRecord("3")
+	_, done, err := sc.poll(state)
+	assert.Nil(t, err)
+	assert.False(t, done)
+	assert.Equal(t, 1, checkpointer.called("GetLeaseOwner", "shard-0"))
+	assert.Equal(t, []string{"1", "2", "3"}, delivered)
+
+	// the lease was taken over during the pause: the records are not processed
+	checkpointer.mux.Lock()
+	checkpointer.leases["shard-0"].owner = "other"
+	checkpointer.mux.Unlock()
+	state.lastPollEnd = state.lastPollEnd.Add(-10 * time.Second)
+	pushRecord("4")
+	_, done, err = sc.poll(state)
+	assert.ErrorIs(t, err, ErrLeaseLost)
+	assert.True(t, done)
+	assert.Equal(t, 2, checkpointer.called("GetLeaseOwner", "shard-0"))
+	assert.Equal(t, []string{"1", "2", "3"}, delivered)
+	assert.Equal(t, kcl.ZOMBIE, shutdownReason)
+}
+
+type unackedMonitoringService struct {
+	metrics.NoopMonitoringService
+	unacked int
+}
+
+func (m *unackedMonitoringService) UnackedRecords(_ string, count int) {
+	m.unacked = count
+}
+
+func TestMaxUnackedRecords(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(50).
+		WithMaxUnackedRecords(3)
+
+	var delivered []string
+	var checkpointer kcl.IRecordProcessorCheckpointer
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		checkpointer = input.Checkpointer
+		for _, r := range input.Records {
+			delivered = append(delivered, string(r.Data))
+		}
+	}}
+	kc := newFakeKinesis("shard-0")
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}}))
+	mService := &unackedMonitoringService{}
+	sc.mService = mService
+
+	state, err := sc.startPolling()
+	assert.Nil(t, err)
+	defer sc.stopPolling(state)
+	pushRecords := func(sequenceNumbers ...string) {
+		kc.mux.Lock()
+		defer kc.mux.Unlock()
+		for _, seq := range sequenceNumbers {
+			kc.pendingRecords["shard-0"] = append(kc.pendingRecords["shard-0"], types.Record{SequenceNumber: aws.String(seq), Data: []byte(seq)})
+		}
+	}
+
+	// the buffer fills up
+	pushRecords("1", "2", "3")
+	_, _, err = sc.poll(state)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1", "2", "3"}, delivered)
+
+	// polling is held while no record is acknowledged
+	pushRecords("4")
+	for i := 0; i < 2; i++ {
+		wait, done, err := sc.poll(state)
+		assert.Nil(t, err)
+		assert.False(t, done)
+		assert.Equal(t, 50*time.Millisecond, wait)
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, delivered)
+	assert.Equal(t, 3, mService.unacked)
+
+	// and resumes once a checkpoint acknowledges some of them
+	assert.Nil(t, checkpointer.Checkpoint(aws.String("2")))
+	_, _, err = sc.poll(state)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1", "2", "3", "4"}, delivered)
+	assert.Equal(t, 1, mService.unacked)
+	assert.Equal(t, 2, sc.unacked.count())
+}
+
+func TestBackoffJitter(t *testing.T) {
+	sc := &PollingShardConsumer{}
+	policy := config.BackoffPolicy{BaseMillis: 100, Multiplier: 2, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		delay := sc.backoff(policy, 2)
+		assert.True(t, delay >= 100*time.Millisecond && delay <= 300*time.Millisecond, "delay out of range: %v", delay)
+	}
+
+	// the jitter source is replaced for deterministic waits
+	defer func() { jitterSource = (*rand.Rand).Float64 }()
+	jitterSource = func(*rand.Rand) float64 { return 0.5 }
+	assert.Equal(t, 300*time.Millisecond, sc.backoff(config.DefaultKMSThrottlingBackoff, 2))
+	assert.Equal(t, 7500*time.Millisecond, sc.backoff(config.DefaultKMSThrottlingBackoff, 10))
+	jitterSource = func(*rand.Rand) float64 { return 0.999 }
+	assert.Equal(t, 500*time.Millisecond, sc.backoff(config.BackoffPolicy{BaseMillis: 100, Multiplier: 2, MaxMillis: 500, Jitter: 0.5}, 10))
+}
+
+func TestCallGetRecordsAPISlidingWindowTPS(t *testing.T) {
+	defer func() {
+		rateLimitTimeNow = time.Now
+		rateLimitTimeSince = time.Since
+		rateLimitAfter = time.After
+	}()
+
+	start := time.Now()
+	now := start
+	rateLimitTimeNow = func() time.Time { return now }
+	rateLimitTimeSince = func(t time.Time) time.Duration { return now.Sub(t) }
+	rateLimitAfter = func(d time.Duration) <-chan time.Time {
+		now = now.Add(d)
+		after := make(chan time.Time, 1)
+		after <- now
+		return after
+	}
+
+	// maxCallsInOneSecond returns the largest number of calls within any rolling second
+	maxCallsInOneSecond := func(calls []time.Time) int {
+		max := 0
+		for i := range calls {
+			n := 0
+			for _, c := range calls[i:] {
+				if c.Sub(calls[i]) < time.Second {
+					n++
+				}
+			}
+			if n > max {
+				max = n
+			}
+		}
+		return max
+	}
+
+	// a burst straddling the boundary of the window opened by the first call
+	burst := func(psc *PollingShardConsumer) []time.Time {
+		m := MockKinesisSubscriberGetter{}
+		m.On("GetRecords", mock.Anything, mock.Anything, mock.Anything).Return(&kinesis.GetRecordsOutput{}, nil)
+		psc.kc = &m
+
+		var calls []time.Time
+		gri := kinesis.GetRecordsInput{ShardIterator: aws.String("shard-iterator-01")}
+		for _, offset := range []int{0, 900, 900, 900, 900, 1001, 1001, 1001, 1001, 1001} {
+			if at := start.Add(time.Duration(offset) * time.Millisecond); at.After(now) {
+				now = at
+			}
+			if _, _, err := psc.callGetRecordsAPI(context.Background(), &gri); err == nil {
+				calls = append(calls, now)
+			} else {
+				assert.ErrorIs(t, err, localTPSExceededError)
+			}
+		}
+		return calls
+	}
+
+	// fixed windows let 9 calls through within a second
+	calls := burst(&PollingShardConsumer{})
+	assert.Len(t, calls, 10)
+	assert.Equal(t, 9, maxCallsInOneSecond(calls))
+
+	now = start
+	psc := &PollingShardConsumer{slidingWindowTPS: true}
+	calls = burst(psc)
+	assert.Len(t, calls, 6)
+	assert.Equal(t, kinesisReadTPSLimit, maxCallsInOneSecond(calls))
+	stats := psc.Stats()
+	assert.Equal(t, 0, stats.CallsLeft)
+	assert.Equal(t, start.Add(900*time.Millisecond), stats.WindowStart)
+
+	// blocking waits for the oldest call of the rolling second to expire
+	now = start
+	calls = burst(&PollingShardConsumer{ctx: context.Background(), slidingWindowTPS: true, blockOnTPSExceeded: true})
+	assert.Len(t, calls, 10)
+	assert.Equal(t, kinesisReadTPSLimit, maxCallsInOneSecond(calls))
+	assert.Equal(t, start.Add(1900*time.Millisecond), calls[6])
+}
+
+func TestAdaptiveMaxRecords(t *testing.T) {
+	limits := func(recordSize int) []int32 {
+		kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+			WithMaxRecords(1000).
+			WithAdaptiveMaxRecords(true)
+		kc := newFakeKinesis("shard-0")
+		checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+		sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, kc, checkpointer)
+
+		state, err := sc.startPolling()
+		assert.Nil(t, err)
+		defer sc.stopPolling(state)
+		for i := 0; i < 3; i++ {
+			kc.mux.Lock()
+			kc.pendingRecords = map[string][]types.Record{"shard-0": {
+				{SequenceNumber: aws.String(strconv.Itoa(2*i + 1)), PartitionKey: aws.String("key"), Data: make([]byte, recordSize)},
+				{SequenceNumber: aws.String(strconv.Itoa(2*i + 2)), PartitionKey: aws.String("key"), Data: make([]byte, recordSize)},
+			}}
+			kc.mux.Unlock()
+			sc.ResetRateLimiter()
+			_, done, err := sc.poll(state)
+			assert.False(t, done)
+			assert.Nil(t, err)
+		}
+		return kc.getRecordsLimits
+	}
+
+	// 1 MB records: no more than 10 fit in a call
+	assert.Equal(t, []int32{1000, 10, 10}, limits(1000000))
+	// 4 MB records: 2 of them
+	assert.Equal(t, []int32{1000, 2, 2}, limits(4000000))
+	// 100 byte records: up to the 10000 records a call returns at most
+	assert.Equal(t, []int32{1000, 10000, 10000}, limits(100))
+}
+
+func TestAdaptiveMaxRecordsFollowsRecordSize(t *testing.T) {
+	a := newAdaptiveMaxRecords(100000)
+	assert.Equal(t, 10000, a.maxRecords(100000))
+
+	record := func(size int) types.Record { return types.Record{Data: make([]byte, size)} }
+	a.observe([]types.Record{record(10000)})
+	assert.Equal(t, 1000, a.maxRecords(100000))
+	// empty responses leave the limit alone
+	a.observe(nil)
+	assert.Equal(t, 1000, a.maxRecords(100000))
+
+	// a single response of larger records only moves the limit part of the way
+	a.observe([]types.Record{record(100000)})
+	assert.True(t, a.maxRecords(100000) < 1000)
+	assert.True(t, a.maxRecords(100000) > 100)
+	for i := 0; i < 20; i++ {
+		a.observe([]types.Record{record(100000)})
+	}
+	assert.Equal(t, 100, a.maxRecords(100000))
+
+	// without a controller, the configured limit is kept
+	var none *adaptiveMaxRecords
+	none.observe([]types.Record{record(100000)})
+	assert.Equal(t, 500, none.maxRecords(500))
+}
+
+func TestInitializationInputHashKeyRange(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	kc := newFakeKinesis()
+	kc.shards = quarterShards()
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-1": {owner: "workerID"}})
+
+	var input *kcl.InitializationInput
+	processor := &testRecordProcessor{initialize: func(in *kcl.InitializationInput) { input = in }}
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, checkpointer)
+	sc.shard.ID = "shard-1"
+	sc.shardCache = newShardMetadataCache(time.Minute, func() ([]types.Shard, error) { return kc.shards, nil })
+
+	state, err := sc.startPolling()
+	assert.Nil(t, err)
+	sc.stopPolling(state)
+
+	if assert.NotNil(t, input) && assert.NotNil(t, input.HashKeyRange) {
+		assert.Equal(t, "shard-1", input.ShardId)
+		assert.Equal(t, aws.ToString(kc.shards[1].HashKeyRange.StartingHashKey), aws.ToString(input.HashKeyRange.StartingHashKey))
+		assert.Equal(t, aws.ToString(kc.shards[1].HashKeyRange.EndingHashKey), aws.ToString(input.HashKeyRange.EndingHashKey))
+	}
+
+	// without shard metadata, the range is left unknown
+	sc = newTestPollingShardConsumer(kclConfig, processor, kc, checkpointer)
+	state, err = sc.startPolling()
+	assert.Nil(t, err)
+	sc.stopPolling(state)
+	assert.Nil(t, input.HashKeyRange)
+}
+
+// prefetchKinesis returns one of its batches of records for every GetRecords call, and signals the call.
+type prefetchKinesis struct {
+	*fakeKinesis
+	batches [][]types.Record
+	calls   chan struct{}
+}
+
+func (k *prefetchKinesis) GetRecords(_ context.Context, params *kinesis.GetRecordsInput, _ ...func(*kinesis.Options)) (*kinesis.GetRecordsOutput, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	out := &kinesis.GetRecordsOutput{NextShardIterator: params.ShardIterator, MillisBehindLatest: aws.Int64(0)}
+	if len(k.batches) > 0 {
+		out.Records, k.batches = k.batches[0], k.batches[1:]
+	}
+	k.calls <- struct{}{}
+	return out, nil
+}
+
+func TestPrefetch(t *testing.T) {
+	events := make(chan config.CheckpointEvent, 10)
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithCheckpointEvents(events).
+		WithEnablePrefetch(true)
+
+	kc := &prefetchKinesis{fakeKinesis: newFakeKinesis("shard-0"), calls: make(chan struct{}, 10)}
+	for _, batch := range [][]string{{"1", "2"}, {"3", "4"}, {"5"}} {
+		var records []types.Record
+		for _, seq := range batch {
+			records = append(records, types.Record{SequenceNumber: aws.String(seq), Data: []byte(seq)})
+		}
+		kc.batches = append(kc.batches, records)
+	}
+
+	var delivered []string
+	var batches, calls int
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		for _, r := range input.Records {
+			delivered = append(delivered, string(r.Data))
+		}
+		// the next records are read while these are processed
+		batches++
+		for calls < batches+1 {
+			select {
+			case <-kc.calls:
+				calls++
+			case <-time.After(time.Second):
+				assert.Fail(t, "no GetRecords call while processing the records")
+				return
+			}
+		}
+		assert.Nil(t, input.Checkpointer.Checkpoint(input.Records[len(input.Records)-1].SequenceNumber))
+	}}
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}}))
+	state, err := sc.startPolling()
+	assert.Nil(t, err)
+	defer sc.stopPolling(state)
+	checkpoints := func() []string {
+		var sequenceNumbers []string
+		for len(events) > 0 {
+			sequenceNumbers = append(sequenceNumbers, (<-events).SequenceNumber)
+		}
+		return sequenceNumbers
+	}
+
+	_, _, err = sc.poll(state)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1", "2"}, delivered)
+	assert.Equal(t, []string{"2"}, checkpoints())
+
+	// the prefetched records are delivered by the next poll, which prefetches the next ones
+	_, _, err = sc.poll(state)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1", "2", "3", "4"}, delivered)
+	assert.Equal(t, []string{"4"}, checkpoints())
+	assert.Equal(t, 3, calls)
+
+	// the records prefetched last are neither delivered nor checkpointed before the next poll
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []string{"1", "2", "3", "4"}, delivered)
+	assert.Nil(t, checkpoints())
+	assert.Equal(t, "4", sc.shard.GetCheckpoint())
+}
+
+// timerRecordProcessor is a testRecordProcessor implementing IRecordProcessorTimer.
+type timerRecordProcessor struct {
+	testRecordProcessor
+	processTimer func(input *kcl.ProcessTimerInput)
+}
+
+func (p *timerRecordProcessor) ProcessTimer(input *kcl.ProcessTimerInput) {
+	p.processTimer(input)
+}
+
+func TestProcessTimer(t *testing.T) {
+	interval := 50 * time.Millisecond
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithProcessTimerIntervalMillis(int(interval.Milliseconds())).
+		WithIdleTimeBetweenReadsInMillis(10000)
+
+	kc := &prefetchKinesis{fakeKinesis: newFakeKinesis("shard-0"), calls: make(chan struct{}, 100)}
+	for i := 1; i <= 5; i++ {
+		kc.batches = append(kc.batches, []types.Record{{SequenceNumber: aws.String(strconv.Itoa(i)), Data: []byte("data")}})
+	}
+
+	var lastSequenceNumber *string
+	var timers []time.Duration
+	processor := &timerRecordProcessor{
+		testRecordProcessor: testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+			lastSequenceNumber = input.Records[len(input.Records)-1].SequenceNumber
+			time.Sleep(30 * time.Millisecond)
+		}},
+		processTimer: func(input *kcl.ProcessTimerInput) {
+			timers = append(timers, input.SinceLastTimer)
+			assert.Nil(t, input.Checkpointer.Checkpoint(lastSequenceNumber))
+		},
+	}
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}}))
+	state, err := sc.startPolling()
+	assert.Nil(t, err)
+	defer sc.stopPolling(state)
+
+	// the timer fires on its interval while records keep coming
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, done, err := sc.poll(state)
+		assert.Nil(t, err)
+		assert.False(t, done)
+	}
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, len(timers), 2)
+	assert.LessOrEqual(t, len(timers), int(elapsed/interval))
+	for _, sinceLastTimer := range timers {
+		assert.GreaterOrEqual(t, sinceLastTimer, interval)
+	}
+
+	// an idle shard waits no longer than until the timer is due
+	wait, done, err := sc.poll(state)
+	assert.Nil(t, err)
+	assert.False(t, done)
+	assert.LessOrEqual(t, wait, interval)
+	fired := len(timers)
+	time.Sleep(wait)
+	_, _, err = sc.poll(state)
+	assert.Nil(t, err)
+	assert.Equal(t, fired+1, len(timers))
+}
+
+type budgetMonitoringService struct {
+	metrics.NoopMonitoringService
+	exhausted map[string]int
+}
+
+func (m *budgetMonitoringService) GetRecordsBudgetExhausted(shard string) {
+	m.exhausted[shard]++
+}
+
+func TestGetRecordsBudget(t *testing.T) {
+	window := 200 * time.Millisecond
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithMaxGetRecordsCalls(3).
+		WithGetRecordsBudgetWindowMillis(int(window.Milliseconds()))
+
+	kc := &prefetchKinesis{fakeKinesis: newFakeKinesis("shard-0", "shard-1"), calls: make(chan struct{}, 100)}
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}, "shard-1": {owner: "workerID"}})
+	budget := newGetRecordsBudget(kclConfig.MaxGetRecordsCalls, window)
+	mService := &budgetMonitoringService{exhausted: map[string]int{}}
+	var consumers []*PollingShardConsumer
+	var states []*pollState
+	for _, shardID := range []string{"shard-0", "shard-1"} {
+		sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, kc, checkpointer)
+		sc.shard.ID = shardID
+		sc.getRecordsBudget = budget
+		sc.mService = mService
+		sc.commonShardConsumer.mService = mService
+		state, err := sc.startPolling()
+		assert.Nil(t, err)
+		defer sc.stopPolling(state)
+		consumers = append(consumers, sc)
+		states = append(states, state)
+	}
+
+	// the calls of the window are shared by the shards
+	for i := 0; i < 3; i++ {
+		_, _, err := consumers[i%2].poll(states[i%2])
+		assert.Nil(t, err)
+	}
+	assert.Len(t, kc.calls, 3)
+
+	// once used up, polling pauses until the next window
+	for i, sc := range consumers {
+		wait, done, err := sc.poll(states[i])
+		assert.Nil(t, err)
+		assert.False(t, done)
+		assert.Greater(t, wait, time.Duration(0))
+		assert.LessOrEqual(t, wait, window)
+	}
+	assert.Len(t, kc.calls, 3)
+	assert.Equal(t, map[string]int{"shard-0": 1, "shard-1": 1}, mService.exhausted)
+
+	// and resumes with the calls of the next window
+	time.Sleep(window)
+	_, _, err := consumers[0].poll(states[0])
+	assert.Nil(t, err)
+	assert.Len(t, kc.calls, 4)
+}
+
+// blockingKinesis blocks GetRecords until the context of the call is canceled.
+type blockingKinesis struct {
+	*fakeKinesis
+	called chan struct{}
+}
+
+func (k *blockingKinesis) GetRecords(ctx context.Context, _ *kinesis.GetRecordsInput, _ ...func(*kinesis.Options)) (*kinesis.GetRecordsOutput, error) {
+	close(k.called)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCancelingContextAbortsGetRecords(t *testing.T) {
+	for _, cancelBy := range []string{"worker context", "stop channel"} {
+		t.Run(cancelBy, func(t *testing.T) {
+			kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+			var shutdownReason kcl.ShutdownReason
+			processor := &testRecordProcessor{shutdown: func(input *kcl.ShutdownInput) {
+				shutdownReason = input.ShutdownReason
+			}}
+			kc := &blockingKinesis{fakeKinesis: newFakeKinesis("shard-0"), called: make(chan struct{})}
+			sc := newTestPollingShardConsumer(kclConfig, processor, kc, newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}}))
+			workerCtx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sc.ctx = workerCtx
+
+			done := make(chan error)
+			go func() { done <- sc.getRecords() }()
+			<-kc.called
+			if cancelBy == "worker context" {
+				cancel()
+			} else {
+				close(*sc.stop)
+			}
+
+			select {
+			case err := <-done:
+				assert.Nil(t, err)
+				assert.Equal(t, kcl.REQUESTED, shutdownReason)
+			case <-time.After(time.Second):
+				assert.Fail(t, "the pending GetRecords call was not aborted")
+			}
+		})
+	}
+}
+
+// slowKinesis answers its first GetRecords calls only after the given delay, unless their context is done first.
+type slowKinesis struct {
+	*fakeKinesis
+	slowCalls int
+	delay     time.Duration
+}
+
+func (k *slowKinesis) GetRecords(ctx context.Context, params *kinesis.GetRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.GetRecordsOutput, error) {
+	k.mux.Lock()
+	slow := k.slowCalls > 0
+	k.slowCalls--
+	k.mux.Unlock()
+	if slow {
+		select {
+		case <-time.After(k.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return k.fakeKinesis.GetRecords(ctx, params, optFns...)
+}
+
+func TestGetRecordsTimeout(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithGetRecordsTimeoutMillis(20).
+		WithGetRecordsTimeoutBackoff(config.BackoffPolicy{BaseMillis: 5, Multiplier: 1}).
+		WithMaxRetryCount(2)
+	kc := &slowKinesis{fakeKinesis: newFakeKinesis("shard-0"), slowCalls: 2, delay: time.Second}
+	kc.pendingRecords["shard-0"] = []types.Record{{SequenceNumber: aws.String("1"), Data: []byte("data")}}
+	var delivered int
+	processor := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		delivered += len(input.Records)
+	}}
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}}))
+	state, err := sc.startPolling()
+	assert.Nil(t, err)
+	defer sc.stopPolling(state)
+
+	// the calls timing out are retried after the backoff
+	for retries := 1; retries <= 2; retries++ {
+		start := time.Now()
+		wait, done, err := sc.poll(state)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+		assert.Nil(t, err)
+		assert.False(t, done)
+		assert.Equal(t, 5*time.Millisecond, wait)
+		assert.Equal(t, retries, state.retriedErrors)
+	}
+	_, done, err := sc.poll(state)
+	assert.Nil(t, err)
+	assert.False(t, done)
+	assert.Equal(t, 1, delivered)
+	assert.Zero(t, state.retriedErrors)
+
+	// up to MaxRetryCount times in a row
+	kc.slowCalls = 3
+	sc.ResetRateLimiter()
+	for retries := 1; retries <= 2; retries++ {
+		_, _, err = sc.poll(state)
+		assert.Nil(t, err)
+	}
+	_, done, err = sc.poll(state)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.True(t, done)
+}
+
+type lagMonitoringService struct {
+	metrics.NoopMonitoringService
+	lags map[string][]float64
+}
+
+func (m *lagMonitoringService) MillisBehindLatest(shard string, milliSeconds float64) {
+	m.lags[shard] = append(m.lags[shard], milliSeconds)
+}
+
+func TestMillisBehindLatestReported(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	kc := newFakeKinesis("shard-0")
+	checkpointer := newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}})
+	sc := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, kc, checkpointer)
+	mService := &lagMonitoringService{lags: map[string][]float64{}}
+	sc.mService = mService
+	sc.commonShardConsumer.mService = mService
+
+	state, err := sc.startPolling()
+	assert.Nil(t, err)
+	defer sc.stopPolling(state)
+	for _, lag := range []int64{5000, 0} {
+		kc.mux.Lock()
+		kc.millisBehindLatest = lag
+		kc.pendingRecords = map[string][]types.Record{"shard-0": {
+			{SequenceNumber: aws.String(strconv.FormatInt(lag, 10)), PartitionKey: aws.String("key"), Data: []byte("data")},
+		}}
+		kc.mux.Unlock()
+		_, done, err := sc.poll(state)
+		assert.False(t, done)
+		assert.Nil(t, err)
+	}
+
+	// the lag returned by every GetRecords call, empty or not
+	_, _, err = sc.poll(state)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]float64{"shard-0": {5000, 0, 0}}, mService.lags)
+}
+
+func TestMaxRecordsInFlightPausesReads(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(10).
+		WithMaxRecordsInFlight(2)
+	kc := &pollTrackingKinesis{fakeKinesis: newFakeKinesis("shard-0", "shard-1"), calls: map[string][]time.Time{}}
+	kc.pendingRecords["shard-0"] = []types.Record{
+		{Data: []byte("1"), PartitionKey: aws.String("key"), SequenceNumber: aws.String("1")},
+		{Data: []byte("2"), PartitionKey: aws.String("key"), SequenceNumber: aws.String("2")},
+	}
+	shard1Calls := func() int {
+		kc.mux.Lock()
+		defer kc.mux.Unlock()
+		return len(kc.calls["shard-1"])
+	}
+	inFlight := newRecordsInFlight(kclConfig.MaxRecordsInFlight)
+
+	// the record processor of shard-0 is slow to process the records read
+	processing := make(chan struct{})
+	drained := make(chan struct{})
+	slow := &testRecordProcessor{processRecords: func(input *kcl.ProcessRecordsInput) {
+		if len(input.Records) > 0 {
+			close(processing)
+			<-drained
+		}
+	}}
+	sc0 := newTestPollingShardConsumer(kclConfig, slow, kc, newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}}))
+	sc0.recordsInFlight = inFlight
+	sc1 := newTestPollingShardConsumer(kclConfig, &testRecordProcessor{}, kc, newTestCheckpointer(map[string]*testLease{"shard-1": {owner: "workerID"}}))
+	sc1.shard.ID = "shard-1"
+	sc1.recordsInFlight = inFlight
+
+	done := make(chan error, 2)
+	go func() { done <- sc0.getRecords() }()
+	<-processing
+	go func() { done <- sc1.getRecords() }()
+
+	// shard-1 is not read while the records of shard-0 are being processed
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, shard1Calls())
+
+	close(drained)
+	assert.Eventually(t, func() bool { return shard1Calls() > 0 }, time.Second, 10*time.Millisecond)
+
+	close(*sc0.stop)
+	close(*sc1.stop)
+	assert.Nil(t, <-done)
+	assert.Nil(t, <-done)
+}
+
+func TestMaxRecordsInFlightWaitEndsOnShutdown(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithMaxRecordsInFlight(1)
+	var shutdownReason kcl.ShutdownReason
+	processor := &testRecordProcessor{shutdown: func(input *kcl.ShutdownInput) {
+		shutdownReason = input.ShutdownReason
+	}}
+	kc := &pollTrackingKinesis{fakeKinesis: newFakeKinesis("shard-0"), calls: map[string][]time.Time{}}
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, newTestCheckpointer(map[string]*testLease{"shard-0": {owner: "workerID"}}))
+	// the records read by other shards are never processed
+	sc.recordsInFlight = newRecordsInFlight(kclConfig.MaxRecordsInFlight)
+	sc.recordsInFlight.add(1)
+
+	done := make(chan error)
+	go func() { done <- sc.getRecords() }()
+	time.Sleep(50 * time.Millisecond)
+	close(*sc.stop)
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+		assert.Equal(t, kcl.REQUESTED, shutdownReason)
+		assert.Empty(t, kc.calls)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the consumer waiting for records in flight did not stop")
+	}
+}
@@ -21,9 +21,14 @@
 package worker
 
 import (
+	"errors"
+	"time"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
 	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
 	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
 )
 
@@ -49,6 +54,19 @@ type (
 	RecordProcessorCheckpointer struct {
 		shard      *par.ShardStatus
 		checkpoint chk.Checkpointer
+
+		// committed checkpoints are published to events, if set
+		events chan<- config.CheckpointEvent
+		// checkpoint successes and failures are reported to mService, if set
+		mService metrics.MonitoringService
+		// the last checkpoint written, which is not written again: e.g. by a processor checkpointing empty batches
+		committed string
+		// records delivered and not checkpointed yet, acknowledged by the checkpoints, if set
+		unacked *unackedRecords
+		// the checkpoints extend the lease of the shard in the same write, if the checkpointer supports it
+		renewLease bool
+		// the checkpoint writes wait for a slot of the worker, if set
+		limiter *checkpointLimiter
 	}
 )
 
@@ -69,15 +87,81 @@ func (pc *PreparedCheckpointer) Checkpoint() error {
 
 func (rc *RecordProcessorCheckpointer) Checkpoint(sequenceNumber *string) error {
 	// checkpoint the last sequence of a closed shard
-	if sequenceNumber == nil {
-		rc.shard.SetCheckpoint(chk.ShardEnd)
-	} else {
-		rc.shard.SetCheckpoint(aws.ToString(sequenceNumber))
+	checkpoint := chk.ShardEnd
+	if sequenceNumber != nil {
+		checkpoint = aws.ToString(sequenceNumber)
+	}
+	if checkpoint == rc.committed {
+		return nil
 	}
+	rc.shard.SetCheckpoint(checkpoint)
 
-	return rc.checkpoint.CheckpointSequence(rc.shard)
+	if err := rc.writeCheckpoint(); err != nil {
+		if r, ok := rc.mService.(metrics.CheckpointReporter); ok {
+			r.CheckpointFailure(rc.shard.ID, err)
+		}
+		return err
+	}
+	if r, ok := rc.mService.(metrics.CheckpointReporter); ok {
+		r.CheckpointSuccess(rc.shard.ID)
+	}
+	rc.committed = checkpoint
+	rc.unacked.acked(checkpoint)
+	if rc.unacked != nil {
+		if r, ok := rc.mService.(metrics.UnackedRecordsReporter); ok {
+			r.UnackedRecords(rc.shard.ID, rc.unacked.count())
+		}
+	}
+
+	rc.publish()
+	return nil
+}
+
+// publish sends the committed checkpoint to the events channel without blocking. The event is dropped if the
+// channel is full.
+func (rc *RecordProcessorCheckpointer) publish() {
+	if rc.events == nil {
+		return
+	}
+
+	event := config.CheckpointEvent{
+		ShardID:        rc.shard.ID,
+		SequenceNumber: rc.shard.GetCheckpoint(),
+		Timestamp:      time.Now(),
+	}
+	select {
+	case rc.events <- event:
+	default:
+	}
 }
 
 func (rc *RecordProcessorCheckpointer) PrepareCheckpoint(_ *string) (kcl.IPreparedCheckpointer, error) {
 	return &PreparedCheckpointer{}, nil
 }
+
+// writeCheckpoint writes the checkpoint of the shard, extending its lease in the same write when configured to. A
+// checkpoint failing the lease conditions, e.g. because the lease was renewed concurrently, is written on its own as
+// before, leaving it to the lease renewal to tell a lost lease from a renewed one. With MaxConcurrentCheckpoints, the
+// write first waits for a free slot.
+func (rc *RecordProcessorCheckpointer) writeCheckpoint() error {
+	if rc.limiter != nil {
+		if !rc.limiter.tryAcquire() {
+			if r, ok := rc.mService.(metrics.CheckpointThrottleReporter); ok {
+				r.CheckpointThrottled(rc.shard.ID)
+			}
+			rc.limiter.acquire()
+		}
+		defer rc.limiter.release()
+	}
+
+	if renewer, ok := rc.checkpoint.(chk.CheckpointLeaseRenewer); ok && rc.renewLease {
+		err := renewer.CheckpointAndRenewLease(rc.shard)
+		if !errors.As(err, &chk.ErrLeaseNotAcquired{}) {
+			if err == nil && rc.mService != nil {
+				rc.mService.LeaseRenewed(rc.shard.ID)
+			}
+			return err
+		}
+	}
+	return rc.checkpoint.CheckpointSequence(rc.shard)
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+func TestCheckpointEvents(t *testing.T) {
+	events := make(chan config.CheckpointEvent, 1)
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithCheckpointEvents(events)
+	sc := newTestCommonShardConsumer(kclConfig, &testRecordProcessor{})
+	checkpointer := newTestCheckpointer(map[string]*testLease{})
+	sc.checkpointer = checkpointer
+	rc := sc.newRecordProcessorCheckpointer()
+
+	assert.Nil(t, rc.Checkpoint(aws.String("100")))
+	// the channel is full, the event is dropped instead of blocking the checkpoint
+	assert.Nil(t, rc.Checkpoint(aws.String("200")))
+	assert.Equal(t, "200", checkpointer.leases["shard-0"].checkpoint)
+
+	event := <-events
+	assert.Equal(t, "shard-0", event.ShardID)
+	assert.Equal(t, "100", event.SequenceNumber)
+	assert.False(t, event.Timestamp.IsZero())
+
+	assert.Nil(t, rc.Checkpoint(nil))
+	event = <-events
+	assert.Equal(t, chk.ShardEnd, event.SequenceNumber)
+}
+
+func TestCheckpointEventsNotPublishedOnFailure(t *testing.T) {
+	events := make(chan config.CheckpointEvent, 1)
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithCheckpointEvents(events)
+	sc := newTestCommonShardConsumer(kclConfig, &testRecordProcessor{})
+	sc.checkpointer = failingCheckpointer{newTestCheckpointer(map[string]*testLease{})}
+
+	assert.NotNil(t, sc.newRecordProcessorCheckpointer().Checkpoint(aws.String("100")))
+	assert.Equal(t, 0, len(events))
+}
+
+// checkpointMonitoringService counts the checkpoint successes and failures reported.
+type checkpointMonitoringService struct {
+	metrics.NoopMonitoringService
+	successes map[string]int
+	failures  []error
+}
+
+func (m *checkpointMonitoringService) CheckpointSuccess(shard string) {
+	m.successes[shard]++
+}
+
+func (m *checkpointMonitoringService) CheckpointFailure(_ string, err error) {
+	m.failures = append(m.failures, err)
+}
+
+func TestCheckpointMetrics(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	mService := &checkpointMonitoringService{successes: map[string]int{}}
+	sc := newTestCommonShardConsumer(kclConfig, &testRecordProcessor{})
+	sc.mService = mService
+	sc.checkpointer = newTestCheckpointer(map[string]*testLease{})
+
+	rc := sc.newRecordProcessorCheckpointer()
+	assert.Nil(t, rc.Checkpoint(aws.String("100")))
+	assert.Nil(t, rc.Checkpoint(nil))
+	assert.Equal(t, map[string]int{"shard-0": 2}, mService.successes)
+	assert.Empty(t, mService.failures)
+
+	sc.checkpointer = failingCheckpointer{newTestCheckpointer(map[string]*testLease{})}
+	err := sc.newRecordProcessorCheckpointer().Checkpoint(aws.String("200"))
+	assert.NotNil(t, err)
+	assert.Equal(t, []error{err}, mService.failures)
+	assert.Equal(t, 2, mService.successes["shard-0"])
+}
+
+// slowCheckpointer takes a while to write a checkpoint, and tracks how many writes are in flight at once.
+type slowCheckpointer struct {
+	*testCheckpointer
+	mux         sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (c *slowCheckpointer) CheckpointSequence(shard *par.ShardStatus) error {
+	c.mux.Lock()
+	c.inFlight++
+	if c.inFlight > c.maxInFlight {
+		c.maxInFlight = c.inFlight
+	}
+	c.mux.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	c.mux.Lock()
+	c.inFlight--
+	c.mux.Unlock()
+	return c.testCheckpointer.CheckpointSequence(shard)
+}
+
+// throttledCheckpointsMonitoringService counts the checkpoints which waited for a slot.
+type throttledCheckpointsMonitoringService struct {
+	metrics.NoopMonitoringService
+	throttled int32
+}
+
+func (m *throttledCheckpointsMonitoringService) CheckpointThrottled(_ string) {
+	atomic.AddInt32(&m.throttled, 1)
+}
+
+func TestMaxConcurrentCheckpoints(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithMaxConcurrentCheckpoints(2)
+	checkpointer := &slowCheckpointer{testCheckpointer: newTestCheckpointer(map[string]*testLease{})}
+	mService := &throttledCheckpointsMonitoringService{}
+	limiter := newCheckpointLimiter(kclConfig.MaxConcurrentCheckpoints)
+
+	// the processors of 10 shards checkpoint all at once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		sc := newTestCommonShardConsumer(kclConfig, &testRecordProcessor{})
+		sc.shard.ID = fmt.Sprintf("shard-%d", i)
+		sc.checkpointer = checkpointer
+		sc.mService = mService
+		sc.checkpointLimiter = limiter
+		rc := sc.newRecordProcessorCheckpointer()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, rc.Checkpoint(aws.String("100")))
+		}()
+	}
+	wg.Wait()
+
+	// the writes queue up rather than going over the cap
+	assert.Equal(t, 2, checkpointer.maxInFlight)
+	assert.Positive(t, atomic.LoadInt32(&mService.throttled))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "100", checkpointer.leases[fmt.Sprintf("shard-%d", i)].checkpoint)
+	}
+}
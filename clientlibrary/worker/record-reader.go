@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+)
+
+// recordFrameHeaderSize is the size of the length prefix of a record frame
+const recordFrameHeaderSize = 4
+
+// RecordReader presents the records of the shards consumed by a worker as an io.Reader, e.g. to pipe them into a
+// tool reading its standard input:
+//
+//	reader := worker.NewRecordReader()
+//	w := worker.NewWorker(reader, kclConfig)
+//	if err := w.Start(); err != nil {
+//		...
+//	}
+//	io.Copy(os.Stdout, reader)
+//
+// Each record is read as a frame: its payload length as a 4-byte big-endian unsigned integer, followed by the payload.
+// The frames of a shard are read in order, the frames of different shards interleaved.
+//
+// A RecordReader is the record processor factory of the worker: its record processors hand the records over to the
+// reader one at a time, and checkpoint each batch up to its last record fully read once the batch is read or the
+// reader is closed. The records are thus read at least once: a record read past its checkpoint, when the lease on its
+// shard is lost or the worker stops, is read again by the next owner of the shard.
+type RecordReader struct {
+	frames chan *recordFrame
+	// the frame being read and the number of its bytes read
+	frame *recordFrame
+	read  int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// recordFrame is a framed record, read is closed once all its bytes are read
+type recordFrame struct {
+	data []byte
+	read chan struct{}
+}
+
+// NewRecordReader creates a RecordReader, to be used as the record processor factory of a worker.
+func NewRecordReader() *RecordReader {
+	return &RecordReader{
+		frames: make(chan *recordFrame),
+		closed: make(chan struct{}),
+	}
+}
+
+// CreateProcessor returns a record processor handing the records of a shard over to the reader.
+func (r *RecordReader) CreateProcessor() kcl.IRecordProcessor {
+	return &recordReaderProcessor{reader: r}
+}
+
+// Read reads the frames of the records, waiting for the next record if none is available. It returns io.EOF once the
+// reader is closed, even in the middle of a frame.
+func (r *RecordReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, io.EOF
+	default:
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.frame == nil {
+		select {
+		case r.frame = <-r.frames:
+			r.read = 0
+		case <-r.closed:
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, r.frame.data[r.read:])
+	r.read += n
+	if r.read == len(r.frame.data) {
+		close(r.frame.read)
+		r.frame = nil
+	}
+	return n, nil
+}
+
+// Close stops the reader: Read returns io.EOF and the record processors stop handing records over, checkpointing the
+// records fully read.
+func (r *RecordReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+	return nil
+}
+
+// recordReaderProcessor hands the records of a shard over to a RecordReader.
+type recordReaderProcessor struct {
+	reader *RecordReader
+	// some records were not read, the shard is not to be checkpointed at SHARD_END
+	unread bool
+}
+
+func (p *recordReaderProcessor) Initialize(_ *kcl.InitializationInput) {}
+
+func (p *recordReaderProcessor) ProcessRecords(input *kcl.ProcessRecordsInput) {
+	// the records to checkpoint are fully read, the ones after them are read again after a restart
+	var lastRead *string
+	read := 0
+	defer func() {
+		p.unread = p.unread || read < len(input.Records)
+		if lastRead != nil {
+			_ = input.Checkpointer.Checkpoint(lastRead)
+		}
+	}()
+
+	var done <-chan struct{}
+	if input.Ctx != nil {
+		done = input.Ctx.Done()
+	}
+	for _, record := range input.Records {
+		frame := &recordFrame{
+			data: make([]byte, recordFrameHeaderSize+len(record.Data)),
+			read: make(chan struct{}),
+		}
+		binary.BigEndian.PutUint32(frame.data, uint32(len(record.Data)))
+		copy(frame.data[recordFrameHeaderSize:], record.Data)
+
+		select {
+		case p.reader.frames <- frame:
+		case <-p.reader.closed:
+			return
+		case <-done:
+			return
+		}
+		select {
+		case <-frame.read:
+			lastRead = record.SequenceNumber
+			read++
+		case <-p.reader.closed:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *recordReaderProcessor) Shutdown(input *kcl.ShutdownInput) {
+	if input.ShutdownReason == kcl.TERMINATE && !p.unread {
+		_ = input.Checkpointer.Checkpoint(nil)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+)
+
+// readFrame reads the payload of the next record frame
+func readFrame(t *testing.T, r io.Reader) string {
+	header := make([]byte, recordFrameHeaderSize)
+	_, err := io.ReadFull(r, header)
+	assert.Nil(t, err)
+	payload := make([]byte, binary.BigEndian.Uint32(header))
+	_, err = io.ReadFull(r, payload)
+	assert.Nil(t, err)
+	return string(payload)
+}
+
+func TestRecordReader(t *testing.T) {
+	reader := NewRecordReader()
+	// read one byte at a time, the frames are split across reads
+	r := iotest.OneByteReader(reader)
+
+	// a batch fully read is checkpointed at its last record
+	processor := reader.CreateProcessor()
+	checkpointer := &recordingCheckpointer{}
+	done := make(chan struct{})
+	go func() {
+		processor.ProcessRecords(&kcl.ProcessRecordsInput{Records: testRecords("1", "22", "333"), Checkpointer: checkpointer})
+		close(done)
+	}()
+	assert.Equal(t, "1", readFrame(t, r))
+	assert.Equal(t, "22", readFrame(t, r))
+	assert.Equal(t, "333", readFrame(t, r))
+	<-done
+	processor.Shutdown(&kcl.ShutdownInput{ShutdownReason: kcl.TERMINATE, Checkpointer: checkpointer})
+	assert.Equal(t, []string{"333", chk.ShardEnd}, checkpointer.checkpoints)
+
+	// a batch partially read when the reader is closed is checkpointed at its last record fully read
+	processor = reader.CreateProcessor()
+	checkpointer = &recordingCheckpointer{}
+	done = make(chan struct{})
+	go func() {
+		processor.ProcessRecords(&kcl.ProcessRecordsInput{Records: testRecords("4", "55", "666"), Checkpointer: checkpointer})
+		close(done)
+	}()
+	assert.Equal(t, "4", readFrame(t, r))
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Close())
+	<-done
+
+	n, err := reader.Read(header)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+	// and not at SHARD_END, its other records being unread
+	processor.Shutdown(&kcl.ShutdownInput{ShutdownReason: kcl.TERMINATE, Checkpointer: checkpointer})
+	assert.Equal(t, []string{"4"}, checkpointer.checkpoints)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"sync"
+)
+
+// shardEndSignals tells the consumers of child shards when a parent shard consumed by the same worker is finished,
+// so that they do not have to poll the lease table for its SHARD_END checkpoint. A nil *shardEndSignals tracks no
+// shard.
+type shardEndSignals struct {
+	mux     sync.Mutex
+	signals map[string]*shardEndSignal
+}
+
+// shardEndSignal is closed when the consumer of a shard returns.
+type shardEndSignal struct {
+	done chan struct{}
+	// whether the shard was checkpointed at SHARD_END, set before done is closed
+	shardEnd bool
+}
+
+func newShardEndSignals() *shardEndSignals {
+	return &shardEndSignals{signals: make(map[string]*shardEndSignal)}
+}
+
+// consuming records that the worker starts consuming the shard.
+func (s *shardEndSignals) consuming(shardID string) *shardEndSignal {
+	if s == nil {
+		return nil
+	}
+
+	signal := &shardEndSignal{done: make(chan struct{})}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.signals[shardID] = signal
+	return signal
+}
+
+// finished records that the consumer of the shard returned, the shard being checkpointed at SHARD_END or not.
+func (s *shardEndSignals) finished(shardID string, signal *shardEndSignal, shardEnd bool) {
+	if s == nil {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.signals[shardID] == signal {
+		delete(s.signals, shardID)
+	}
+	signal.shardEnd = shardEnd
+	close(signal.done)
+}
+
+// waitFor blocks while the worker consumes the shard. consumed is false if the worker was not consuming it; otherwise
+// shardEnd tells whether its consumer checkpointed it at SHARD_END.
+func (s *shardEndSignals) waitFor(shardID string) (shardEnd bool, consumed bool) {
+	if s == nil {
+		return false, false
+	}
+
+	s.mux.Lock()
+	signal, ok := s.signals[shardID]
+	s.mux.Unlock()
+	if !ok {
+		return false, false
+	}
+
+	<-signal.done
+	return signal.shardEnd, true
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package worker
+package worker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// shardMetadata is the immutable part of the shard description returned by ListShards.
+type shardMetadata struct {
+	ShardID                string
+	ParentShardID          string
+	AdjacentParentShardID  string
+	StartingHashKey        string
+	EndingHashKey          string
+	StartingSequenceNumber string
+	EndingSequenceNumber   string
+}
+
+// shardMetadataLoader lists all shards of the stream.
+type shardMetadataLoader func() ([]types.Shard, error)
+
+// shardMetadataCache is a read-through TTL cache of shard metadata shared by all shard consumers of a worker.
+// It is refreshed on every shard sync and invalidated as soon as a resharding is detected, so consumers never
+// act on stale parent or hash key range information.
+type shardMetadataCache struct {
+	mux         sync.RWMutex
+	ttl         time.Duration
+	load        shardMetadataLoader
+	shards      map[string]*shardMetadata
+	lastRefresh time.Time
+	now         func() time.Time
+}
+
+func newShardMetadataCache(ttl time.Duration, load shardMetadataLoader) *shardMetadataCache {
+	return &shardMetadataCache{
+		ttl:    ttl,
+		load:   load,
+		shards: make(map[string]*shardMetadata),
+		now:    time.Now,
+	}
+}
+
+func newShardMetadata(s types.Shard) *shardMetadata {
+	m := &shardMetadata{
+		ShardID:               aws.ToString(s.ShardId),
+		ParentShardID:         aws.ToString(s.ParentShardId),
+		AdjacentParentShardID: aws.ToString(s.AdjacentParentShardId),
+	}
+	if s.HashKeyRange != nil {
+		m.StartingHashKey = aws.ToString(s.HashKeyRange.StartingHashKey)
+		m.EndingHashKey = aws.ToString(s.HashKeyRange.EndingHashKey)
+	}
+	if s.SequenceNumberRange != nil {
+		m.StartingSequenceNumber = aws.ToString(s.SequenceNumberRange.StartingSequenceNumber)
+		m.EndingSequenceNumber = aws.ToString(s.SequenceNumberRange.EndingSequenceNumber)
+	}
+	return m
+}
+
+// get returns the metadata of the given shard. On a miss or an expired cache the shards are re-read
+// through the loader. Concurrent misses are collapsed into a single load.
+func (c *shardMetadataCache) get(shardID string) (*shardMetadata, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	c.mux.RLock()
+	m, ok := c.lookup(shardID)
+	c.mux.RUnlock()
+	if ok {
+		return m, nil
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	// another consumer may have loaded the shards while we were waiting for the lock
+	if m, ok := c.lookup(shardID); ok {
+		return m, nil
+	}
+
+	if c.load == nil {
+		return nil, nil
+	}
+
+	shards, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.replace(shards)
+
+	return c.shards[shardID], nil
+}
+
+// refresh replaces the cached metadata with a fresh shard listing. It reports whether the listing
+// differs from the cached one in a way that indicates a resharding (shards added, removed or closed).
+func (c *shardMetadataCache) refresh(shards []types.Shard) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	resharded := len(c.shards) > 0 && c.isResharded(shards)
+	c.replace(shards)
+	return resharded
+}
+
+// invalidate drops all cached metadata so that the next lookup re-reads it from Kinesis.
+func (c *shardMetadataCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.shards = make(map[string]*shardMetadata)
+	c.lastRefresh = time.Time{}
+}
+
+// lookup requires the caller to hold the lock. A fresh cache is authoritative: a shard missing from it
+// is reported as unknown rather than triggering another load.
+func (c *shardMetadataCache) lookup(shardID string) (*shardMetadata, bool) {
+	if c.lastRefresh.IsZero() || c.now().Sub(c.lastRefresh) > c.ttl {
+		return nil, false
+	}
+	return c.shards[shardID], true
+}
+
+// replace requires the caller to hold the write lock.
+func (c *shardMetadataCache) replace(shards []types.Shard) {
+	fresh := make(map[string]*shardMetadata, len(shards))
+	for _, s := range shards {
+		m := newShardMetadata(s)
+		fresh[m.ShardID] = m
+	}
+	c.shards = fresh
+	c.lastRefresh = c.now()
+}
+
+// isResharded requires the caller to hold the lock.
+func (c *shardMetadataCache) isResharded(shards []types.Shard) bool {
+	if len(shards) != len(c.shards) {
+		return true
+	}
+	for _, s := range shards {
+		cached, ok := c.shards[aws.ToString(s.ShardId)]
+		if !ok {
+			return true
+		}
+		// an open shard that has been closed since the last listing
+		if cached.EndingSequenceNumber != newShardMetadata(s).EndingSequenceNumber {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func testShard(id, parent, adjacentParent, endingSequence string) types.Shard {
+	s := types.Shard{
+		ShardId: aws.String(id),
+		HashKeyRange: &types.HashKeyRange{
+			StartingHashKey: aws.String("0"),
+			EndingHashKey:   aws.String("340282366920938463463374607431768211455"),
+		},
+		SequenceNumberRange: &types.SequenceNumberRange{
+			StartingSequenceNumber: aws.String("49590338271490256608559692538361571095921575989136588898"),
+		},
+	}
+	if parent != "" {
+		s.ParentShardId = aws.String(parent)
+	}
+	if adjacentParent != "" {
+		s.AdjacentParentShardId = aws.String(adjacentParent)
+	}
+	if endingSequence != "" {
+		s.SequenceNumberRange.EndingSequenceNumber = aws.String(endingSequence)
+	}
+	return s
+}
+
+func TestShardMetadataCacheHitAndMiss(t *testing.T) {
+	loads := 0
+	cache := newShardMetadataCache(time.Minute, func() ([]types.Shard, error) {
+		loads++
+		return []types.Shard{
+			testShard("shardId-000000000000", "", "", ""),
+			testShard("shardId-000000000001", "shardId-000000000000", "shardId-000000000002", ""),
+		}, nil
+	})
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	// miss on empty cache goes through the loader
+	meta, err := cache.get("shardId-000000000001")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, loads)
+	assert.Equal(t, "shardId-000000000000", meta.ParentShardID)
+	assert.Equal(t, "shardId-000000000002", meta.AdjacentParentShardID)
+	assert.Equal(t, "0", meta.StartingHashKey)
+	assert.Equal(t, "340282366920938463463374607431768211455", meta.EndingHashKey)
+
+	// hit
+	meta, err = cache.get("shardId-000000000000")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, loads)
+	assert.Equal(t, "shardId-000000000000", meta.ShardID)
+
+	// unknown shard within TTL does not reload
+	meta, err = cache.get("shardId-000000000009")
+	assert.Nil(t, err)
+	assert.Nil(t, meta)
+	assert.Equal(t, 1, loads)
+
+	// expired entries are re-read
+	now = now.Add(2 * time.Minute)
+	_, err = cache.get("shardId-000000000000")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, loads)
+}
+
+func TestShardMetadataCacheLoadError(t *testing.T) {
+	loadErr := errors.New("ListShards failed")
+	cache := newShardMetadataCache(time.Minute, func() ([]types.Shard, error) {
+		return nil, loadErr
+	})
+
+	meta, err := cache.get("shardId-000000000000")
+	assert.Nil(t, meta)
+	assert.ErrorIs(t, err, loadErr)
+}
+
+func TestShardMetadataCacheConcurrentMissesLoadOnce(t *testing.T) {
+	var mux sync.Mutex
+	loads := 0
+	cache := newShardMetadataCache(time.Minute, func() ([]types.Shard, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		loads++
+		return []types.Shard{testShard("shardId-000000000000", "", "", "")}, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			meta, err := cache.get("shardId-000000000000")
+			assert.Nil(t, err)
+			assert.NotNil(t, meta)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, loads)
+}
+
+func TestShardMetadataCacheInvalidation(t *testing.T) {
+	loads := 0
+	cache := newShardMetadataCache(time.Minute, func() ([]types.Shard, error) {
+		loads++
+		return []types.Shard{testShard("shardId-000000000000", "", "", "")}, nil
+	})
+
+	// the first listing is never reported as a resharding
+	assert.False(t, cache.refresh([]types.Shard{testShard("shardId-000000000000", "", "", "")}))
+	// same listing
+	assert.False(t, cache.refresh([]types.Shard{testShard("shardId-000000000000", "", "", "")}))
+
+	// split: parent closed and two children appear
+	resharded := cache.refresh([]types.Shard{
+		testShard("shardId-000000000000", "", "", "49590338271490256608559692540925702759324208523137515618"),
+		testShard("shardId-000000000001", "shardId-000000000000", "", ""),
+		testShard("shardId-000000000002", "shardId-000000000000", "", ""),
+	})
+	assert.True(t, resharded)
+	meta, err := cache.get("shardId-000000000002")
+	assert.Nil(t, err)
+	assert.Equal(t, "shardId-000000000000", meta.ParentShardID)
+	assert.Equal(t, 0, loads)
+
+	// closing a shard only is a resharding as well
+	assert.True(t, cache.refresh([]types.Shard{
+		testShard("shardId-000000000000", "", "", "49590338271490256608559692540925702759324208523137515618"),
+		testShard("shardId-000000000001", "shardId-000000000000", "", "49590338271490256608559692540925702759324208523137515619"),
+		testShard("shardId-000000000002", "shardId-000000000000", "", ""),
+	}))
+
+	// explicit invalidation forces the next lookup to read through
+	cache.invalidate()
+	meta, err = cache.get("shardId-000000000000")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, loads)
+	assert.Equal(t, "", meta.EndingSequenceNumber)
+}
+
+func TestShardMetadataCacheNil(t *testing.T) {
+	var cache *shardMetadataCache
+
+	meta, err := cache.get("shardId-000000000000")
+	assert.Nil(t, meta)
+	assert.Nil(t, err)
+	assert.False(t, cache.refresh(nil))
+	cache.invalidate()
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+	"github.com/vmware/vmware-go-kcl-v2/logger"
+)
+
+// TeeCheckpointMode decides which processors of a TeeRecordProcessor the shard checkpoint waits for.
+type TeeCheckpointMode int
+
+const (
+	// TeeCheckpointAfterAll checkpoints the shard at the lowest position checkpointed by all the processors.
+	TeeCheckpointAfterAll TeeCheckpointMode = iota + 1
+
+	// TeeCheckpointAfterPrimary checkpoints the shard as the primary processor does. The checkpoints of the
+	// secondary processors are discarded.
+	TeeCheckpointAfterPrimary
+)
+
+// TeeRecordProcessor delivers the records of a shard to several record processors, e.g. to run an old and a new
+// processor side by side and compare their outputs before a cutover. Each batch is delivered to the primary
+// processor, then to the secondary ones, in order.
+//
+// A secondary processor which panics is logged and dropped: it no longer receives records nor holds the checkpoint
+// of the shard back. A panic of the primary processor is not recovered.
+type TeeRecordProcessor struct {
+	primary     kcl.IRecordProcessor
+	secondaries []kcl.IRecordProcessor
+	mode        TeeCheckpointMode
+	log         logger.Logger
+
+	mux sync.Mutex
+	// checkpointer of the shard and the coordinator of the processors checkpointing it, with TeeCheckpointAfterAll
+	checkpointer kcl.IRecordProcessorCheckpointer
+	coordinator  *CheckpointCoordinator
+	// secondary processors dropped after a panic
+	failed map[int]bool
+}
+
+// NewTeeRecordProcessor creates a TeeRecordProcessor checkpointing after all the processors.
+func NewTeeRecordProcessor(primary kcl.IRecordProcessor, secondaries ...kcl.IRecordProcessor) *TeeRecordProcessor {
+	return &TeeRecordProcessor{
+		primary:     primary,
+		secondaries: secondaries,
+		mode:        TeeCheckpointAfterAll,
+		log:         logger.GetDefaultLogger(),
+		failed:      make(map[int]bool),
+	}
+}
+
+// WithCheckpointMode sets which processors the shard checkpoint waits for.
+func (t *TeeRecordProcessor) WithCheckpointMode(mode TeeCheckpointMode) *TeeRecordProcessor {
+	t.mode = mode
+	return t
+}
+
+// WithLogger sets the logger the failures of the secondary processors are reported to.
+func (t *TeeRecordProcessor) WithLogger(log logger.Logger) *TeeRecordProcessor {
+	t.log = log
+	return t
+}
+
+func (t *TeeRecordProcessor) Initialize(input *kcl.InitializationInput) {
+	t.primary.Initialize(input)
+	t.forEachSecondary(func(i int, p kcl.IRecordProcessor) {
+		p.Initialize(input)
+	})
+}
+
+func (t *TeeRecordProcessor) ProcessRecords(input *kcl.ProcessRecordsInput) {
+	primaryInput := *input
+	primaryInput.Checkpointer = t.checkpointerOf(input.Checkpointer, 0)
+	t.primary.ProcessRecords(&primaryInput)
+
+	t.forEachSecondary(func(i int, p kcl.IRecordProcessor) {
+		secondaryInput := *input
+		// the processors may reorder or trim their slice
+		secondaryInput.Records = append([]types.Record(nil), input.Records...)
+		secondaryInput.Checkpointer = t.checkpointerOf(input.Checkpointer, i+1)
+		p.ProcessRecords(&secondaryInput)
+	})
+}
+
+func (t *TeeRecordProcessor) Shutdown(input *kcl.ShutdownInput) {
+	t.primary.Shutdown(&kcl.ShutdownInput{
+		ShutdownReason: input.ShutdownReason,
+		Checkpointer:   t.checkpointerOf(input.Checkpointer, 0),
+	})
+	t.forEachSecondary(func(i int, p kcl.IRecordProcessor) {
+		p.Shutdown(&kcl.ShutdownInput{
+			ShutdownReason: input.ShutdownReason,
+			Checkpointer:   t.checkpointerOf(input.Checkpointer, i+1),
+		})
+	})
+}
+
+// forEachSecondary calls fn with each secondary processor which has not failed, dropping the ones panicking.
+func (t *TeeRecordProcessor) forEachSecondary(fn func(i int, p kcl.IRecordProcessor)) {
+	for i, p := range t.secondaries {
+		t.mux.Lock()
+		failed := t.failed[i]
+		t.mux.Unlock()
+		if failed {
+			continue
+		}
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.log.Errorf("Secondary record processor %d failed, dropping it: %v", i, r)
+					t.drop(i)
+				}
+			}()
+			fn(i, p)
+		}()
+	}
+}
+
+// drop stops delivering records to the secondary processor i, and waiting for its checkpoints.
+func (t *TeeRecordProcessor) drop(i int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.failed[i] = true
+	if t.coordinator != nil {
+		if err := t.coordinator.RemoveStage(strconv.Itoa(i + 1)); err != nil {
+			t.log.Errorf("Failed to checkpoint after dropping secondary record processor %d: %+v", i, err)
+		}
+	}
+}
+
+// checkpointerOf returns the checkpointer handed over to the processor of the given index, the primary being 0.
+func (t *TeeRecordProcessor) checkpointerOf(checkpointer kcl.IRecordProcessorCheckpointer, index int) kcl.IRecordProcessorCheckpointer {
+	if checkpointer == nil {
+		return nil
+	}
+	if t.mode == TeeCheckpointAfterPrimary {
+		if index == 0 {
+			return checkpointer
+		}
+		return discardingCheckpointer{}
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.coordinator == nil || t.checkpointer != checkpointer {
+		stages := []string{"0"}
+		for i := range t.secondaries {
+			if !t.failed[i] {
+				stages = append(stages, strconv.Itoa(i+1))
+			}
+		}
+		t.checkpointer = checkpointer
+		t.coordinator = NewCheckpointCoordinator(checkpointer, stages...)
+	}
+	stage, err := t.coordinator.Stage(strconv.Itoa(index))
+	if err != nil {
+		// the processor failed and its stage was removed, it no longer holds the checkpoint back
+		return discardingCheckpointer{}
+	}
+	return stage
+}
+
+// discardingCheckpointer accepts and discards every checkpoint.
+type discardingCheckpointer struct{}
+
+func (c discardingCheckpointer) Checkpoint(_ *string) error {
+	return nil
+}
+
+func (c discardingCheckpointer) PrepareCheckpoint(sequenceNumber *string) (kcl.IPreparedCheckpointer, error) {
+	return &PreparedCheckpointer{
+		pendingCheckpointSequenceNumber: &kcl.ExtendedSequenceNumber{SequenceNumber: sequenceNumber},
+		checkpointer:                    c,
+	}, nil
+}
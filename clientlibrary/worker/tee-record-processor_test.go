@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/stretchr/testify/assert"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+)
+
+func testRecords(sequenceNumbers ...string) []types.Record {
+	var records []types.Record
+	for _, seq := range sequenceNumbers {
+		records = append(records, types.Record{Data: []byte(seq), PartitionKey: aws.String("key"), SequenceNumber: aws.String(seq)})
+	}
+	return records
+}
+
+// checkpointingProcessor records the batches it receives and checkpoints the last record of every n-th batch.
+func checkpointingProcessor(batches *[][]types.Record, n int) *testRecordProcessor {
+	count := 0
+	return &testRecordProcessor{
+		processRecords: func(input *kcl.ProcessRecordsInput) {
+			*batches = append(*batches, input.Records)
+			count++
+			if count%n == 0 {
+				_ = input.Checkpointer.Checkpoint(input.Records[len(input.Records)-1].SequenceNumber)
+			}
+		},
+		shutdown: func(input *kcl.ShutdownInput) {
+			if input.ShutdownReason == kcl.TERMINATE {
+				_ = input.Checkpointer.Checkpoint(nil)
+			}
+		},
+	}
+}
+
+func TestTeeRecordProcessorDeliversIdenticalBatches(t *testing.T) {
+	var oldBatches, newBatches [][]types.Record
+	tee := NewTeeRecordProcessor(checkpointingProcessor(&oldBatches, 1), checkpointingProcessor(&newBatches, 2))
+	checkpointer := &recordingCheckpointer{}
+
+	tee.Initialize(&kcl.InitializationInput{ShardId: "shard-0"})
+	for _, batch := range [][]string{{"1", "2"}, {"3"}, {"4", "5"}} {
+		tee.ProcessRecords(&kcl.ProcessRecordsInput{Records: testRecords(batch...), Checkpointer: checkpointer})
+	}
+	tee.Shutdown(&kcl.ShutdownInput{ShutdownReason: kcl.TERMINATE, Checkpointer: checkpointer})
+
+	assert.Equal(t, oldBatches, newBatches)
+	assert.Len(t, oldBatches, 3)
+	// the secondary processor checkpoints every other batch
+	assert.Equal(t, []string{"3", chk.ShardEnd}, checkpointer.checkpoints)
+}
+
+func TestTeeRecordProcessorCheckpointAfterPrimary(t *testing.T) {
+	var oldBatches, newBatches [][]types.Record
+	tee := NewTeeRecordProcessor(checkpointingProcessor(&oldBatches, 1), checkpointingProcessor(&newBatches, 2)).
+		WithCheckpointMode(TeeCheckpointAfterPrimary)
+	checkpointer := &recordingCheckpointer{}
+
+	for _, batch := range [][]string{{"1", "2"}, {"3"}} {
+		tee.ProcessRecords(&kcl.ProcessRecordsInput{Records: testRecords(batch...), Checkpointer: checkpointer})
+	}
+	assert.Equal(t, []string{"2", "3"}, checkpointer.checkpoints)
+}
+
+func TestTeeRecordProcessorDropsFailingSecondary(t *testing.T) {
+	var oldBatches [][]types.Record
+	calls := 0
+	failing := &testRecordProcessor{processRecords: func(_ *kcl.ProcessRecordsInput) {
+		calls++
+		panic("unexpected record")
+	}}
+	tee := NewTeeRecordProcessor(checkpointingProcessor(&oldBatches, 1), failing)
+	checkpointer := &recordingCheckpointer{}
+
+	for _, batch := range [][]string{{"1", "2"}, {"3"}} {
+		tee.ProcessRecords(&kcl.ProcessRecordsInput{Records: testRecords(batch...), Checkpointer: checkpointer})
+	}
+	assert.Equal(t, 1, calls)
+	assert.Len(t, oldBatches, 2)
+	// the failed processor no longer holds the checkpoint back
+	assert.Equal(t, []string{"2", "3"}, checkpointer.checkpoints)
+}
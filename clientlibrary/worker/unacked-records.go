@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+)
+
+// unackedRecords tracks the records delivered to the record processor of a shard which are not covered by a
+// checkpoint yet, with MaxUnackedRecords. Checkpoints may be written from any goroutine. A nil tracker tracks nothing.
+type unackedRecords struct {
+	mux sync.Mutex
+	// sequence numbers of the unacknowledged records, in delivery order
+	sequenceNumbers []string
+}
+
+// delivered adds records handed over to the record processor.
+func (u *unackedRecords) delivered(records []types.Record) {
+	if u == nil {
+		return
+	}
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	for _, r := range records {
+		u.sequenceNumbers = append(u.sequenceNumbers, aws.ToString(r.SequenceNumber))
+	}
+}
+
+// acked drops the records covered by a checkpoint committed at the given sequence number, or SHARD_END.
+func (u *unackedRecords) acked(checkpoint string) {
+	if u == nil {
+		return
+	}
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if checkpoint == chk.ShardEnd {
+		u.sequenceNumbers = nil
+		return
+	}
+	acked := 0
+	for acked < len(u.sequenceNumbers) && chk.CompareSequenceNumbers(u.sequenceNumbers[acked], checkpoint) <= 0 {
+		acked++
+	}
+	u.sequenceNumbers = u.sequenceNumbers[acked:]
+}
+
+// count returns the number of unacknowledged records.
+func (u *unackedRecords) count() int {
+	if u == nil {
+		return 0
+	}
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return len(u.sequenceNumbers)
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+// checkpointLimiter caps the checkpoint writes in flight across the shard consumers of a worker, with
+// MaxConcurrentCheckpoints.
+type checkpointLimiter struct {
+	slots chan struct{}
+}
+
+func newCheckpointLimiter(maxConcurrent int) *checkpointLimiter {
+	return &checkpointLimiter{slots: make(chan struct{}, maxConcurrent)}
+}
+
+// tryAcquire takes a slot if one is free.
+func (l *checkpointLimiter) tryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire takes a slot, waiting for one to be released.
+func (l *checkpointLimiter) acquire() {
+	l.slots <- struct{}{}
+}
+
+// release gives back a slot taken by tryAcquire or acquire.
+func (l *checkpointLimiter) release() {
+	<-l.slots
+}
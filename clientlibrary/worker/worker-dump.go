@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+)
+
+// WorkerDump is the diagnostic snapshot of a worker returned by Dump, as JSON.
+type WorkerDump struct {
+	WorkerID   string
+	StreamName string
+	Time       time.Time
+	// Running is set while the event loop of the worker runs, the shards are only dumped then
+	Running bool
+	Shards  []ShardDump
+	// Config is the configuration of the worker. Functions and interfaces are reduced to their type, so that
+	// neither credentials nor other secrets end up in the dump.
+	Config map[string]interface{}
+}
+
+// ShardDump is the diagnostic snapshot of a shard known to the worker.
+type ShardDump struct {
+	ShardID       string
+	ParentShardID string `json:",omitempty"`
+	Checkpoint    string
+	LeaseOwner    string
+	LeaseTimeout  time.Time
+	ClaimRequest  string `json:",omitempty"`
+	Closed        bool
+	LastPollTime  time.Time
+	// Consumer is the state of the consumer of the shard, when the shard is consumed by the worker
+	Consumer *ConsumerDump `json:",omitempty"`
+}
+
+// ConsumerDump is the diagnostic snapshot of a shard consumer. The rate limiter and the poll statistics are only
+// known for the polling consumers.
+type ConsumerDump struct {
+	FanOut      bool
+	RateLimiter *RateLimiterStats `json:",omitempty"`
+	Polling     *PollStats        `json:",omitempty"`
+}
+
+// Dump returns a JSON snapshot of the worker and its shard consumers, for troubleshooting: checkpoints, leases,
+// rate limiters, poll statistics and the configuration. It can be called at any time, the shards being left out
+// while the worker is not running.
+func (w *Worker) Dump() ([]byte, error) {
+	dump := WorkerDump{
+		WorkerID:   w.workerID,
+		StreamName: w.streamName,
+		Time:       time.Now(),
+		Config:     dumpConfig(w.kclConfig),
+	}
+
+	if w.stop != nil && w.dumpRequests != nil {
+		shards := make(chan []ShardDump, 1)
+		select {
+		case w.dumpRequests <- shards:
+			select {
+			case dump.Shards = <-shards:
+				dump.Running = true
+			case <-*w.stop:
+			}
+		case <-*w.stop:
+		}
+	}
+
+	return json.MarshalIndent(dump, "", "  ")
+}
+
+// dumpShards takes a diagnostic snapshot of the shards. It must be called by the event loop, which owns the shard
+// status.
+func (w *Worker) dumpShards() []ShardDump {
+	shards := make([]ShardDump, 0, len(w.shardStatus))
+	for _, shard := range w.shardStatus {
+		shard.Mux.RLock()
+		dump := ShardDump{
+			ShardID:       shard.ID,
+			ParentShardID: shard.ParentShardId,
+			Checkpoint:    shard.Checkpoint,
+			LeaseOwner:    shard.AssignedTo,
+			LeaseTimeout:  shard.LeaseTimeout,
+			ClaimRequest:  shard.ClaimRequest,
+			Closed:        shard.Closed,
+			LastPollTime:  shard.LastPollTime,
+		}
+		shard.Mux.RUnlock()
+
+		if consumer := w.consumer(shard.ID); consumer != nil {
+			dump.Consumer = dumpConsumer(consumer)
+		}
+		shards = append(shards, dump)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].ShardID < shards[j].ShardID })
+	return shards
+}
+
+func dumpConsumer(consumer shardConsumer) *ConsumerDump {
+	switch c := consumer.(type) {
+	case *PollingShardConsumer:
+		rateLimiter := c.Stats()
+		polling := c.PollStats()
+		return &ConsumerDump{RateLimiter: &rateLimiter, Polling: &polling}
+	case *FanOutShardConsumer:
+		return &ConsumerDump{FanOut: true}
+	}
+	return &ConsumerDump{}
+}
+
+// dumpConfig returns the fields of the configuration which can be marshaled to JSON as they are, and the type of the
+// others: functions, channels and interfaces such as the credentials provider or the logger.
+func dumpConfig(kclConfig *config.KinesisClientLibConfiguration) map[string]interface{} {
+	if kclConfig == nil {
+		return nil
+	}
+
+	fields := map[string]interface{}{}
+	v := reflect.ValueOf(kclConfig).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		value := v.Field(i)
+		switch value.Kind() {
+		case reflect.Func, reflect.Chan, reflect.Interface, reflect.UnsafePointer:
+			if value.IsNil() {
+				fields[field.Name] = nil
+			} else if value.Kind() == reflect.Interface {
+				fields[field.Name] = fmt.Sprintf("%T", value.Interface())
+			} else {
+				fields[field.Name] = value.Type().String()
+			}
+		default:
+			fields[field.Name] = value.Interface()
+		}
+	}
+	return fields
+}
+
+// addConsumer registers the consumer of a shard for Dump.
+func (w *Worker) addConsumer(shardID string, consumer shardConsumer) {
+	w.consumersMux.Lock()
+	defer w.consumersMux.Unlock()
+	if w.consumers == nil {
+		w.consumers = make(map[string]shardConsumer)
+	}
+	w.consumers[shardID] = consumer
+}
+
+// removeConsumer unregisters the consumer of a shard, unless the shard already has another consumer.
+func (w *Worker) removeConsumer(shardID string, consumer shardConsumer) {
+	w.consumersMux.Lock()
+	defer w.consumersMux.Unlock()
+	if w.consumers[shardID] == consumer {
+		delete(w.consumers, shardID)
+	}
+}
+
+func (w *Worker) consumer(shardID string) shardConsumer {
+	w.consumersMux.Lock()
+	defer w.consumersMux.Unlock()
+	return w.consumers[shardID]
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package worker
+package worker
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// defaultShardLevelMetrics are enabled when enhanced monitoring is enabled without naming any metric.
+var defaultShardLevelMetrics = []types.MetricsName{types.MetricsNameIncomingBytes, types.MetricsNameIteratorAgeMilliseconds}
+
+// enableEnhancedMonitoring enables shard-level enhanced monitoring on the stream. The metrics which were not already
+// enabled are remembered, so that disableEnhancedMonitoring only disables what the worker enabled.
+func (w *Worker) enableEnhancedMonitoring() error {
+	log := w.kclConfig.Logger
+
+	metrics := defaultShardLevelMetrics
+	if len(w.kclConfig.ShardLevelMetrics) > 0 {
+		metrics = make([]types.MetricsName, 0, len(w.kclConfig.ShardLevelMetrics))
+		for _, m := range w.kclConfig.ShardLevelMetrics {
+			metrics = append(metrics, types.MetricsName(m))
+		}
+	}
+
+	out, err := w.kc.EnableEnhancedMonitoring(context.TODO(), &kinesis.EnableEnhancedMonitoringInput{
+		StreamName:        &w.streamName,
+		ShardLevelMetrics: metrics,
+	})
+	if err != nil {
+		return err
+	}
+
+	enabled := make(map[types.MetricsName]bool)
+	for _, m := range out.CurrentShardLevelMetrics {
+		enabled[m] = true
+	}
+	w.enabledShardLevelMetrics = nil
+	for _, m := range out.DesiredShardLevelMetrics {
+		if !enabled[m] {
+			w.enabledShardLevelMetrics = append(w.enabledShardLevelMetrics, m)
+		}
+	}
+	if len(w.enabledShardLevelMetrics) == 0 {
+		log.Infof("Enhanced monitoring already enabled on stream %s for %v", w.streamName, metrics)
+	} else {
+		log.Infof("Enabled enhanced monitoring on stream %s for %v", w.streamName, w.enabledShardLevelMetrics)
+	}
+	return nil
+}
+
+// disableEnhancedMonitoring disables the shard-level metrics enabled by enableEnhancedMonitoring.
+func (w *Worker) disableEnhancedMonitoring() error {
+	if len(w.enabledShardLevelMetrics) == 0 {
+		return nil
+	}
+
+	_, err := w.kc.DisableEnhancedMonitoring(context.TODO(), &kinesis.DisableEnhancedMonitoringInput{
+		StreamName:        &w.streamName,
+		ShardLevelMetrics: w.enabledShardLevelMetrics,
+	})
+	if err != nil {
+		return err
+	}
+
+	w.kclConfig.Logger.Infof("Disabled enhanced monitoring on stream %s for %v", w.streamName, w.enabledShardLevelMetrics)
+	w.enabledShardLevelMetrics = nil
+	return nil
+}
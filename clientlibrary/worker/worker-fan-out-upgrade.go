@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
+)
+
+// fanOutUpgrade counts the throttled GetRecords calls of the polling consumers, with FanOutThrottleThreshold, and
+// requests the worker to switch to enhanced fan-out once there are too many of them. Once the worker switched, the
+// polling consumers hand their shards over.
+type fanOutUpgrade struct {
+	threshold int
+	window    time.Duration
+
+	mux       sync.Mutex
+	throttles []time.Time
+
+	// signaled when threshold calls were throttled within window
+	requests chan struct{}
+	// closed once the worker switched to enhanced fan-out
+	switched   chan struct{}
+	switchOnce sync.Once
+	// signaled when a polling consumer handed its shard over, for the worker to take it back
+	handOvers chan struct{}
+}
+
+func newFanOutUpgrade(threshold int, window time.Duration) *fanOutUpgrade {
+	return &fanOutUpgrade{
+		threshold: threshold,
+		window:    window,
+		requests:  make(chan struct{}, 1),
+		switched:  make(chan struct{}),
+		handOvers: make(chan struct{}, 1),
+	}
+}
+
+// throttled counts a throttled GetRecords call. It is a no-op on a nil fanOutUpgrade.
+func (u *fanOutUpgrade) throttled() {
+	if u == nil {
+		return
+	}
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	now := time.Now()
+	kept := u.throttles[:0]
+	for _, t := range u.throttles {
+		if now.Sub(t) < u.window {
+			kept = append(kept, t)
+		}
+	}
+	u.throttles = append(kept, now)
+	if len(u.throttles) < u.threshold {
+		return
+	}
+
+	u.throttles = nil
+	select {
+	case u.requests <- struct{}{}:
+	default:
+	}
+}
+
+// switchToFanOut tells the polling consumers to hand their shards over.
+func (u *fanOutUpgrade) switchToFanOut() {
+	u.switchOnce.Do(func() {
+		close(u.switched)
+	})
+}
+
+// handingOver returns true once the worker switched to enhanced fan-out. It is false on a nil fanOutUpgrade.
+func (u *fanOutUpgrade) handingOver() bool {
+	if u == nil {
+		return false
+	}
+	select {
+	case <-u.switched:
+		return true
+	default:
+		return false
+	}
+}
+
+// handedOver signals that a polling consumer ended after the switch, so that the worker takes its shard back with a
+// fan-out consumer. It is a no-op on a nil fanOutUpgrade or before the switch.
+func (u *fanOutUpgrade) handedOver() {
+	if !u.handingOver() {
+		return
+	}
+	select {
+	case u.handOvers <- struct{}{}:
+	default:
+	}
+}
+
+// upgradeToFanOut switches the worker to enhanced fan-out: the consumer is registered, if needed, and the shards are
+// consumed with fan-out consumers from then on. It returns false when the consumer could not be registered, the
+// switch being tried again after the next throttled calls.
+func (w *Worker) upgradeToFanOut() bool {
+	log := w.kclConfig.Logger
+
+	consumerARN := w.kclConfig.EnhancedFanOutConsumerARN
+	if consumerARN == "" {
+		var err error
+		consumerARN, err = w.fetchConsumerARN()
+		if err != nil {
+			log.Errorf("Failed to switch stream %s to enhanced fan-out: %+v", w.streamName, err)
+			return false
+		}
+	}
+
+	log.Warnf("GetRecords throttled %d times within %d ms, switching stream %s to enhanced fan-out consumer %s",
+		w.kclConfig.FanOutThrottleThreshold, w.kclConfig.FanOutThrottleWindowMillis, w.streamName, consumerARN)
+	w.consumerARN = consumerARN
+	w.fanOut = true
+	w.fanOutUpgrade.switchToFanOut()
+	if r, ok := w.mService.(metrics.FanOutUpgradeReporter); ok {
+		r.WorkerFanOutUpgraded()
+	}
+	return true
+}
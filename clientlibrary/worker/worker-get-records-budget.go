@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"sync"
+	"time"
+)
+
+// getRecordsBudget caps the GetRecords calls of all the polling shard consumers of a worker over fixed windows, which
+// start with their first call.
+type getRecordsBudget struct {
+	mux         sync.Mutex
+	calls       int
+	window      time.Duration
+	windowStart time.Time
+	callsLeft   int
+}
+
+func newGetRecordsBudget(calls int, window time.Duration) *getRecordsBudget {
+	return &getRecordsBudget{calls: calls, window: window}
+}
+
+// take takes one of the calls of the current window. When none is left, it returns false with how long until the
+// next window.
+func (b *getRecordsBudget) take() (time.Duration, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := time.Now()
+	if b.windowStart.IsZero() || now.Sub(b.windowStart) >= b.window {
+		b.windowStart = now
+		b.callsLeft = b.calls
+	}
+	if b.callsLeft < 1 {
+		return b.window - now.Sub(b.windowStart), false
+	}
+	b.callsLeft--
+	return 0, true
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"sort"
+	"time"
+)
+
+// ShardHealth is the health of a shard held by the worker.
+type ShardHealth struct {
+	ShardID string
+	// LastPollTime is when records were last read from the shard, zero until the first read
+	LastPollTime time.Time
+	// Stalled is set when the shard has not been read for longer than FailoverTimeMillis since its first read
+	Stalled bool
+}
+
+// WorkerHealth is a snapshot of the health of a worker, passed to the heartbeat.
+type WorkerHealth struct {
+	WorkerID string
+	Time     time.Time
+	// HeldShards is the number of shards whose lease is held by the worker
+	HeldShards int
+	Shards     []ShardHealth
+	// Stalled is set when any of the held shards is stalled
+	Stalled bool
+	// Standby is set while the worker is a warm standby, holding no lease until promoted
+	Standby bool
+}
+
+// WithHeartbeat sets a function called with a health snapshot of the worker every HeartbeatIntervalMillis, to push
+// the liveness of the worker to an external system. It is called from a dedicated goroutine and should not block.
+func (w *Worker) WithHeartbeat(heartbeat func(WorkerHealth)) *Worker {
+	w.heartbeat = heartbeat
+	return w
+}
+
+// health takes a health snapshot of the worker. It must be called by the event loop, which owns the shard status.
+func (w *Worker) health() WorkerHealth {
+	now := time.Now()
+	stallTimeout := time.Duration(w.kclConfig.FailoverTimeMillis) * time.Millisecond
+
+	health := WorkerHealth{WorkerID: w.workerID, Time: now, Standby: w.standby}
+	for _, shard := range w.shardStatus {
+		if shard.GetLeaseOwner() != w.workerID {
+			continue
+		}
+
+		lastPollTime := shard.GetLastPollTime()
+		stalled := !lastPollTime.IsZero() && now.Sub(lastPollTime) > stallTimeout
+		health.Shards = append(health.Shards, ShardHealth{ShardID: shard.ID, LastPollTime: lastPollTime, Stalled: stalled})
+		health.Stalled = health.Stalled || stalled
+	}
+	health.HeldShards = len(health.Shards)
+	sort.Slice(health.Shards, func(i, j int) bool { return health.Shards[i].ShardID < health.Shards[j].ShardID })
+	return health
+}
+
+// runHeartbeat calls the heartbeat with a health snapshot on every interval until the worker stops.
+func (w *Worker) runHeartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-*w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		snapshot := make(chan WorkerHealth, 1)
+		select {
+		case w.healthRequests <- snapshot:
+		case <-*w.stop:
+			return
+		}
+		w.heartbeat(<-snapshot)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+)
+
+// ErrLeaseBackupNotSupported is returned when exporting or importing leases with a checkpointer which does not
+// implement checkpoint.LeaseBackup
+var ErrLeaseBackupNotSupported = errors.New("checkpointer does not support lease backups")
+
+// ExportLeases writes every lease of the lease table to w as a JSON array, e.g. to back the table up or to move it
+// to another region. The worker does not need to be started, the default DynamoDB checkpointer is created if none
+// was set.
+func (w *Worker) ExportLeases(out io.Writer) error {
+	backup, err := w.leaseBackup()
+	if err != nil {
+		return err
+	}
+
+	leases, err := backup.ListLeases()
+	if err != nil {
+		return err
+	}
+	if leases == nil {
+		leases = []chk.Lease{}
+	}
+
+	return json.NewEncoder(out).Encode(leases)
+}
+
+// ImportLeases reads leases written by ExportLeases from r and writes their checkpoints to the lease table. A lease
+// whose shard already has a checkpoint which is not older in the table is skipped, so importing an old backup never
+// rewinds a shard.
+func (w *Worker) ImportLeases(in io.Reader) error {
+	log := w.kclConfig.Logger
+
+	backup, err := w.leaseBackup()
+	if err != nil {
+		return err
+	}
+
+	var leases []chk.Lease
+	if err := json.NewDecoder(in).Decode(&leases); err != nil {
+		return fmt.Errorf("invalid lease backup: %w", err)
+	}
+
+	imported := 0
+	for _, lease := range leases {
+		written, err := backup.ImportLease(lease)
+		if err != nil {
+			return fmt.Errorf("failed to import lease of shard %s: %w", lease.ShardID, err)
+		}
+		if !written {
+			log.Infof("Skipped importing lease of shard %s, the lease table holds a newer checkpoint", lease.ShardID)
+			continue
+		}
+		imported++
+	}
+
+	log.Infof("Imported %d of %d leases", imported, len(leases))
+	return nil
+}
+
+func (w *Worker) leaseBackup() (chk.LeaseBackup, error) {
+	if w.checkpointer == nil {
+		checkpointer := chk.NewDynamoCheckpoint(w.kclConfig)
+		if err := checkpointer.Init(); err != nil {
+			return nil, err
+		}
+		w.checkpointer = checkpointer
+	}
+
+	backup, ok := w.checkpointer.(chk.LeaseBackup)
+	if !ok {
+		return nil, ErrLeaseBackupNotSupported
+	}
+	return backup, nil
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+)
+
+// backupCheckpointer is an in-memory lease table supporting lease backups.
+type backupCheckpointer struct {
+	*testCheckpointer
+}
+
+func (c backupCheckpointer) ListLeases() ([]chk.Lease, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var leases []chk.Lease
+	for id, lease := range c.leases {
+		exported := chk.Lease{ShardID: id, Checkpoint: lease.checkpoint, Owner: lease.owner, StreamName: lease.streamName}
+		if !lease.leaseTimeout.IsZero() {
+			exported.LeaseTimeout = lease.leaseTimeout.Format(time.RFC3339Nano)
+		}
+		leases = append(leases, exported)
+	}
+	return leases, nil
+}
+
+func (c backupCheckpointer) ImportLease(lease chk.Lease) (bool, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	current, ok := c.leases[lease.ShardID]
+	if !ok {
+		c.leases[lease.ShardID] = &testLease{checkpoint: lease.Checkpoint}
+		return true, nil
+	}
+	if lease.Checkpoint == "" || (current.checkpoint != "" && chk.CompareSequenceNumbers(current.checkpoint, lease.Checkpoint) >= 0) {
+		return false, nil
+	}
+	current.checkpoint = lease.Checkpoint
+	return true, nil
+}
+
+func TestExportImportLeases(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "stream", "us-west-2", "worker")
+	source := newTestWorker(kclConfig, backupCheckpointer{newTestCheckpointer(map[string]*testLease{
+		"shard-0": {checkpoint: "100", owner: "worker", leaseTimeout: time.Now()},
+		"shard-1": {checkpoint: "200"},
+		"shard-2": {checkpoint: chk.ShardEnd},
+	})})
+
+	var backup bytes.Buffer
+	assert.Nil(t, source.ExportLeases(&backup))
+
+	// the target table already moved shard-1 further, and has no lease of the other shards
+	target := backupCheckpointer{newTestCheckpointer(map[string]*testLease{
+		"shard-1": {checkpoint: "300", owner: "other"},
+	})}
+	assert.Nil(t, newTestWorker(kclConfig, target).ImportLeases(&backup))
+
+	assert.Equal(t, "100", target.leases["shard-0"].checkpoint)
+	assert.Equal(t, "", target.leases["shard-0"].owner)
+	assert.Equal(t, "300", target.leases["shard-1"].checkpoint)
+	assert.Equal(t, "other", target.leases["shard-1"].owner)
+	assert.Equal(t, chk.ShardEnd, target.leases["shard-2"].checkpoint)
+
+	// importing the same backup again changes nothing
+	var again bytes.Buffer
+	assert.Nil(t, source.ExportLeases(&again))
+	assert.Nil(t, newTestWorker(kclConfig, target).ImportLeases(&again))
+	assert.Equal(t, "300", target.leases["shard-1"].checkpoint)
+}
+
+func TestLeaseBackupErrors(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "stream", "us-west-2", "worker")
+
+	// checkpointers without lease backups are rejected
+	w := newTestWorker(kclConfig, newTestCheckpointer(map[string]*testLease{}))
+	assert.ErrorIs(t, w.ExportLeases(&bytes.Buffer{}), ErrLeaseBackupNotSupported)
+	assert.ErrorIs(t, w.ImportLeases(strings.NewReader("[]")), ErrLeaseBackupNotSupported)
+
+	// so are malformed backups
+	w = newTestWorker(kclConfig, backupCheckpointer{newTestCheckpointer(map[string]*testLease{})})
+	assert.NotNil(t, w.ImportLeases(strings.NewReader("{")))
+}
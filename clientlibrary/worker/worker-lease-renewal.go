@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"errors"
+	"time"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+// leaseRenewalBatchInterval is how often the collected lease renewals are written. It is short compared to the lease
+// refresh period, so that waiting for the next batch does not put the leases at risk.
+const leaseRenewalBatchInterval = 250 * time.Millisecond
+
+var errLeaseRenewalStopped = errors.New("lease renewal stopped")
+
+// leaseRenewalRequest is the renewal of one lease, answered once its batch has been written.
+type leaseRenewalRequest struct {
+	shard    *par.ShardStatus
+	assignTo string
+	result   chan error
+}
+
+// leaseRenewalBatcher collects the lease renewals of the shard consumers of a worker and renews them together on a
+// shared tick.
+type leaseRenewalBatcher struct {
+	renewer  chk.BatchLeaseRenewer
+	interval time.Duration
+	requests chan *leaseRenewalRequest
+	stop     *chan struct{}
+}
+
+func newLeaseRenewalBatcher(renewer chk.BatchLeaseRenewer, interval time.Duration, stop *chan struct{}) *leaseRenewalBatcher {
+	return &leaseRenewalBatcher{
+		renewer:  renewer,
+		interval: interval,
+		requests: make(chan *leaseRenewalRequest),
+		stop:     stop,
+	}
+}
+
+// renew queues the renewal of the lease on the shard and waits for the batch it is part of to be written.
+func (b *leaseRenewalBatcher) renew(shard *par.ShardStatus, assignTo string) error {
+	req := &leaseRenewalRequest{shard: shard, assignTo: assignTo, result: make(chan error, 1)}
+	select {
+	case b.requests <- req:
+	case <-*b.stop:
+		return errLeaseRenewalStopped
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-*b.stop:
+		return errLeaseRenewalStopped
+	}
+}
+
+// run writes the renewals collected since the previous tick until the worker stops.
+func (b *leaseRenewalBatcher) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	var pending []*leaseRenewalRequest
+	for {
+		select {
+		case req := <-b.requests:
+			pending = append(pending, req)
+		case <-ticker.C:
+			if len(pending) > 0 {
+				b.flush(pending)
+				pending = nil
+			}
+		case <-*b.stop:
+			return
+		}
+	}
+}
+
+// flush renews the pending leases, one batch per lease owner.
+func (b *leaseRenewalBatcher) flush(pending []*leaseRenewalRequest) {
+	byOwner := make(map[string][]*leaseRenewalRequest)
+	for _, req := range pending {
+		byOwner[req.assignTo] = append(byOwner[req.assignTo], req)
+	}
+
+	for assignTo, reqs := range byOwner {
+		shards := make([]*par.ShardStatus, 0, len(reqs))
+		for _, req := range reqs {
+			shards = append(shards, req.shard)
+		}
+
+		errs := b.renewer.RenewLeases(shards, assignTo)
+		for _, req := range reqs {
+			req.result <- errs[req.shard.ID]
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import "sync"
+
+// pollWaiter is a shard consumer waiting for a GetRecords slot.
+type pollWaiter struct {
+	lag   int64
+	ready chan struct{}
+}
+
+// pollScheduler caps the number of GetRecords calls in flight across the polling shard consumers of a worker. A slot
+// freed while consumers are waiting is handed over to the most behind of them when prioritizing by lag, and to the
+// longest waiting one otherwise.
+type pollScheduler struct {
+	mux     sync.Mutex
+	slots   int
+	byLag   bool
+	waiting []*pollWaiter
+}
+
+func newPollScheduler(slots int, byLag bool) *pollScheduler {
+	return &pollScheduler{slots: slots, byLag: byLag}
+}
+
+// acquire waits for a slot for a shard lagging lag milliseconds behind. It returns false, without a slot, when stop is
+// closed first.
+func (s *pollScheduler) acquire(lag int64, stop <-chan struct{}) bool {
+	s.mux.Lock()
+	if s.slots > 0 && len(s.waiting) == 0 {
+		s.slots--
+		s.mux.Unlock()
+		return true
+	}
+	waiter := &pollWaiter{lag: lag, ready: make(chan struct{})}
+	s.waiting = append(s.waiting, waiter)
+	s.mux.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return true
+	case <-stop:
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for i, w := range s.waiting {
+		if w == waiter {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return false
+		}
+	}
+	// the slot was handed over meanwhile, pass it on
+	s.releaseLocked()
+	return false
+}
+
+// release frees the slot taken by acquire.
+func (s *pollScheduler) release() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.releaseLocked()
+}
+
+func (s *pollScheduler) releaseLocked() {
+	if len(s.waiting) == 0 {
+		s.slots++
+		return
+	}
+
+	next := 0
+	for i, w := range s.waiting {
+		if s.byLag && w.lag > s.waiting[next].lag {
+			next = i
+		}
+	}
+	waiter := s.waiting[next]
+	s.waiting = append(s.waiting[:next], s.waiting[next+1:]...)
+	close(waiter.ready)
+}
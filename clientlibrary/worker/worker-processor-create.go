@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"math/rand"
+	"time"
+
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+// processorCreateFailure tracks the consecutive failures to create the record processor of a shard.
+type processorCreateFailure struct {
+	failures int
+	retryAt  time.Time
+	rand     *rand.Rand
+}
+
+// createProcessor creates the record processor of the shard, through CreateShardProcessor if the factory can fail.
+func (w *Worker) createProcessor(shardID string) (kcl.IRecordProcessor, error) {
+	if factory, ok := w.processorFactory.(kcl.IShardRecordProcessorFactory); ok {
+		return factory.CreateShardProcessor(shardID)
+	}
+	return w.processorFactory.CreateProcessor(), nil
+}
+
+// processorCreateHeld returns true if the shard is not to be acquired: creating its record processor failed less than
+// the ProcessorCreateBackoff ago, or more than MaxProcessorCreateRetries times in a row.
+func (w *Worker) processorCreateHeld(shardID string) bool {
+	failure, ok := w.processorCreateFailures[shardID]
+	if !ok {
+		return false
+	}
+	return failure.failures > w.kclConfig.MaxProcessorCreateRetries || time.Now().Before(failure.retryAt)
+}
+
+// processorCreateFailed records the failure to create the record processor of a shard, and releases the lease just
+// acquired on it, so that another worker can consume the shard in the meantime.
+func (w *Worker) processorCreateFailed(shard *par.ShardStatus, err error) {
+	log := w.kclConfig.Logger
+
+	if w.processorCreateFailures == nil {
+		w.processorCreateFailures = make(map[string]*processorCreateFailure)
+	}
+	failure, ok := w.processorCreateFailures[shard.ID]
+	if !ok {
+		failure = &processorCreateFailure{rand: newShardRand(w.randomSeed, shard.ID)}
+		w.processorCreateFailures[shard.ID] = failure
+	}
+	failure.failures++
+	if r, ok := w.mService.(metrics.ProcessorCreateFailureReporter); ok {
+		r.ProcessorCreateFailed(shard.ID)
+	}
+
+	if failure.failures > w.kclConfig.MaxProcessorCreateRetries {
+		log.Errorf("Failed to create the record processor of shard %s %d times, leaving the shard to the other workers: %+v",
+			shard.ID, failure.failures, err)
+	} else {
+		wait := w.kclConfig.ProcessorCreateBackoff.Backoff(failure.failures, jitterSource(failure.rand))
+		failure.retryAt = time.Now().Add(wait)
+		log.Warnf("Failed to create the record processor of shard %s, retrying in %s: %+v", shard.ID, wait, err)
+	}
+
+	if err := w.checkpointer.RemoveLeaseOwner(shard.ID); err != nil {
+		log.Errorf("Failed to release the lease on shard %s: %+v", shard.ID, err)
+	}
+	shard.SetLeaseOwner("")
+}
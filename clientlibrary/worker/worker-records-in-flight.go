@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import "sync"
+
+// recordsInFlight counts the records read and not processed yet across the polling shard consumers of a worker, with
+// MaxRecordsInFlight.
+type recordsInFlight struct {
+	mux   sync.Mutex
+	max   int
+	count int
+	// closed, and replaced, whenever records are released
+	released chan struct{}
+}
+
+func newRecordsInFlight(max int) *recordsInFlight {
+	return &recordsInFlight{max: max, released: make(chan struct{})}
+}
+
+// wait blocks while the maximum number of records or more are in flight. It returns false when done is closed first.
+func (r *recordsInFlight) wait(done <-chan struct{}) bool {
+	for {
+		r.mux.Lock()
+		if r.count < r.max {
+			r.mux.Unlock()
+			return true
+		}
+		released := r.released
+		r.mux.Unlock()
+
+		select {
+		case <-released:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// add counts records read.
+func (r *recordsInFlight) add(n int) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.count += n
+}
+
+// release gives back records processed, waking the consumers waiting up.
+func (r *recordsInFlight) release(n int) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.count -= n
+	close(r.released)
+	r.released = make(chan struct{})
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reshardingThrottle smooths the reactions of a worker to resharding. The closures of shards are coalesced into
+// one shard sync per interval, and the lease table writes they lead to are spread evenly over time.
+type reshardingThrottle struct {
+	// shards closed since the last resharding sync
+	closedShards int64
+	// signaled, without blocking, when a shard closes
+	closures chan struct{}
+
+	// minimum time between two lease table writes, 0 when unlimited
+	writeInterval time.Duration
+	mux           sync.Mutex
+	nextWrite     time.Time
+	stop          *chan struct{}
+
+	// the clock the writes are spread with, replaced in tests
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+func newReshardingThrottle(maxWritesPerSecond int, stop *chan struct{}) *reshardingThrottle {
+	t := &reshardingThrottle{
+		closures: make(chan struct{}, 1),
+		stop:     stop,
+		now:      time.Now,
+		after:    time.After,
+	}
+	if maxWritesPerSecond > 0 {
+		t.writeInterval = time.Second / time.Duration(maxWritesPerSecond)
+	}
+	return t
+}
+
+// shardClosed records the closure of a shard and signals it, unless a signal is already pending.
+func (t *reshardingThrottle) shardClosed() {
+	atomic.AddInt64(&t.closedShards, 1)
+	select {
+	case t.closures <- struct{}{}:
+	default:
+	}
+}
+
+// takeClosedShards returns the number of shards closed since the previous call.
+func (t *reshardingThrottle) takeClosedShards() int {
+	return int(atomic.SwapInt64(&t.closedShards, 0))
+}
+
+// waitForWrite blocks until the next lease table write is allowed. It returns false if the worker stops meanwhile.
+func (t *reshardingThrottle) waitForWrite() bool {
+	if t.writeInterval == 0 {
+		return true
+	}
+
+	t.mux.Lock()
+	now := t.now()
+	slot := t.nextWrite
+	if slot.Before(now) {
+		slot = now
+	}
+	t.nextWrite = slot.Add(t.writeInterval)
+	t.mux.Unlock()
+
+	select {
+	case <-t.after(slot.Sub(now)):
+		return true
+	case <-*t.stop:
+		return false
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+// leaseCreatingCheckpointer records the times at which leases are created.
+type leaseCreatingCheckpointer struct {
+	*testCheckpointer
+	writes []time.Time
+}
+
+func (c *leaseCreatingCheckpointer) CreateLease(shard *par.ShardStatus) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.record("CreateLease", shard.ID)
+	c.writes = append(c.writes, time.Now())
+	return nil
+}
+
+// reshardingMonitoringService records the resharding events reported per interval.
+type reshardingMonitoringService struct {
+	metrics.NoopMonitoringService
+	mux    sync.Mutex
+	counts []int
+}
+
+func (m *reshardingMonitoringService) ReshardingEventsPerInterval(count int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.counts = append(m.counts, count)
+}
+
+func (m *reshardingMonitoringService) reported() []int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]int(nil), m.counts...)
+}
+
+func TestReshardingStormThrottlesLeaseWrites(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	checkpointer := &leaseCreatingCheckpointer{testCheckpointer: newTestCheckpointer(map[string]*testLease{})}
+	stop := make(chan struct{})
+	defer close(stop)
+	throttle := newReshardingThrottle(100, &stop)
+	// the clock stands still, the waits for the writes return at once
+	start := time.Now()
+	var waitsMux sync.Mutex
+	var waits []time.Duration
+	throttle.now = func() time.Time { return start }
+	throttle.after = func(d time.Duration) <-chan time.Time {
+		waitsMux.Lock()
+		defer waitsMux.Unlock()
+		waits = append(waits, d)
+		c := make(chan time.Time, 1)
+		c <- start.Add(d)
+		return c
+	}
+
+	// every shard of the stream is split at once, each consumer creating the leases of two children concurrently
+	const closedShards = 10
+	var wg sync.WaitGroup
+	for i := 0; i < closedShards; i++ {
+		sc := newTestCommonShardConsumer(kclConfig, &testRecordProcessor{})
+		sc.checkpointer = checkpointer
+		sc.resharding = throttle
+		children := []types.ChildShard{
+			{ShardId: aws.String("child-a"), ParentShards: []string{sc.shard.ID}},
+			{ShardId: aws.String("child-b"), ParentShards: []string{sc.shard.ID}},
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sc.resharding.shardClosed()
+			sc.createChildLeases(children)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, closedShards, throttle.takeClosedShards())
+	assert.Equal(t, 0, throttle.takeClosedShards())
+
+	// the writes are spread evenly over slots 10ms apart: never more than 100 per second
+	assert.Equal(t, 2*closedShards, len(checkpointer.writes))
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	assert.Equal(t, 2*closedShards, len(waits))
+	for i, wait := range waits {
+		assert.Equal(t, time.Duration(i)*10*time.Millisecond, wait)
+	}
+}
+
+func TestReshardingThrottleStopsWaiting(t *testing.T) {
+	stop := make(chan struct{})
+	throttle := newReshardingThrottle(1, &stop)
+	assert.True(t, throttle.waitForWrite())
+
+	close(stop)
+	start := time.Now()
+	assert.False(t, throttle.waitForWrite())
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestReshardingStormCoalescesShardSyncs(t *testing.T) {
+	mService := &reshardingMonitoringService{}
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithReshardingSyncIntervalMillis(300).
+		WithMonitoringService(mService)
+	w := startTestWorker(t, kclConfig, newFakeKinesis("shard-0"), newTestCheckpointer(map[string]*testLease{}))
+	defer w.Shutdown()
+
+	const closedShards = 50
+	var wg sync.WaitGroup
+	for i := 0; i < closedShards; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.resharding.shardClosed()
+		}()
+	}
+	wg.Wait()
+
+	// the first closure syncs at once, the others wait for the end of the interval
+	assert.Eventually(t, func() bool {
+		total := 0
+		for _, count := range mService.reported() {
+			total += count
+		}
+		return total == closedShards
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.LessOrEqual(t, len(mService.reported()), 2)
+}
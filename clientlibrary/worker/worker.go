@@ -33,6 +33,7 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"math/big"
 	"sync"
 	"time"
@@ -41,37 +42,110 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 
 	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
 	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
 	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
 	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
 	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+	"github.com/vmware/vmware-go-kcl-v2/logger"
 )
 
+// ErrWorkerNotRunning is returned by the operations which need the worker event loop when the worker has not
+// been started or has been shut down.
+var ErrWorkerNotRunning = errors.New("worker is not running")
+
+// rejoinInterval spaces the rejoins of a worker which lost all its leases, so that a worker whose consumers keep
+// failing does not spin on the lease table.
+var rejoinInterval = time.Second
+
+// kinesisAPI is the subset of the Kinesis client used by the worker and its shard consumers.
+type kinesisAPI interface {
+	KinesisSubscriberGetter
+	ListShards(ctx context.Context, params *kinesis.ListShardsInput, optFns ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error)
+	DescribeStream(ctx context.Context, params *kinesis.DescribeStreamInput, optFns ...func(*kinesis.Options)) (*kinesis.DescribeStreamOutput, error)
+	DescribeStreamSummary(ctx context.Context, params *kinesis.DescribeStreamSummaryInput, optFns ...func(*kinesis.Options)) (*kinesis.DescribeStreamSummaryOutput, error)
+	DescribeStreamConsumer(ctx context.Context, params *kinesis.DescribeStreamConsumerInput, optFns ...func(*kinesis.Options)) (*kinesis.DescribeStreamConsumerOutput, error)
+	RegisterStreamConsumer(ctx context.Context, params *kinesis.RegisterStreamConsumerInput, optFns ...func(*kinesis.Options)) (*kinesis.RegisterStreamConsumerOutput, error)
+	EnableEnhancedMonitoring(ctx context.Context, params *kinesis.EnableEnhancedMonitoringInput, optFns ...func(*kinesis.Options)) (*kinesis.EnableEnhancedMonitoringOutput, error)
+	DisableEnhancedMonitoring(ctx context.Context, params *kinesis.DisableEnhancedMonitoringInput, optFns ...func(*kinesis.Options)) (*kinesis.DisableEnhancedMonitoringOutput, error)
+}
+
 // Worker is the high level class that Kinesis applications use to start processing data. It initializes and oversees
 // different components (e.g. syncing shard and lease information, tracking shard assignments, and processing data from
 // the shards).
 type Worker struct {
 	streamName  string
+	streamARN   string
 	regionName  string
 	workerID    string
 	consumerARN string
 
 	processorFactory kcl.IRecordProcessorFactory
 	kclConfig        *config.KinesisClientLibConfiguration
-	kc               *kinesis.Client
+	kc               kinesisAPI
 	checkpointer     chk.Checkpointer
 	mService         metrics.MonitoringService
 
-	stop      *chan struct{}
-	waitGroup *sync.WaitGroup
-	done      bool
+	stop *chan struct{}
+	// canceled along with the stop channel, aborting the Kinesis calls of the shard consumers in flight
+	ctx         context.Context
+	cancel      context.CancelFunc
+	waitGroup   *sync.WaitGroup
+	done        bool
+	shutdownMux sync.Mutex
+	// closed once the worker has shut down
+	finished chan struct{}
+	// closed once the first lease acquisition pass has completed, or after ReadinessTimeoutMillis
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// on demand rebalance passes, run by the event loop
+	rebalanceRequests chan chan error
+	// promotions out of the warm standby, run by the event loop
+	promoteRequests chan chan error
+	// set while the worker is a warm standby, acquiring no lease
+	standby bool
+	// health snapshots, taken by the event loop
+	healthRequests chan chan WorkerHealth
+	// diagnostic dumps of the shards, taken by the event loop
+	dumpRequests chan chan []ShardDump
+	// called with a health snapshot every HeartbeatIntervalMillis
+	heartbeat func(WorkerHealth)
 
 	randomSeed int64
 
 	shardStatus          map[string]*par.ShardStatus
 	shardStealInProgress bool
+	shardCache           *shardMetadataCache
+	leaseRenewer         *leaseRenewalBatcher
+	pollScheduler        *pollScheduler
+	getRecordsBudget     *getRecordsBudget
+	checkpointLimiter    *checkpointLimiter
+	recordsInFlight      *recordsInFlight
+	// the shards whose record processor could not be created, only accessed by the event loop
+	processorCreateFailures map[string]*processorCreateFailure
+	// polls the shards with ConsumerPoolSize goroutines, nil when every shard has a goroutine of its own
+	consumerPool *consumerPool
+	// signals the end of the shards consumed to the consumers of their child shards, nil when not configured
+	shardEnds *shardEndSignals
+	// coalesces the shard syncs and throttles the lease table writes caused by resharding, nil when not configured
+	resharding *reshardingThrottle
+	// switches the worker to enhanced fan-out when its polling consumers are throttled, nil when not configured
+	fanOutUpgrade *fanOutUpgrade
+	// the shards are consumed with enhanced fan-out, configured or after a switch
+	fanOut bool
+	// signaled when a shard consumer ends, with RejoinOnLeaseLoss, so that the event loop notices the loss of all leases
+	consumerEnds chan struct{}
+	// the number of consecutive shard syncs the shard of each orphaned lease was missing from, with CleanupOrphanedLeases
+	orphanedLeases map[string]int
+	// the running shard consumers by shard, read by Dump
+	consumersMux sync.Mutex
+	consumers    map[string]shardConsumer
+
+	// shard-level metrics enabled by the worker, disabled again on shutdown
+	enabledShardLevelMetrics []types.MetricsName
 }
 
 // NewWorker constructs a Worker instance for processing Kinesis stream data.
@@ -81,6 +155,10 @@ func NewWorker(factory kcl.IRecordProcessorFactory, kclConfig *config.KinesisCli
 		// Replaces nil with noop monitor service (not emitting any metrics).
 		mService = metrics.NoopMonitoringService{}
 	}
+	// a monitoring service shared by the workers of several streams is scoped to the stream of this worker
+	if scoper, ok := mService.(metrics.StreamScoper); ok {
+		mService = scoper.ForStream(kclConfig.StreamName)
+	}
 
 	return &Worker{
 		streamName:       kclConfig.StreamName,
@@ -129,52 +207,186 @@ func (w *Worker) Start() error {
 		// entering event loop
 		w.eventLoop()
 	}()
+
+	if w.leaseRenewer != nil {
+		w.waitGroup.Add(1)
+		go func() {
+			defer w.waitGroup.Done()
+			w.leaseRenewer.run()
+		}()
+	}
+
+	if w.consumerPool != nil {
+		w.consumerPool.start(w.waitGroup)
+	}
+
+	if w.heartbeat != nil {
+		w.waitGroup.Add(1)
+		go func() {
+			defer w.waitGroup.Done()
+			w.runHeartbeat(time.Duration(w.kclConfig.HeartbeatIntervalMillis) * time.Millisecond)
+		}()
+	}
+
+	if w.kclConfig.MaxWorkerLifetimeMillis > 0 {
+		go w.expireLifetime(time.Duration(w.kclConfig.MaxWorkerLifetimeMillis) * time.Millisecond)
+	}
+
+	if w.kclConfig.ReadinessTimeoutMillis > 0 {
+		go w.expireReadiness(time.Duration(w.kclConfig.ReadinessTimeoutMillis) * time.Millisecond)
+	}
 	return nil
 }
 
+// expireReadiness reports the worker ready once it has been started for the given timeout, unless it is already.
+func (w *Worker) expireReadiness(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-*w.stop:
+		return
+	case <-w.ready:
+		return
+	case <-timer.C:
+	}
+
+	w.kclConfig.Logger.Warnf("Worker %s did not complete its first lease acquisition within %s, reporting ready", w.workerID, timeout)
+	w.markReady()
+}
+
+// markReady closes the channel returned by Ready, once.
+func (w *Worker) markReady() {
+	w.readyOnce.Do(func() {
+		close(w.ready)
+	})
+}
+
+// expireLifetime shuts the worker down once it has been running for the given lifetime.
+func (w *Worker) expireLifetime(lifetime time.Duration) {
+	timer := time.NewTimer(lifetime)
+	defer timer.Stop()
+
+	select {
+	case <-*w.stop:
+		return
+	case <-timer.C:
+	}
+
+	w.kclConfig.Logger.Infof("Worker %s reached its maximum lifetime of %s, shutting down", w.workerID, lifetime)
+	if r, ok := w.mService.(metrics.WorkerLifetimeReporter); ok {
+		r.WorkerLifetimeExpired()
+	}
+	w.Shutdown()
+}
+
 // Shutdown signals worker to shut down. Worker will try initiating shutdown of all record processors.
 func (w *Worker) Shutdown() {
 	log := w.kclConfig.Logger
 	log.Infof("Worker shutdown in requested.")
 
+	w.shutdownMux.Lock()
+	defer w.shutdownMux.Unlock()
 	if w.done || w.stop == nil {
 		return
 	}
 
 	close(*w.stop)
+	w.cancel()
 	w.done = true
 	w.waitGroup.Wait()
 
+	if err := w.disableEnhancedMonitoring(); err != nil {
+		log.Errorf("Failed to disable enhanced monitoring on stream %s: %+v", w.streamName, err)
+	}
+
 	w.mService.Shutdown()
+	close(w.finished)
 	log.Infof("Worker loop is complete. Exiting from worker.")
 }
 
+// Done returns a channel which is closed once the worker has shut down, either through Shutdown or because it
+// reached MaxWorkerLifetimeMillis. The channel is only available once the worker has been started.
+func (w *Worker) Done() <-chan struct{} {
+	return w.finished
+}
+
+// Ready returns a channel which is closed once the worker has completed its first shard discovery and lease
+// acquisition pass, or ReadinessTimeoutMillis after it was started, e.g. to answer the readiness probes of
+// Kubernetes. The channel is only available once the worker has been started.
+func (w *Worker) Ready() <-chan struct{} {
+	return w.ready
+}
+
+// Rebalance runs a lease distribution pass right away, instead of waiting for the next shard sync, e.g. after
+// the fleet of workers has been scaled up or down. The pass syncs the shards, acquires the available leases (not
+// owned or expired) up to MaxLeasesForWorker and, when lease stealing is enabled, claims a shard from the most
+// loaded worker, which gives it up on its next lease renewal.
+//
+// The pass runs on the worker event loop, so it is safe to call concurrently with normal operation. Rebalance
+// blocks until the pass is complete.
+func (w *Worker) Rebalance() error {
+	return w.runOnEventLoop(w.rebalanceRequests)
+}
+
+// Promote ends the warm standby of a worker started with StartAsStandby: it acquires the available leases right
+// away, in a lease distribution pass like Rebalance, and on every shard sync from then on. Promote blocks until the
+// pass is complete. Promoting a worker which is not on standby has no effect.
+func (w *Worker) Promote() error {
+	return w.runOnEventLoop(w.promoteRequests)
+}
+
+// runOnEventLoop sends a request to the event loop and waits for its outcome.
+func (w *Worker) runOnEventLoop(requests chan chan error) error {
+	if w.stop == nil || requests == nil {
+		return ErrWorkerNotRunning
+	}
+
+	done := make(chan error, 1)
+	select {
+	case requests <- done:
+	case <-*w.stop:
+		return ErrWorkerNotRunning
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-*w.stop:
+		return ErrWorkerNotRunning
+	}
+}
+
 // initialize
 func (w *Worker) initialize() error {
 	log := w.kclConfig.Logger
 	log.Infof("Worker initialization in progress...")
 
+	if minInterval := w.kclConfig.MinLeaseRenewalIntervalMillis; minInterval > 0 && minInterval >= w.kclConfig.FailoverTimeMillis-w.kclConfig.ClockSkewToleranceMillis {
+		return fmt.Errorf("MinLeaseRenewalIntervalMillis %d would let leases expire, it must be lower than FailoverTimeMillis %d minus ClockSkewToleranceMillis %d",
+			minInterval, w.kclConfig.FailoverTimeMillis, w.kclConfig.ClockSkewToleranceMillis)
+	}
+
+	// credentials from a custom source are checked up front rather than on the first request
+	if w.kclConfig.CredentialsRefresh != nil {
+		if _, err := w.kclConfig.KinesisCredentials.Retrieve(context.TODO()); err != nil {
+			log.Errorf("Failed to retrieve credentials: %+v", err)
+			return fmt.Errorf("invalid CredentialsRefresh: %w", err)
+		}
+	}
+
 	// Create default Kinesis client
 	if w.kc == nil {
 		// create session for Kinesis
 		log.Infof("Creating Kinesis client")
 
-		resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-			if service == kinesis.ServiceID && len(w.kclConfig.KinesisEndpoint) > 0 {
-				return aws.Endpoint{
-					PartitionID:   "aws",
-					URL:           w.kclConfig.KinesisEndpoint,
-					SigningRegion: w.regionName,
-				}, nil
-			}
-			// returning EndpointNotFoundError will allow the service to fallback to it's default resolution
-			return aws.Endpoint{}, &aws.EndpointNotFoundError{}
-		})
+		resolver := config.NewEndpointResolver(kinesis.ServiceID, w.kclConfig.KinesisEndpoint, w.regionName)
 
 		cfg, err := awsConfig.LoadDefaultConfig(
 			context.TODO(),
 			awsConfig.WithRegion(w.regionName),
 			awsConfig.WithCredentialsProvider(w.kclConfig.KinesisCredentials),
+			awsConfig.WithHTTPClient(w.kclConfig.NewHTTPClient()),
 			awsConfig.WithEndpointResolverWithOptions(resolver),
 			awsConfig.WithRetryer(func() aws.Retryer {
 				return retry.AddWithMaxBackoffDelay(retry.NewStandard(), retry.DefaultMaxBackoff)
@@ -190,6 +402,11 @@ func (w *Worker) initialize() error {
 		log.Infof("Use custom Kinesis service.")
 	}
 
+	if err := w.checkStreamStatus(); err != nil {
+		log.Errorf("Failed to start on stream %s: %+v", w.streamName, err)
+		return err
+	}
+
 	// Create default dynamodb based checkpointer implementation
 	if w.checkpointer == nil {
 		log.Infof("Creating DynamoDB based checkpointer")
@@ -198,6 +415,7 @@ func (w *Worker) initialize() error {
 		log.Infof("Use custom checkpointer implementation.")
 	}
 
+	w.fanOut = w.kclConfig.EnableEnhancedFanOutConsumer
 	if w.kclConfig.EnableEnhancedFanOutConsumer {
 		log.Debugf("Enhanced fan-out is enabled")
 		w.consumerARN = w.kclConfig.EnhancedFanOutConsumerARN
@@ -211,11 +429,24 @@ func (w *Worker) initialize() error {
 		}
 	}
 
+	if w.kclConfig.EnableEnhancedMonitoring {
+		if err := w.enableEnhancedMonitoring(); err != nil {
+			log.Errorf("Failed to enable enhanced monitoring on stream %s: %+v", w.streamName, err)
+		}
+	}
+
 	err := w.mService.Init(w.kclConfig.ApplicationName, w.streamName, w.workerID)
 	if err != nil {
 		log.Errorf("Failed to start monitoring service: %+v", err)
 	}
 
+	if w.kclConfig.EnableStreamGenerations {
+		if err := w.scopeLeasesToStreamGeneration(); err != nil {
+			log.Errorf("Failed to read the generation of stream %s: %+v", w.streamName, err)
+			return err
+		}
+	}
+
 	log.Infof("Initializing Checkpointer")
 	if err := w.checkpointer.Init(); err != nil {
 		log.Errorf("Failed to start Checkpointer: %+v", err)
@@ -223,28 +454,142 @@ func (w *Worker) initialize() error {
 	}
 
 	w.shardStatus = make(map[string]*par.ShardStatus)
+	w.shardCache = newShardMetadataCache(time.Duration(w.kclConfig.ShardMetadataCacheTTLMillis)*time.Millisecond, w.listShards)
 
 	stopChan := make(chan struct{})
 	w.stop = &stopChan
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.rebalanceRequests = make(chan chan error)
+	w.promoteRequests = make(chan chan error)
+	w.standby = w.kclConfig.StartAsStandby
+	w.healthRequests = make(chan chan WorkerHealth)
+	w.dumpRequests = make(chan chan []ShardDump)
+	w.finished = make(chan struct{})
+	w.ready = make(chan struct{})
+	w.readyOnce = sync.Once{}
+	if w.kclConfig.RejoinOnLeaseLoss {
+		w.consumerEnds = make(chan struct{}, 1)
+	}
 
 	w.waitGroup = &sync.WaitGroup{}
 
+	if w.kclConfig.MaxConcurrentGetRecords > 0 {
+		w.pollScheduler = newPollScheduler(w.kclConfig.MaxConcurrentGetRecords, w.kclConfig.PrioritizePollingByLag)
+	}
+	if w.kclConfig.MaxGetRecordsCalls > 0 {
+		w.getRecordsBudget = newGetRecordsBudget(w.kclConfig.MaxGetRecordsCalls,
+			time.Duration(w.kclConfig.GetRecordsBudgetWindowMillis)*time.Millisecond)
+	}
+	if w.kclConfig.MaxConcurrentCheckpoints > 0 {
+		w.checkpointLimiter = newCheckpointLimiter(w.kclConfig.MaxConcurrentCheckpoints)
+	}
+	if w.kclConfig.MaxRecordsInFlight > 0 {
+		w.recordsInFlight = newRecordsInFlight(w.kclConfig.MaxRecordsInFlight)
+	}
+
+	if w.kclConfig.FanOutThrottleThreshold > 0 && !w.kclConfig.EnableEnhancedFanOutConsumer {
+		w.fanOutUpgrade = newFanOutUpgrade(w.kclConfig.FanOutThrottleThreshold,
+			time.Duration(w.kclConfig.FanOutThrottleWindowMillis)*time.Millisecond)
+	}
+
+	if w.kclConfig.ConsumerPoolSize > 0 && !w.kclConfig.EnableEnhancedFanOutConsumer {
+		w.consumerPool = newConsumerPool(w.kclConfig.ConsumerPoolSize, w.stop)
+	}
+
+	if w.kclConfig.CoordinateSelfOwnedParentShards {
+		w.shardEnds = newShardEndSignals()
+	}
+
+	if w.kclConfig.ReshardingSyncIntervalMillis > 0 || w.kclConfig.MaxReshardingLeaseWritesPerSecond > 0 {
+		w.resharding = newReshardingThrottle(w.kclConfig.MaxReshardingLeaseWritesPerSecond, w.stop)
+	}
+
+	if w.kclConfig.EnableBatchedLeaseRenewal {
+		if renewer, ok := w.checkpointer.(chk.BatchLeaseRenewer); ok {
+			w.leaseRenewer = newLeaseRenewalBatcher(renewer, leaseRenewalBatchInterval, w.stop)
+		} else {
+			log.Warnf("Checkpointer does not support batched lease renewal, renewing leases one by one")
+		}
+	}
+
 	log.Infof("Initialization complete.")
 
 	return nil
 }
 
-// newShardConsumer creates shard consumer for the specified shard
-func (w *Worker) newShardConsumer(shard *par.ShardStatus) shardConsumer {
+// checkStreamStatus checks that the stream can be consumed: ACTIVE, or UPDATING when the StreamStatusPolicy allows it.
+// The shards of a stream being resharded may be seen in transient states, which the shard syncs catch up with. The
+// ARN of the stream is kept for the shard consumers.
+func (w *Worker) checkStreamStatus() error {
+	summary, err := w.kc.DescribeStreamSummary(context.TODO(), &kinesis.DescribeStreamSummaryInput{StreamName: aws.String(w.streamName)})
+	if err != nil {
+		return err
+	}
+
+	var status types.StreamStatus
+	if summary.StreamDescriptionSummary != nil {
+		status = summary.StreamDescriptionSummary.StreamStatus
+		w.streamARN = aws.ToString(summary.StreamDescriptionSummary.StreamARN)
+	}
+	switch {
+	case status == types.StreamStatusActive:
+		return nil
+	case status == types.StreamStatusUpdating && w.kclConfig.StreamStatusPolicy == config.AllowUpdatingStream:
+		w.kclConfig.Logger.Warnf("Stream %s is %s, e.g. being resharded, starting anyway", w.streamName, status)
+		return nil
+	default:
+		return fmt.Errorf("stream %s is %s, not ACTIVE", w.streamName, status)
+	}
+}
+
+// scopeLeasesToStreamGeneration scopes the leases of the checkpointer to the current generation of the stream, its
+// creation time.
+func (w *Worker) scopeLeasesToStreamGeneration() error {
+	scoper, ok := w.checkpointer.(chk.StreamGenerationScoper)
+	if !ok {
+		w.kclConfig.Logger.Warnf("Checkpointer does not support stream generations, the leases are not scoped to one")
+		return nil
+	}
+
+	summary, err := w.kc.DescribeStreamSummary(context.TODO(), &kinesis.DescribeStreamSummaryInput{StreamName: aws.String(w.streamName)})
+	if err != nil {
+		return err
+	}
+	generation := aws.ToTime(summary.StreamDescriptionSummary.StreamCreationTimestamp).UTC().Format(time.RFC3339Nano)
+	w.kclConfig.Logger.Infof("Scoping the leases to generation %s of stream %s", generation, w.streamName)
+	scoper.SetStreamGeneration(generation)
+	return nil
+}
+
+// newShardConsumer creates shard consumer for the specified shard, handing its records to the given record processor
+func (w *Worker) newShardConsumer(shard *par.ShardStatus, recordProcessor kcl.IRecordProcessor) shardConsumer {
+	// The shard consumer logs with the shard it is working on. The configuration is copied so that the
+	// logger is not shared with the other consumers.
+	kclConfig := *w.kclConfig
+	kclConfig.Logger = w.kclConfig.Logger.WithFields(logger.Fields{
+		logger.StreamNameKey: w.streamName,
+		logger.WorkerIDKey:   w.workerID,
+		logger.ShardIDKey:    shard.ID,
+	})
+	if interval := w.kclConfig.ErrorLogSummaryIntervalMillis; interval > 0 {
+		kclConfig.Logger = logger.NewDedupLogger(kclConfig.Logger, time.Duration(interval)*time.Millisecond)
+	}
+
 	common := commonShardConsumer{
-		shard:           shard,
-		kc:              w.kc,
-		checkpointer:    w.checkpointer,
-		recordProcessor: w.processorFactory.CreateProcessor(),
-		kclConfig:       w.kclConfig,
-		mService:        w.mService,
+		shard:             shard,
+		kc:                w.kc,
+		checkpointer:      w.checkpointer,
+		recordProcessor:   recordProcessor,
+		kclConfig:         &kclConfig,
+		mService:          w.mService,
+		shardCache:        w.shardCache,
+		leaseRenewer:      w.leaseRenewer,
+		resharding:        w.resharding,
+		shardEnds:         w.shardEnds,
+		checkpointLimiter: w.checkpointLimiter,
+		leaseAcquiredTime: time.Now(),
 	}
-	if w.kclConfig.EnableEnhancedFanOutConsumer {
+	if w.fanOut {
 		w.kclConfig.Logger.Infof("Start enhanced fan-out shard consumer for shard: %v", shard.ID)
 		return &FanOutShardConsumer{
 			commonShardConsumer: common,
@@ -257,9 +602,18 @@ func (w *Worker) newShardConsumer(shard *par.ShardStatus) shardConsumer {
 	return &PollingShardConsumer{
 		commonShardConsumer: common,
 		streamName:          w.streamName,
+		streamARN:           w.streamARN,
 		consumerID:          w.workerID,
 		stop:                w.stop,
+		ctx:                 w.ctx,
 		mService:            w.mService,
+		blockOnTPSExceeded:  w.kclConfig.BlockOnTPSExceeded,
+		slidingWindowTPS:    w.kclConfig.SlidingWindowTPSLimit,
+		pollScheduler:       w.pollScheduler,
+		getRecordsBudget:    w.getRecordsBudget,
+		recordsInFlight:     w.recordsInFlight,
+		fanOutUpgrade:       w.fanOutUpgrade,
+		rand:                newShardRand(w.randomSeed, shard.ID),
 	}
 }
 
@@ -268,19 +622,101 @@ func (w *Worker) eventLoop() {
 	log := w.kclConfig.Logger
 
 	var foundShards int
+	var shardSyncSleep int
+	// kept across the requests served in between, so that they do not postpone the shard sync
+	var shardSyncTimer <-chan time.Time
+
+	// shard closures, coalesced into at most one shard sync per ReshardingSyncIntervalMillis
+	var shardClosures <-chan struct{}
+	var reshardingSyncTimer <-chan time.Time
+	var lastReshardingSync time.Time
+
+	// rejoins after the loss of all the leases, at most one per rejoinInterval
+	var rejoinTimer <-chan time.Time
+	var lastRejoin time.Time
+	// requests to switch to enhanced fan-out, until switched, and the shards handed over by the polling consumers
+	var fanOutRequests, fanOutHandOvers <-chan struct{}
+	if w.fanOutUpgrade != nil {
+		fanOutRequests = w.fanOutUpgrade.requests
+		fanOutHandOvers = w.fanOutUpgrade.handOvers
+	}
+	reshardingSyncInterval := time.Duration(w.kclConfig.ReshardingSyncIntervalMillis) * time.Millisecond
+	if w.resharding != nil && reshardingSyncInterval > 0 {
+		shardClosures = w.resharding.closures
+	}
+
 	for {
-		// Add [-50%, +50%] random jitter to ShardSyncIntervalMillis. When multiple workers
-		// starts at the same time, this decreases the probability of them calling
-		// kinesis.DescribeStream at the same time, and hit the hard-limit on aws API calls.
-		// On average the period remains the same so that doesn't affect behavior.
-		rnd, _ := rand.Int(rand.Reader, big.NewInt(int64(w.kclConfig.ShardSyncIntervalMillis)))
-		shardSyncSleep := w.kclConfig.ShardSyncIntervalMillis/2 + int(rnd.Int64())
+		if shardSyncTimer == nil {
+			// Add [-50%, +50%] random jitter to ShardSyncIntervalMillis. When multiple workers
+			// starts at the same time, this decreases the probability of them calling
+			// kinesis.DescribeStream at the same time, and hit the hard-limit on aws API calls.
+			// On average the period remains the same so that doesn't affect behavior.
+			rnd, _ := rand.Int(rand.Reader, big.NewInt(int64(w.kclConfig.ShardSyncIntervalMillis)))
+			shardSyncSleep = w.kclConfig.ShardSyncIntervalMillis/2 + int(rnd.Int64())
+			shardSyncTimer = time.After(time.Duration(shardSyncSleep) * time.Millisecond)
+		}
 
 		select {
 		case <-*w.stop:
 			log.Infof("Shutting down...")
 			return
-		case <-time.After(time.Duration(shardSyncSleep) * time.Millisecond):
+		case done := <-w.rebalanceRequests:
+			log.Infof("Rebalancing leases on demand")
+			done <- w.rebalancePass()
+			continue
+		case done := <-w.promoteRequests:
+			if !w.standby {
+				done <- nil
+				continue
+			}
+			log.Infof("Promoting worker %s out of standby", w.workerID)
+			w.standby = false
+			done <- w.rebalancePass()
+			continue
+		case health := <-w.healthRequests:
+			health <- w.health()
+			continue
+		case dump := <-w.dumpRequests:
+			dump <- w.dumpShards()
+			continue
+		case <-w.consumerEnds:
+			if rejoinTimer == nil {
+				rejoinTimer = time.After(time.Until(lastRejoin.Add(rejoinInterval)))
+			}
+			continue
+		case <-rejoinTimer:
+			rejoinTimer = nil
+			if w.rejoinIfLeasesLost() {
+				lastRejoin = time.Now()
+			}
+			continue
+		case <-fanOutRequests:
+			if !w.upgradeToFanOut() {
+				continue
+			}
+			fanOutRequests = nil
+			continue
+		case <-fanOutHandOvers:
+			log.Infof("Taking the shards handed over to enhanced fan-out back")
+			if err := w.rebalancePass(); err != nil {
+				log.Errorf("Error taking the shards handed over to enhanced fan-out back: %+v", err)
+			}
+			continue
+		case <-shardClosures:
+			if reshardingSyncTimer == nil {
+				reshardingSyncTimer = time.After(time.Until(lastReshardingSync.Add(reshardingSyncInterval)))
+			}
+			continue
+		case <-reshardingSyncTimer:
+			reshardingSyncTimer = nil
+			lastReshardingSync = time.Now()
+			closedShards := w.resharding.takeClosedShards()
+			if r, ok := w.mService.(metrics.ReshardingReporter); ok {
+				r.ReshardingEventsPerInterval(closedShards)
+			}
+			log.Infof("Syncing shards after %d shards closed", closedShards)
+		case <-shardSyncTimer:
+			shardSyncTimer = nil
 			log.Debugf("Waited %d ms to sync shards...", shardSyncSleep)
 		}
 
@@ -296,22 +732,95 @@ func (w *Worker) eventLoop() {
 			log.Infof("Found %d shards", foundShards)
 		}
 
-		// Count the number of leases held by this worker excluding the processed shard
-		counter := 0
-		for _, shard := range w.shardStatus {
-			if shard.GetLeaseOwner() == w.workerID && shard.GetCheckpoint() != chk.ShardEnd {
-				counter++
+		w.acquireLeases()
+		w.markReady()
+
+		if w.kclConfig.ShutdownWhenNoOpenShards && w.streamHasNoOpenShards() {
+			log.Infof("Stream %s has no open shard left to consume, shutting down", w.streamName)
+			// Shutdown waits for the event loop to return
+			go w.Shutdown()
+			continue
+		}
+
+		if w.kclConfig.EnableLeaseStealing {
+			err = w.rebalance()
+			if err != nil {
+				log.Warnf("Error in rebalance: %+v", err)
 			}
 		}
+	}
+}
 
-		// max number of lease has not been reached yet
-		if counter < w.kclConfig.MaxLeasesForWorker {
-			for _, shard := range w.shardStatus {
-				// already owner of the shard
-				if shard.GetLeaseOwner() == w.workerID {
-					continue
-				}
+// streamHasNoOpenShards returns true if the worker has nothing left to consume: it holds no lease and every shard known
+// is completed. No shard being listed may be a transient failure of the shard discovery rather than a stream with no
+// open shard, so the open shard count of DescribeStreamSummary has the final say.
+func (w *Worker) streamHasNoOpenShards() bool {
+	log := w.kclConfig.Logger
+
+	if w.heldLeases() > 0 {
+		return false
+	}
+	for _, shard := range w.shardStatus {
+		if shard.GetCheckpoint() != chk.ShardEnd {
+			return false
+		}
+	}
+
+	summary, err := w.kc.DescribeStreamSummary(context.TODO(), &kinesis.DescribeStreamSummaryInput{StreamName: aws.String(w.streamName)})
+	if err != nil {
+		log.Warnf("Cannot verify that stream %s has no open shard: %+v", w.streamName, err)
+		return false
+	}
+	openShards := aws.ToInt32(summary.StreamDescriptionSummary.OpenShardCount)
+	if openShards > 0 {
+		log.Warnf("No open shard listed for stream %s, which has %d open shards: the listing is not trusted", w.streamName, openShards)
+		return false
+	}
+	return true
+}
+
+// rebalancePass syncs the shards and acquires every available lease, then claims a shard to steal if enabled.
+func (w *Worker) rebalancePass() error {
+	if err := w.syncShard(); err != nil {
+		return err
+	}
+
+	// acquireLeases stops once MaxLeasesForWorker leases are held
+	for w.acquireLeases() {
+	}
+	w.markReady()
+
+	if w.kclConfig.EnableLeaseStealing {
+		return w.rebalance()
+	}
+	return nil
+}
 
+// acquireLeases takes the lease on one more shard, and starts consuming it, unless the worker already holds
+// MaxLeasesForWorker leases. It returns true if a lease was acquired.
+func (w *Worker) acquireLeases() bool {
+	log := w.kclConfig.Logger
+
+	// a warm standby acquires no lease until promoted
+	if w.standby {
+		return false
+	}
+
+	// max number of lease has not been reached yet
+	if w.heldLeases() < w.kclConfig.MaxLeasesForWorker {
+		for _, shard := range w.shardStatus {
+			// already owner of the shard
+			if shard.GetLeaseOwner() == w.workerID {
+				continue
+			}
+
+			// the record processor of the shard could not be created lately
+			if w.processorCreateHeld(shard.ID) {
+				continue
+			}
+
+			// SHARD_END is final: the checkpoint of a shard known to be completed is not read again.
+			if shard.GetCheckpoint() != chk.ShardEnd {
 				err := w.checkpointer.FetchCheckpoint(shard)
 				if err != nil {
 					// checkpoint may not exist yet is not an error condition.
@@ -321,66 +830,155 @@ func (w *Worker) eventLoop() {
 						continue
 					}
 				}
+			}
 
-				// The shard is closed and we have processed all records
-				if shard.GetCheckpoint() == chk.ShardEnd {
-					continue
-				}
+			// The shard is closed and we have processed all records. Until its children are leased, the shard is
+			// taken again: its consumer ends at once, and signals the consumers of the children waiting on it.
+			if shard.GetCheckpoint() == chk.ShardEnd && w.childShardsLeased(shard) {
+				continue
+			}
 
-				var stealShard bool
-				if w.kclConfig.EnableLeaseStealing && shard.ClaimRequest != "" {
-					upcomingStealingInterval := time.Now().UTC().Add(time.Duration(w.kclConfig.LeaseStealingIntervalMillis) * time.Millisecond)
-					if shard.GetLeaseTimeout().Before(upcomingStealingInterval) && !shard.IsClaimRequestExpired(w.kclConfig) {
-						if shard.ClaimRequest == w.workerID {
-							stealShard = true
-							log.Debugf("Stealing shard: %s", shard.ID)
-						} else {
-							log.Debugf("Shard being stolen: %s", shard.ID)
-							continue
-						}
+			var stealShard bool
+			if w.kclConfig.EnableLeaseStealing && shard.ClaimRequest != "" {
+				upcomingStealingInterval := time.Now().UTC().Add(time.Duration(w.kclConfig.LeaseStealingIntervalMillis) * time.Millisecond)
+				if shard.GetLeaseTimeout().Before(upcomingStealingInterval) && !shard.IsClaimRequestExpired(w.kclConfig) {
+					if shard.ClaimRequest == w.workerID {
+						stealShard = true
+						log.Debugf("Stealing shard: %s", shard.ID)
+					} else {
+						log.Debugf("Shard being stolen: %s", shard.ID)
+						continue
 					}
 				}
+			}
 
-				err = w.checkpointer.GetLease(shard, w.workerID)
-				if err != nil {
-					// cannot get lease on the shard
-					if !errors.As(err, &chk.ErrLeaseNotAcquired{}) {
-						log.Errorf("Cannot get lease: %+v", err)
-					}
-					continue
+			err := w.checkpointer.GetLease(shard, w.workerID)
+			if err != nil {
+				// cannot get lease on the shard
+				if !errors.As(err, &chk.ErrLeaseNotAcquired{}) {
+					log.Errorf("Cannot get lease: %+v", err)
 				}
+				continue
+			}
 
-				if stealShard {
-					log.Debugf("Successfully stole shard: %+v", shard.ID)
-					w.shardStealInProgress = false
-				}
+			if stealShard {
+				log.Debugf("Successfully stole shard: %+v", shard.ID)
+				w.shardStealInProgress = false
+			}
 
-				// log metrics on got lease
-				w.mService.LeaseGained(shard.ID)
-				w.waitGroup.Add(1)
-				go func(shard *par.ShardStatus) {
-					defer w.waitGroup.Done()
-					if err := w.newShardConsumer(shard).getRecords(); err != nil {
-						log.Errorf("Error in getRecords: %+v", err)
+			recordProcessor, err := w.createProcessor(shard.ID)
+			if err != nil {
+				w.processorCreateFailed(shard, err)
+				continue
+			}
+			delete(w.processorCreateFailures, shard.ID)
+
+			// log metrics on got lease
+			w.mService.LeaseGained(shard.ID)
+			w.waitGroup.Add(1)
+			shardEnd := w.shardEnds.consuming(shard.ID)
+			consumer := w.newShardConsumer(shard, recordProcessor)
+			w.addConsumer(shard.ID, consumer)
+			done := func(shard *par.ShardStatus, err error) {
+				defer w.waitGroup.Done()
+				w.removeConsumer(shard.ID, consumer)
+				w.shardEnds.finished(shard.ID, shardEnd, shard.GetCheckpoint() == chk.ShardEnd)
+				if err != nil {
+					log.Errorf("Error in getRecords: %+v", err)
+				}
+				if _, polling := consumer.(*PollingShardConsumer); polling {
+					w.fanOutUpgrade.handedOver()
+				}
+				if w.consumerEnds != nil {
+					select {
+					case w.consumerEnds <- struct{}{}:
+					default:
 					}
-				}(shard)
-				// exit from for loop and not to grab more shard for now.
-				break
+				}
 			}
+			if polling, ok := consumer.(*PollingShardConsumer); ok && w.consumerPool != nil {
+				w.consumerPool.submit(polling, func(err error) {
+					done(shard, err)
+				})
+				return true
+			}
+			go func(shard *par.ShardStatus) {
+				done(shard, consumer.getRecords())
+			}(shard)
+			// exit from for loop and not to grab more shard for now.
+			return true
 		}
+	}
+	return false
+}
 
-		if w.kclConfig.EnableLeaseStealing {
-			err = w.rebalance()
-			if err != nil {
-				log.Warnf("Error in rebalance: %+v", err)
-			}
+// childShardsLeased returns whether the known child shards of the shard are all leased, i.e. checkpointed or owned by a
+// worker. The lease owner of a child not known to be leased is read from the lease table.
+func (w *Worker) childShardsLeased(parent *par.ShardStatus) bool {
+	for _, shard := range w.shardStatus {
+		if shard.ParentShardId != parent.ID || shard.GetCheckpoint() != "" || shard.GetLeaseOwner() != "" {
+			continue
+		}
+		owner, err := w.checkpointer.GetLeaseOwner(shard.ID)
+		if err != nil && !errors.Is(err, chk.NoLeaseOwnerErr) {
+			w.kclConfig.Logger.Warnf("Couldn't get the lease owner of shard %s: %+v", shard.ID, err)
+		}
+		if owner == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// heldLeases returns the number of leases held by the worker, excluding the shards consumed to their end.
+func (w *Worker) heldLeases() int {
+	held := 0
+	for _, shard := range w.shardStatus {
+		if shard.GetLeaseOwner() == w.workerID && shard.GetCheckpoint() != chk.ShardEnd {
+			held++
+		}
+	}
+	return held
+}
+
+// rejoinIfLeasesLost runs a lease distribution pass right away when the worker holds no lease anymore while the stream
+// has shards left to consume, e.g. after all its leases expired during a DynamoDB outage. It returns true if the worker
+// rejoined.
+func (w *Worker) rejoinIfLeasesLost() bool {
+	log := w.kclConfig.Logger
+
+	if w.heldLeases() > 0 {
+		return false
+	}
+	consumable := false
+	for _, shard := range w.shardStatus {
+		if shard.GetCheckpoint() != chk.ShardEnd {
+			consumable = true
+			break
 		}
 	}
+	if !consumable {
+		return false
+	}
+
+	log.Warnf("Worker %s lost all its leases, reacquiring leases right away", w.workerID)
+	if r, ok := w.mService.(metrics.WorkerRejoinReporter); ok {
+		r.WorkerRejoined()
+	}
+	if err := w.rebalancePass(); err != nil {
+		log.Errorf("Error reacquiring leases: %+v", err)
+	}
+	return true
 }
 
 func (w *Worker) rebalance() error {
 	log := w.kclConfig.Logger
 
+	// nor does it steal any
+	if w.standby {
+		return nil
+	}
+
 	workers, err := w.checkpointer.ListActiveWorkers(w.shardStatus)
 	if err != nil {
 		log.Debugf("Error listing workers. workerID: %s. Error: %+v ", w.workerID, err)
@@ -390,7 +988,7 @@ func (w *Worker) rebalance() error {
 	// Only attempt to steal one shard at time, to allow for linear convergence
 	if w.shardStealInProgress {
 		shardInfo := make(map[string]bool)
-		err := w.getShardIDs("", shardInfo)
+		err := w.getShardIDs(shardInfo)
 		if err != nil {
 			return err
 		}
@@ -465,62 +1063,129 @@ func (w *Worker) rebalance() error {
 
 // List all shards and store them into shardStatus table
 // If shard has been removed, need to exclude it from cached shard status.
-func (w *Worker) getShardIDs(nextToken string, shardInfo map[string]bool) error {
+// shardInfo is filled with every shard of the stream, set to false for the shards rejected by the shard filter.
+func (w *Worker) getShardIDs(shardInfo map[string]bool) error {
 	log := w.kclConfig.Logger
 
-	args := &kinesis.ListShardsInput{}
-
-	// When you have a nextToken, you can't set the streamName
-	if nextToken != "" {
-		args.NextToken = aws.String(nextToken)
-	} else {
-		args.StreamName = aws.String(w.streamName)
-	}
-
-	listShards, err := w.kc.ListShards(context.TODO(), args)
+	shards, err := w.listShards()
 	if err != nil {
-		log.Errorf("Error in ListShards: %s Error: %+v Request: %s", w.streamName, err, args)
 		return err
 	}
 
-	for _, s := range listShards.Shards {
+	for _, s := range shards {
+		// shards filtered out are neither tracked nor leased
+		if !w.acceptShard(s) {
+			log.Debugf("Skipping shard %s rejected by shard filter", *s.ShardId)
+			shardInfo[*s.ShardId] = false
+			continue
+		}
+
 		// record avail shardId from fresh reading from Kinesis
 		shardInfo[*s.ShardId] = true
 
-		// found new shard
-		if _, ok := w.shardStatus[*s.ShardId]; !ok {
-			log.Infof("Found new shard with id %s", *s.ShardId)
-			w.shardStatus[*s.ShardId] = &par.ShardStatus{
-				ID:                     *s.ShardId,
-				ParentShardId:          aws.ToString(s.ParentShardId),
-				Mux:                    &sync.RWMutex{},
-				StartingSequenceNumber: aws.ToString(s.SequenceNumberRange.StartingSequenceNumber),
-				EndingSequenceNumber:   aws.ToString(s.SequenceNumberRange.EndingSequenceNumber),
+		// A shard already known is only updated with its ending sequence number. It does not tell that the
+		// shard is closed: the nil shard iterator returned by GetRecords does, and a shard closed that way is
+		// not reopened by a listing lagging behind.
+		if shard, ok := w.shardStatus[*s.ShardId]; ok {
+			endingSequenceNumber := aws.ToString(s.SequenceNumberRange.EndingSequenceNumber)
+			if endingSequenceNumber != "" {
+				shard.Mux.Lock()
+				shard.EndingSequenceNumber = endingSequenceNumber
+				shard.Mux.Unlock()
+			} else if shard.IsClosed() {
+				log.Debugf("Shard %s is listed open but has been closed according to GetRecords", *s.ShardId)
 			}
+			continue
 		}
+
+		// found new shard
+		log.Infof("Found new shard with id %s", *s.ShardId)
+		w.shardStatus[*s.ShardId] = &par.ShardStatus{
+			ID:                     *s.ShardId,
+			ParentShardId:          aws.ToString(s.ParentShardId),
+			Mux:                    &sync.RWMutex{},
+			StartingSequenceNumber: aws.ToString(s.SequenceNumberRange.StartingSequenceNumber),
+			EndingSequenceNumber:   aws.ToString(s.SequenceNumberRange.EndingSequenceNumber),
+		}
+	}
+
+	if w.shardCache.refresh(shards) {
+		log.Infof("Resharding detected on stream %s, shard metadata cache has been refreshed", w.streamName)
 	}
 
-	if listShards.NextToken != nil {
-		err := w.getShardIDs(aws.ToString(listShards.NextToken), shardInfo)
+	return nil
+}
+
+// acceptShard checks the shard hash key range against the configured shard filter.
+func (w *Worker) acceptShard(s types.Shard) bool {
+	if w.kclConfig.ShardFilter == nil || s.HashKeyRange == nil {
+		return true
+	}
+
+	start, ok1 := new(big.Int).SetString(aws.ToString(s.HashKeyRange.StartingHashKey), 10)
+	end, ok2 := new(big.Int).SetString(aws.ToString(s.HashKeyRange.EndingHashKey), 10)
+	if !ok1 || !ok2 {
+		// Rather consume an irrelevant shard than miss records.
+		w.kclConfig.Logger.Warnf("Invalid hash key range of shard %s: %+v", aws.ToString(s.ShardId), s.HashKeyRange)
+		return true
+	}
+
+	return w.kclConfig.ShardFilter.Accept(aws.ToString(s.ShardId), start, end)
+}
+
+// listShards reads all shards of the stream from Kinesis without touching the cached shard status.
+func (w *Worker) listShards() ([]types.Shard, error) {
+	log := w.kclConfig.Logger
+
+	var shards []types.Shard
+	args := &kinesis.ListShardsInput{StreamName: aws.String(w.streamName)}
+	for retries := 0; ; {
+		listShards, err := w.kc.ListShards(context.TODO(), args)
+		var expiredTokenErr *types.ExpiredNextTokenException
+		if errors.As(err, &expiredTokenErr) && retries < w.kclConfig.ListShardsExpiredTokenRetries {
+			retries++
+			// the shards are listed in order, resume after the last one listed
+			args = &kinesis.ListShardsInput{StreamName: aws.String(w.streamName)}
+			if len(shards) > 0 {
+				args.ExclusiveStartShardId = shards[len(shards)-1].ShardId
+			}
+			log.Warnf("ListShards pagination token of stream %s expired, resuming after shard %q, retryCount: %d",
+				w.streamName, aws.ToString(args.ExclusiveStartShardId), retries)
+			continue
+		}
 		if err != nil {
 			log.Errorf("Error in ListShards: %s Error: %+v Request: %s", w.streamName, err, args)
-			return err
+			return nil, err
 		}
-	}
+		shards = append(shards, listShards.Shards...)
 
-	return nil
+		if listShards.NextToken == nil {
+			return shards, nil
+		}
+
+		// When you have a nextToken, you can't set the streamName
+		args = &kinesis.ListShardsInput{NextToken: listShards.NextToken}
+	}
 }
 
 // syncShard to sync the cached shard info with actual shard info from Kinesis
 func (w *Worker) syncShard() error {
 	log := w.kclConfig.Logger
 	shardInfo := make(map[string]bool)
-	err := w.getShardIDs("", shardInfo)
+	err := w.getShardIDs(shardInfo)
 
 	if err != nil {
 		return err
 	}
 
+	// An empty listing, e.g. of a stream being recreated, is not trusted to remove every lease.
+	if len(shardInfo) == 0 {
+		if len(w.shardStatus) > 0 {
+			log.Warnf("No shard listed for stream %s, keeping the %d shards known", w.streamName, len(w.shardStatus))
+		}
+		return nil
+	}
+
 	for _, shard := range w.shardStatus {
 		// The cached shard no longer existed, remove it.
 		if _, ok := shardInfo[shard.ID]; !ok {
@@ -528,11 +1193,60 @@ func (w *Worker) syncShard() error {
 			delete(w.shardStatus, shard.ID)
 			// remove the shard entry in dynamoDB as well
 			// Note: syncShard runs periodically. we don't need to do anything in case of error here.
+			if w.resharding != nil && !w.resharding.waitForWrite() {
+				return nil
+			}
 			if err := w.checkpointer.RemoveLeaseInfo(shard.ID); err != nil {
 				log.Errorf("Failed to remove shard lease info: %s Error: %+v", shard.ID, err)
 			}
 		}
 	}
 
+	if w.kclConfig.CleanupOrphanedLeases {
+		w.cleanupOrphanedLeases(shardInfo)
+	}
 	return nil
 }
+
+// cleanupOrphanedLeases removes the leases of the shards missing from the stream for OrphanedLeaseMinSyncs consecutive
+// shard syncs, e.g. left over by a stream deleted and recreated with the same name. Only the leases written for the
+// stream are considered, so that the leases of other streams sharing the lease table are kept.
+func (w *Worker) cleanupOrphanedLeases(shardInfo map[string]bool) {
+	log := w.kclConfig.Logger
+
+	lister, ok := w.checkpointer.(chk.LeaseBackup)
+	if !ok {
+		log.Warnf("Cannot clean up orphaned leases, the checkpointer does not list the leases")
+		return
+	}
+	leases, err := lister.ListLeases()
+	if err != nil {
+		log.Errorf("Failed to list leases for the orphaned leases cleanup: %+v", err)
+		return
+	}
+
+	orphaned := make(map[string]int)
+	for _, lease := range leases {
+		if lease.StreamName != w.streamName {
+			continue
+		}
+		if _, ok := shardInfo[lease.ShardID]; ok {
+			continue
+		}
+		missed := w.orphanedLeases[lease.ShardID] + 1
+		if missed < w.kclConfig.OrphanedLeaseMinSyncs {
+			orphaned[lease.ShardID] = missed
+			continue
+		}
+
+		if w.resharding != nil && !w.resharding.waitForWrite() {
+			break
+		}
+		log.Infof("Removing lease of shard %s, missing from stream %s for %d shard syncs", lease.ShardID, w.streamName, missed)
+		if err := w.checkpointer.RemoveLeaseInfo(lease.ShardID); err != nil {
+			log.Errorf("Failed to remove orphaned lease of shard %s: %+v", lease.ShardID, err)
+			orphaned[lease.ShardID] = missed
+		}
+	}
+	w.orphanedLeases = orphaned
+}
@@ -0,0 +1,1592 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/stretchr/testify/assert"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	kcl "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+// fakeKinesis serves a fixed set of open shards without any record.
+type fakeKinesis struct {
+	mux    sync.Mutex
+	shards []types.Shard
+	// status of the stream, ACTIVE if not set
+	streamStatus types.StreamStatus
+
+	// shard-level metrics enabled on the stream and the metrics passed to DisableEnhancedMonitoring
+	shardLevelMetrics map[types.MetricsName]bool
+	disabledMetrics   []types.MetricsName
+
+	// shards for which GetRecords returns no next shard iterator
+	closedShards map[string]bool
+	// records returned, once, by the next GetRecords of a shard
+	pendingRecords map[string][]types.Record
+	// error returned by every GetRecords call, if set
+	getRecordsErr error
+	// MillisBehindLatest returned by every GetRecords call
+	millisBehindLatest int64
+	// the Limit and the StreamARN of every GetRecords call
+	getRecordsLimits     []int32
+	getRecordsStreamARNs []string
+	// number of GetShardIterator calls, and the last one
+	shardIteratorRequests    int
+	lastShardIteratorRequest *kinesis.GetShardIteratorInput
+	// number of GetShardIterator calls returning no shard iterator
+	nilShardIterators int
+	// ARN of the registered enhanced fan-out consumer, and the subscriptions to the shards
+	consumerARN   string
+	subscriptions []*kinesis.SubscribeToShardInput
+}
+
+func newFakeKinesis(shardIDs ...string) *fakeKinesis {
+	k := &fakeKinesis{
+		shardLevelMetrics: map[types.MetricsName]bool{},
+		closedShards:      map[string]bool{},
+		pendingRecords:    map[string][]types.Record{},
+	}
+	for _, id := range shardIDs {
+		k.shards = append(k.shards, types.Shard{
+			ShardId:             aws.String(id),
+			SequenceNumberRange: &types.SequenceNumberRange{StartingSequenceNumber: aws.String("0")},
+		})
+	}
+	return k
+}
+
+func (k *fakeKinesis) ListShards(_ context.Context, _ *kinesis.ListShardsInput, _ ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	return &kinesis.ListShardsOutput{Shards: append([]types.Shard(nil), k.shards...)}, nil
+}
+
+func (k *fakeKinesis) GetShardIterator(_ context.Context, params *kinesis.GetShardIteratorInput, _ ...func(*kinesis.Options)) (*kinesis.GetShardIteratorOutput, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.shardIteratorRequests++
+	k.lastShardIteratorRequest = params
+	if k.nilShardIterators > 0 {
+		k.nilShardIterators--
+		return &kinesis.GetShardIteratorOutput{}, nil
+	}
+	return &kinesis.GetShardIteratorOutput{ShardIterator: params.ShardId}, nil
+}
+
+// GetRecords uses the shard ID as shard iterator.
+func (k *fakeKinesis) GetRecords(_ context.Context, params *kinesis.GetRecordsInput, _ ...func(*kinesis.Options)) (*kinesis.GetRecordsOutput, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.getRecordsLimits = append(k.getRecordsLimits, aws.ToInt32(params.Limit))
+	k.getRecordsStreamARNs = append(k.getRecordsStreamARNs, aws.ToString(params.StreamARN))
+	if k.getRecordsErr != nil {
+		return nil, k.getRecordsErr
+	}
+	shardID := aws.ToString(params.ShardIterator)
+	records := k.pendingRecords[shardID]
+	delete(k.pendingRecords, shardID)
+	if k.closedShards[shardID] {
+		return &kinesis.GetRecordsOutput{Records: records, MillisBehindLatest: aws.Int64(k.millisBehindLatest)}, nil
+	}
+	return &kinesis.GetRecordsOutput{Records: records, NextShardIterator: params.ShardIterator, MillisBehindLatest: aws.Int64(k.millisBehindLatest)}, nil
+}
+
+// SubscribeToShard records the subscription, which has no event stream: the fan-out consumer ends right away.
+func (k *fakeKinesis) SubscribeToShard(_ context.Context, params *kinesis.SubscribeToShardInput, _ ...func(*kinesis.Options)) (*kinesis.SubscribeToShardOutput, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.subscriptions = append(k.subscriptions, params)
+	return nil, errors.New("no event stream")
+}
+
+func (k *fakeKinesis) DescribeStream(_ context.Context, params *kinesis.DescribeStreamInput, _ ...func(*kinesis.Options)) (*kinesis.DescribeStreamOutput, error) {
+	return &kinesis.DescribeStreamOutput{StreamDescription: &types.StreamDescription{
+		StreamARN:  aws.String("arn:aws:kinesis:us-west-2:123456789012:stream/" + aws.ToString(params.StreamName)),
+		StreamName: params.StreamName,
+	}}, nil
+}
+
+// DescribeStreamSummary returns a stream created at the start of 2023, open shards being the ones listed without an
+// ending sequence number.
+func (k *fakeKinesis) DescribeStreamSummary(_ context.Context, params *kinesis.DescribeStreamSummaryInput, _ ...func(*kinesis.Options)) (*kinesis.DescribeStreamSummaryOutput, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	var openShards int32
+	for _, s := range k.shards {
+		if s.SequenceNumberRange.EndingSequenceNumber == nil {
+			openShards++
+		}
+	}
+	status := k.streamStatus
+	if status == "" {
+		status = types.StreamStatusActive
+	}
+	return &kinesis.DescribeStreamSummaryOutput{StreamDescriptionSummary: &types.StreamDescriptionSummary{
+		StreamName:              params.StreamName,
+		StreamARN:               aws.String(config.StreamARN("us-west-2", "123456789012", aws.ToString(params.StreamName))),
+		StreamStatus:            status,
+		StreamCreationTimestamp: aws.Time(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)),
+		OpenShardCount:          aws.Int32(openShards),
+	}}, nil
+}
+
+func (k *fakeKinesis) DescribeStreamConsumer(_ context.Context, params *kinesis.DescribeStreamConsumerInput, _ ...func(*kinesis.Options)) (*kinesis.DescribeStreamConsumerOutput, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if k.consumerARN == "" {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("consumer not found")}
+	}
+	return &kinesis.DescribeStreamConsumerOutput{ConsumerDescription: &types.ConsumerDescription{
+		ConsumerARN:    aws.String(k.consumerARN),
+		ConsumerName:   params.ConsumerName,
+		ConsumerStatus: types.ConsumerStatusActive,
+	}}, nil
+}
+
+func (k *fakeKinesis) RegisterStreamConsumer(_ context.Context, params *kinesis.RegisterStreamConsumerInput, _ ...func(*kinesis.Options)) (*kinesis.RegisterStreamConsumerOutput, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.consumerARN = aws.ToString(params.StreamARN) + "/consumer/" + aws.ToString(params.ConsumerName)
+	return &kinesis.RegisterStreamConsumerOutput{Consumer: &types.Consumer{
+		ConsumerARN:    aws.String(k.consumerARN),
+		ConsumerName:   params.ConsumerName,
+		ConsumerStatus: types.ConsumerStatusActive,
+	}}, nil
+}
+
+func (k *fakeKinesis) EnableEnhancedMonitoring(_ context.Context, params *kinesis.EnableEnhancedMonitoringInput, _ ...func(*kinesis.Options)) (*kinesis.EnableEnhancedMonitoringOutput, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	out := &kinesis.EnableEnhancedMonitoringOutput{StreamName: params.StreamName}
+	for m := range k.shardLevelMetrics {
+		out.CurrentShardLevelMetrics = append(out.CurrentShardLevelMetrics, m)
+	}
+	for _, m := range params.ShardLevelMetrics {
+		k.shardLevelMetrics[m] = true
+	}
+	for m := range k.shardLevelMetrics {
+		out.DesiredShardLevelMetrics = append(out.DesiredShardLevelMetrics, m)
+	}
+	return out, nil
+}
+
+func (k *fakeKinesis) DisableEnhancedMonitoring(_ context.Context, params *kinesis.DisableEnhancedMonitoringInput, _ ...func(*kinesis.Options)) (*kinesis.DisableEnhancedMonitoringOutput, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	for _, m := range params.ShardLevelMetrics {
+		delete(k.shardLevelMetrics, m)
+	}
+	k.disabledMetrics = append(k.disabledMetrics, params.ShardLevelMetrics...)
+	return &kinesis.DisableEnhancedMonitoringOutput{StreamName: params.StreamName}, nil
+}
+
+// testRecordProcessorFactory creates record processors which do nothing.
+type testRecordProcessorFactory struct{}
+
+func (f testRecordProcessorFactory) CreateProcessor() kcl.IRecordProcessor {
+	return &testRecordProcessor{}
+}
+
+// testLease is a lease table entry of testCheckpointer.
+type testLease struct {
+	checkpoint   string
+	owner        string
+	leaseTimeout time.Time
+	streamName   string
+}
+
+// testCheckpointer keeps the lease table in memory and counts the calls made to it.
+type testCheckpointer struct {
+	mux    sync.Mutex
+	leases map[string]*testLease
+	calls  map[string]int
+}
+
+func newTestCheckpointer(leases map[string]*testLease) *testCheckpointer {
+	return &testCheckpointer{leases: leases, calls: map[string]int{}}
+}
+
+func (c *testCheckpointer) called(method, shardID string) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.calls[method+"/"+shardID]
+}
+
+func (c *testCheckpointer) record(method, shardID string) *testLease {
+	c.calls[method+"/"+shardID]++
+	lease, ok := c.leases[shardID]
+	if !ok {
+		lease = &testLease{}
+		c.leases[shardID] = lease
+	}
+	return lease
+}
+
+func (c *testCheckpointer) Init() error {
+	return nil
+}
+
+func (c *testCheckpointer) GetLease(shard *par.ShardStatus, assignTo string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	lease := c.record("GetLease", shard.ID)
+	if lease.owner != "" && lease.owner != assignTo && time.Now().Before(lease.leaseTimeout) {
+		return chk.ErrLeaseNotAcquired{}
+	}
+	lease.owner = assignTo
+	lease.leaseTimeout = time.Now().Add(time.Minute)
+	shard.SetLeaseOwner(assignTo)
+	shard.SetLeaseTimeout(lease.leaseTimeout)
+	return nil
+}
+
+func (c *testCheckpointer) CheckpointSequence(shard *par.ShardStatus) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.record("CheckpointSequence", shard.ID).checkpoint = shard.GetCheckpoint()
+	return nil
+}
+
+func (c *testCheckpointer) FetchCheckpoint(shard *par.ShardStatus) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	lease := c.record("FetchCheckpoint", shard.ID)
+	if lease.checkpoint == "" {
+		return chk.ErrSequenceIDNotFound
+	}
+	shard.SetCheckpoint(lease.checkpoint)
+	shard.SetLeaseOwner(lease.owner)
+	shard.SetLeaseTimeout(lease.leaseTimeout)
+	return nil
+}
+
+func (c *testCheckpointer) RemoveLeaseInfo(shardID string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.record("RemoveLeaseInfo", shardID)
+	delete(c.leases, shardID)
+	return nil
+}
+
+func (c *testCheckpointer) RemoveLeaseOwner(shardID string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.record("RemoveLeaseOwner", shardID).owner = ""
+	return nil
+}
+
+func (c *testCheckpointer) GetLeaseOwner(shardID string) (string, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.record("GetLeaseOwner", shardID).owner, nil
+}
+
+func (c *testCheckpointer) ListActiveWorkers(shardStatus map[string]*par.ShardStatus) (map[string][]*par.ShardStatus, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	workers := map[string][]*par.ShardStatus{}
+	for _, shard := range shardStatus {
+		// sync the lease owners with the lease table
+		if lease, ok := c.leases[shard.ID]; ok {
+			shard.SetLeaseOwner(lease.owner)
+		}
+		if owner := shard.GetLeaseOwner(); owner != "" && shard.GetCheckpoint() != chk.ShardEnd {
+			workers[owner] = append(workers[owner], shard)
+		}
+	}
+	return workers, nil
+}
+
+func (c *testCheckpointer) ClaimShard(shard *par.ShardStatus, claimID string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.record("ClaimShard", shard.ID)
+	shard.ClaimRequest = claimID
+	return nil
+}
+
+// failingCheckpointer fails every checkpoint.
+type failingCheckpointer struct {
+	*testCheckpointer
+}
+
+func (c failingCheckpointer) CheckpointSequence(_ *par.ShardStatus) error {
+	return errors.New("checkpoint failed")
+}
+
+// newTestWorker returns a worker tracking the given shards, without any AWS client.
+func newTestWorker(kclConfig *config.KinesisClientLibConfiguration, checkpointer chk.Checkpointer, shardIDs ...string) *Worker {
+	w := NewWorker(nil, kclConfig).WithCheckpointer(checkpointer)
+	w.mService = metrics.NoopMonitoringService{}
+	w.shardStatus = make(map[string]*par.ShardStatus)
+	for _, id := range shardIDs {
+		w.shardStatus[id] = &par.ShardStatus{ID: id, Mux: &sync.RWMutex{}}
+	}
+	stop := make(chan struct{})
+	w.stop = &stop
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.waitGroup = &sync.WaitGroup{}
+	return w
+}
+
+// quarterShards splits the 128 bit hash key space evenly into 4 shards.
+func quarterShards() []types.Shard {
+	quarter := new(big.Int).Lsh(big.NewInt(1), 126)
+	var shards []types.Shard
+	for i := int64(0); i < 4; i++ {
+		start := new(big.Int).Mul(quarter, big.NewInt(i))
+		end := new(big.Int).Sub(new(big.Int).Add(start, quarter), big.NewInt(1))
+		shards = append(shards, types.Shard{
+			ShardId: aws.String("shard-" + big.NewInt(i).String()),
+			HashKeyRange: &types.HashKeyRange{
+				StartingHashKey: aws.String(start.String()),
+				EndingHashKey:   aws.String(end.String()),
+			},
+		})
+	}
+	return shards
+}
+
+func TestAcceptShardWithPartiallyOverlappingFilter(t *testing.T) {
+	quarter := new(big.Int).Lsh(big.NewInt(1), 126)
+	half := new(big.Int).Rsh(quarter, 1)
+	// from the middle of shard-1 to the middle of shard-2
+	filter := config.HashKeyRangeFilter{{
+		StartingHashKey: new(big.Int).Add(quarter, half),
+		EndingHashKey:   new(big.Int).Add(new(big.Int).Mul(quarter, big.NewInt(2)), half),
+	}}
+
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithShardFilter(filter)
+	w := NewWorker(nil, kclConfig)
+
+	var accepted []string
+	for _, s := range quarterShards() {
+		if w.acceptShard(s) {
+			accepted = append(accepted, *s.ShardId)
+		}
+	}
+	assert.Equal(t, []string{"shard-1", "shard-2"}, accepted)
+}
+
+func TestAcceptShardWithoutFilter(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	w := NewWorker(nil, kclConfig)
+
+	for _, s := range quarterShards() {
+		assert.True(t, w.acceptShard(s))
+	}
+}
+
+func TestAcquireLeasesSkipsCompletedShards(t *testing.T) {
+	leaseTimeout := time.Now().Add(time.Minute)
+	checkpointer := newTestCheckpointer(map[string]*testLease{
+		// the children of shard-0 are leased, the child of shard-1 is not
+		"shard-0": {checkpoint: chk.ShardEnd},
+		"shard-1": {checkpoint: chk.ShardEnd},
+		"shard-2": {checkpoint: "49590338271490256608559692538361571095921575989136588898", owner: "other", leaseTimeout: leaseTimeout},
+		"shard-3": {owner: "other", leaseTimeout: leaseTimeout},
+	})
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	w := newTestWorker(kclConfig, checkpointer, "shard-0", "shard-1", "shard-2", "shard-3", "shard-4")
+	w.shardStatus["shard-2"].ParentShardId = "shard-0"
+	w.shardStatus["shard-3"].ParentShardId = "shard-0"
+	w.shardStatus["shard-4"].ParentShardId = "shard-1"
+	factory := &failingProcessorFactory{
+		failures: map[string]int{"shard-1": 1, "shard-4": 1},
+		attempts: map[string]int{},
+	}
+	w.processorFactory = factory
+
+	w.acquireLeases()
+	w.acquireLeases()
+
+	assert.Equal(t, 0, checkpointer.called("GetLease", "shard-0"))
+	// SHARD_END is only read once
+	assert.Equal(t, 1, checkpointer.called("FetchCheckpoint", "shard-0"))
+	for _, id := range []string{"shard-2", "shard-3"} {
+		assert.Equal(t, 2, checkpointer.called("GetLease", id), id)
+	}
+	assert.Equal(t, "other", w.shardStatus["shard-2"].GetLeaseOwner())
+
+	// the completed shard is taken again until its child is leased
+	assert.Equal(t, 1, checkpointer.called("GetLease", "shard-1"))
+	assert.Equal(t, 1, checkpointer.called("FetchCheckpoint", "shard-1"))
+	assert.Equal(t, 1, factory.attempts["shard-1"])
+}
+
+func TestCleanupOrphanedLeases(t *testing.T) {
+	checkpointer := backupCheckpointer{newTestCheckpointer(map[string]*testLease{
+		"shard-0": {checkpoint: "100", streamName: "streamName"},
+		// leases of the stream before it was recreated
+		"shardId-000000000001": {checkpoint: "200", streamName: "streamName"},
+		"shardId-000000000002": {checkpoint: chk.ShardEnd, streamName: "streamName"},
+		// leases of another stream sharing the lease table, and of an unknown stream
+		"shardId-000000000003": {checkpoint: "300", streamName: "otherStream"},
+		"shardId-000000000004": {checkpoint: "400"},
+	})}
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithCleanupOrphanedLeases(true).
+		WithOrphanedLeaseMinSyncs(2)
+	w := newTestWorker(kclConfig, checkpointer)
+	kc := newFakeKinesis("shard-0")
+	w.kc = kc
+
+	// the leases are only removed once missing from two shard syncs
+	assert.Nil(t, w.syncShard())
+	assert.Equal(t, 5, len(checkpointer.leases))
+	assert.Nil(t, w.syncShard())
+	assert.Equal(t, 1, checkpointer.called("RemoveLeaseInfo", "shardId-000000000001"))
+	assert.Equal(t, 1, checkpointer.called("RemoveLeaseInfo", "shardId-000000000002"))
+	assert.Equal(t, 3, len(checkpointer.leases))
+
+	// the leases not written for the stream are kept
+	assert.Nil(t, w.syncShard())
+	assert.Equal(t, 0, checkpointer.called("RemoveLeaseInfo", "shardId-000000000003"))
+	assert.Equal(t, 0, checkpointer.called("RemoveLeaseInfo", "shardId-000000000004"))
+
+	// an empty listing removes no lease
+	kc.shards = nil
+	assert.Nil(t, w.syncShard())
+	assert.Nil(t, w.syncShard())
+	assert.Equal(t, 0, checkpointer.called("RemoveLeaseInfo", "shard-0"))
+	assert.NotNil(t, checkpointer.leases["shard-0"])
+}
+
+// startTestWorker runs the event loop of a worker backed by fakes, with a shard sync interval long enough for
+// the tests to drive it.
+func startTestWorker(t *testing.T, kclConfig *config.KinesisClientLibConfiguration, kc kinesisAPI, checkpointer chk.Checkpointer) *Worker {
+	w := NewWorker(testRecordProcessorFactory{}, kclConfig.WithShardSyncIntervalMillis(3600000)).
+		WithCheckpointer(checkpointer)
+	w.kc = kc
+	assert.Nil(t, w.Start())
+	return w
+}
+
+func TestRebalanceAfterFleetShrinks(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	checkpointer := newTestCheckpointer(map[string]*testLease{
+		"shard-0": {owner: "workerID", leaseTimeout: time.Now().Add(time.Minute)},
+		"shard-1": {owner: "gone", leaseTimeout: expired},
+		"shard-2": {owner: "gone", leaseTimeout: expired},
+		"shard-3": {owner: "gone", leaseTimeout: expired},
+	})
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	w := startTestWorker(t, kclConfig, newFakeKinesis("shard-0", "shard-1", "shard-2", "shard-3"), checkpointer)
+	defer w.Shutdown()
+
+	// the leases of the worker which left are all taken over in a single pass
+	assert.Nil(t, w.Rebalance())
+	for _, id := range []string{"shard-0", "shard-1", "shard-2", "shard-3"} {
+		assert.Equal(t, "workerID", w.shardStatus[id].GetLeaseOwner(), id)
+	}
+}
+
+func TestWarmStandby(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	checkpointer := newTestCheckpointer(map[string]*testLease{
+		"shard-0": {owner: "active", leaseTimeout: expired},
+		"shard-1": {owner: "active", leaseTimeout: expired},
+	})
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithStartAsStandby(true)
+	w := startTestWorker(t, kclConfig, newFakeKinesis("shard-0", "shard-1"), checkpointer)
+	defer w.Shutdown()
+
+	// the shards are synced, but no lease is acquired while on standby
+	assert.Nil(t, w.Rebalance())
+	assert.Len(t, w.shardStatus, 2)
+	assert.Equal(t, 0, w.heldLeases())
+	assert.True(t, w.health().Standby)
+
+	assert.Nil(t, w.Promote())
+	for _, id := range []string{"shard-0", "shard-1"} {
+		assert.Equal(t, "workerID", w.shardStatus[id].GetLeaseOwner(), id)
+	}
+	assert.False(t, w.health().Standby)
+	assert.Nil(t, w.Promote())
+}
+
+func TestReadyAfterInitialLeaseAcquisition(t *testing.T) {
+	checkpointer := newTestCheckpointer(map[string]*testLease{})
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithShardSyncIntervalMillis(200)
+	w := NewWorker(testRecordProcessorFactory{}, kclConfig).WithCheckpointer(checkpointer)
+	w.kc = newFakeKinesis("shard-0")
+	assert.Nil(t, w.Start())
+	defer w.Shutdown()
+
+	// not ready before the first shard sync
+	select {
+	case <-w.Ready():
+		assert.Fail(t, "ready before any lease acquisition")
+	default:
+	}
+
+	select {
+	case <-w.Ready():
+		assert.Equal(t, "workerID", w.shardStatus["shard-0"].GetLeaseOwner())
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "not ready after the first shard sync")
+	}
+}
+
+func TestReadyAfterReadinessTimeout(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithReadinessTimeoutMillis(50)
+	start := time.Now()
+	w := startTestWorker(t, kclConfig, newFakeKinesis("shard-0"), newTestCheckpointer(map[string]*testLease{}))
+	defer w.Shutdown()
+
+	// the first shard sync is an hour away
+	select {
+	case <-w.Ready():
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "not ready after the readiness timeout")
+	}
+}
+
+// generationCheckpointer records the stream generation its leases are scoped to.
+type generationCheckpointer struct {
+	*testCheckpointer
+	generation string
+}
+
+func (c *generationCheckpointer) SetStreamGeneration(generation string) {
+	c.generation = generation
+}
+
+func TestLeasesScopedToStreamGeneration(t *testing.T) {
+	checkpointer := &generationCheckpointer{testCheckpointer: newTestCheckpointer(map[string]*testLease{})}
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithEnableStreamGenerations(true)
+	w := startTestWorker(t, kclConfig, newFakeKinesis("shard-0"), checkpointer)
+	defer w.Shutdown()
+	assert.Equal(t, "2023-01-01T00:00:00Z", checkpointer.generation)
+}
+
+func TestRebalanceAfterFleetGrows(t *testing.T) {
+	valid := time.Now().Add(time.Minute)
+	checkpointer := newTestCheckpointer(map[string]*testLease{
+		"shard-0": {owner: "other", leaseTimeout: valid},
+		"shard-1": {owner: "other", leaseTimeout: valid},
+		"shard-2": {owner: "other", leaseTimeout: valid},
+		"shard-3": {owner: "other", leaseTimeout: valid},
+	})
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithLeaseStealing(true)
+	w := startTestWorker(t, kclConfig, newFakeKinesis("shard-0", "shard-1", "shard-2", "shard-3"), checkpointer)
+	defer w.Shutdown()
+
+	// the new worker claims a shard of the over-allocated worker
+	assert.Nil(t, w.Rebalance())
+	claimed := ""
+	for id, shard := range w.shardStatus {
+		if shard.ClaimRequest == "workerID" {
+			assert.Equal(t, "", claimed, "a single shard is claimed at once")
+			claimed = id
+		}
+	}
+	assert.NotEqual(t, "", claimed)
+	assert.Equal(t, 1, checkpointer.called("ClaimShard", claimed))
+}
+
+func TestRebalanceWorkerNotRunning(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	w := NewWorker(testRecordProcessorFactory{}, kclConfig)
+	assert.Equal(t, ErrWorkerNotRunning, w.Rebalance())
+}
+
+// lifetimeMonitoringService counts the lifetime triggered shutdowns.
+type lifetimeMonitoringService struct {
+	metrics.NoopMonitoringService
+	expired int32
+}
+
+func (m *lifetimeMonitoringService) WorkerLifetimeExpired() {
+	atomic.AddInt32(&m.expired, 1)
+}
+
+func TestWorkerShutsDownAfterMaxLifetime(t *testing.T) {
+	checkpointer := newTestCheckpointer(map[string]*testLease{})
+	mService := &lifetimeMonitoringService{}
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithMaxWorkerLifetimeMillis(500).
+		WithMonitoringService(mService)
+	w := startTestWorker(t, kclConfig, newFakeKinesis("shard-0"), checkpointer)
+	defer w.Shutdown()
+	assert.Nil(t, w.Rebalance())
+
+	select {
+	case <-w.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker not shut down after its maximum lifetime")
+	}
+
+	// the lease is released for another worker to take over
+	assert.Equal(t, 1, checkpointer.called("RemoveLeaseOwner", "shard-0"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mService.expired))
+	assert.Equal(t, ErrWorkerNotRunning, w.Rebalance())
+}
+
+// rejoinMonitoringService counts the rejoins of the worker.
+type rejoinMonitoringService struct {
+	metrics.NoopMonitoringService
+	rejoins int32
+}
+
+func (m *rejoinMonitoringService) WorkerRejoined() {
+	atomic.AddInt32(&m.rejoins, 1)
+}
+
+func TestWorkerRejoinsAfterLosingAllLeases(t *testing.T) {
+	checkpointer := newTestCheckpointer(map[string]*testLease{})
+	mService := &rejoinMonitoringService{}
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithRejoinOnLeaseLoss(true).
+		WithMonitoringService(mService)
+	kc := newFakeKinesis("shard-0", "shard-1")
+	// every consumer fails, all the leases are given up
+	kc.getRecordsErr = errors.New("transient failure")
+	w := startTestWorker(t, kclConfig, kc, checkpointer)
+	defer w.Shutdown()
+	assert.Nil(t, w.Rebalance())
+
+	assert.Eventually(t, func() bool {
+		return checkpointer.called("RemoveLeaseOwner", "shard-0") > 0 && checkpointer.called("RemoveLeaseOwner", "shard-1") > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	kc.mux.Lock()
+	kc.getRecordsErr = nil
+	kc.mux.Unlock()
+
+	// the leases are taken again long before the next shard sync
+	assert.Eventually(t, func() bool {
+		return w.shardStatus["shard-0"].GetLeaseOwner() == "workerID" && w.shardStatus["shard-1"].GetLeaseOwner() == "workerID"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, atomic.LoadInt32(&mService.rejoins) > 0)
+}
+
+func TestWorkerDump(t *testing.T) {
+	checkpointer := newTestCheckpointer(map[string]*testLease{
+		"shard-1": {checkpoint: "49590338271490256608559692538361571095921575989136588898", owner: "other", leaseTimeout: time.Now().Add(time.Minute)},
+	})
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(10).
+		WithOnGetRecordsResponse(func(string, *kinesis.GetRecordsOutput) {})
+	w := NewWorker(testRecordProcessorFactory{}, kclConfig.WithShardSyncIntervalMillis(3600000)).WithCheckpointer(checkpointer)
+	w.kc = newFakeKinesis("shard-0", "shard-1")
+
+	dumpWorker := func() WorkerDump {
+		data, err := w.Dump()
+		assert.Nil(t, err)
+		var dump WorkerDump
+		assert.Nil(t, json.Unmarshal(data, &dump))
+		return dump
+	}
+
+	// safe before the worker starts
+	dump := dumpWorker()
+	assert.False(t, dump.Running)
+	assert.Empty(t, dump.Shards)
+
+	assert.Nil(t, w.Start())
+	assert.Nil(t, w.Rebalance())
+	// wait for a poll of the shard
+	assert.Eventually(t, func() bool { return !w.shardStatus["shard-0"].GetLastPollTime().IsZero() }, 5*time.Second, 10*time.Millisecond)
+
+	dump = dumpWorker()
+	assert.True(t, dump.Running)
+	assert.Equal(t, "workerID", dump.WorkerID)
+	assert.Equal(t, 2, len(dump.Shards))
+
+	consumed := dump.Shards[0]
+	assert.Equal(t, "shard-0", consumed.ShardID)
+	assert.Equal(t, "workerID", consumed.LeaseOwner)
+	assert.False(t, consumed.LeaseTimeout.IsZero())
+	if assert.NotNil(t, consumed.Consumer) {
+		assert.NotNil(t, consumed.Consumer.RateLimiter)
+		if assert.NotNil(t, consumed.Consumer.Polling) {
+			assert.False(t, consumed.Consumer.Polling.LastPollEnd.IsZero())
+			assert.Equal(t, int64(0), *consumed.Consumer.Polling.MillisBehindLatest)
+		}
+	}
+
+	other := dump.Shards[1]
+	assert.Equal(t, "shard-1", other.ShardID)
+	assert.Equal(t, "other", other.LeaseOwner)
+	assert.Equal(t, "49590338271490256608559692538361571095921575989136588898", other.Checkpoint)
+	assert.Nil(t, other.Consumer)
+
+	// the configuration is included, without the functions themselves
+	assert.Equal(t, "streamName", dump.Config["StreamName"])
+	assert.Equal(t, float64(10), dump.Config["IdleTimeBetweenReadsInMillis"])
+	assert.Equal(t, "func(string, *kinesis.GetRecordsOutput)", dump.Config["OnGetRecordsResponse"])
+
+	w.Shutdown()
+	dump = dumpWorker()
+	assert.False(t, dump.Running)
+}
+
+func TestEnhancedMonitoringEnabledAndDisabled(t *testing.T) {
+	kc := newFakeKinesis("shard-0")
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithEnhancedMonitoring()
+	w := startTestWorker(t, kclConfig, kc, newTestCheckpointer(map[string]*testLease{}))
+
+	assert.Equal(t, map[types.MetricsName]bool{
+		types.MetricsNameIncomingBytes:           true,
+		types.MetricsNameIteratorAgeMilliseconds: true,
+	}, kc.shardLevelMetrics)
+
+	w.Shutdown()
+	assert.Empty(t, kc.shardLevelMetrics)
+}
+
+func TestEnhancedMonitoringAlreadyEnabled(t *testing.T) {
+	kc := newFakeKinesis("shard-0")
+	kc.shardLevelMetrics[types.MetricsNameIncomingBytes] = true
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithEnhancedMonitoring("IncomingBytes", "IteratorAgeMilliseconds")
+	w := startTestWorker(t, kclConfig, kc, newTestCheckpointer(map[string]*testLease{}))
+	w.Shutdown()
+
+	// only the metric enabled by the worker is disabled
+	assert.Equal(t, []types.MetricsName{types.MetricsNameIteratorAgeMilliseconds}, kc.disabledMetrics)
+	assert.Equal(t, map[types.MetricsName]bool{types.MetricsNameIncomingBytes: true}, kc.shardLevelMetrics)
+}
+
+func TestShardClosedByGetRecordsWhileListedOpen(t *testing.T) {
+	kc := newFakeKinesis("shard-0")
+	kc.closedShards["shard-0"] = true
+	checkpointer := newTestCheckpointer(map[string]*testLease{})
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	w := newTestWorker(kclConfig, checkpointer)
+	w.kc = kc
+	assert.Nil(t, w.syncShard())
+	shard := w.shardStatus["shard-0"]
+
+	var shutdownReason kcl.ShutdownReason
+	processor := &testRecordProcessor{shutdown: func(input *kcl.ShutdownInput) {
+		shutdownReason = input.ShutdownReason
+	}}
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, checkpointer)
+	sc.shard = shard
+	assert.Nil(t, sc.getRecords())
+
+	// the nil shard iterator wins over the listing
+	assert.Equal(t, kcl.TERMINATE, shutdownReason)
+	assert.True(t, shard.IsClosed())
+	assert.Nil(t, w.syncShard())
+	assert.True(t, w.shardStatus["shard-0"].IsClosed())
+}
+
+func TestShardListedClosedWhileGetRecordsServesIt(t *testing.T) {
+	kc := newFakeKinesis("shard-0")
+	kc.shards[0].SequenceNumberRange.EndingSequenceNumber = aws.String("100")
+	checkpointer := newTestCheckpointer(map[string]*testLease{})
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithIdleTimeBetweenReadsInMillis(1).
+		WithMaxConsecutiveEmptyPollsBeforeRelease(2)
+	w := newTestWorker(kclConfig, checkpointer)
+	w.kc = kc
+	assert.Nil(t, w.syncShard())
+	shard := w.shardStatus["shard-0"]
+	assert.Equal(t, "100", shard.EndingSequenceNumber)
+
+	var shutdownReason kcl.ShutdownReason
+	processor := &testRecordProcessor{shutdown: func(input *kcl.ShutdownInput) {
+		shutdownReason = input.ShutdownReason
+	}}
+	sc := newTestPollingShardConsumer(kclConfig, processor, kc, checkpointer)
+	sc.shard = shard
+	assert.Nil(t, sc.getRecords())
+
+	// the shard is read until GetRecords reports it closed, here until the lease is released for being idle
+	assert.Equal(t, kcl.REQUESTED, shutdownReason)
+	assert.False(t, shard.IsClosed())
+}
+
+// batchRenewingCheckpointer records the lease renewal batches.
+type batchRenewingCheckpointer struct {
+	*testCheckpointer
+	batches [][]string
+}
+
+func (c *batchRenewingCheckpointer) RenewLeases(shards []*par.ShardStatus, assignTo string) map[string]error {
+	errs := make(map[string]error)
+	var batch []string
+	for _, shard := range shards {
+		batch = append(batch, shard.ID)
+		if err := c.GetLease(shard, assignTo); err != nil {
+			errs[shard.ID] = err
+		}
+	}
+	c.batches = append(c.batches, batch)
+	return errs
+}
+
+func TestLeaseRenewalsBatched(t *testing.T) {
+	checkpointer := &batchRenewingCheckpointer{testCheckpointer: newTestCheckpointer(map[string]*testLease{
+		"shard-2": {owner: "otherWorker", leaseTimeout: time.Now().Add(time.Minute)},
+	})}
+	stop := make(chan struct{})
+	defer close(stop)
+	batcher := newLeaseRenewalBatcher(checkpointer, 200*time.Millisecond, &stop)
+	go batcher.run()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shard := &par.ShardStatus{ID: fmt.Sprintf("shard-%d", i), Mux: &sync.RWMutex{}}
+			errs[i] = batcher.renew(shard, "workerID")
+		}(i)
+	}
+	wg.Wait()
+
+	// one write for the three consumers, the lease lost to another worker is reported to its consumer only
+	if assert.Len(t, checkpointer.batches, 1) {
+		assert.ElementsMatch(t, []string{"shard-0", "shard-1", "shard-2"}, checkpointer.batches[0])
+	}
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.True(t, errors.As(errs[2], &chk.ErrLeaseNotAcquired{}))
+}
+
+func TestLeaseRenewalStoppedWithWorker(t *testing.T) {
+	checkpointer := &batchRenewingCheckpointer{testCheckpointer: newTestCheckpointer(map[string]*testLease{})}
+	stop := make(chan struct{})
+	batcher := newLeaseRenewalBatcher(checkpointer, time.Hour, &stop)
+	go batcher.run()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- batcher.renew(&par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}, "workerID")
+	}()
+	close(stop)
+
+	select {
+	case err := <-result:
+		assert.Equal(t, errLeaseRenewalStopped, err)
+	case <-time.After(time.Second):
+		t.Fatal("lease renewal still waiting after the worker stopped")
+	}
+	assert.Empty(t, checkpointer.batches)
+}
+
+func TestHeartbeatFiresOnInterval(t *testing.T) {
+	checkpointer := newTestCheckpointer(map[string]*testLease{})
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithShardSyncIntervalMillis(3600000).
+		WithHeartbeatIntervalMillis(100)
+
+	heartbeats := make(chan WorkerHealth, 100)
+	w := NewWorker(testRecordProcessorFactory{}, kclConfig).
+		WithCheckpointer(checkpointer).
+		WithHeartbeat(func(health WorkerHealth) { heartbeats <- health })
+	w.kc = newFakeKinesis("shard-0", "shard-1")
+	assert.Nil(t, w.Start())
+	defer w.Shutdown()
+	assert.Nil(t, w.Rebalance())
+
+	var previous time.Time
+	for {
+		select {
+		case health := <-heartbeats:
+			assert.Equal(t, "workerID", health.WorkerID)
+			if !previous.IsZero() {
+				assert.GreaterOrEqual(t, health.Time.Sub(previous), 50*time.Millisecond)
+				assert.LessOrEqual(t, health.Time.Sub(previous), 300*time.Millisecond)
+			}
+			previous = health.Time
+
+			if health.HeldShards < 2 || health.Shards[0].LastPollTime.IsZero() || health.Shards[1].LastPollTime.IsZero() {
+				continue
+			}
+			assert.Equal(t, "shard-0", health.Shards[0].ShardID)
+			assert.Equal(t, "shard-1", health.Shards[1].ShardID)
+			assert.False(t, health.Stalled)
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("no heartbeat reporting both shards polled")
+		}
+	}
+}
+
+func TestHealthReportsStalledShard(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithFailoverTimeMillis(1000)
+	w := newTestWorker(kclConfig, newTestCheckpointer(map[string]*testLease{}), "shard-0", "shard-1", "shard-2")
+	w.shardStatus["shard-0"].SetLeaseOwner("workerID")
+	w.shardStatus["shard-0"].SetLastPollTime(time.Now())
+	w.shardStatus["shard-1"].SetLeaseOwner("workerID")
+	w.shardStatus["shard-1"].SetLastPollTime(time.Now().Add(-time.Minute))
+	w.shardStatus["shard-2"].SetLeaseOwner("otherWorker")
+
+	health := w.health()
+	assert.Equal(t, 2, health.HeldShards)
+	assert.True(t, health.Stalled)
+	assert.False(t, health.Shards[0].Stalled)
+	assert.True(t, health.Shards[1].Stalled)
+}
+
+func TestPollSchedulerPrioritizesByLag(t *testing.T) {
+	scheduler := newPollScheduler(1, true)
+	stop := make(chan struct{})
+	defer close(stop)
+	assert.True(t, scheduler.acquire(0, stop))
+
+	// three shards queue up behind the single slot
+	var mux sync.Mutex
+	var order []int64
+	var wg sync.WaitGroup
+	for i, lag := range []int64{10, 5000, 300} {
+		wg.Add(1)
+		go func(lag int64) {
+			defer wg.Done()
+			if scheduler.acquire(lag, stop) {
+				mux.Lock()
+				order = append(order, lag)
+				mux.Unlock()
+				scheduler.release()
+			}
+		}(lag)
+		// queue them in a known order
+		for waiting := 0; waiting != i+1; {
+			time.Sleep(time.Millisecond)
+			scheduler.mux.Lock()
+			waiting = len(scheduler.waiting)
+			scheduler.mux.Unlock()
+		}
+	}
+
+	scheduler.release()
+	wg.Wait()
+	assert.Equal(t, []int64{5000, 300, 10}, order)
+}
+
+func TestPollSchedulerInArrivalOrder(t *testing.T) {
+	scheduler := newPollScheduler(1, false)
+	stop := make(chan struct{})
+	assert.True(t, scheduler.acquire(0, stop))
+
+	granted := make(chan int64, 2)
+	for i, lag := range []int64{10, 5000} {
+		go func(lag int64) {
+			if scheduler.acquire(lag, stop) {
+				granted <- lag
+			}
+		}(lag)
+		for waiting := 0; waiting != i+1; {
+			time.Sleep(time.Millisecond)
+			scheduler.mux.Lock()
+			waiting = len(scheduler.waiting)
+			scheduler.mux.Unlock()
+		}
+	}
+
+	scheduler.release()
+	assert.Equal(t, int64(10), <-granted)
+
+	// waiting shards give up when the worker stops
+	close(stop)
+	select {
+	case lag := <-granted:
+		t.Errorf("slot granted to shard lagging %d ms after the worker stopped", lag)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCredentialsRefreshUsesLatestCredentials(t *testing.T) {
+	var mux sync.Mutex
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		mux.Unlock()
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".DescribeStreamSummary") {
+			_, _ = w.Write([]byte(`{"StreamDescriptionSummary":{"StreamStatus":"ACTIVE"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"Shards":[]}`))
+	}))
+	defer server.Close()
+
+	// every retrieval rotates the credentials, which expire at once
+	var rotations int32
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithKinesisEndpoint(server.URL).
+		WithCredentialsRefresh(func(_ context.Context) (aws.Credentials, error) {
+			n := atomic.AddInt32(&rotations, 1)
+			return aws.Credentials{
+				AccessKeyID:     fmt.Sprintf("AKID%d", n),
+				SecretAccessKey: "secret",
+				CanExpire:       true,
+				Expires:         time.Now(),
+			}, nil
+		})
+	w := NewWorker(testRecordProcessorFactory{}, kclConfig).WithCheckpointer(newTestCheckpointer(map[string]*testLease{}))
+	assert.Nil(t, w.initialize())
+	// the credentials were retrieved to validate the provider, then to check the status of the stream
+	assert.Equal(t, int32(2), atomic.LoadInt32(&rotations))
+
+	for i := 0; i < 2; i++ {
+		_, err := w.kc.ListShards(context.TODO(), &kinesis.ListShardsInput{StreamName: aws.String("streamName")})
+		assert.Nil(t, err)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	// every request signs with new credentials
+	assert.Equal(t, 3, len(authorizations))
+	assert.True(t, strings.Contains(authorizations[0], "Credential=AKID2/"), authorizations[0])
+	assert.True(t, strings.Contains(authorizations[1], "Credential=AKID3/"), authorizations[1])
+	assert.True(t, strings.Contains(authorizations[2], "Credential=AKID4/"), authorizations[2])
+}
+
+func TestCredentialsRefreshValidatedAtStartup(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithCredentialsRefresh(func(_ context.Context) (aws.Credentials, error) {
+			return aws.Credentials{}, errors.New("token expired")
+		})
+	w := NewWorker(testRecordProcessorFactory{}, kclConfig).WithCheckpointer(newTestCheckpointer(map[string]*testLease{}))
+	w.kc = newFakeKinesis("shard-0")
+
+	err := w.Start()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "token expired")
+}
+
+// eventRecordingFactory creates record processors which log what they are called for, and checkpoint the records
+// delivered and the end of their shard.
+type eventRecordingFactory struct {
+	mux    sync.Mutex
+	events []string
+}
+
+func (f *eventRecordingFactory) record(event string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.events = append(f.events, event)
+}
+
+func (f *eventRecordingFactory) recorded() []string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return append([]string(nil), f.events...)
+}
+
+func (f *eventRecordingFactory) CreateProcessor() kcl.IRecordProcessor {
+	var shardID string
+	return &eventRecordingProcessor{
+		initialize: func(input *kcl.InitializationInput) {
+			shardID = input.ShardId
+			f.record("initialize " + shardID)
+		},
+		testRecordProcessor: testRecordProcessor{
+			processRecords: func(input *kcl.ProcessRecordsInput) {
+				if n := len(input.Records); n > 0 {
+					f.record(fmt.Sprintf("process %s %s", shardID, aws.ToString(input.Records[n-1].SequenceNumber)))
+					_ = input.Checkpointer.Checkpoint(input.Records[n-1].SequenceNumber)
+				}
+			},
+			shutdown: func(input *kcl.ShutdownInput) {
+				if input.ShutdownReason == kcl.TERMINATE {
+					_ = input.Checkpointer.Checkpoint(nil)
+					f.record("terminate " + shardID)
+				}
+			},
+		},
+	}
+}
+
+type eventRecordingProcessor struct {
+	testRecordProcessor
+	initialize func(input *kcl.InitializationInput)
+}
+
+func (p *eventRecordingProcessor) Initialize(input *kcl.InitializationInput) {
+	p.initialize(input)
+}
+
+func TestChildWaitsOnParentOwnedBySameWorker(t *testing.T) {
+	kc := newFakeKinesis("parent", "child")
+	kc.shards[1].ParentShardId = aws.String("parent")
+	kc.closedShards["parent"] = true
+	kc.pendingRecords["parent"] = []types.Record{{SequenceNumber: aws.String("100"), Data: []byte("data")}}
+	kc.pendingRecords["child"] = []types.Record{{SequenceNumber: aws.String("200"), Data: []byte("data")}}
+
+	// polling the lease table for the end of the parent would stall the child for an hour
+	factory := &eventRecordingFactory{}
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithCoordinateSelfOwnedParentShards(true).
+		WithShardSyncIntervalMillis(3600000)
+	kclConfig.ParentShardPollIntervalMillis = 3600000
+	checkpointer := newTestCheckpointer(map[string]*testLease{"parent": {checkpoint: "50"}})
+	w := NewWorker(factory, kclConfig).WithCheckpointer(checkpointer)
+	w.kc = kc
+	assert.Nil(t, w.Start())
+	defer w.Shutdown()
+	assert.Nil(t, w.Rebalance())
+
+	assert.Eventually(t, func() bool {
+		return len(factory.recorded()) == 5
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the child starts once the parent has been completely processed
+	events := factory.recorded()
+	parentEnd := indexOf(events, "terminate parent")
+	assert.Equal(t, indexOf(events, "process parent 100")+1, parentEnd)
+	assert.Less(t, parentEnd, indexOf(events, "initialize child"))
+	assert.Less(t, indexOf(events, "initialize child"), indexOf(events, "process child 200"))
+}
+
+func indexOf(events []string, event string) int {
+	for i, e := range events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+type fanOutUpgradeMonitoringService struct {
+	metrics.NoopMonitoringService
+	upgrades int32
+}
+
+func (m *fanOutUpgradeMonitoringService) WorkerFanOutUpgraded() {
+	atomic.AddInt32(&m.upgrades, 1)
+}
+
+func TestWorkerSwitchesToFanOutWhenThrottled(t *testing.T) {
+	checkpointer := newTestCheckpointer(map[string]*testLease{
+		"shard-0": {checkpoint: "100"},
+		"shard-1": {checkpoint: "200"},
+	})
+	mService := &fanOutUpgradeMonitoringService{}
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithFanOutThrottleThreshold(5).
+		WithThroughputExceededBackoff(config.BackoffPolicy{BaseMillis: 10, Multiplier: 1}).
+		WithMonitoringService(mService)
+	kc := newFakeKinesis("shard-0", "shard-1")
+	// the shards are read by other applications as well
+	kc.getRecordsErr = &types.ProvisionedThroughputExceededException{Message: aws.String("Rate exceeded")}
+	w := startTestWorker(t, kclConfig, kc, checkpointer)
+	defer w.Shutdown()
+	assert.Nil(t, w.Rebalance())
+
+	// the shards are handed over to fan-out consumers, which resume from their checkpoints
+	assert.Eventually(t, func() bool {
+		kc.mux.Lock()
+		defer kc.mux.Unlock()
+		subscribed := map[string]bool{}
+		for _, subscription := range kc.subscriptions {
+			subscribed[aws.ToString(subscription.ShardId)] = true
+		}
+		return subscribed["shard-0"] && subscribed["shard-1"]
+	}, 5*time.Second, 10*time.Millisecond)
+
+	kc.mux.Lock()
+	for _, subscription := range kc.subscriptions {
+		assert.Equal(t, "arn:aws:kinesis:us-west-2:123456789012:stream/streamName/consumer/appName", aws.ToString(subscription.ConsumerARN))
+		assert.Equal(t, types.ShardIteratorTypeAfterSequenceNumber, subscription.StartingPosition.Type)
+		expected := map[string]string{"shard-0": "100", "shard-1": "200"}[aws.ToString(subscription.ShardId)]
+		assert.Equal(t, expected, aws.ToString(subscription.StartingPosition.SequenceNumber))
+	}
+	kc.mux.Unlock()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mService.upgrades))
+}
+
+func TestWorkerConsumesWithFanOut(t *testing.T) {
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithEnhancedFanOutConsumerName("fanOutConsumer")
+	kc := newFakeKinesis("shard-0")
+	w := startTestWorker(t, kclConfig, kc, newTestCheckpointer(map[string]*testLease{}))
+	defer w.Shutdown()
+	assert.Nil(t, w.Rebalance())
+
+	// the consumer is registered, and the shard subscribed to rather than polled
+	assert.Eventually(t, func() bool {
+		kc.mux.Lock()
+		defer kc.mux.Unlock()
+		return len(kc.subscriptions) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	kc.mux.Lock()
+	defer kc.mux.Unlock()
+	assert.Equal(t, "arn:aws:kinesis:us-west-2:123456789012:stream/streamName/consumer/fanOutConsumer", kc.consumerARN)
+	assert.Equal(t, kc.consumerARN, aws.ToString(kc.subscriptions[0].ConsumerARN))
+	assert.Equal(t, "shard-0", aws.ToString(kc.subscriptions[0].ShardId))
+	assert.Empty(t, kc.getRecordsLimits)
+}
+
+// pagingKinesis lists one shard per page, and lets the given number of pagination tokens expire.
+type pagingKinesis struct {
+	*fakeKinesis
+	expiredTokens int
+	requests      []*kinesis.ListShardsInput
+}
+
+func (k *pagingKinesis) ListShards(_ context.Context, params *kinesis.ListShardsInput, _ ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.requests = append(k.requests, params)
+
+	next := 0
+	switch {
+	case params.NextToken != nil:
+		if k.expiredTokens > 0 {
+			k.expiredTokens--
+			return nil, &types.ExpiredNextTokenException{Message: aws.String("expired")}
+		}
+		next, _ = strconv.Atoi(aws.ToString(params.NextToken))
+	case params.ExclusiveStartShardId != nil:
+		for i, s := range k.shards {
+			if aws.ToString(s.ShardId) == aws.ToString(params.ExclusiveStartShardId) {
+				next = i + 1
+			}
+		}
+	}
+	out := &kinesis.ListShardsOutput{Shards: k.shards[next : next+1]}
+	if next+1 < len(k.shards) {
+		out.NextToken = aws.String(strconv.Itoa(next + 1))
+	}
+	return out, nil
+}
+
+func TestListShardsResumesAfterExpiredToken(t *testing.T) {
+	kc := &pagingKinesis{fakeKinesis: newFakeKinesis("shard-0", "shard-1", "shard-2"), expiredTokens: 1}
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID")
+	w := newTestWorker(kclConfig, newTestCheckpointer(map[string]*testLease{}))
+	w.kc = kc
+
+	// the listing resumes after the last shard listed
+	shards, err := w.listShards()
+	assert.Nil(t, err)
+	var shardIDs []string
+	for _, s := range shards {
+		shardIDs = append(shardIDs, aws.ToString(s.ShardId))
+	}
+	assert.Equal(t, []string{"shard-0", "shard-1", "shard-2"}, shardIDs)
+	if assert.Len(t, kc.requests, 4) {
+		assert.Equal(t, "shard-0", aws.ToString(kc.requests[2].ExclusiveStartShardId))
+		assert.Equal(t, "streamName", aws.ToString(kc.requests[2].StreamName))
+	}
+
+	// the shard sync fails once the retries are used up
+	kc.expiredTokens = 2
+	w.kclConfig.ListShardsExpiredTokenRetries = 1
+	_, err = w.listShards()
+	var expiredTokenErr *types.ExpiredNextTokenException
+	assert.True(t, errors.As(err, &expiredTokenErr))
+}
+
+// emptyListingKinesis lists no shard, as a shard discovery cut short would, whatever the shards of the stream.
+type emptyListingKinesis struct {
+	*fakeKinesis
+}
+
+func (k *emptyListingKinesis) ListShards(_ context.Context, _ *kinesis.ListShardsInput, _ ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error) {
+	return &kinesis.ListShardsOutput{}, nil
+}
+
+func TestStartOnStreamStatus(t *testing.T) {
+	tests := []struct {
+		status      types.StreamStatus
+		policy      config.StreamStatusPolicy
+		wantStarted bool
+	}{
+		{types.StreamStatusActive, config.AllowUpdatingStream, true},
+		{types.StreamStatusUpdating, config.AllowUpdatingStream, true},
+		{types.StreamStatusCreating, config.AllowUpdatingStream, false},
+		{types.StreamStatusDeleting, config.AllowUpdatingStream, false},
+		{types.StreamStatusActive, config.RequireActiveStream, true},
+		{types.StreamStatusUpdating, config.RequireActiveStream, false},
+		{types.StreamStatusCreating, config.RequireActiveStream, false},
+		{types.StreamStatusDeleting, config.RequireActiveStream, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.status, tt.policy), func(t *testing.T) {
+			kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+				WithStreamStatusPolicy(tt.policy)
+			kc := newFakeKinesis("shard-0")
+			kc.streamStatus = tt.status
+			w := NewWorker(testRecordProcessorFactory{}, kclConfig).WithCheckpointer(newTestCheckpointer(map[string]*testLease{}))
+			w.kc = kc
+
+			err := w.Start()
+			if tt.wantStarted {
+				assert.Nil(t, err)
+				w.Shutdown()
+			} else {
+				assert.ErrorContains(t, err, string(tt.status))
+			}
+		})
+	}
+}
+
+func TestShutdownWhenNoOpenShards(t *testing.T) {
+	start := func(kc kinesisAPI, checkpointer chk.Checkpointer) *Worker {
+		kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+			WithShardSyncIntervalMillis(20).
+			WithShutdownWhenNoOpenShards(true)
+		w := NewWorker(testRecordProcessorFactory{}, kclConfig).WithCheckpointer(checkpointer)
+		w.kc = kc
+		assert.Nil(t, w.Start())
+		return w
+	}
+
+	// the stream has open shards which are not listed: the worker keeps running
+	kc := &emptyListingKinesis{newFakeKinesis("shard-0", "shard-1")}
+	w := start(kc, newTestCheckpointer(map[string]*testLease{}))
+	select {
+	case <-w.Done():
+		t.Fatal("worker shut down while the stream has open shards")
+	case <-time.After(300 * time.Millisecond):
+	}
+	w.Shutdown()
+
+	// every shard is closed and completed, which the stream confirms: the worker shuts down
+	closed := newFakeKinesis("shard-0", "shard-1")
+	for i := range closed.shards {
+		closed.shards[i].SequenceNumberRange.EndingSequenceNumber = aws.String("100")
+	}
+	w = start(closed, newTestCheckpointer(map[string]*testLease{
+		"shard-0": {checkpoint: chk.ShardEnd},
+		"shard-1": {checkpoint: chk.ShardEnd},
+	}))
+	select {
+	case <-w.Done():
+	case <-time.After(2 * time.Second):
+		w.Shutdown()
+		t.Fatal("worker did not shut down once the stream had no open shard")
+	}
+}
+
+// failingProcessorFactory fails to create the record processor of a shard a number of times, and counts the attempts.
+type failingProcessorFactory struct {
+	mux      sync.Mutex
+	failures map[string]int
+	attempts map[string]int
+}
+
+func (f *failingProcessorFactory) CreateProcessor() kcl.IRecordProcessor {
+	return &testRecordProcessor{}
+}
+
+func (f *failingProcessorFactory) CreateShardProcessor(shardID string) (kcl.IRecordProcessor, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.attempts[shardID]++
+	if f.failures[shardID] > 0 {
+		f.failures[shardID]--
+		return nil, errors.New("resource exhausted")
+	}
+	return &testRecordProcessor{}, nil
+}
+
+type processorCreateMonitoringService struct {
+	metrics.NoopMonitoringService
+	mux      sync.Mutex
+	failures map[string]int
+}
+
+func (m *processorCreateMonitoringService) ProcessorCreateFailed(shard string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.failures[shard]++
+}
+
+func TestProcessorCreateFailures(t *testing.T) {
+	factory := &failingProcessorFactory{
+		// shard-1 fails once, shard-2 always
+		failures: map[string]int{"shard-1": 1, "shard-2": 1000},
+		attempts: map[string]int{},
+	}
+	mService := &processorCreateMonitoringService{failures: map[string]int{}}
+	checkpointer := newTestCheckpointer(map[string]*testLease{})
+	kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+		WithShardSyncIntervalMillis(3600000).
+		WithProcessorCreateBackoff(config.BackoffPolicy{BaseMillis: 1, Multiplier: 1}).
+		WithMaxProcessorCreateRetries(2).
+		WithMonitoringService(mService)
+	w := NewWorker(factory, kclConfig).WithCheckpointer(checkpointer)
+	w.kc = newFakeKinesis("shard-0", "shard-1", "shard-2")
+	assert.Nil(t, w.Start())
+	defer w.Shutdown()
+
+	// the leases whose record processor could not be created are released
+	assert.Nil(t, w.Rebalance())
+	assert.Equal(t, "workerID", w.shardStatus["shard-0"].GetLeaseOwner())
+	for _, id := range []string{"shard-1", "shard-2"} {
+		assert.Equal(t, "", w.shardStatus[id].GetLeaseOwner(), id)
+		assert.Equal(t, 1, checkpointer.called("RemoveLeaseOwner", id), id)
+	}
+
+	// shard-1 is acquired on retry, shard-2 is left to the other workers once out of retries
+	for i := 0; i < 5; i++ {
+		time.Sleep(5 * time.Millisecond)
+		assert.Nil(t, w.Rebalance())
+	}
+	assert.Equal(t, "workerID", w.shardStatus["shard-1"].GetLeaseOwner())
+	assert.Equal(t, "", w.shardStatus["shard-2"].GetLeaseOwner())
+
+	factory.mux.Lock()
+	assert.Equal(t, map[string]int{"shard-0": 1, "shard-1": 2, "shard-2": 3}, factory.attempts)
+	factory.mux.Unlock()
+	mService.mux.Lock()
+	assert.Equal(t, map[string]int{"shard-1": 1, "shard-2": 3}, mService.failures)
+	mService.mux.Unlock()
+}
+
+func TestMergedChildWaitsOnBothParents(t *testing.T) {
+	// parent-a is consumed by this worker, parent-b by another one
+	for _, order := range [][]string{{"parent-a", "parent-b"}, {"parent-b", "parent-a"}} {
+		t.Run(strings.Join(order, " then "), func(t *testing.T) {
+			kc := newFakeKinesis("parent-a", "parent-b", "child")
+			kc.shards[2].ParentShardId = aws.String("parent-a")
+			kc.shards[2].AdjacentParentShardId = aws.String("parent-b")
+			kc.pendingRecords["parent-a"] = []types.Record{{SequenceNumber: aws.String("100"), Data: []byte("data")}}
+			kc.pendingRecords["child"] = []types.Record{{SequenceNumber: aws.String("200"), Data: []byte("data")}}
+
+			factory := &eventRecordingFactory{}
+			kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "workerID").
+				WithShardSyncIntervalMillis(3600000).
+				WithIdleTimeBetweenReadsInMillis(20)
+			kclConfig.ParentShardPollIntervalMillis = 20
+			checkpointer := newTestCheckpointer(map[string]*testLease{
+				"parent-a": {checkpoint: "50"},
+				"parent-b": {checkpoint: "300", owner: "other", leaseTimeout: time.Now().Add(time.Hour)},
+			})
+			w := NewWorker(factory, kclConfig).WithCheckpointer(checkpointer)
+			w.kc = kc
+			assert.Nil(t, w.Start())
+			defer w.Shutdown()
+			assert.Nil(t, w.Rebalance())
+			assert.Eventually(t, func() bool {
+				return indexOf(factory.recorded(), "process parent-a 100") >= 0
+			}, 5*time.Second, 10*time.Millisecond)
+
+			endParent := func(parent string) {
+				if parent == "parent-a" {
+					kc.mux.Lock()
+					kc.closedShards["parent-a"] = true
+					kc.mux.Unlock()
+					assert.Eventually(t, func() bool {
+						return indexOf(factory.recorded(), "terminate parent-a") >= 0
+					}, 5*time.Second, 10*time.Millisecond)
+					return
+				}
+				checkpointer.mux.Lock()
+				checkpointer.leases["parent-b"].checkpoint = chk.ShardEnd
+				checkpointer.mux.Unlock()
+				factory.record("terminate parent-b")
+			}
+
+			// no record of the child is delivered while one of its parents is still being consumed
+			endParent(order[0])
+			time.Sleep(200 * time.Millisecond)
+			assert.Equal(t, -1, indexOf(factory.recorded(), "process child 200"))
+
+			endParent(order[1])
+			assert.Eventually(t, func() bool {
+				return indexOf(factory.recorded(), "process child 200") >= 0
+			}, 5*time.Second, 10*time.Millisecond)
+			events := factory.recorded()
+			assert.Less(t, indexOf(events, "terminate "+order[1]), indexOf(events, "process child 200"))
+		})
+	}
+}
+
+func TestWorkersShareMemoryLeaseTable(t *testing.T) {
+	table := chk.NewMemoryLeaseTable()
+	kc := newFakeKinesis("shard-0", "shard-1", "shard-2", "shard-3")
+	kc.pendingRecords["shard-0"] = []types.Record{{SequenceNumber: aws.String("100"), Data: []byte("data")}}
+
+	var workers []*Worker
+	for _, workerID := range []string{"worker-1", "worker-2"} {
+		kclConfig := config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", workerID).
+			WithMaxLeasesForWorker(2).
+			WithShardSyncIntervalMillis(3600000)
+		w := NewWorker(&eventRecordingFactory{}, kclConfig).WithCheckpointer(chk.NewMemoryCheckpointer(kclConfig, table))
+		w.kc = kc
+		assert.Nil(t, w.Start())
+		defer w.Shutdown()
+		workers = append(workers, w)
+	}
+
+	// the workers race for the leases
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *Worker) {
+			defer wg.Done()
+			assert.Nil(t, w.Rebalance())
+		}(w)
+	}
+	wg.Wait()
+
+	// every shard is held by exactly one of them, as recorded in the lease table
+	reader := chk.NewMemoryCheckpointer(config.NewKinesisClientLibConfig("appName", "streamName", "us-west-2", "reader"), table)
+	for _, id := range []string{"shard-0", "shard-1", "shard-2", "shard-3"} {
+		owner, err := reader.GetLeaseOwner(id)
+		assert.Nil(t, err)
+		var holders []string
+		for _, w := range workers {
+			if w.shardStatus[id].GetLeaseOwner() == w.workerID {
+				holders = append(holders, w.workerID)
+			}
+		}
+		assert.Equal(t, []string{owner}, holders, id)
+	}
+
+	// the records are processed and checkpointed in the lease table
+	assert.Eventually(t, func() bool {
+		shard := &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}
+		return reader.FetchCheckpoint(shard) == nil && shard.GetCheckpoint() == "100"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package logger
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupLogger coalesces the warnings and errors logged repeatedly. A message is identified by its format and by the
+// type of its error arguments, its error class, so that the same failure with a different request or error text is
+// still the same message. The first occurrence is logged, the next ones within the interval are counted, and the
+// next occurrence after the interval is logged with the count of the occurrences it summarizes.
+type dedupLogger struct {
+	Logger
+	interval time.Duration
+	now      func() time.Time
+
+	mux      sync.Mutex
+	messages map[string]*repeatedMessage
+}
+
+// repeatedMessage counts the occurrences of a message since it was last logged.
+type repeatedMessage struct {
+	logged     time.Time
+	suppressed int
+}
+
+// NewDedupLogger returns a logger coalescing the warnings and errors repeated within the interval, e.g. the same
+// error of every retry of a failing call, into one log line per interval with the number of occurrences. The loggers
+// derived with WithFields count their occurrences apart, e.g. per shard.
+func NewDedupLogger(log Logger, interval time.Duration) Logger {
+	return &dedupLogger{
+		Logger:   log,
+		interval: interval,
+		now:      time.Now,
+		messages: make(map[string]*repeatedMessage),
+	}
+}
+
+func (l *dedupLogger) Warnf(format string, args ...interface{}) {
+	if format, ok := l.occurrence(Warn, format, args); ok {
+		l.Logger.Warnf(format, args...)
+	}
+}
+
+func (l *dedupLogger) Errorf(format string, args ...interface{}) {
+	if format, ok := l.occurrence(Error, format, args); ok {
+		l.Logger.Errorf(format, args...)
+	}
+}
+
+func (l *dedupLogger) WithFields(keyValues Fields) Logger {
+	return &dedupLogger{
+		Logger:   l.Logger.WithFields(keyValues),
+		interval: l.interval,
+		now:      l.now,
+		messages: make(map[string]*repeatedMessage),
+	}
+}
+
+// occurrence counts an occurrence of the message. It returns whether to log it, and the format to log it with,
+// mentioning the occurrences suppressed since it was last logged.
+func (l *dedupLogger) occurrence(level, format string, args []interface{}) (string, bool) {
+	var key strings.Builder
+	key.WriteString(level)
+	key.WriteString(":")
+	key.WriteString(format)
+	for _, arg := range args {
+		if _, ok := arg.(error); ok {
+			fmt.Fprintf(&key, ":%T", arg)
+		}
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := l.now()
+	message, ok := l.messages[key.String()]
+	if !ok {
+		l.messages[key.String()] = &repeatedMessage{logged: now}
+		return format, true
+	}
+	if now.Sub(message.logged) < l.interval {
+		message.suppressed++
+		return format, false
+	}
+
+	suppressed, elapsed := message.suppressed, now.Sub(message.logged)
+	message.logged = now
+	message.suppressed = 0
+	if suppressed == 0 {
+		return format, true
+	}
+	return format + fmt.Sprintf(" (repeated %d more times in the last %s)", suppressed, elapsed.Round(time.Second)), true
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// capturingLogger records the lines logged, prefixed with their fields.
+type capturingLogger struct {
+	Logger
+	fields Fields
+	lines  *[]string
+}
+
+func (l *capturingLogger) Warnf(format string, args ...interface{}) {
+	*l.lines = append(*l.lines, fmt.Sprintf("%v warn: ", l.fields)+fmt.Sprintf(format, args...))
+}
+
+func (l *capturingLogger) Errorf(format string, args ...interface{}) {
+	*l.lines = append(*l.lines, fmt.Sprintf("%v error: ", l.fields)+fmt.Sprintf(format, args...))
+}
+
+func (l *capturingLogger) WithFields(keyValues Fields) Logger {
+	return &capturingLogger{Logger: l.Logger, fields: keyValues, lines: l.lines}
+}
+
+type throttledError struct{ requestID string }
+
+func (e *throttledError) Error() string { return "throttled, request " + e.requestID }
+
+func TestDedupLogger(t *testing.T) {
+	var lines []string
+	now := time.Unix(0, 0)
+	log := NewDedupLogger(&capturingLogger{Logger: GetDefaultLogger(), lines: &lines}, 10*time.Second)
+	log.(*dedupLogger).now = func() time.Time { return now }
+
+	shard1 := log.WithFields(Fields{"shard": "shard-1"})
+	shard2 := log.WithFields(Fields{"shard": "shard-2"})
+
+	// the same error class with a different text is repeated
+	for i := 0; i < 5; i++ {
+		shard1.Errorf("Error getting records: %+v", &throttledError{requestID: fmt.Sprint(i)})
+		now = now.Add(time.Second)
+	}
+	// a different error class, or a different shard, is logged
+	shard1.Errorf("Error getting records: %+v", errors.New("expired iterator"))
+	shard2.Errorf("Error getting records: %+v", &throttledError{requestID: "a"})
+	assert.Equal(t, []string{
+		"map[shard:shard-1] error: Error getting records: throttled, request 0",
+		"map[shard:shard-1] error: Error getting records: expired iterator",
+		"map[shard:shard-2] error: Error getting records: throttled, request a",
+	}, lines)
+
+	// the next occurrence after the interval summarizes the suppressed ones
+	lines = nil
+	now = now.Add(10 * time.Second)
+	shard1.Errorf("Error getting records: %+v", &throttledError{requestID: "5"})
+	shard1.Errorf("Error getting records: %+v", &throttledError{requestID: "6"})
+	shard1.Warnf("Error getting records: %+v", &throttledError{requestID: "7"})
+	assert.Equal(t, []string{
+		"map[shard:shard-1] error: Error getting records: throttled, request 5 (repeated 4 more times in the last 15s)",
+		"map[shard:shard-1] warn: Error getting records: throttled, request 7",
+	}, lines)
+}
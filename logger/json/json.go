@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package json implements the KCL logger emitting one JSON object per log line, suitable for log
+// aggregation. It only depends on the standard library.
+package json
+
+import (
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vmware/vmware-go-kcl-v2/logger"
+)
+
+const (
+	// TimeKey is the key of the log line timestamp.
+	TimeKey = "time"
+	// LevelKey is the key of the log line level.
+	LevelKey = "level"
+	// MessageKey is the key of the formatted log message.
+	MessageKey = "msg"
+)
+
+var levels = map[string]int{
+	logger.Debug: 0,
+	logger.Info:  1,
+	logger.Warn:  2,
+	logger.Error: 3,
+	logger.Fatal: 4,
+}
+
+type jsonLogger struct {
+	mux    *sync.Mutex
+	out    io.Writer
+	level  int
+	fields logger.Fields
+}
+
+// NewJSONLogger creates a new logger.Logger writing JSON log lines at or above the info level to stdout.
+func NewJSONLogger() logger.Logger {
+	return NewJSONLoggerWithWriter(os.Stdout, logger.Info)
+}
+
+// NewJSONLoggerWithWriter creates a new logger.Logger writing JSON log lines at or above the given
+// level to out.
+func NewJSONLoggerWithWriter(out io.Writer, level string) logger.Logger {
+	l, ok := levels[level]
+	if !ok {
+		l = levels[logger.Info]
+	}
+
+	return &jsonLogger{
+		mux:    &sync.Mutex{},
+		out:    out,
+		level:  l,
+		fields: logger.Fields{},
+	}
+}
+
+func (j *jsonLogger) Debugf(format string, args ...interface{}) {
+	j.log(logger.Debug, format, args...)
+}
+
+func (j *jsonLogger) Infof(format string, args ...interface{}) {
+	j.log(logger.Info, format, args...)
+}
+
+func (j *jsonLogger) Warnf(format string, args ...interface{}) {
+	j.log(logger.Warn, format, args...)
+}
+
+func (j *jsonLogger) Errorf(format string, args ...interface{}) {
+	j.log(logger.Error, format, args...)
+}
+
+func (j *jsonLogger) Fatalf(format string, args ...interface{}) {
+	j.log(logger.Fatal, format, args...)
+	os.Exit(1)
+}
+
+func (j *jsonLogger) Panicf(format string, args ...interface{}) {
+	j.log("panic", format, args...)
+	panic(fmt.Sprintf(format, args...))
+}
+
+// WithFields returns a logger adding the given fields (e.g. shardID, workerID, streamName) to
+// every log line.
+func (j *jsonLogger) WithFields(keyValues logger.Fields) logger.Logger {
+	fields := make(logger.Fields, len(j.fields)+len(keyValues))
+	for k, v := range j.fields {
+		fields[k] = v
+	}
+	for k, v := range keyValues {
+		fields[k] = v
+	}
+
+	return &jsonLogger{
+		mux:    j.mux,
+		out:    j.out,
+		level:  j.level,
+		fields: fields,
+	}
+}
+
+func (j *jsonLogger) log(level, format string, args ...interface{}) {
+	if l, ok := levels[level]; ok && l < j.level {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(j.fields)+3)
+	for k, v := range j.fields {
+		// errors marshal to an empty object
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry[TimeKey] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry[LevelKey] = level
+	entry[MessageKey] = fmt.Sprintf(format, args...)
+
+	line, err := stdjson.Marshal(entry)
+	if err != nil {
+		// a field cannot be encoded, keep the message rather than dropping the line
+		line, _ = stdjson.Marshal(map[string]interface{}{
+			TimeKey:    entry[TimeKey],
+			LevelKey:   level,
+			MessageKey: entry[MessageKey],
+			"logError": err.Error(),
+		})
+	}
+
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	_, _ = j.out.Write(append(line, '\n'))
+}
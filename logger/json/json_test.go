@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2023 VMware, Inc.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished to do
+ * so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial
+ * portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package json
+
+import (
+	"bufio"
+	"bytes"
+	stdjson "encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vmware/vmware-go-kcl-v2/logger"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewJSONLoggerWithWriter(&buf, logger.Info)
+
+	contextLogger := log.WithFields(logger.Fields{
+		logger.StreamNameKey: "streamName",
+		logger.WorkerIDKey:   "workerID",
+	}).WithFields(logger.Fields{logger.ShardIDKey: "shardId-000000000000"})
+	contextLogger.Debugf("Not logged at info level")
+	contextLogger.Infof("Processed %d records", 10)
+	contextLogger.WithFields(logger.Fields{"error": errors.New("boom")}).Errorf("Failed")
+
+	scanner := bufio.NewScanner(&buf)
+	var entries []map[string]interface{}
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		assert.Nil(t, stdjson.Unmarshal(scanner.Bytes(), &entry), "invalid JSON: %s", scanner.Text())
+		entries = append(entries, entry)
+	}
+
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "info", entries[0][LevelKey])
+	assert.Equal(t, "Processed 10 records", entries[0][MessageKey])
+	assert.Equal(t, "streamName", entries[0][logger.StreamNameKey])
+	assert.Equal(t, "workerID", entries[0][logger.WorkerIDKey])
+	assert.Equal(t, "shardId-000000000000", entries[0][logger.ShardIDKey])
+	assert.NotEmpty(t, entries[0][TimeKey])
+
+	assert.Equal(t, "error", entries[1][LevelKey])
+	assert.Equal(t, "boom", entries[1]["error"])
+}
+
+func TestJSONLoggerParentFieldsUnchanged(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewJSONLoggerWithWriter(&buf, logger.Debug)
+	_ = log.WithFields(logger.Fields{logger.ShardIDKey: "shardId-000000000000"})
+	log.Debugf("no fields")
+
+	entry := map[string]interface{}{}
+	assert.Nil(t, stdjson.Unmarshal(bytes.TrimSpace(buf.Bytes()), &entry))
+	assert.NotContains(t, entry, logger.ShardIDKey)
+}
@@ -41,6 +41,13 @@ const (
 	Fatal = "fatal"
 )
 
+// Well-known field keys attached by KCL to the loggers of workers and shard consumers.
+const (
+	StreamNameKey = "streamName"
+	WorkerIDKey   = "workerID"
+	ShardIDKey    = "shardID"
+)
+
 // Logger is the common interface for logging.
 type Logger interface {
 	Debugf(format string, args ...interface{})